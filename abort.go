@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+var (
+	clientAborts = metrics.Default.Counter("railtail_tcp_aborts_total",
+		"TCP connections aborted by a reset or an unresponsive peer, by side.", "side", "client")
+	upstreamAborts = metrics.Default.Counter("railtail_tcp_aborts_total",
+		"TCP connections aborted by a reset or an unresponsive peer, by side.", "side", "upstream")
+)
+
+// abortMessages are the errors of tailnet connections for the peer aborting, which the
+// tsnet network stack reports as text rather than errnos.
+var abortMessages = []string{
+	"connection reset by peer",
+	"connection aborted",
+	"operation timed out",
+}
+
+// isAbort reports whether err is the peer of a connection aborting it: a reset, or the
+// peer not answering keepalives or acknowledging data any more. Deadlines railtail sets
+// itself are not.
+func isAbort(err error) bool {
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ETIMEDOUT) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Err == nil {
+		return false
+	}
+	for _, msg := range abortMessages {
+		if opErr.Err.Error() == msg {
+			return true
+		}
+	}
+
+	return false
+}
+
+// propagateAbort closes the other end of a TCP connection right away when one end aborted
+// it, for the reason (CloseClientAbort or CloseUpstreamAbort) the copy failed for. The
+// client is reset, so that it sees the abort instead of a clean end of stream. The tailnet
+// connection is closed, which tsnet turns into a reset when what it sent is left unread,
+// and frees the target's connection slot without waiting for a timeout.
+func propagateAbort(reason string, client, target net.Conn) {
+	switch reason {
+	case CloseClientAbort:
+		clientAborts.Inc()
+		_ = target.Close()
+	case CloseUpstreamAbort:
+		upstreamAborts.Inc()
+		resetConn(client)
+	}
+}
+
+// resetConn closes conn with a reset rather than a FIN, where it is a TCP socket.
+func resetConn(conn net.Conn) {
+	if tc := tcpConnOf(conn); tc != nil {
+		_ = tc.SetLinger(0)
+	}
+	_ = conn.Close()
+}
+
+// detectDeadClient makes reads and writes of conn fail once the client stopped answering
+// for timeout, instead of waiting for the idle timeout: keepalive probes are sent after a
+// third of it without traffic, and on Linux data left unacknowledged for timeout fails
+// the connection too (TCP_USER_TIMEOUT). A timeout of 0 keeps the system defaults.
+func detectDeadClient(conn net.Conn, timeout time.Duration) {
+	tc := tcpConnOf(conn)
+	if tc == nil || timeout <= 0 {
+		return
+	}
+
+	_ = tc.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     timeout / 3,
+		Interval: timeout / 9,
+		Count:    6,
+	})
+	setUserTimeout(tc, timeout)
+}
+
+// tcpConnOf returns the TCP socket under conn, looking through TLS and other wrappers
+// that expose the connection they wrap, or nil if there is none.
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setUserTimeout fails conn when data it sent is left unacknowledged for timeout.
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	_ = raw.Control(func(fd uintptr) {
+		_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(timeout.Milliseconds()))
+	})
+}
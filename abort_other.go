@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// setUserTimeout is only supported on Linux, elsewhere keepalives alone detect dead clients.
+func setUserTimeout(*net.TCPConn, time.Duration) {}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// ErrAllowedHoursInvalid is returned for access windows that cannot be parsed.
+var ErrAllowedHoursInvalid = errors.New("allowed hours are invalid")
+
+// weekdays maps the abbreviations of the days of the week to time.Weekday.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// accessWindow is when a listener accepts connections, like "Mon-Fri 08:00-18:00
+// Europe/Madrid": rules separated by semicolons, each of days and a time range, and an
+// optional time zone (UTC by default) at the end. A range ending before it starts runs
+// past midnight, into the next day. A nil accessWindow is always open.
+type accessWindow struct {
+	spec  string
+	rules []windowRule
+	loc   *time.Location
+}
+
+// windowRule is a time range on some days of the week, in minutes since midnight.
+type windowRule struct {
+	days       [7]bool
+	start, end int
+}
+
+// parseAccessWindow parses spec, returning nil if it is empty.
+func parseAccessWindow(spec string) (*accessWindow, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	w := &accessWindow{spec: spec, loc: time.UTC}
+	parts := strings.Split(spec, ";")
+
+	// The time zone, if any, follows the last rule
+	last := strings.Fields(parts[len(parts)-1])
+	if len(last) == 3 {
+		loc, err := time.LoadLocation(last[2])
+		if err != nil {
+			return nil, fmt.Errorf("%w: '%s': %w", ErrAllowedHoursInvalid, spec, err)
+		}
+		w.loc = loc
+		parts[len(parts)-1] = strings.Join(last[:2], " ")
+	}
+
+	for _, part := range parts {
+		rule, err := parseWindowRule(part)
+		if err != nil {
+			return nil, fmt.Errorf("%w: '%s': %w", ErrAllowedHoursInvalid, spec, err)
+		}
+		w.rules = append(w.rules, rule)
+	}
+
+	return w, nil
+}
+
+// parseWindowRule parses days and a time range, like "Mon-Fri 08:00-18:00".
+func parseWindowRule(s string) (windowRule, error) {
+	var rule windowRule
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return rule, fmt.Errorf("expected days and hours, like Mon-Fri 08:00-18:00, got '%s'", strings.TrimSpace(s))
+	}
+
+	for _, days := range strings.Split(fields[0], ",") {
+		from, to, isRange := strings.Cut(strings.ToLower(days), "-")
+		first, ok := weekdays[from]
+		if !ok {
+			return rule, fmt.Errorf("unknown day '%s'", from)
+		}
+		lastDay := first
+		if isRange {
+			if lastDay, ok = weekdays[to]; !ok {
+				return rule, fmt.Errorf("unknown day '%s'", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			rule.days[d] = true
+			if d == lastDay {
+				break
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return rule, fmt.Errorf("expected hours like 08:00-18:00, got '%s'", fields[1])
+	}
+	var err error
+	if rule.start, err = parseClock(start); err != nil {
+		return rule, err
+	}
+	if rule.end, err = parseClock(end); err != nil {
+		return rule, err
+	}
+	if rule.start == rule.end {
+		return rule, fmt.Errorf("hours '%s' are empty", fields[1])
+	}
+
+	return rule, nil
+}
+
+// parseClock parses a time of day, like 08:00 or 24:00, into minutes since midnight.
+func parseClock(s string) (int, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time of day '%s'", s)
+	}
+
+	return h*60 + m, nil
+}
+
+// open reports whether the window is open at t.
+func (w *accessWindow) open(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+
+	t = t.In(w.loc)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+	for _, r := range w.rules {
+		if r.start < r.end {
+			if r.days[day] && minute >= r.start && minute < r.end {
+				return true
+			}
+			continue
+		}
+		// Runs past midnight: the evening of its days, and the morning after
+		if (r.days[day] && minute >= r.start) || (r.days[yesterday] && minute < r.end) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// opensAt returns when the window next opens after t, or the zero time if never.
+func (w *accessWindow) opensAt(t time.Time) time.Time {
+	t = t.In(w.loc)
+	var next time.Time
+	for i := 0; i <= 7; i++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()+i, 0, 0, 0, 0, w.loc)
+		for _, r := range w.rules {
+			if !r.days[day.Weekday()] {
+				continue
+			}
+			start := time.Date(day.Year(), day.Month(), day.Day(), r.start/60, r.start%60, 0, 0, w.loc)
+			if start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+
+	return next
+}
+
+// refusal explains why a connection at t is refused.
+func (w *accessWindow) refusal(t time.Time) string {
+	message := "access is only allowed " + w.spec
+	if next := w.opensAt(t); !next.IsZero() {
+		message += ", next from " + next.Format(time.RFC3339)
+	}
+
+	return message
+}
+
+// logRefused logs that a connection of kind from remoteAddr was refused at t, and
+// counts it.
+func (w *accessWindow) logRefused(kind, remoteAddr string, t time.Time) {
+	countClosed(kind, CloseOutsideWindow)
+
+	event := logger.Stderr.Warn().
+		Str("remote-addr", remoteAddr).
+		Str("allowed-hours", w.spec).
+		Str("reason", CloseOutsideWindow)
+	if next := w.opensAt(t); !next.IsZero() {
+		event = event.Time("opens-at", next)
+	}
+	event.Msg("connection refused outside allowed hours")
+}
+
+// limitHours returns handler refusing requests outside window with 403 Forbidden,
+// saying when they are allowed.
+func limitHours(window *accessWindow, handler http.Handler) http.Handler {
+	if window == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		if !window.open(now) {
+			window.logRefused(connKindHTTP, r.RemoteAddr, now)
+			http.Error(w, "Forbidden: "+window.refusal(now), http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME challenge types.
+const (
+	ACMEChallengeHTTP = "http-01"
+	ACMEChallengeDNS  = "dns-01"
+)
+
+// Certificates are renewed when they expire within acmeRenewBefore, checked every
+// acmeCheckInterval.
+const (
+	acmeRenewBefore   = 30 * 24 * time.Hour
+	acmeCheckInterval = 12 * time.Hour
+)
+
+// ErrACMEInvalid is returned for inconsistent ACME settings.
+var ErrACMEInvalid = errors.New("ACME settings are invalid")
+
+// validateACME checks the ACME settings.
+func validateACME(cfg *Config) []error {
+	if len(cfg.ACMEDomains) == 0 {
+		return nil
+	}
+
+	var errors_ []error
+	if cfg.TLSCertFile != "" {
+		errors_ = append(errors_, fmt.Errorf("%w: ACME_DOMAINS and TLS_CERT_FILE are mutually exclusive",
+			ErrACMEInvalid))
+	}
+	switch cfg.ACMEChallenge {
+	case ACMEChallengeHTTP:
+	case ACMEChallengeDNS:
+		if cfg.ACMEDNSHook == "" {
+			errors_ = append(errors_, fmt.Errorf("%w: the dns-01 challenge requires ACME_DNS_HOOK", ErrACMEInvalid))
+		}
+	default:
+		errors_ = append(errors_, fmt.Errorf("%w: ACME_CHALLENGE must be http-01 or dns-01, got '%s'",
+			ErrACMEInvalid, cfg.ACMEChallenge))
+	}
+
+	return errors_
+}
+
+// newACMEConfig returns the TLS configuration of the listener with certificates
+// provisioned through ACME and cached in cacheDir, and a wrapper answering HTTP-01
+// challenges on the plain HTTP listener.
+func newACMEConfig(cfg *Config, cacheDir string) (*tls.Config, func(http.Handler) http.Handler) {
+	client := &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL}
+
+	if cfg.ACMEChallenge == ACMEChallengeDNS {
+		m := &dnsCertManager{
+			client:  client,
+			cache:   autocert.DirCache(cacheDir),
+			domains: cfg.ACMEDomains,
+			email:   cfg.ACMEEmail,
+			hook:    cfg.ACMEDNSHook,
+		}
+		go m.run(context.Background())
+
+		return &tls.Config{
+			GetCertificate: m.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}, func(next http.Handler) http.Handler { return next }
+	}
+
+	// autocert solves TLS-ALPN-01 on the listener itself, and HTTP-01 when its
+	// HTTPHandler is served on port 80 (HTTP_REDIRECT_PORT)
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+		Email:      cfg.ACMEEmail,
+		Client:     client,
+	}
+	tlsConfig := m.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+
+	return tlsConfig, m.HTTPHandler
+}
+
+// dnsCertManager provisions and renews a certificate through the DNS-01 challenge,
+// delegating the TXT records to a hook command.
+type dnsCertManager struct {
+	client  *acme.Client
+	cache   autocert.Cache
+	domains []string
+	email   string
+	hook    string // called as: hook present|cleanup <fqdn> <value>
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (m *dnsCertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.cert == nil {
+		return nil, errors.New("acme: certificate not provisioned yet")
+	}
+	return m.cert, nil
+}
+
+// run loads the cached certificate and renews it when needed, for the life of the process.
+func (m *dnsCertManager) run(ctx context.Context) {
+	if data, err := m.cache.Get(ctx, m.domains[0]); err == nil {
+		if cert, err := parseCertPEM(data); err == nil {
+			m.setCert(cert)
+		}
+	}
+
+	for {
+		if m.needsRenewal() {
+			if err := m.obtain(ctx); err != nil {
+				logger.StderrWithSource.Error().
+					Str(logger.ErrAttr(err), logger.ErrValue(err)).
+					Strs("domains", m.domains).
+					Msg("failed to obtain acme certificate")
+			} else {
+				logger.Stdout.Info().
+					Strs("domains", m.domains).
+					Msg("obtained acme certificate")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(acmeCheckInterval):
+		}
+	}
+}
+
+func (m *dnsCertManager) setCert(cert *tls.Certificate) {
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+}
+
+func (m *dnsCertManager) needsRenewal() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.cert == nil || time.Until(m.cert.Leaf.NotAfter) < acmeRenewBefore
+}
+
+// obtain orders a certificate for the domains and stores it in the cache.
+func (m *dnsCertManager) obtain(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	if err := m.ensureAccount(ctx); err != nil {
+		return err
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.domains...))
+	if err != nil {
+		return err
+	}
+
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, u); err != nil {
+			return err
+		}
+	}
+
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.domains}, key)
+	if err != nil {
+		return err
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return err
+	}
+
+	data, err := encodeCertPEM(key, der)
+	if err != nil {
+		return err
+	}
+	cert, err := parseCertPEM(data)
+	if err != nil {
+		return err
+	}
+	if err := m.cache.Put(ctx, m.domains[0], data); err != nil {
+		return err
+	}
+	m.setCert(cert)
+
+	return nil
+}
+
+// ensureAccount loads or creates the ACME account key, and registers it.
+func (m *dnsCertManager) ensureAccount(ctx context.Context) error {
+	const keyName = "acme_account+key"
+
+	if m.client.Key == nil {
+		data, err := m.cache.Get(ctx, keyName)
+		switch {
+		case err == nil:
+			block, _ := pem.Decode(data)
+			if block == nil {
+				return errors.New("acme: invalid account key in cache")
+			}
+			if m.client.Key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return err
+			}
+
+		case errors.Is(err, autocert.ErrCacheMiss):
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				return err
+			}
+			der, err := x509.MarshalECPrivateKey(key)
+			if err != nil {
+				return err
+			}
+			if err := m.cache.Put(ctx, keyName, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+				return err
+			}
+			m.client.Key = key
+
+		default:
+			return err
+		}
+	}
+
+	account := &acme.Account{}
+	if m.email != "" {
+		account.Contact = []string{"mailto:" + m.email}
+	}
+	if _, err := m.client.Register(ctx, account, acme.AcceptTOS); err != nil &&
+		!errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+
+	return nil
+}
+
+// authorize solves the DNS-01 challenge of the authorization at url.
+func (m *dnsCertManager) authorize(ctx context.Context, url string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == ACMEChallengeDNS {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("acme: no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	value, err := m.client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.")
+
+	if err := m.runHook(ctx, "present", fqdn, value); err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.runHook(context.Background(), "cleanup", fqdn, value); err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("fqdn", fqdn).
+				Msg("failed to clean up acme dns record")
+		}
+	}()
+
+	if _, err := m.client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+
+	return err
+}
+
+// runHook runs the DNS hook command. It must only return once the record is visible.
+func (m *dnsCertManager) runHook(ctx context.Context, action, fqdn, value string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, m.hook, action, fqdn, value)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("acme dns hook %s %s: %w: %s", action, fqdn, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// encodeCertPEM encodes a key and certificate chain the way autocert caches them.
+func encodeCertPEM(key crypto.Signer, chain [][]byte) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	_ = pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range chain {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
+
+	return buf.Bytes(), nil
+}
+
+// parseCertPEM parses a cached key and certificate chain.
+func parseCertPEM(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cert, nil
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+	"tailscale.com/tsnet"
+)
+
+//go:embed web
+var webFS embed.FS
+
+// startedAt is when the process started, reported as uptime.
+var startedAt = time.Now()
+
+// newAdminMux creates the handler for the admin listener.
+func newAdminMux(ts *tsnet.Server, cfg *Config, tunnels *tunnelManager, schedules *scheduler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Default.Handler())
+
+	web, _ := fs.Sub(webFS, "web")
+	mux.Handle("GET /", http.FileServerFS(web))
+
+	mux.HandleFunc("GET /healthz", healthz(ts))
+	mux.HandleFunc("GET /admin/status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := nodeStatus(r.Context(), ts, cfg)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("GET /admin/connections", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, conns.Snapshot())
+	})
+	mux.HandleFunc("GET /admin/stats", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"time":               time.Now(),
+			"active_connections": conns.Len(),
+			"bytes_in":           bytesInTotal.Value(),
+			"bytes_out":          bytesOutTotal.Value(),
+		})
+	})
+	mux.HandleFunc("GET /admin/stats/history", func(w http.ResponseWriter, r *http.Request) {
+		if statsHistory == nil {
+			writeJSONError(w, http.StatusNotFound, ErrStatsHistoryDisabled)
+			return
+		}
+		var since time.Time
+		if s := r.URL.Query().Get("last"); s != "" {
+			last, err := time.ParseDuration(s)
+			if err != nil || last <= 0 {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("last must be a positive duration, got '%s'", s))
+				return
+			}
+			since = time.Now().Add(-last)
+		}
+		writeJSON(w, http.StatusOK, statsHistory.History(since))
+	})
+	mux.HandleFunc("GET /admin/slo", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, slo.Statuses())
+	})
+	mux.HandleFunc("GET /admin/errors", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, logger.RecentErrors.Entries())
+	})
+
+	mux.HandleFunc("GET /admin/tunnels", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, tunnels.List())
+	})
+	mux.HandleFunc("POST /admin/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			TunnelConfig
+			Persist bool `json:"persist"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := tunnels.Add(req.TunnelConfig, req.Persist); err != nil {
+			writeJSONError(w, tunnelErrorStatus(err), err)
+			return
+		}
+		stateDB.audit("tunnel.add", strconv.Itoa(req.Listen), r.RemoteAddr, req)
+		writeJSON(w, http.StatusCreated, req.TunnelConfig)
+	})
+	mux.HandleFunc("DELETE /admin/tunnels/{listen}", func(w http.ResponseWriter, r *http.Request) {
+		port, err := strconv.Atoi(r.PathValue("listen"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := tunnels.Remove(port); err != nil {
+			writeJSONError(w, tunnelErrorStatus(err), err)
+			return
+		}
+		stateDB.audit("tunnel.remove", strconv.Itoa(port), r.RemoteAddr, nil)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("POST /admin/tunnels/{listen}/switch", func(w http.ResponseWriter, r *http.Request) {
+		port, err := strconv.Atoi(r.PathValue("listen"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		var req TargetSwitchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		sw, err := tunnels.Switch(port, req)
+		if err != nil {
+			writeJSONError(w, tunnelErrorStatus(err), err)
+			return
+		}
+		stateDB.audit("tunnel.switch", strconv.Itoa(port), r.RemoteAddr, req)
+		writeJSON(w, http.StatusOK, sw)
+	})
+
+	mux.HandleFunc("GET /admin/maintenance", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, maintenance.Status())
+	})
+	mux.HandleFunc("PUT /admin/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Duration string `json:"duration"`
+			Message  string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		var duration time.Duration
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("duration must be positive, got '%s'", req.Duration))
+				return
+			}
+			duration = d
+		}
+
+		status := maintenance.start(duration, req.Message)
+		stateDB.audit("maintenance.start", "", r.RemoteAddr, req)
+		writeJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("DELETE /admin/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		maintenance.stop()
+		stateDB.audit("maintenance.stop", "", r.RemoteAddr, nil)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /admin/schedules", func(w http.ResponseWriter, _ *http.Request) {
+		if stateDB == nil {
+			writeJSONError(w, http.StatusNotFound, ErrStateDisabled)
+			return
+		}
+		writeJSON(w, http.StatusOK, schedules.List())
+	})
+	mux.HandleFunc("POST /admin/schedules", func(w http.ResponseWriter, r *http.Request) {
+		var req ScheduleConfig
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		sc, err := schedules.Add(req)
+		if err != nil {
+			writeJSONError(w, scheduleErrorStatus(err), err)
+			return
+		}
+		stateDB.audit("schedule.add", strconv.FormatInt(sc.ID, 10), r.RemoteAddr, req)
+		writeJSON(w, http.StatusCreated, sc)
+	})
+	mux.HandleFunc("DELETE /admin/schedules/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := schedules.Remove(id); err != nil {
+			writeJSONError(w, scheduleErrorStatus(err), err)
+			return
+		}
+		stateDB.audit("schedule.remove", strconv.FormatInt(id, 10), r.RemoteAddr, nil)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /admin/tokens", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, tunnelTokens.List())
+	})
+	mux.HandleFunc("POST /admin/tokens", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Listen int    `json:"listen"`
+			TTL    string `json:"ttl"`
+			Once   bool   `json:"once"`
+			Note   string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		token, info, err := mintToken(cfg, tunnels, req.Listen, req.TTL, req.Once, req.Note)
+		if err != nil {
+			writeJSONError(w, tokenErrorStatus(err), err)
+			return
+		}
+		stateDB.audit("token.mint", info.ID, r.RemoteAddr, info)
+		writeJSON(w, http.StatusCreated, struct {
+			Token string `json:"token"`
+			TokenInfo
+		}{token, info})
+	})
+	mux.HandleFunc("DELETE /admin/tokens/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := tunnelTokens.Revoke(r.PathValue("id")); err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		stateDB.audit("token.revoke", r.PathValue("id"), r.RemoteAddr, nil)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /admin/tenants", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, tenants.usage())
+	})
+	mux.HandleFunc("GET /admin/recordings", func(w http.ResponseWriter, _ *http.Request) {
+		if recordings == nil {
+			writeJSONError(w, http.StatusNotFound, ErrRecordingDisabled)
+			return
+		}
+		infos, err := recordings.List()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, infos)
+	})
+	mux.HandleFunc("GET /admin/recordings/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if recordings == nil {
+			writeJSONError(w, http.StatusNotFound, ErrRecordingDisabled)
+			return
+		}
+		f, err := recordings.Open(r.PathValue("id"))
+		if err != nil {
+			writeJSONError(w, recordingErrorStatus(err), err)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+r.PathValue("id")+recordingExt+`"`)
+		_, _ = io.Copy(w, f)
+	})
+	mux.HandleFunc("DELETE /admin/recordings/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if recordings == nil {
+			writeJSONError(w, http.StatusNotFound, ErrRecordingDisabled)
+			return
+		}
+		if err := recordings.Remove(r.PathValue("id")); err != nil {
+			writeJSONError(w, recordingErrorStatus(err), err)
+			return
+		}
+		stateDB.audit("recording.remove", r.PathValue("id"), r.RemoteAddr, nil)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /admin/audit", func(w http.ResponseWriter, r *http.Request) {
+		if stateDB == nil {
+			writeJSONError(w, http.StatusNotFound, ErrStateDisabled)
+			return
+		}
+		limit := 100
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("limit must be a positive integer, got '%s'", s))
+				return
+			}
+			limit = n
+		}
+		records, err := stateDB.auditRecords(limit)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, records)
+	})
+
+	return mux
+}
+
+// mintToken mints a token for the listener on port listen, valid for ttl (like 30m),
+// provided the listener requires tokens.
+func mintToken(cfg *Config, tunnels *tunnelManager, listen int, ttl string, once bool, note string) (string, TokenInfo, error) {
+	lifetime, err := time.ParseDuration(ttl)
+	if err != nil {
+		return "", TokenInfo{}, fmt.Errorf("%w: %w", ErrTokenTTL, err)
+	}
+
+	// Only listeners requiring tokens check them
+	port := strconv.Itoa(listen)
+	required := port == cfg.ListenPort && cfg.RequireToken
+	if t, ok := tunnels.Get(listen); ok {
+		required = t.RequireToken
+	} else if port != cfg.ListenPort {
+		return "", TokenInfo{}, fmt.Errorf("%w: %d", ErrTunnelNotFound, listen)
+	}
+	if !required {
+		return "", TokenInfo{}, fmt.Errorf("%w: port %d", ErrTokenNotRequired, listen)
+	}
+
+	return tunnelTokens.Mint(port, lifetime, once, note)
+}
+
+// tokenErrorStatus maps mintToken errors to HTTP status codes.
+func tokenErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTunnelNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrTokenTTL), errors.Is(err, ErrTokenNotRequired):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// recordingErrorStatus maps recordingStore errors to HTTP status codes.
+func recordingErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrRecordingNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrRecordingActive):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// NodeStatus is the admin API summary of the railtail node.
+type NodeStatus struct {
+	Mode         ForwardTrafficType `json:"mode"`
+	TargetAddr   string             `json:"target_addr,omitempty"`
+	ListenPort   string             `json:"listen_port"`
+	Uptime       string             `json:"uptime"`
+	BackendState string             `json:"backend_state"`
+	Hostname     string             `json:"hostname"`
+	DNSName      string             `json:"dns_name"`
+	TailscaleIPs []string           `json:"tailscale_ips"`
+	Version      string             `json:"version"`
+	Peers        int                `json:"peers"`
+	OnlinePeers  int                `json:"online_peers"`
+}
+
+// nodeStatus queries tsnet for the current state of the node.
+func nodeStatus(ctx context.Context, ts *tsnet.Server, cfg *Config) (*NodeStatus, error) {
+	lc, err := localClient(ts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	st, err := lc.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &NodeStatus{
+		Mode:         cfg.ForwardTrafficType,
+		TargetAddr:   cfg.TargetAddr,
+		ListenPort:   cfg.ListenPort,
+		Uptime:       time.Since(startedAt).Round(time.Second).String(),
+		BackendState: st.BackendState,
+		Version:      st.Version,
+		Peers:        len(st.Peer),
+	}
+	for _, ip := range st.TailscaleIPs {
+		status.TailscaleIPs = append(status.TailscaleIPs, ip.String())
+	}
+	if st.Self != nil {
+		status.Hostname = st.Self.HostName
+		status.DNSName = st.Self.DNSName
+	}
+	for _, peer := range st.Peer {
+		if peer.Online {
+			status.OnlinePeers++
+		}
+	}
+
+	return status, nil
+}
+
+// tunnelErrorStatus maps tunnelManager errors to HTTP status codes.
+func tunnelErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTunnelNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrTunnelExists), errors.Is(err, ErrTunnelSwitching):
+		return http.StatusConflict
+	case errors.Is(err, ErrTargetAddrInvalid), errors.Is(err, ErrListenPortInvalid),
+		errors.Is(err, ErrTunnelPersistUnset), errors.Is(err, ErrProxyProtocolInvalid),
+		errors.Is(err, ErrTunnelModeInvalid), errors.Is(err, ErrTCPProtocolInvalid),
+		errors.Is(err, ErrTCPProfileInvalid), errors.Is(err, ErrMQTTTopicInvalid),
+		errors.Is(err, ErrRecordingDisabled), errors.Is(err, ErrTenantNotFound),
+		errors.Is(err, ErrSwitchInvalid):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// scheduleErrorStatus maps scheduler errors to HTTP status codes.
+func scheduleErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrScheduleNotFound), errors.Is(err, ErrStateDisabled):
+		return http.StatusNotFound
+	case errors.Is(err, ErrScheduleInvalid):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes err as a JSON error response.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// ErrAdminUnauthorized is returned for admin requests without the ADMIN_TOKEN.
+var ErrAdminUnauthorized = errors.New("missing or invalid admin token")
+
+// adminPublicPaths are served without the admin token: the dashboard page, which asks
+// for the token itself, and the health check, neither holding any data.
+var adminPublicPaths = map[string]bool{"/": true, "/index.html": true, "/healthz": true}
+
+// requireAdminToken lets requests carrying token as a bearer token through to next, and
+// answers others with 401 Unauthorized, except for adminPublicPaths, and /metrics with
+// publicMetrics. It applies on either network. An empty token lets every request through,
+// which validateConfig only allows on the tailnet, leaving access to the ACLs.
+func requireAdminToken(token string, publicMetrics bool, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		public := adminPublicPaths[r.URL.Path] || publicMetrics && r.URL.Path == "/metrics"
+		if !public && !validAdminToken(token, r.Header.Get("Authorization")) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="railtail admin"`)
+			writeJSONError(w, http.StatusUnauthorized, ErrAdminUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validAdminToken reports whether authorization, the value of an Authorization header,
+// carries token as a bearer token.
+func validAdminToken(token, authorization string) bool {
+	scheme, candidate, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(candidate)), []byte(token)) == 1
+}
+
+// Networks the admin server can listen on.
+const (
+	AdminNetworkLocal   = "local"   // the container's interfaces, like the main listener
+	AdminNetworkTailnet = "tailnet" // the tailnet node only
+)
+
+// adminListener listens on port of the configured admin network.
+func adminListener(ts *tsnet.Server, cfg *Config, port string) (net.Listener, error) {
+	if cfg.AdminNetwork == AdminNetworkTailnet {
+		return ts.Listen("tcp", ":"+port)
+	}
+
+	return net.Listen("tcp", "[::]:"+port)
+}
+
+// serveAdmin runs the admin server on ln until it fails. It is meant to be started in
+// its own goroutine, so failures are logged rather than returned.
+func serveAdmin(ln net.Listener, network string, handler http.Handler) {
+	logger.Stdout.Info().
+		Str("admin-addr", ln.Addr().String()).
+		Str("admin-network", network).
+		Msg("starting admin server")
+
+	server := http.Server{
+		ReadHeaderTimeout: 5 * time.Second,
+		Handler:           handler,
+	}
+	if err := server.Serve(ln); err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("admin-addr", ln.Addr().String()).
+			Msg("admin server stopped")
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rmonvfer/railtail/adminpb"
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"tailscale.com/tsnet"
+)
+
+// watchBuffer is how many connection events or log entries a stream buffers; a client
+// falling further behind misses some.
+const watchBuffer = 256
+
+// grpcAdmin serves the admin API over gRPC, as defined in
+// proto/railtail/admin/v1/admin.proto.
+type grpcAdmin struct {
+	adminpb.UnimplementedAdminServer
+
+	ts      *tsnet.Server
+	cfg     *Config
+	tunnels *tunnelManager
+}
+
+// newGRPCAdmin creates the gRPC server of the admin API.
+func newGRPCAdmin(ts *tsnet.Server, cfg *Config, tunnels *tunnelManager) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := checkGRPCAdminToken(ctx, cfg.AdminToken); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := checkGRPCAdminToken(ss.Context(), cfg.AdminToken); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	adminpb.RegisterAdminServer(server, &grpcAdmin{ts: ts, cfg: cfg, tunnels: tunnels})
+	// Lets grpcurl and the like discover the service without the proto file
+	reflection.Register(server)
+
+	return server
+}
+
+// checkGRPCAdminToken checks that the call of ctx carries token in its authorization
+// metadata, like the JSON API, if set.
+func checkGRPCAdminToken(ctx context.Context, token string) error {
+	if token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, authorization := range md.Get("authorization") {
+		if validAdminToken(token, authorization) {
+			return nil
+		}
+	}
+
+	return status.Error(codes.Unauthenticated, ErrAdminUnauthorized.Error())
+}
+
+// serveGRPCAdmin runs the gRPC admin server on ln until it fails. It is meant to be
+// started in its own goroutine, so failures are logged rather than returned.
+func serveGRPCAdmin(ln net.Listener, network string, server *grpc.Server) {
+	logger.Stdout.Info().
+		Str("admin-grpc-addr", ln.Addr().String()).
+		Str("admin-network", network).
+		Msg("starting gRPC admin server")
+
+	if err := server.Serve(ln); err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("admin-grpc-addr", ln.Addr().String()).
+			Msg("gRPC admin server stopped")
+	}
+}
+
+func (a *grpcAdmin) GetStatus(ctx context.Context, _ *adminpb.GetStatusRequest) (*adminpb.NodeStatus, error) {
+	st, err := nodeStatus(ctx, a.ts, a.cfg)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return &adminpb.NodeStatus{
+		Mode:         string(st.Mode),
+		TargetAddr:   st.TargetAddr,
+		ListenPort:   st.ListenPort,
+		Uptime:       st.Uptime,
+		BackendState: st.BackendState,
+		Hostname:     st.Hostname,
+		DnsName:      st.DNSName,
+		TailscaleIps: st.TailscaleIPs,
+		Version:      st.Version,
+		Peers:        int32(st.Peers),
+		OnlinePeers:  int32(st.OnlinePeers),
+	}, nil
+}
+
+func (a *grpcAdmin) GetStats(context.Context, *adminpb.GetStatsRequest) (*adminpb.Stats, error) {
+	return &adminpb.Stats{
+		Time:              timestamppb.Now(),
+		ActiveConnections: int64(conns.Len()),
+		BytesIn:           bytesInTotal.Value(),
+		BytesOut:          bytesOutTotal.Value(),
+	}, nil
+}
+
+func (a *grpcAdmin) ListConnections(context.Context, *adminpb.ListConnectionsRequest) (*adminpb.ListConnectionsResponse, error) {
+	resp := &adminpb.ListConnectionsResponse{}
+	for _, c := range conns.Snapshot() {
+		resp.Connections = append(resp.Connections, connectionPB(c))
+	}
+
+	return resp, nil
+}
+
+func (a *grpcAdmin) WatchConnections(req *adminpb.WatchConnectionsRequest, stream grpc.ServerStreamingServer[adminpb.ConnectionEvent]) error {
+	events, stop := conns.Watch(watchBuffer)
+	defer stop()
+
+	// Connections opened since watching started are in the snapshot too, sent once
+	sent := make(map[uint64]bool)
+	if req.IncludeOpen {
+		for _, c := range conns.Snapshot() {
+			sent[c.ID] = true
+			event := &adminpb.ConnectionEvent{Type: adminpb.ConnectionEvent_TYPE_OPEN, Connection: connectionPB(c)}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-events:
+			event := &adminpb.ConnectionEvent{Connection: connectionPB(e.Conn), Reason: e.Reason}
+			switch e.Type {
+			case "open":
+				if sent[e.Conn.ID] {
+					continue
+				}
+				event.Type = adminpb.ConnectionEvent_TYPE_OPEN
+			case "close":
+				delete(sent, e.Conn.ID)
+				event.Type = adminpb.ConnectionEvent_TYPE_CLOSE
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (a *grpcAdmin) TailLogs(req *adminpb.TailLogsRequest, stream grpc.ServerStreamingServer[adminpb.LogEntry]) error {
+	minLevel := zerolog.TraceLevel
+	if req.MinLevel != "" {
+		level, err := zerolog.ParseLevel(req.MinLevel)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		minLevel = level
+	}
+
+	entries, stop := logger.Tail.Subscribe(watchBuffer)
+	defer stop()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case data := <-entries:
+			var entry struct {
+				Time    time.Time `json:"time"`
+				Level   string    `json:"level"`
+				Message string    `json:"message"`
+			}
+			if err := json.Unmarshal(data, &entry); err != nil {
+				continue
+			}
+			if level, err := zerolog.ParseLevel(entry.Level); err == nil && level < minLevel {
+				continue
+			}
+			if err := stream.Send(&adminpb.LogEntry{
+				Time:    timestamppb.New(entry.Time),
+				Level:   entry.Level,
+				Message: entry.Message,
+				Json:    string(bytes.TrimSpace(data)),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (a *grpcAdmin) ListTunnels(context.Context, *adminpb.ListTunnelsRequest) (*adminpb.ListTunnelsResponse, error) {
+	resp := &adminpb.ListTunnelsResponse{}
+	for _, t := range a.tunnels.List() {
+		pb := tunnelPB(t.TunnelConfig)
+		pb.Persisted = t.Persisted
+		pb.CreatedAt = timestamppb.New(t.CreatedAt)
+		resp.Tunnels = append(resp.Tunnels, pb)
+	}
+
+	return resp, nil
+}
+
+func (a *grpcAdmin) AddTunnel(ctx context.Context, req *adminpb.AddTunnelRequest) (*adminpb.Tunnel, error) {
+	if req.Tunnel == nil {
+		return nil, status.Error(codes.InvalidArgument, "tunnel is required")
+	}
+	t := req.Tunnel
+	cfg := TunnelConfig{
+		Listen:        int(t.Listen),
+		Mode:          t.Mode,
+		Target:        t.Target,
+		ProxyProtocol: t.ProxyProtocol,
+		Protocol:      t.Protocol,
+		Record:        t.Record,
+		AllowedHours:  t.AllowedHours,
+		RequireToken:  t.RequireToken,
+		Tenant:        t.Tenant,
+
+		MQTTAllowedTopics: t.MqttAllowedTopics,
+		Profile:           t.Profile,
+	}
+	if err := a.tunnels.Add(cfg, req.Persist); err != nil {
+		return nil, grpcError(tunnelErrorStatus(err), err)
+	}
+	stateDB.audit("tunnel.add", strconv.Itoa(cfg.Listen), peerAddr(ctx), struct {
+		TunnelConfig
+		Persist bool `json:"persist"`
+	}{cfg, req.Persist})
+
+	return tunnelPB(cfg), nil
+}
+
+func (a *grpcAdmin) RemoveTunnel(ctx context.Context, req *adminpb.RemoveTunnelRequest) (*adminpb.RemoveTunnelResponse, error) {
+	if err := a.tunnels.Remove(int(req.Listen)); err != nil {
+		return nil, grpcError(tunnelErrorStatus(err), err)
+	}
+	stateDB.audit("tunnel.remove", strconv.Itoa(int(req.Listen)), peerAddr(ctx), nil)
+
+	return &adminpb.RemoveTunnelResponse{}, nil
+}
+
+func (a *grpcAdmin) ListTokens(context.Context, *adminpb.ListTokensRequest) (*adminpb.ListTokensResponse, error) {
+	resp := &adminpb.ListTokensResponse{}
+	for _, info := range tunnelTokens.List() {
+		resp.Tokens = append(resp.Tokens, tokenInfoPB(info))
+	}
+
+	return resp, nil
+}
+
+func (a *grpcAdmin) MintToken(ctx context.Context, req *adminpb.MintTokenRequest) (*adminpb.MintTokenResponse, error) {
+	token, info, err := mintToken(a.cfg, a.tunnels, int(req.Listen), req.Ttl, req.Once, req.Note)
+	if err != nil {
+		return nil, grpcError(tokenErrorStatus(err), err)
+	}
+	stateDB.audit("token.mint", info.ID, peerAddr(ctx), info)
+
+	return &adminpb.MintTokenResponse{Token: token, Info: tokenInfoPB(info)}, nil
+}
+
+func (a *grpcAdmin) RevokeToken(ctx context.Context, req *adminpb.RevokeTokenRequest) (*adminpb.RevokeTokenResponse, error) {
+	if err := tunnelTokens.Revoke(req.Id); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	stateDB.audit("token.revoke", req.Id, peerAddr(ctx), nil)
+
+	return &adminpb.RevokeTokenResponse{}, nil
+}
+
+func (a *grpcAdmin) ListTenants(context.Context, *adminpb.ListTenantsRequest) (*adminpb.ListTenantsResponse, error) {
+	resp := &adminpb.ListTenantsResponse{}
+	for _, u := range tenants.usage() {
+		resp.Tenants = append(resp.Tenants, &adminpb.TenantUsage{
+			Name:              u.Name,
+			ActiveConnections: u.ActiveConnections,
+			Accepted:          u.Accepted,
+			RateLimited:       u.RateLimited,
+			OverQuota:         u.OverQuota,
+			BytesIn:           u.BytesIn,
+			BytesOut:          u.BytesOut,
+		})
+	}
+
+	return resp, nil
+}
+
+func (a *grpcAdmin) ListAudit(_ context.Context, req *adminpb.ListAuditRequest) (*adminpb.ListAuditResponse, error) {
+	if stateDB == nil {
+		return nil, status.Error(codes.FailedPrecondition, ErrStateDisabled.Error())
+	}
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = 100
+	}
+
+	records, err := stateDB.auditRecords(limit)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &adminpb.ListAuditResponse{}
+	for _, r := range records {
+		resp.Records = append(resp.Records, &adminpb.AuditRecord{
+			Id:         r.ID,
+			Time:       timestamppb.New(r.Time),
+			Action:     r.Action,
+			Subject:    r.Subject,
+			RemoteAddr: r.RemoteAddr,
+			Detail:     string(r.Detail),
+		})
+	}
+
+	return resp, nil
+}
+
+// grpcError returns err with the gRPC code matching the HTTP status the REST API answers
+// it with.
+func grpcError(httpStatus int, err error) error {
+	code := codes.Internal
+	switch httpStatus {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	}
+
+	return status.Error(code, err.Error())
+}
+
+// peerAddr returns the address of the client of a call, for the audit trail.
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+
+	return ""
+}
+
+func connectionPB(c ConnSnapshot) *adminpb.Connection {
+	pb := &adminpb.Connection{
+		Id:         c.ID,
+		Kind:       c.Kind,
+		RemoteAddr: c.RemoteAddr,
+		Target:     c.Target,
+		StartedAt:  timestamppb.New(c.StartedAt),
+		BytesIn:    c.BytesIn,
+		BytesOut:   c.BytesOut,
+		Request:    c.Request,
+		UploadSize: c.UploadSize,
+		Uploading:  c.Uploading,
+		LastActive: timestamppb.New(c.LastActive),
+	}
+	if l := c.Latency; l != nil {
+		pb.Latency = &adminpb.ConnectionLatency{
+			Samples: l.Samples,
+			MeanMs:  l.MeanMs,
+			P50Ms:   l.P50Ms,
+			P99Ms:   l.P99Ms,
+			MaxMs:   l.MaxMs,
+		}
+	}
+
+	return pb
+}
+
+func tunnelPB(t TunnelConfig) *adminpb.Tunnel {
+	return &adminpb.Tunnel{
+		Listen:        int32(t.Listen),
+		Mode:          t.mode(),
+		Target:        t.Target,
+		ProxyProtocol: t.ProxyProtocol,
+		Protocol:      t.Protocol,
+		Record:        t.Record,
+		AllowedHours:  t.AllowedHours,
+		RequireToken:  t.RequireToken,
+		Tenant:        t.Tenant,
+
+		MqttAllowedTopics: t.MQTTAllowedTopics,
+		Profile:           t.Profile,
+	}
+}
+
+func tokenInfoPB(info TokenInfo) *adminpb.TokenInfo {
+	return &adminpb.TokenInfo{
+		Id:        info.ID,
+		Listen:    info.Listen,
+		ExpiresAt: timestamppb.New(info.ExpiresAt),
+		Once:      info.Once,
+		Client:    info.Client,
+		Note:      info.Note,
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestRequireAdminToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	tests := []struct {
+		name          string
+		token         string
+		publicMetrics bool
+		path          string
+		authorization string
+		status        int
+	}{
+		{"no token configured", "", false, "/admin/tunnels", "", http.StatusOK},
+		{"missing", "s3cret", false, "/admin/tunnels", "", http.StatusUnauthorized},
+		{"wrong", "s3cret", false, "/admin/tokens", "Bearer nope", http.StatusUnauthorized},
+		{"not a bearer token", "s3cret", false, "/admin/tokens", "Basic s3cret", http.StatusUnauthorized},
+		{"valid", "s3cret", false, "/admin/tokens", "Bearer s3cret", http.StatusOK},
+		{"valid, lowercase scheme", "s3cret", false, "/admin/tokens", "bearer s3cret", http.StatusOK},
+		{"dashboard", "s3cret", false, "/", "", http.StatusOK},
+		{"health check", "s3cret", false, "/healthz", "", http.StatusOK},
+		{"metrics", "s3cret", false, "/metrics", "", http.StatusUnauthorized},
+		{"public metrics", "s3cret", true, "/metrics", "", http.StatusOK},
+		{"public metrics only", "s3cret", true, "/admin/tunnels", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			requireAdminToken(tt.token, tt.publicMetrics, ok).ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestCheckGRPCAdminToken(t *testing.T) {
+	withAuthorization := func(value string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", value))
+	}
+
+	if err := checkGRPCAdminToken(context.Background(), ""); err != nil {
+		t.Errorf("without a token configured: %v, want nil", err)
+	}
+	if err := checkGRPCAdminToken(withAuthorization("Bearer s3cret"), "s3cret"); err != nil {
+		t.Errorf("with the token: %v, want nil", err)
+	}
+	for _, ctx := range []context.Context{context.Background(), withAuthorization("Bearer nope")} {
+		if err := checkGRPCAdminToken(ctx, "s3cret"); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("without the token: %v, want %v", err, codes.Unauthenticated)
+		}
+	}
+}
+
+func TestAdminTokenWarningOnTailnet(t *testing.T) {
+	tests := []struct {
+		network string
+		token   string
+		warns   bool
+	}{
+		{AdminNetworkTailnet, "", true},
+		{AdminNetworkTailnet, "s3cret", false},
+		{AdminNetworkLocal, "s3cret", false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{AdminPort: "9090", AdminNetwork: tt.network, AdminToken: tt.token}
+		warns := false
+		for _, w := range configWarnings(cfg) {
+			warns = warns || errors.Is(w, ErrConfigWarning) && strings.Contains(w.Error(), "ADMIN_TOKEN")
+		}
+		if warns != tt.warns {
+			t.Errorf("ADMIN_NETWORK=%s with token %q: warned %v, want %v", tt.network, tt.token, warns, tt.warns)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+// Package adminpb holds the Go code generated from proto/railtail/admin/v1/admin.proto,
+// the gRPC flavour of railtail's admin API. Regenerate it after changing the proto file.
+package adminpb
+
+//go:generate sh -c "cd .. && buf generate"
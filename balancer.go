@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Sticky session policies.
+const (
+	StickyNone     = ""
+	StickyCookie   = "cookie"
+	StickyClientIP = "client-ip"
+	StickyHeader   = "header"
+)
+
+// ErrStickyInvalid is returned for sticky session policies that cannot be parsed.
+var ErrStickyInvalid = errors.New("sticky session policy is invalid")
+
+// stickyPolicy decides how clients are pinned to a target when several are configured.
+type stickyPolicy struct {
+	kind   string
+	header string // request header hashed by StickyHeader
+}
+
+// parseStickyPolicy parses a STICKY_SESSIONS value: cookie, client-ip or header:<name>.
+func parseStickyPolicy(value string) (stickyPolicy, error) {
+	kind, header, _ := strings.Cut(strings.TrimSpace(value), ":")
+	kind = strings.ToLower(kind)
+
+	switch kind {
+	case StickyNone, StickyCookie, StickyClientIP:
+		if header != "" {
+			return stickyPolicy{}, fmt.Errorf("%w: '%s' takes no argument", ErrStickyInvalid, kind)
+		}
+	case StickyHeader:
+		if header == "" {
+			return stickyPolicy{}, fmt.Errorf("%w: header requires a name (header:<name>)", ErrStickyInvalid)
+		}
+	default:
+		return stickyPolicy{}, fmt.Errorf("%w: expected cookie, client-ip or header:<name>, got '%s'",
+			ErrStickyInvalid, value)
+	}
+
+	return stickyPolicy{kind: kind, header: http.CanonicalHeaderKey(header)}, nil
+}
+
+// poolOptions configures how a targetPool balances traffic.
+type poolOptions struct {
+	sticky  stickyPolicy
+	cookie  string           // cookie used by StickyCookie
+	outlier *outlierSettings // nil disables outlier detection
+	health  *healthSettings  // nil disables active health checks
+	latency *latencySettings // nil balances round-robin
+
+	concurrency *concurrencySettings // nil leaves requests in flight unlimited
+}
+
+// poolTarget is a target address of a targetPool.
+type poolTarget struct {
+	addr  string
+	id    string       // stable identifier, used as the sticky cookie value
+	stats *targetStats // nil when outlier detection is disabled
+	probe *targetProbe // nil when active health checks are disabled
+
+	latency *targetLatency // nil unless balancing by latency
+
+	limiter *concurrencyLimiter // nil when requests in flight are unlimited
+
+	health targetHealth // consecutive failures, for the target health hooks
+
+	mirror string // target client traffic is also copied to, while a tunnel switches to it
+}
+
+// tcpTargetPicker picks the targets of TCP connections: a targetPool, or the targetSwitch
+// of a tunnel.
+type tcpTargetPicker interface {
+	pickTCP(remoteAddr string) *poolTarget
+}
+
+// targetPool spreads connections and requests over one or more targets, round-robin
+// (over the lowest latency ones when balancing by latency) unless a sticky policy pins
+// clients to a target.
+type targetPool struct {
+	targets   []*poolTarget
+	sticky    stickyPolicy
+	cookie    string
+	byLatency bool
+
+	next atomic.Uint64
+}
+
+// newTargetPool creates a pool over addrs. With outlier detection enabled or latency-aware
+// balancing, and several targets, or with active health checks, the pool evaluates its
+// targets in the background for the life of the process.
+func newTargetPool(addrs []string, opts poolOptions) *targetPool {
+	p := &targetPool{
+		sticky:    opts.sticky,
+		cookie:    opts.cookie,
+		byLatency: opts.latency != nil && len(addrs) > 1,
+	}
+	for _, addr := range addrs {
+		t := &poolTarget{addr: addr, id: strconv.FormatUint(hashString(addr), 16)}
+		if opts.outlier != nil {
+			t.stats = &targetStats{}
+		}
+		if opts.health != nil {
+			t.probe = &targetProbe{}
+		}
+		if p.byLatency {
+			t.latency = &targetLatency{}
+		}
+		if opts.concurrency != nil {
+			t.limiter = newConcurrencyLimiter(*opts.concurrency, addr)
+		}
+		p.targets = append(p.targets, t)
+	}
+
+	if opts.outlier != nil && len(p.targets) > 1 {
+		go p.detectOutliers(opts.outlier)
+	}
+	if opts.health != nil {
+		go p.checkHealth(opts.health)
+	}
+	if p.byLatency {
+		go p.probeLatency(opts.latency)
+	}
+
+	return p
+}
+
+// pickHTTP selects the target for r. With cookie stickiness, the cookie pinning the
+// client is set on w when the request does not already carry a valid one (or its
+// target has been ejected).
+func (p *targetPool) pickHTTP(w http.ResponseWriter, r *http.Request) *poolTarget {
+	if len(p.targets) == 1 {
+		return p.targets[0]
+	}
+
+	available := p.available()
+	switch p.sticky.kind {
+	case StickyCookie:
+		if c, err := r.Cookie(p.cookie); err == nil {
+			for _, t := range available {
+				if t.id == c.Value {
+					return t
+				}
+			}
+		}
+
+		t := p.balance(available)
+		http.SetCookie(w, &http.Cookie{
+			Name:     p.cookie,
+			Value:    t.id,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return t
+
+	case StickyClientIP:
+		return byKey(available, requestClientIP(r))
+
+	case StickyHeader:
+		// Requests without the header have nothing to stick to.
+		if key := r.Header.Get(p.sticky.header); key != "" {
+			return byKey(available, key)
+		}
+	}
+
+	return p.balance(available)
+}
+
+// pickTCP selects the target for a connection from remoteAddr. TCP connections carry
+// neither cookies nor headers, so any sticky policy pins by client IP.
+func (p *targetPool) pickTCP(remoteAddr string) *poolTarget {
+	if len(p.targets) == 1 {
+		return p.targets[0]
+	}
+
+	available := p.available()
+	if p.sticky.kind != StickyNone {
+		return byKey(available, hostOnly(remoteAddr))
+	}
+
+	return p.balance(available)
+}
+
+// pickAny selects a target for traffic coming from no client in particular (e.g.
+// replayed requests), so the sticky policy does not apply.
+func (p *targetPool) pickAny() *poolTarget {
+	if len(p.targets) == 1 {
+		return p.targets[0]
+	}
+
+	return p.balance(p.available())
+}
+
+// available returns the targets not ejected by outlier detection nor failing their
+// health checks, or every target if none is left.
+func (p *targetPool) available() []*poolTarget {
+	available := make([]*poolTarget, 0, len(p.targets))
+	for _, t := range p.targets {
+		if !t.isEjected() && !t.isDown() {
+			available = append(available, t)
+		}
+	}
+	if len(available) == 0 {
+		return p.targets
+	}
+
+	return available
+}
+
+// balance selects one of targets round-robin, among the lowest latency ones when
+// balancing by latency and they have been measured.
+func (p *targetPool) balance(targets []*poolTarget) *poolTarget {
+	if p.byLatency {
+		if fast := fastest(targets); len(fast) > 0 {
+			return p.roundRobin(fast)
+		}
+	}
+
+	return p.roundRobin(targets)
+}
+
+func (p *targetPool) roundRobin(targets []*poolTarget) *poolTarget {
+	return targets[(p.next.Add(1)-1)%uint64(len(targets))]
+}
+
+// byKey maps key to one of targets with rendezvous hashing, so that adding or removing
+// a target only moves the clients of that target.
+func byKey(targets []*poolTarget, key string) *poolTarget {
+	var (
+		best      *poolTarget
+		bestScore uint64
+	)
+	for i, t := range targets {
+		score := hashString(t.id + "\x00" + key)
+		if i == 0 || score > bestScore {
+			best, bestScore = t, score
+		}
+	}
+
+	return best
+}
+
+// requestClientIP returns the IP of the client that sent r. Behind Railway's edge the
+// connection comes from the proxy, so the first X-Forwarded-For entry is preferred.
+func requestClientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		first, _, _ := strings.Cut(fwd, ",")
+		return strings.TrimSpace(first)
+	}
+
+	return hostOnly(r.RemoteAddr)
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
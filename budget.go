@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+	"golang.org/x/sync/semaphore"
+)
+
+// Buffer memory reserved per forwarded TCP connection (one buffer per direction) and
+// per HTTP request (the reverse proxy's copy buffer and request body buffering).
+const (
+	tcpConnBufferBytes     = 2 * copyBufferSize
+	httpRequestBufferBytes = 64 << 10
+)
+
+// ErrBufferBudgetExhausted is returned when a connection is refused for lack of buffer memory.
+var ErrBufferBudgetExhausted = errors.New("buffer memory budget exhausted")
+
+// budget is the process-wide buffer memory budget, nil when unlimited.
+var budget *bufferBudget
+
+var (
+	budgetInUse = metrics.Default.Gauge("railtail_buffer_bytes_in_use",
+		"Buffer memory reserved by forwarded connections and requests.")
+	budgetQueued = metrics.Default.Counter("railtail_buffer_admissions_queued_total",
+		"Connections and requests that waited for buffer memory.")
+	budgetRejected = metrics.Default.Counter("railtail_buffer_admissions_rejected_total",
+		"Connections and requests refused for lack of buffer memory.")
+)
+
+// bufferBudget caps the buffer memory reserved by connections in flight, so that a burst
+// of transfers cannot exhaust the container's memory.
+type bufferBudget struct {
+	sem  *semaphore.Weighted
+	wait time.Duration // how long to queue for memory; 0 rejects right away
+}
+
+// newBufferBudget creates a budget of limit bytes, or returns nil if limit is 0.
+func newBufferBudget(limit int64, wait time.Duration) *bufferBudget {
+	if limit <= 0 {
+		return nil
+	}
+
+	metrics.Default.Gauge("railtail_buffer_budget_bytes",
+		"Buffer memory budget shared by all connections and requests.").Set(limit)
+
+	return &bufferBudget{sem: semaphore.NewWeighted(limit), wait: wait}
+}
+
+// admit reserves n bytes, queueing for up to the configured wait. It reports whether the
+// reservation was made; if so, the caller must release it.
+func (b *bufferBudget) admit(ctx context.Context, n int64) bool {
+	if b == nil {
+		return true
+	}
+
+	if !b.sem.TryAcquire(n) {
+		if b.wait <= 0 {
+			budgetRejected.Inc()
+			return false
+		}
+
+		budgetQueued.Inc()
+		ctx, cancel := context.WithTimeout(ctx, b.wait)
+		defer cancel()
+		if err := b.sem.Acquire(ctx, n); err != nil {
+			budgetRejected.Inc()
+			return false
+		}
+	}
+
+	budgetInUse.Add(n)
+	return true
+}
+
+// release returns n bytes admitted earlier.
+func (b *bufferBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+
+	b.sem.Release(n)
+	budgetInUse.Add(-n)
+}
+
+// admitRequests answers requests with 503 when the budget has no room for them.
+func admitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !budget.admit(r.Context(), httpRequestBufferBytes) {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(ErrBufferBudgetExhausted), logger.ErrValue(ErrBufferBudgetExhausted)).
+				Str("remote-addr", r.RemoteAddr).
+				Str("reason", CloseLimitExceeded).
+				Msg("refusing request")
+			countClosed(connKindHTTP, CloseLimitExceeded)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, ErrBufferBudgetExhausted.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer budget.release(httpRequestBufferBytes)
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+const (
+	// bulkCopyBufferSize is the size of the copy buffers of bulk connections, for the
+	// reads and writes of file protocols (SMB, NFS), which run to megabytes.
+	bulkCopyBufferSize = 1 << 20
+	// bulkSocketBufferSize is the size asked for the socket buffers of bulk clients.
+	bulkSocketBufferSize = 4 << 20
+	// bulkCoalesceSize is how much is buffered of the writes into the tailnet before they
+	// are passed on, see coalescingConn.
+	bulkCoalesceSize = 256 << 10
+	// bulkCoalesceDelay is how long buffered writes wait for more to pass on with them.
+	bulkCoalesceDelay = time.Millisecond
+	// bulkThroughputMinBytes is how much a bulk connection must move in a direction for
+	// its throughput that way to be recorded; less tells more about latency.
+	bulkThroughputMinBytes = 1 << 20
+	// bulkRelayCheckDelay is how long after connecting the path of a bulk connection is
+	// checked, leaving the peers time to set up a direct path.
+	bulkRelayCheckDelay = 15 * time.Second
+	// bulkRelayWarnInterval is how often bulk connections relayed to the same peer are
+	// warned about.
+	bulkRelayWarnInterval = 10 * time.Minute
+)
+
+var bulkCopyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, bulkCopyBufferSize)
+		return &b
+	},
+}
+
+// bulkThroughputBuckets are the bounds of the throughputs of bulk connections, in bytes
+// per second: from 128 KiB/s, a DERP relay under load, to 1 GiB/s.
+var bulkThroughputBuckets = []float64{1 << 17, 1 << 18, 1 << 19, 1 << 20, 1 << 21, 1 << 22, 1 << 23, 1 << 24, 1 << 25, 1 << 26, 1 << 27, 1 << 28, 1 << 29, 1 << 30}
+
+// bulkPaths finds the bulk connections relayed through DERP, set in main.
+var bulkPaths *pathLookup
+
+// coalescingConn buffers the writes to a connection into the tailnet, passing them on
+// in one write once bulkCoalesceSize bytes are buffered, or bulkCoalesceDelay after the
+// first, so that the many small reads of a busy client do not each become a write (and
+// a burst of small segments) into the tailnet stack. Writes of a full buffer or more go
+// straight through.
+type coalescingConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	w         *bufio.Writer
+	timer     *time.Timer
+	scheduled bool
+	err       error // of a flush on the timer, returned by the next write
+}
+
+func newCoalescingConn(conn net.Conn) *coalescingConn {
+	c := &coalescingConn{Conn: conn, w: bufio.NewWriterSize(conn, bulkCoalesceSize)}
+	c.timer = time.AfterFunc(bulkCoalesceDelay, c.flush)
+	c.timer.Stop()
+
+	return c
+}
+
+// Write implements the io.Writer interface.
+func (c *coalescingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	if err != nil {
+		c.err = err
+		return n, err
+	}
+	if c.w.Buffered() > 0 && !c.scheduled {
+		c.scheduled = true
+		c.timer.Reset(bulkCoalesceDelay)
+	}
+
+	return n, nil
+}
+
+// flush passes the buffered writes on.
+func (c *coalescingConn) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.scheduled = false
+	if c.err == nil {
+		c.err = c.w.Flush()
+	}
+}
+
+// CloseWrite passes the buffered writes on, then closes the write side of the connection.
+func (c *coalescingConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timer.Stop()
+	if c.err == nil {
+		c.err = c.w.Flush()
+	}
+	if c.err != nil {
+		return c.err
+	}
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+
+	return errors.ErrUnsupported
+}
+
+// transferMeter measures the throughput of a bulk connection each way, over the time from
+// the first to the last bytes that way, so that a client sitting idle between files does
+// not drag it down.
+type transferMeter struct {
+	upload, download transferSpan
+}
+
+// transferSpan is what a connection moved in one direction. It is only updated by the
+// copy of that direction.
+type transferSpan struct {
+	first, last time.Time
+	bytes       int64
+}
+
+// count records n bytes moved.
+func (s *transferSpan) count(n int) {
+	if n == 0 {
+		return
+	}
+
+	now := time.Now()
+	if s.first.IsZero() {
+		s.first = now
+	}
+	s.last = now
+	s.bytes += int64(n)
+}
+
+// throughput returns the bytes per second moved, and false if too little was moved to
+// tell.
+func (s *transferSpan) throughput() (float64, bool) {
+	span := s.last.Sub(s.first)
+	if s.bytes < bulkThroughputMinBytes || span <= 0 {
+		return 0, false
+	}
+
+	return float64(s.bytes) / span.Seconds(), true
+}
+
+// record records the throughputs of the connection from remote to target, accepted on
+// the listener with the local address local, once it is closed.
+func (m *transferMeter) record(local net.Addr, remote, target string) {
+	event := logger.Stdout.Debug().
+		Str("remote-addr", remote).
+		Str("target", target)
+	for _, dir := range []struct {
+		name string
+		span *transferSpan
+	}{{"upload", &m.upload}, {"download", &m.download}} {
+		rate, ok := dir.span.throughput()
+		if !ok {
+			continue
+		}
+		metrics.Default.HistogramWithBuckets("railtail_tcp_bulk_throughput_bytes_per_second",
+			"Throughput of bulk connections each way, by listen port and direction.", bulkThroughputBuckets,
+			"listener", listenPort(local), "direction", dir.name).Observe(rate)
+		event = event.Int64(dir.name+"-bytes", dir.span.bytes).Float64(dir.name+"-bytes-per-second", rate)
+	}
+	event.Msg("bulk transfer done")
+}
+
+// warnRelayed checks, bulkRelayCheckDelay from now, whether conn, a bulk connection
+// dialed to target, is relayed through DERP, and warns about it: relays are shared and
+// rate-limited, and file protocols over them are unusably slow. It returns a function
+// cancelling the check, for connections closed before.
+func (l *pathLookup) warnRelayed(conn net.Conn, target string) (stop func()) {
+	if l == nil {
+		return func() {}
+	}
+
+	timer := time.AfterFunc(bulkRelayCheckDelay, func() {
+		peer, err := l.connPeer(conn)
+		if err != nil || peer == nil || peer.CurAddr != "" {
+			return
+		}
+		metrics.Default.Counter("railtail_tcp_bulk_relayed_total",
+			"Bulk connections still relayed through DERP after connecting, instead of direct.").Inc()
+
+		l.mu.Lock()
+		warned := time.Since(l.warned[peer.HostName]) < bulkRelayWarnInterval
+		if !warned {
+			l.warned[peer.HostName] = time.Now()
+		}
+		l.mu.Unlock()
+		if warned {
+			return
+		}
+		logger.Stderr.Warn().
+			Str("target", target).
+			Str("peer", peer.HostName).
+			Str("relay", peer.Relay).
+			Msg("bulk connection relayed through DERP; file transfers will be slow until the peers connect directly " +
+				"(allow UDP 41641 to the peer, avoid hard NATs, see tailscale netcheck)")
+	})
+
+	return func() { timer.Stop() }
+}
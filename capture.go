@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/tsnet"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// Capture scopes.
+const (
+	CaptureScopeListener = "listener"
+	CaptureScopeTailnet  = "tailnet"
+	CaptureScopeBoth     = "both"
+)
+
+// ErrCaptureInvalid is returned for CAPTURE values that cannot be parsed.
+var ErrCaptureInvalid = errors.New("capture is invalid")
+
+// pcap file format constants.
+const (
+	pcapMagic        = 0xa1b2c3d4 // microsecond timestamps
+	pcapLinkTypeRaw  = 101        // raw IPv4 or IPv6 packets
+	pcapMaxSnaplen   = 262144
+	pcapMaxSegment   = 65000 // payload of synthesized TCP segments
+	pcapHeaderLength = 24
+	pcapRecordLength = 16
+)
+
+// captureSettings configures the debug packet capture.
+type captureSettings struct {
+	path     string // pcap file; each scope gets its own when capturing both
+	scope    string
+	snaplen  int   // bytes kept of each packet; 0 keeps them whole
+	sample   int   // capture one in sample connections (listener) or packets (tailnet)
+	maxBytes int64 // the capture stops once a file reaches this size
+}
+
+// parseCapture parses a CAPTURE value: pcap:<path>.
+func parseCapture(value string) (string, error) {
+	format, path, ok := strings.Cut(value, ":")
+	if !ok || format != "pcap" || path == "" {
+		return "", fmt.Errorf("%w: expected pcap:<path>, got '%s'", ErrCaptureInvalid, value)
+	}
+
+	return path, nil
+}
+
+// capturePath returns the file scope is captured to: path itself, or path with the scope
+// appended to its name when both scopes are captured.
+func (s captureSettings) capturePath(scope string) string {
+	if s.scope != CaptureScopeBoth {
+		return s.path
+	}
+
+	ext := filepath.Ext(s.path)
+	return strings.TrimSuffix(s.path, ext) + "-" + scope + ext
+}
+
+// pcapWriter writes packets to a pcap file, up to a size bound.
+type pcapWriter struct {
+	path     string
+	snaplen  int
+	maxBytes int64
+
+	mu      sync.Mutex
+	w       *bufio.Writer
+	f       *os.File
+	written int64
+	full    bool
+}
+
+// newPcapWriter creates the pcap file at path, for packets of linkType.
+func newPcapWriter(path string, linkType uint32, snaplen int, maxBytes int64) (*pcapWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %w", err)
+	}
+
+	if snaplen <= 0 || snaplen > pcapMaxSnaplen {
+		snaplen = pcapMaxSnaplen
+	}
+	p := &pcapWriter{path: path, snaplen: snaplen, maxBytes: maxBytes, f: f, w: bufio.NewWriter(f)}
+
+	var header [pcapHeaderLength]byte
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2) // version 2.4
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], uint32(snaplen))
+	binary.LittleEndian.PutUint32(header[20:], linkType)
+	if _, err := p.w.Write(header[:]); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	p.written = pcapHeaderLength
+
+	// Flush regularly, so that the file can be read while capturing
+	go func() {
+		for range time.Tick(time.Second) {
+			p.mu.Lock()
+			_ = p.w.Flush()
+			p.mu.Unlock()
+		}
+	}()
+
+	return p, nil
+}
+
+// write writes a packet seen at ts, truncated to the snaplen. origLen is the length of
+// the packet before any truncation.
+func (p *pcapWriter) write(ts time.Time, data []byte, origLen int) {
+	if len(data) > p.snaplen {
+		data = data[:p.snaplen]
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.full {
+		return
+	}
+	if p.maxBytes > 0 && p.written+int64(pcapRecordLength+len(data)) > p.maxBytes {
+		p.full = true
+		_ = p.w.Flush()
+		logger.Stderr.Warn().
+			Str("file", p.path).
+			Int64("bytes", p.written).
+			Msg("capture file is full, capture stopped")
+		return
+	}
+
+	var header [pcapRecordLength]byte
+	binary.LittleEndian.PutUint32(header[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(origLen))
+	_, _ = p.w.Write(header[:])
+	_, _ = p.w.Write(data)
+	p.written += int64(pcapRecordLength + len(data))
+}
+
+// captureListener captures the traffic of one in sample connections it accepts. TCP
+// segments are synthesized from what is read from and written to the connection, so the
+// capture shows the payloads as the listener sees them (still encrypted when the listener
+// terminates TLS above it), not the packets on the wire.
+type captureListener struct {
+	net.Listener
+	pcap   *pcapWriter
+	sample uint64
+
+	accepted atomic.Uint64
+}
+
+func (l *captureListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || (l.accepted.Add(1)-1)%l.sample != 0 {
+		return conn, err
+	}
+
+	c := &capturedConn{
+		Conn:   conn,
+		pcap:   l.pcap,
+		client: tcpEndpointOf(conn.RemoteAddr()),
+		server: tcpEndpointOf(conn.LocalAddr()),
+	}
+	c.client.seq, c.server.seq = 1000, 5000
+	c.segment(c.client, c.server, tcpFlagSYN, nil)
+	c.segment(c.server, c.client, tcpFlagSYN|tcpFlagACK, nil)
+	c.client.seq++
+	c.server.seq++
+	c.segment(c.client, c.server, tcpFlagACK, nil)
+
+	return c, nil
+}
+
+// TCP flags of synthesized segments.
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// tcpEndpoint is one end of a captured connection.
+type tcpEndpoint struct {
+	ip   net.IP
+	port uint16
+	seq  uint32
+}
+
+func tcpEndpointOf(addr net.Addr) *tcpEndpoint {
+	e := &tcpEndpoint{ip: net.IPv4zero}
+	if a, ok := addr.(*net.TCPAddr); ok {
+		e.ip, e.port = a.IP, uint16(a.Port)
+	}
+
+	return e
+}
+
+// capturedConn is a connection whose traffic is captured as TCP segments.
+type capturedConn struct {
+	net.Conn
+	pcap *pcapWriter
+
+	mu             sync.Mutex
+	client, server *tcpEndpoint
+	clientFIN      bool
+	serverFIN      bool
+}
+
+func (c *capturedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.payload(c.client, c.server, p[:n])
+	}
+	if err == io.EOF {
+		c.fin(c.client, c.server, &c.clientFIN)
+	}
+
+	return n, err
+}
+
+func (c *capturedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.payload(c.server, c.client, p[:n])
+	}
+
+	return n, err
+}
+
+// CloseWrite half-closes the connection, if it supports it.
+func (c *capturedConn) CloseWrite() error {
+	conn, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return nil
+	}
+	c.fin(c.server, c.client, &c.serverFIN)
+
+	return conn.CloseWrite()
+}
+
+func (c *capturedConn) Close() error {
+	c.fin(c.server, c.client, &c.serverFIN)
+
+	return c.Conn.Close()
+}
+
+// NetConn returns the captured connection.
+func (c *capturedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// payload captures data sent from src to dst.
+func (c *capturedConn) payload(src, dst *tcpEndpoint, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(data) > 0 {
+		n := min(len(data), pcapMaxSegment)
+		c.segment(src, dst, tcpFlagPSH|tcpFlagACK, data[:n])
+		src.seq += uint32(n)
+		data = data[n:]
+	}
+}
+
+// fin captures src closing its side, once.
+func (c *capturedConn) fin(src, dst *tcpEndpoint, sent *bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if *sent {
+		return
+	}
+	*sent = true
+	c.segment(src, dst, tcpFlagFIN|tcpFlagACK, nil)
+	src.seq++
+}
+
+// segment writes a TCP segment from src to dst, in an IPv4 packet if both ends are
+// IPv4, IPv6 otherwise.
+func (c *capturedConn) segment(src, dst *tcpEndpoint, flags byte, payload []byte) {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], src.seq)
+	if flags&tcpFlagACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], dst.seq)
+	}
+	tcp[12] = 5 << 4 // header length, in 32-bit words
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	tcp = append(tcp, payload...)
+
+	var packet []byte
+	src4, dst4 := src.ip.To4(), dst.ip.To4()
+	if src4 != nil && dst4 != nil {
+		packet = make([]byte, 20, 20+len(tcp))
+		packet[0] = 0x45 // IPv4, 5-word header
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(tcp)))
+		packet[6] = 0x40 // don't fragment
+		packet[8] = 64   // TTL
+		packet[9] = 6    // TCP
+		copy(packet[12:], src4)
+		copy(packet[16:], dst4)
+		binary.BigEndian.PutUint16(packet[10:], ipv4Checksum(packet))
+	} else {
+		packet = make([]byte, 40, 40+len(tcp))
+		packet[0] = 0x60 // IPv6
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6  // TCP
+		packet[7] = 64 // hop limit
+		copy(packet[8:], src.ip.To16())
+		copy(packet[24:], dst.ip.To16())
+	}
+	packet = append(packet, tcp...)
+
+	c.pcap.write(time.Now(), packet, len(packet))
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return ^uint16(sum)
+}
+
+// captureTailnet captures one in settings.sample packets seen by the tsnet interface,
+// until ctx is done. Packets carry a Tailscale-specific header: Wireshark needs the
+// ts-dissector.lua dissector from the Tailscale repository to decode them.
+func captureTailnet(ctx context.Context, ts *tsnet.Server, settings captureSettings) error {
+	lc, err := localClient(ts)
+	if err != nil {
+		return err
+	}
+	stream, err := lc.StreamDebugCapture(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start tailnet capture: %w", err)
+	}
+
+	r := bufio.NewReader(stream)
+	var header [pcapHeaderLength]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		_ = stream.Close()
+		return fmt.Errorf("failed to start tailnet capture: %w", err)
+	}
+	order := binary.ByteOrder(binary.LittleEndian)
+	if binary.BigEndian.Uint32(header[0:]) == pcapMagic {
+		order = binary.BigEndian
+	}
+
+	pcap, err := newPcapWriter(settings.capturePath(CaptureScopeTailnet),
+		order.Uint32(header[20:]), settings.snaplen, settings.maxBytes)
+	if err != nil {
+		_ = stream.Close()
+		return err
+	}
+
+	go func() {
+		defer stream.Close()
+
+		var (
+			record [pcapRecordLength]byte
+			seen   uint64
+		)
+		for {
+			if _, err := io.ReadFull(r, record[:]); err != nil {
+				return
+			}
+			data := make([]byte, order.Uint32(record[8:]))
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			if seen++; (seen-1)%uint64(settings.sample) != 0 {
+				continue
+			}
+
+			ts := time.Unix(int64(order.Uint32(record[0:])), int64(order.Uint32(record[4:]))*1000)
+			pcap.write(ts, data, int(order.Uint32(record[12:])))
+		}
+	}()
+
+	return nil
+}
+
+// startCapture starts capturing traffic as configured, wrapping listeners when the
+// listener scope is captured.
+func startCapture(ctx context.Context, ts *tsnet.Server, settings captureSettings, listeners []net.Listener) error {
+	if settings.scope == CaptureScopeListener || settings.scope == CaptureScopeBoth {
+		pcap, err := newPcapWriter(settings.capturePath(CaptureScopeListener),
+			pcapLinkTypeRaw, settings.snaplen, settings.maxBytes)
+		if err != nil {
+			return err
+		}
+
+		wrapped := make(map[net.Listener]net.Listener)
+		for i, l := range listeners {
+			// Accept workers may share a listener
+			if wrapped[l] == nil {
+				wrapped[l] = &captureListener{Listener: l, pcap: pcap, sample: uint64(settings.sample)}
+			}
+			listeners[i] = wrapped[l]
+		}
+	}
+
+	if settings.scope == CaptureScopeTailnet || settings.scope == CaptureScopeBoth {
+		if err := captureTailnet(ctx, ts, settings); err != nil {
+			return err
+		}
+	}
+
+	logger.Stderr.Warn().
+		Str("scope", settings.scope).
+		Str("path", settings.path).
+		Int("snaplen", settings.snaplen).
+		Int("sample", settings.sample).
+		Msg("capturing traffic, for debugging only")
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// Modes of client certificate authentication on the listener (TLS_CLIENT_AUTH).
+const (
+	TLSClientAuthRequire  = "require"  // refuse clients without a certificate the CA signed
+	TLSClientAuthOptional = "optional" // verify certificates clients present, accept clients without
+)
+
+// ErrClientCAInvalid is returned for TLS_CLIENT_CA_FILE without a usable certificate.
+var ErrClientCAInvalid = errors.New("client CA file has no PEM certificate")
+
+// acmeTLSALPN is the protocol of TLS-ALPN-01 challenges, whose validation connections
+// from the ACME CA carry no client certificate.
+const acmeTLSALPN = "acme-tls/1"
+
+// loadClientCAs returns the certificates of the PEM bundle at path.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w: %s", ErrClientCAInvalid, path)
+	}
+
+	return pool, nil
+}
+
+// requireClientCerts makes tlsConfig verify client certificates against the CAs of
+// TLS_CLIENT_CA_FILE, or as SVIDs with TLS_CLIENT_SPIFFE, and require one unless
+// TLS_CLIENT_AUTH is optional. ACME validation connections are let through without one.
+func requireClientCerts(tlsConfig *tls.Config, cfg *Config) error {
+	if cfg.TLSClientCAFile != "" {
+		pool, err := loadClientCAs(cfg.TLSClientCAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientCAs = pool
+	}
+
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if cfg.TLSClientAuth == TLSClientAuthOptional {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	acmeConfig := tlsConfig.Clone()
+	acmeConfig.ClientAuth = tls.NoClientCert
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if slices.Contains(hello.SupportedProtos, acmeTLSALPN) {
+			return acmeConfig, nil
+		}
+		return nil, nil
+	}
+	if cfg.TLSClientSPIFFE {
+		workloadSVIDs.requireClientSVIDs(tlsConfig)
+	}
+
+	return nil
+}
+
+// clientIdentity returns the identity of the verified client certificate of a TLS
+// connection: its first URI SAN (like a SPIFFE ID), else its first DNS name, else its
+// first email address, else its subject common name. It is empty without a certificate.
+func clientIdentity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+
+	cert := state.PeerCertificates[0]
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	default:
+		return cert.Subject.CommonName
+	}
+}
+
+// matchIdentity reports whether identity matches one of patterns: equal to it, or
+// starting with what precedes the trailing * of the pattern, like
+// spiffe://example.org/ns/prod/*.
+func matchIdentity(identity string, patterns []string) bool {
+	if identity == "" {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(identity, prefix) {
+				return true
+			}
+		} else if identity == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// logClientIdentity adds the identity of the client certificate of r, if any, to event.
+func logClientIdentity(event *zerolog.Event, r *http.Request) *zerolog.Event {
+	if identity := clientIdentity(r.TLS); identity != "" {
+		return event.Str("client-identity", identity)
+	}
+
+	return event
+}
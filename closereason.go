@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Reasons connections (TCP) and requests (HTTP) are closed for.
+const (
+	CloseCompleted     = "completed"      // HTTP: the response was sent
+	CloseClientEOF     = "client-eof"     // the client closed first (HTTP: went away before the response)
+	CloseUpstreamEOF   = "upstream-eof"   // the target closed first
+	CloseClientError   = "client-error"   // reading from or writing to the client failed
+	CloseUpstreamError = "upstream-error" // reading from or writing to the target failed
+	CloseClientAbort   = "client-abort"   // TCP: the client reset the connection or stopped answering
+	CloseUpstreamAbort = "upstream-abort" // TCP: the target reset the connection or stopped answering
+	CloseIdleTimeout   = "idle-timeout"   // no traffic for TCP_IDLE_TIMEOUT
+	CloseMaxLifetime   = "max-lifetime"   // MAX_CONN_LIFETIME reached
+	CloseDrained       = "drained"        // its target or tunnel was removed, and DRAIN_TIMEOUT passed
+	CloseDialFailed    = "dial-failed"    // the target could not be reached
+	CloseLimitExceeded = "limit-exceeded" // refused by the concurrency limit or the buffer budget
+	CloseOutsideWindow = "outside-window" // refused outside the allowed hours
+	CloseMaintenance   = "maintenance"    // refused during maintenance
+	CloseUnauthorized  = "unauthorized"   // refused for a missing or invalid tunnel token or route credentials, or MQTT_ALLOWED_TOPICS
+	CloseUnknown       = "unknown"
+)
+
+// closeError is an error that ended a connection, with the reason it was closed for.
+type closeError struct {
+	reason string
+	err    error
+}
+
+func (e *closeError) Error() string { return e.reason + ": " + e.err.Error() }
+func (e *closeError) Unwrap() error { return e.err }
+
+// withCloseReason annotates err with the reason the connection it ended was closed for.
+func withCloseReason(reason string, err error) error {
+	return &closeError{reason: reason, err: err}
+}
+
+// closeReasonOf returns the reason err was annotated with, or CloseUnknown.
+func closeReasonOf(err error) string {
+	var ce *closeError
+	if errors.As(err, &ce) {
+		return ce.reason
+	}
+
+	return CloseUnknown
+}
+
+// closedNormally reports whether connections closed for reason ended the way connections
+// do, rather than failing: one side closed it, or railtail did on purpose.
+func closedNormally(reason string) bool {
+	switch reason {
+	case CloseClientEOF, CloseUpstreamEOF, CloseIdleTimeout, CloseMaxLifetime, CloseDrained:
+		return true
+	}
+
+	return false
+}
+
+// copyFailureReason classifies the error of copying from the src side to the dst side
+// of a connection ("client" or "upstream"): writes failing are the fault of dst, reads of
+// src. Resets and unresponsive peers are told apart as aborts.
+func copyFailureReason(err error, src, dst string) string {
+	side := src
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "write" {
+		side = dst
+	}
+	switch {
+	case side == "client" && isAbort(err):
+		return CloseClientAbort
+	case side == "client":
+		return CloseClientError
+	case isAbort(err):
+		return CloseUpstreamAbort
+	default:
+		return CloseUpstreamError
+	}
+}
+
+// httpFailureReason classifies the error of forwarding r to its target, as returned by
+// classifyError.
+func httpFailureReason(r *http.Request, err error) string {
+	switch {
+	case r.Context().Err() != nil:
+		return CloseClientEOF
+	case errors.Is(err, ErrDial):
+		return CloseDialFailed
+	default:
+		return CloseUpstreamError
+	}
+}
+
+// countClosed counts a connection or request of kind closed for reason.
+func countClosed(kind, reason string) {
+	metrics.Default.Counter("railtail_connections_closed_total",
+		"Connections (TCP) and requests (HTTP) closed, by reason.", "kind", kind, "reason", reason).Inc()
+}
+
+// trackedKey is the context key of the trackedConn of a request.
+type trackedKey struct{}
+
+// setRequestCloseReason sets the reason the request r is closed for, if it is tracked.
+func setRequestCloseReason(r *http.Request, reason string) {
+	if c, ok := r.Context().Value(trackedKey{}).(*trackedConn); ok {
+		c.setCloseReason(reason)
+	}
+}
+
+// setRequestCloseCause sets the reason the request r is closed for, and whether err, the
+// error that ended it, is a deadline being hit, if it is tracked.
+func setRequestCloseCause(r *http.Request, reason string, err error) {
+	if c, ok := r.Context().Value(trackedKey{}).(*trackedConn); ok {
+		c.setCloseCause(reason, err)
+	}
+}
+
+// requestListener returns the listen port r was received on, "" if unknown.
+func requestListener(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return listenPort(addr)
+	}
+
+	return ""
+}
+
+// withTracked returns r carrying c, for setRequestCloseReason.
+func withTracked(r *http.Request, c *trackedConn) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), trackedKey{}, c))
+}
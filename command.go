@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// ErrCommandInvalid is returned for route commands that cannot be sent.
+var ErrCommandInvalid = errors.New("route command is invalid")
+
+const (
+	// commandTimeout bounds an exchange with the target by default, from dial to reply.
+	commandTimeout = 10 * time.Second
+	// commandMaxReply bounds the replies read from the target by default.
+	commandMaxReply = 1 << 20
+	// commandMaxBody bounds the request bodies sent with {{ body }}.
+	commandMaxBody = 1 << 20
+)
+
+// commandPlaceholder matches the placeholders of the bytes sent by a command: {{ body }},
+// {{ method }}, {{ path }}, {{ query "name" }} and {{ header "Name" }}.
+var commandPlaceholder = regexp.MustCompile(`\{\{\s*(body|method|path|query\s+"([^"]+)"|header\s+"([^"]+)")\s*\}\}`)
+
+// RouteCommand turns the requests of a route into exchanges with a TCP service, like the
+// admin interface of a legacy daemon: the request is rendered into bytes sent to the
+// target, and what the target replies, up to a delimiter, is the response.
+type RouteCommand struct {
+	Send        string        `yaml:"send"`         // Bytes to send, with placeholders
+	Until       string        `yaml:"until"`        // Delimiter ending the reply, like "\r\n"; the target closing the connection if empty
+	Strip       bool          `yaml:"strip"`        // Leave the delimiter out of the response
+	Timeout     time.Duration `yaml:"timeout"`      // Bound of the exchange, from dial to reply; 10s if 0
+	MaxReply    int           `yaml:"max_reply"`    // Bound of the reply, in bytes; 1 MiB if 0
+	ContentType string        `yaml:"content_type"` // Content type of responses; text/plain; charset=utf-8 if empty
+}
+
+// validate checks the command of a route.
+func (c RouteCommand) validate() error {
+	if c.Send == "" {
+		return fmt.Errorf("%w: send is required", ErrCommandInvalid)
+	}
+	if rest := commandPlaceholder.ReplaceAllString(c.Send, ""); strings.Contains(rest, "{{") {
+		return fmt.Errorf(`%w: send supports {{ body }}, {{ method }}, {{ path }}, {{ query "name" }} and {{ header "Name" }}`,
+			ErrCommandInvalid)
+	}
+	if c.Strip && c.Until == "" {
+		return fmt.Errorf("%w: strip requires until", ErrCommandInvalid)
+	}
+	if c.Timeout < 0 || c.MaxReply < 0 {
+		return fmt.Errorf("%w: timeout and max_reply must not be negative", ErrCommandInvalid)
+	}
+
+	return nil
+}
+
+// commandHandler serves the requests of a route with a command, exchanging with target
+// on a connection of its own for each.
+type commandHandler struct {
+	route  string
+	target string
+	prefix string // path prefix of the route, trimmed from {{ path }}
+	cmd    RouteCommand
+	body   bool // whether cmd sends the request body
+	dial   dialFunc
+
+	ok       *metrics.Counter
+	failed   *metrics.Counter
+	timedOut *metrics.Counter
+}
+
+// newCommandHandler returns the commandHandler of the route rc.
+func newCommandHandler(rc RouteConfig, dial dialFunc) *commandHandler {
+	counter := func(result string) *metrics.Counter {
+		return metrics.Default.Counter("railtail_route_commands_total",
+			"Exchanges with the TCP targets of route commands, by route and result.", "route", rc.Name, "result", result)
+	}
+
+	cmd := *rc.Command
+	cmd.Timeout = cmp.Or(cmd.Timeout, commandTimeout)
+	cmd.MaxReply = cmp.Or(cmd.MaxReply, commandMaxReply)
+	cmd.ContentType = cmp.Or(cmd.ContentType, "text/plain; charset=utf-8")
+
+	h := &commandHandler{
+		route:    rc.Name,
+		target:   rc.Target,
+		prefix:   rc.PathPrefix,
+		cmd:      cmd,
+		dial:     dial,
+		ok:       counter("ok"),
+		failed:   counter("failed"),
+		timedOut: counter("timeout"),
+	}
+	for _, match := range commandPlaceholder.FindAllStringSubmatch(cmd.Send, -1) {
+		h.body = h.body || match[1] == "body"
+	}
+
+	return h
+}
+
+// ServeHTTP implements the http.Handler interface. Requests that cannot be rendered are
+// refused with 400 (or 413 for big bodies); exchanges that fail get 502, or 504 when the
+// target does not reply in time.
+func (h *commandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, status, err := h.render(r)
+	if err != nil {
+		http.Error(w, "Error rendering command: "+err.Error(), status)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.cmd.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	reply, err := h.exchange(ctx, payload)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+			h.timedOut.Inc()
+		} else {
+			h.failed.Inc()
+		}
+		logger.Stderr.Warn().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("route", h.route).
+			Str("target", h.target).
+			Str("remote-addr", r.RemoteAddr).
+			Msg("route command failed")
+		http.Error(w, "Error exchanging with target: "+err.Error(), status)
+		return
+	}
+	h.ok.Inc()
+
+	logger.Stdout.Debug().
+		Str("route", h.route).
+		Str("target", h.target).
+		Int("sent", len(payload)).
+		Int("received", len(reply)).
+		Dur("duration", time.Since(start)).
+		Msg("route command exchanged")
+
+	w.Header().Set("Content-Type", h.cmd.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(reply)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(reply)
+}
+
+// render returns the bytes to send for r. Values taken from the request URL and headers
+// must hold no line break or NUL byte, which could smuggle commands to the target.
+func (h *commandHandler) render(r *http.Request) ([]byte, int, error) {
+	var body []byte
+	if h.body && r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, commandMaxBody+1))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if len(body) > commandMaxBody {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("body is over %d bytes", commandMaxBody)
+		}
+	}
+
+	var err error
+	payload := commandPlaceholder.ReplaceAllStringFunc(h.cmd.Send, func(placeholder string) string {
+		match := commandPlaceholder.FindStringSubmatch(placeholder)
+		var value string
+		switch {
+		case match[1] == "body":
+			return string(body)
+		case match[1] == "method":
+			value = r.Method
+		case match[1] == "path":
+			value = strings.TrimPrefix(r.URL.Path, h.prefix)
+		case match[2] != "":
+			value = r.URL.Query().Get(match[2])
+		default:
+			value = r.Header.Get(match[3])
+		}
+		if strings.ContainsAny(value, "\r\n\x00") && err == nil {
+			err = fmt.Errorf("%s holds a line break or NUL byte", strings.Trim(placeholder, "{} "))
+		}
+		return value
+	})
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	return []byte(payload), http.StatusOK, nil
+}
+
+// exchange sends payload to the target and returns its reply: up to and including the
+// delimiter of the command, without it if stripped, or all it sent before closing the
+// connection.
+func (h *commandHandler) exchange(ctx context.Context, payload []byte) ([]byte, error) {
+	conn, err := h.dial(ctx, "tcp", h.target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// Unblock reads and writes when the exchange times out or the client goes away
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := conn.Write(payload); err != nil {
+		return nil, err
+	}
+
+	until := []byte(h.cmd.Until)
+	var reply bytes.Buffer
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := conn.Read(buf)
+		reply.Write(buf[:n])
+		if len(until) > 0 {
+			// Only the end of the reply, where the delimiter may have been completed, is searched
+			from := max(reply.Len()-n-len(until)+1, 0)
+			if i := bytes.Index(reply.Bytes()[from:], until); i >= 0 {
+				end := from + i + len(until)
+				if h.cmd.Strip {
+					end -= len(until)
+				}
+				return reply.Bytes()[:end], nil
+			}
+		}
+		if reply.Len() > h.cmd.MaxReply {
+			return nil, fmt.Errorf("reply is over %d bytes", h.cmd.MaxReply)
+		}
+		if errors.Is(err, io.EOF) && len(until) == 0 {
+			return reply.Bytes(), nil
+		}
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("connection closed before %q", h.cmd.Until)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Errors returned when a request cannot get a slot toward its target.
+var (
+	ErrTargetQueueFull    = errors.New("too many requests queued for the target")
+	ErrTargetQueueTimeout = errors.New("timed out queueing for the target")
+)
+
+// Adaptive concurrency: the limit is adjusted every adaptiveWindow samples, and the
+// baseline latency forgotten every adaptiveBaselineTTL so it follows lasting changes.
+const (
+	adaptiveInitialLimit = 10
+	adaptiveWindow       = 20
+	adaptiveBaselineTTL  = 5 * time.Minute
+	adaptiveDecrease     = 0.75 // multiplier applied to the limit on congestion
+)
+
+// concurrencySettings caps the requests and connections in flight toward each target.
+type concurrencySettings struct {
+	limit        int           // requests in flight per target, the upper bound when adaptive
+	queueSize    int           // requests waiting for a slot per target; 0 rejects right away
+	queueTimeout time.Duration // how long a request waits for a slot
+
+	adaptive         bool    // adjust the limit to the target's latency
+	latencyTolerance float64 // latency, relative to the baseline, above which the limit decreases
+}
+
+// concurrencyLimiter lets up to limit requests through to a target at once. The others
+// wait for a slot in a bounded FIFO queue, so bursts are smoothed out instead of
+// reaching the target all at once.
+//
+// An adaptive limiter probes for the target's capacity (AIMD): after a window of
+// requests that kept the limit busy, the limit grows by one as long as their latency
+// stays within the tolerance of the baseline (the lowest latency seen recently). Once
+// latency grows past it, or requests fail, the target is taken to be congested and the
+// limit shrinks by a quarter.
+type concurrencyLimiter struct {
+	queueSize    int
+	queueTimeout time.Duration
+	maxLimit     int
+	adaptive     bool
+	tolerance    float64
+
+	mu       sync.Mutex
+	limit    int
+	inFlight int
+	waiters  list.List // of chan struct{}, closed when the waiter gets a slot
+
+	// Adaptive state
+	saturated  bool // the limit was reached during the window
+	samples    int
+	sum        time.Duration
+	failures   int
+	baseline   time.Duration
+	baselineAt time.Time
+
+	inFlightGauge, depthGauge, limitGauge *metrics.Gauge
+	fullRejections, timeoutRejections     *metrics.Counter
+}
+
+func newConcurrencyLimiter(settings concurrencySettings, target string) *concurrencyLimiter {
+	limit := settings.limit
+	if settings.adaptive {
+		limit = min(limit, adaptiveInitialLimit)
+	}
+
+	l := &concurrencyLimiter{
+		queueSize:    settings.queueSize,
+		queueTimeout: settings.queueTimeout,
+		maxLimit:     settings.limit,
+		adaptive:     settings.adaptive,
+		tolerance:    settings.latencyTolerance,
+		limit:        limit,
+
+		inFlightGauge: metrics.Default.Gauge("railtail_target_in_flight",
+			"Requests and connections in flight toward the target.", "target", target),
+		depthGauge: metrics.Default.Gauge("railtail_target_queue_depth",
+			"Requests and connections waiting for a slot toward the target.", "target", target),
+		fullRejections: metrics.Default.Counter("railtail_target_queue_rejected_total",
+			"Requests and connections refused while waiting for a slot toward the target, by reason.",
+			"target", target, "reason", "queue-full"),
+		timeoutRejections: metrics.Default.Counter("railtail_target_queue_rejected_total",
+			"Requests and connections refused while waiting for a slot toward the target, by reason.",
+			"target", target, "reason", "timeout"),
+		limitGauge: metrics.Default.Gauge("railtail_target_concurrency_limit",
+			"Requests and connections allowed in flight toward the target.", "target", target),
+	}
+	l.limitGauge.Set(int64(limit))
+
+	return l
+}
+
+// acquire takes a slot, waiting in the queue if the target is at its limit. If it
+// returns nil, the caller must call release once done with the target.
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.inFlight < l.limit && l.waiters.Len() == 0 {
+		l.inFlight++
+		l.saturated = l.saturated || l.inFlight == l.limit
+		l.updateGaugesLocked()
+		l.mu.Unlock()
+		return nil
+	}
+	l.saturated = true
+	if l.waiters.Len() >= l.queueSize {
+		l.mu.Unlock()
+		l.fullRejections.Inc()
+		return ErrTargetQueueFull
+	}
+	ready := make(chan struct{})
+	elem := l.waiters.PushBack(ready)
+	l.updateGaugesLocked()
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = ErrTargetQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-ready:
+		// Got the slot while giving up
+		return nil
+	default:
+	}
+	l.waiters.Remove(elem)
+	l.updateGaugesLocked()
+	if errors.Is(err, ErrTargetQueueTimeout) {
+		l.timeoutRejections.Inc()
+	}
+
+	return err
+}
+
+// release gives back a slot taken by acquire, to the next waiter if any.
+func (l *concurrencyLimiter) release() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	l.grantLocked()
+}
+
+// sample records the latency of a request to the target, and whether it failed, adjusting
+// the limit of an adaptive limiter at the end of each window.
+func (l *concurrencyLimiter) sample(latency time.Duration, failed bool) {
+	if l == nil || !l.adaptive {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.samples++
+	l.sum += latency
+	if failed {
+		l.failures++
+	}
+	if l.samples < adaptiveWindow {
+		return
+	}
+
+	average := l.sum / time.Duration(l.samples)
+	if l.baseline == 0 || average < l.baseline || time.Since(l.baselineAt) > adaptiveBaselineTTL {
+		l.baseline, l.baselineAt = average, time.Now()
+	}
+
+	switch {
+	case l.failures > 0 || float64(average) > l.tolerance*float64(l.baseline):
+		l.limit = max(1, int(float64(l.limit)*adaptiveDecrease))
+	case l.saturated:
+		l.limit = min(l.maxLimit, l.limit+1)
+	}
+	l.limitGauge.Set(int64(l.limit))
+
+	l.samples, l.sum, l.failures, l.saturated = 0, 0, 0, false
+	l.grantLocked()
+}
+
+// grantLocked hands free slots to the waiters, oldest first.
+func (l *concurrencyLimiter) grantLocked() {
+	for l.inFlight < l.limit && l.waiters.Len() > 0 {
+		close(l.waiters.Remove(l.waiters.Front()).(chan struct{}))
+		l.inFlight++
+		l.saturated = l.saturated || l.inFlight == l.limit
+	}
+	l.updateGaugesLocked()
+}
+
+func (l *concurrencyLimiter) updateGaugesLocked() {
+	l.inFlightGauge.Set(int64(l.inFlight))
+	l.depthGauge.Set(int64(l.waiters.Len()))
+}
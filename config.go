@@ -5,11 +5,16 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
+	"net/netip"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/rmonvfer/railtail/internal/middleware"
 )
 
 // ForwardTrafficType defines the supported traffic forwarding modes.
@@ -29,28 +34,494 @@ var (
 	ErrListenPortInvalid = errors.New("listen-port is invalid")
 	ErrMissingAuthKey    = errors.New("TS_AUTHKEY environment variable is required")
 	ErrMissingTargetAddr = errors.New("TARGET_ADDR is required when not in proxy mode (or use -proxy-mode)")
+
+	ErrTransportOverrideInvalid = errors.New("HTTP_TRANSPORT_OVERRIDES is invalid")
+	ErrUpstreamProxyInvalid     = errors.New("upstream proxy is invalid")
+	ErrOutlierSettingsInvalid   = errors.New("outlier detection settings are invalid")
 )
 
 // Config holds the application configuration.
 type Config struct {
 	// Tailscale configuration
-	TSHostname     string `env:"TS_HOSTNAME" env-default:"railtail"`           // Hostname for the Tailscale node
-	TSLoginServer  string `env:"TS_LOGIN_SERVER"`                              // Custom login server (e.g., Headscale)
-	TSStateDirPath string `env:"TS_STATEDIR_PATH" env-default:"/tmp/railtail"` // Directory to store Tailscale state
-	TSAuthKey      string `env:"TS_AUTHKEY"`                                   // Tailscale auth key
+	TSHostname     string `yaml:"ts_hostname" env:"TS_HOSTNAME" env-default:"railtail"`                // Hostname for the Tailscale node
+	TSLoginServer  string `yaml:"ts_login_server" env:"TS_LOGIN_SERVER"`                               // Custom login server (e.g., Headscale)
+	TSStateDirPath string `yaml:"ts_statedir_path" env:"TS_STATEDIR_PATH" env-default:"/tmp/railtail"` // Directory to store Tailscale state
+	TSAuthKey      string `yaml:"ts_authkey" env:"TS_AUTHKEY"`                                         // Tailscale auth key
+
+	DERPRegion             string        `yaml:"derp_region" env:"DERP_REGION"`                                             // Home DERP region (ID or code) to pin instead of the closest one
+	LogConnectionPaths     bool          `yaml:"log_connection_paths" env:"LOG_CONNECTION_PATHS" env-default:"false"`       // Log whether connections to targets go direct or through a DERP relay
+	TailnetMetricsInterval time.Duration `yaml:"tailnet_metrics_interval" env:"TAILNET_METRICS_INTERVAL" env-default:"15s"` // How often Tailscale engine statistics are collected into metrics (0 = disabled)
+	DialBackend            string        `yaml:"dial_backend" env:"DIAL_BACKEND"`                                           // What targets are dialed through: tailnet (default), direct, loopback or a socks5:// proxy URL
+	NoTailscale            bool          `yaml:"no_tailscale" env:"NO_TAILSCALE" env-default:"false"`                       // Run without joining a tailnet, dialing targets with DIAL_BACKEND
 
 	// Network configuration
-	ListenPort         string `env:"LISTEN_PORT" env-default:"8080"`          // Port to listen on
-	TargetAddr         string `env:"TARGET_ADDR"`                             // Target address to forward traffic to
-	ProxyMode          bool   `env:"PROXY_MODE" env-default:"false"`          // Enable Tailnet proxy mode
-	InsecureSkipVerify bool   `env:"INSECURE_SKIP_VERIFY" env-default:"true"` // Skip TLS verification for HTTPS
+	ListenPort                  string        `yaml:"listen_port" env:"LISTEN_PORT" env-default:"8080"`                                      // Port to listen on
+	AcceptWorkers               int           `yaml:"accept_workers" env:"ACCEPT_WORKERS" env-default:"1"`                                   // Accept loops, each on its own SO_REUSEPORT socket (Linux)
+	ListenBacklog               int           `yaml:"listen_backlog" env:"LISTEN_BACKLOG" env-default:"0"`                                   // Kernel accept queue length (0 = system default, Linux)
+	TailnetListenPort           string        `yaml:"tailnet_listen_port" env:"TAILNET_LISTEN_PORT"`                                         // Also serve the listener on this port of the tailnet node; disabled if empty
+	TargetAddr                  string        `yaml:"target_addr" env:"TARGET_ADDR"`                                                         // Target address(es) to forward traffic to, comma-separated
+	ProxyMode                   bool          `yaml:"proxy_mode" env:"PROXY_MODE" env-default:"false"`                                       // Enable Tailnet proxy mode
+	TailnetProxyHosts           string        `yaml:"tailnet_proxy_hosts" env:"TAILNET_PROXY_HOSTS"`                                         // Send requests for a host to another host:port in Tailnet Proxy mode
+	TailnetProxySearchDomain    string        `yaml:"tailnet_proxy_search_domain" env:"TAILNET_PROXY_SEARCH_DOMAIN"`                         // MagicDNS suffix appended to short names in Tailnet Proxy mode
+	TailnetProxyDNSCacheTTL     time.Duration `yaml:"tailnet_proxy_dns_cache_ttl" env:"TAILNET_PROXY_DNS_CACHE_TTL" env-default:"30s"`       // How long MagicDNS names under the search domain are cached
+	TailnetProxyLogSample       int           `yaml:"tailnet_proxy_log_sample" env:"TAILNET_PROXY_LOG_SAMPLE" env-default:"1"`               // Log one in N requests per destination in Tailnet Proxy mode
+	TailnetProxyQuiet           bool          `yaml:"tailnet_proxy_quiet" env:"TAILNET_PROXY_QUIET" env-default:"false"`                     // Only log failed requests in Tailnet Proxy mode
+	TailnetProxyMaxDestinations int           `yaml:"tailnet_proxy_max_destinations" env:"TAILNET_PROXY_MAX_DESTINATIONS" env-default:"100"` // Destinations counted individually, the rest are counted as "other"
+	TailnetProxyAllowedHosts    []string      `yaml:"tailnet_proxy_allowed_hosts" env:"TAILNET_PROXY_ALLOWED_HOSTS" env-separator:","`       // Destinations the Tailnet Proxy may forward to (host patterns, see hostPattern)
+	TailnetProxyAuthToken       string        `yaml:"tailnet_proxy_auth_token" env:"TAILNET_PROXY_AUTH_TOKEN"`                               // Token clients must send as Proxy-Authorization
+	AllowOpenProxy              bool          `yaml:"allow_open_proxy" env:"ALLOW_OPEN_PROXY" env-default:"false"`                           // Run the Tailnet Proxy without allowlist or auth token
+	InsecureSkipVerify          bool          `yaml:"insecure_skip_verify" env:"INSECURE_SKIP_VERIFY" env-default:"true"`                    // Skip TLS verification for HTTPS
+	TCPProxyProtocol            string        `yaml:"tcp_proxy_protocol" env:"TCP_PROXY_PROTOCOL"`                                           // Send a PROXY protocol header (v1 or v2) to TCP targets
+	TCPAcceptProxyProtocol      bool          `yaml:"tcp_accept_proxy_protocol" env:"TCP_ACCEPT_PROXY_PROTOCOL" env-default:"false"`         // Read a PROXY protocol header from TCP clients, such as an earlier railtail hop
+	TCPAcceptProxyFrom          []string      `yaml:"tcp_accept_proxy_from" env:"TCP_ACCEPT_PROXY_FROM" env-separator:","`                   // Peers trusted to send PROXY protocol headers (IPs or CIDRs)
+	TCPProtocol                 string        `yaml:"tcp_protocol" env:"TCP_PROTOCOL"`                                                       // Application protocol of the TCP target (postgres, mysql, redis, smtp, syslog, mqtt or ftp)
+	MQTTAllowedTopics           []string      `yaml:"mqtt_allowed_topics" env:"MQTT_ALLOWED_TOPICS" env-separator:","`                       // Topic filters MQTT 5 clients may use, passed on to the broker
+	TCPProfile                  string        `yaml:"tcp_profile" env:"TCP_PROFILE"`                                                         // Tuning profile of TCP connections (broker, desktop, bulk)
+	FTPPassivePorts             string        `yaml:"ftp_passive_ports" env:"FTP_PASSIVE_PORTS"`                                             // Local ports the data connections of FTP transfers are accepted on, like 30000-30009
+	FTPPassiveAddress           string        `yaml:"ftp_passive_address" env:"FTP_PASSIVE_ADDRESS"`                                         // IPv4 address announced to FTP clients in PASV replies
+	TCPIdleTimeout              time.Duration `yaml:"tcp_idle_timeout" env:"TCP_IDLE_TIMEOUT" env-default:"5m"`                              // Close TCP connections without traffic for this long (0 = never)
+	TCPKeepalive                time.Duration `yaml:"tcp_keepalive" env:"TCP_KEEPALIVE" env-default:"0"`                                     // Keep idle TCP connections alive on the way with keepalives and tailnet pings (0 = disabled)
+	TCPDeadClientTimeout        time.Duration `yaml:"tcp_dead_client_timeout" env:"TCP_DEAD_CLIENT_TIMEOUT" env-default:"30s"`               // Close TCP connections of clients that stopped answering for this long (0 = system defaults)
+	TCPMaxInflightKB            int           `yaml:"tcp_max_inflight_kb" env:"TCP_MAX_INFLIGHT_KB" env-default:"0"`                         // Bytes of TCP connections read ahead of the other side taking them, per direction, in KiB (0 = copy as read)
+	TCPMaxConnsPerIP            int           `yaml:"tcp_max_conns_per_ip" env:"TCP_MAX_CONNS_PER_IP" env-default:"0"`                       // TCP connections each client address may have open at once (0 = unlimited)
+	TCPConnRatePerIP            float64       `yaml:"tcp_conn_rate_per_ip" env:"TCP_CONN_RATE_PER_IP" env-default:"0"`                       // New TCP connections per second each client address may open (0 = unlimited)
+	TCPConnBurstPerIP           int           `yaml:"tcp_conn_burst_per_ip" env:"TCP_CONN_BURST_PER_IP" env-default:"0"`                     // New TCP connections let through at once above the rate (0 = the rate)
+	TargetIPFamily              string        `yaml:"target_ip_family" env:"TARGET_IP_FAMILY" env-default:"auto"`                            // Address family of targets given by name: auto, ipv4, ipv6, prefer-ipv4 or prefer-ipv6
+	HostsFile                   string        `yaml:"hosts_file" env:"HOSTS_FILE"`                                                           // Hosts file (/etc/hosts format) resolving target names before MagicDNS and DNS
+	TargetEnvFile               string        `yaml:"target_env_file" env:"TARGET_ENV_FILE"`                                                 // Env file whose variables take precedence in target templates, re-read on SIGHUP
+	TargetHeader                string        `yaml:"target_header" env:"TARGET_HEADER"`                                                     // Trusted request header selecting the HTTP target among TargetHeaderAllowed
+	TargetHeaderAllowed         string        `yaml:"target_header_allowed" env:"TARGET_HEADER_ALLOWED"`                                     // Targets TargetHeader may select, comma-separated
+
+	// Syslog forwarding (TCP_PROTOCOL=syslog)
+	SyslogBatchSize  int    `yaml:"syslog_batch_size" env:"SYSLOG_BATCH_SIZE" env-default:"100"`     // Messages written to the target at once
+	SyslogQueueSize  int    `yaml:"syslog_queue_size" env:"SYSLOG_QUEUE_SIZE" env-default:"10000"`   // Messages held in memory while the target is unreachable
+	SyslogSpoolDir   string `yaml:"syslog_spool_dir" env:"SYSLOG_SPOOL_DIR"`                         // Write messages overflowing the queue here; dropped if empty
+	SyslogSpoolMaxMB int    `yaml:"syslog_spool_max_mb" env:"SYSLOG_SPOOL_MAX_MB" env-default:"100"` // Size bound of each spool file, in MiB
+
+	// Outbound HTTP transport configuration
+	HTTPMaxIdleConns        int           `yaml:"http_max_idle_conns" env:"HTTP_MAX_IDLE_CONNS" env-default:"100"`                 // Idle connections kept across all targets
+	HTTPMaxIdleConnsPerHost int           `yaml:"http_max_idle_conns_per_host" env:"HTTP_MAX_IDLE_CONNS_PER_HOST" env-default:"2"` // Idle connections kept per target
+	HTTPMaxConnsPerHost     int           `yaml:"http_max_conns_per_host" env:"HTTP_MAX_CONNS_PER_HOST" env-default:"0"`           // Connection cap per target (0 = unlimited)
+	HTTPIdleConnTimeout     time.Duration `yaml:"http_idle_conn_timeout" env:"HTTP_IDLE_CONN_TIMEOUT" env-default:"90s"`           // How long idle connections are kept
+	HTTPDisableKeepAlives   bool          `yaml:"http_disable_keepalives" env:"HTTP_DISABLE_KEEPALIVES" env-default:"false"`       // Disable connection reuse
+	HTTPTransportOverrides  string        `yaml:"http_transport_overrides" env:"HTTP_TRANSPORT_OVERRIDES"`                         // Per-target overrides of the above
+	HTTPLogUpstreamConns    bool          `yaml:"http_log_upstream_conns" env:"HTTP_LOG_UPSTREAM_CONNS" env-default:"false"`       // Log connection reuse of every upstream request
+	UpstreamProxy           string        `yaml:"upstream_proxy" env:"UPSTREAM_PROXY"`                                             // HTTP or SOCKS5 proxy on the tailnet to reach HTTP targets through
+
+	// End-to-end self-test once the tailnet is up
+	SelfTest              bool          `yaml:"self_test" env:"SELF_TEST" env-default:"false"`                                 // Check every target before serving
+	SelfTestPath          string        `yaml:"self_test_path" env:"SELF_TEST_PATH" env-default:"/"`                           // Path requested from HTTP targets
+	SelfTestStatus        int           `yaml:"self_test_status" env:"SELF_TEST_STATUS" env-default:"0"`                       // Expected HTTP status (0 = anything below 500)
+	SelfTestBannerTimeout time.Duration `yaml:"self_test_banner_timeout" env:"SELF_TEST_BANNER_TIMEOUT" env-default:"0"`       // How long to wait for a TCP banner (0 = do not read one)
+	SelfTestTimeout       time.Duration `yaml:"self_test_timeout" env:"SELF_TEST_TIMEOUT" env-default:"10s"`                   // Timeout of each check
+	SelfTestExitOnFailure bool          `yaml:"self_test_exit_on_failure" env:"SELF_TEST_EXIT_ON_FAILURE" env-default:"false"` // Exit instead of serving when a check fails
+
+	// Connection pre-warming once the tailnet is up
+	PrewarmConnections int    `yaml:"prewarm_connections" env:"PREWARM_CONNECTIONS" env-default:"0"` // Connections opened to every target before serving (0 = disabled)
+	PrewarmPath        string `yaml:"prewarm_path" env:"PREWARM_PATH" env-default:"/"`               // Path of the HEAD requests pre-warming HTTP targets
+
+	// Local TLS termination (HTTP and Tailnet Proxy modes)
+	TLSCertFile           string        `yaml:"tls_cert_file" env:"TLS_CERT_FILE"`                                         // Certificate to terminate TLS with on the listener
+	TLSKeyFile            string        `yaml:"tls_key_file" env:"TLS_KEY_FILE"`                                           // Key of TLSCertFile
+	HTTPRedirectPort      string        `yaml:"http_redirect_port" env:"HTTP_REDIRECT_PORT"`                               // Plain HTTP port redirecting to HTTPS; disabled if empty
+	HSTSMaxAge            time.Duration `yaml:"hsts_max_age" env:"HSTS_MAX_AGE" env-default:"0"`                           // Strict-Transport-Security max-age; disabled if 0
+	HSTSIncludeSubdomains bool          `yaml:"hsts_include_subdomains" env:"HSTS_INCLUDE_SUBDOMAINS" env-default:"false"` // Add includeSubDomains to HSTS
+	HSTSPreload           bool          `yaml:"hsts_preload" env:"HSTS_PRELOAD" env-default:"false"`                       // Add preload to HSTS
+	TLSClientCAFile       string        `yaml:"tls_client_ca_file" env:"TLS_CLIENT_CA_FILE"`                               // CAs (PEM) client certificates are verified against; no client certificates if empty
+	TLSClientAuth         string        `yaml:"tls_client_auth" env:"TLS_CLIENT_AUTH" env-default:"require"`               // require or optional client certificates
+
+	// ACME certificates for the listener, instead of TLSCertFile
+	ACMEDomains      []string `yaml:"acme_domains" env:"ACME_DOMAINS" env-separator:","`                                                        // Public hostnames to obtain certificates for; disabled if empty
+	ACMEEmail        string   `yaml:"acme_email" env:"ACME_EMAIL"`                                                                              // Contact email of the ACME account
+	ACMEDirectoryURL string   `yaml:"acme_directory_url" env:"ACME_DIRECTORY_URL" env-default:"https://acme-v02.api.letsencrypt.org/directory"` // ACME directory, Let's Encrypt by default
+	ACMEChallenge    string   `yaml:"acme_challenge" env:"ACME_CHALLENGE" env-default:"http-01"`                                                // http-01 (with TLS-ALPN-01) or dns-01
+	ACMEDNSHook      string   `yaml:"acme_dns_hook" env:"ACME_DNS_HOOK"`                                                                        // Command managing the dns-01 TXT records
+
+	// SPIFFE workload identity from the Workload API of a SPIRE agent
+	SPIFFEEndpointSocket string   `yaml:"spiffe_endpoint_socket" env:"SPIFFE_ENDPOINT_SOCKET"`             // Workload API address, unix:///path or tcp://ip:port; disabled if empty
+	TLSClientSPIFFE      bool     `yaml:"tls_client_spiffe" env:"TLS_CLIENT_SPIFFE" env-default:"false"`   // Verify client certificates of the TLS listener as SVIDs
+	SPIFFEUpstream       bool     `yaml:"spiffe_upstream" env:"SPIFFE_UPSTREAM" env-default:"false"`       // Present the SVID to HTTPS targets and verify theirs
+	SPIFFEUpstreamIDs    []string `yaml:"spiffe_upstream_ids" env:"SPIFFE_UPSTREAM_IDS" env-separator:","` // SPIFFE IDs HTTPS targets may present, exact or with a trailing *; any if empty
+
+	// Memory budget for connection buffers
+	BufferBudgetMB   int           `yaml:"buffer_budget_mb" env:"BUFFER_BUDGET_MB" env-default:"0"`     // Buffer memory for connections in flight, in MiB (0 = unlimited)
+	BufferBudgetWait time.Duration `yaml:"buffer_budget_wait" env:"BUFFER_BUDGET_WAIT" env-default:"0"` // How long connections queue for buffer memory before being refused
+
+	// Maximum connection lifetime
+	MaxConnLifetime      time.Duration `yaml:"max_conn_lifetime" env:"MAX_CONN_LIFETIME" env-default:"0"`               // Close client connections older than this (0 = unlimited)
+	MaxConnLifetimeGrace time.Duration `yaml:"max_conn_lifetime_grace" env:"MAX_CONN_LIFETIME_GRACE" env-default:"30s"` // How long HTTP connections get to finish their requests past the lifetime
+
+	// Draining of removed targets and tunnels (see drain.go)
+	DrainTimeout time.Duration `yaml:"drain_timeout" env:"DRAIN_TIMEOUT" env-default:"0"` // Close connections to removed targets still open after this long (0 = never)
+
+	// Idle connection reaper (see reaper.go)
+	ReapIdleTCP  time.Duration `yaml:"reap_idle_tcp" env:"REAP_IDLE_TCP" env-default:"0"`   // Close TCP connections without traffic for this long (0 = never)
+	ReapIdleHTTP time.Duration `yaml:"reap_idle_http" env:"REAP_IDLE_HTTP" env-default:"0"` // Abort HTTP requests without traffic for this long (0 = never)
+
+	// Runtime state kept across restarts (see state.go)
+	StateDB bool `yaml:"state_db" env:"STATE_DB" env-default:"false"` // Keep runtime state in a SQLite database in the state directory
+
+	// Store-and-forward of POST requests (HTTP mode, see webhook.go)
+	WebhookSpoolDir       string        `yaml:"webhook_spool_dir" env:"WEBHOOK_SPOOL_DIR"`                                  // Spool POST requests here while the target is unreachable; disabled if empty
+	WebhookSpoolMaxMB     int           `yaml:"webhook_spool_max_mb" env:"WEBHOOK_SPOOL_MAX_MB" env-default:"100"`          // Size bound of the spool, in MiB
+	WebhookSpoolMaxBodyMB int           `yaml:"webhook_spool_max_body_mb" env:"WEBHOOK_SPOOL_MAX_BODY_MB" env-default:"10"` // Bigger requests are forwarded but never spooled, in MiB
+	WebhookDedupTTL       time.Duration `yaml:"webhook_dedup_ttl" env:"WEBHOOK_DEDUP_TTL" env-default:"0"`                  // How long requests to the main target are remembered to suppress their retries; disabled if 0
+	WebhookDedupHeader    string        `yaml:"webhook_dedup_header" env:"WEBHOOK_DEDUP_HEADER"`                            // Idempotency key header; requests are keyed by their hash if empty
+
+	// Access window of the main listener (see accesswindow.go)
+	AllowedHours string `yaml:"allowed_hours" env:"ALLOWED_HOURS"` // When connections are accepted, like "Mon-Fri 08:00-18:00 Europe/Madrid"; always if empty
+
+	// Tunnel tokens (see tokens.go)
+	RequireToken bool          `yaml:"require_token" env:"REQUIRE_TOKEN" env-default:"false"` // Only accept clients of the main listener with a token minted through the admin API
+	TokenMaxTTL  time.Duration `yaml:"token_max_ttl" env:"TOKEN_MAX_TTL" env-default:"24h"`   // Longest lifetime of minted tokens
+
+	// Tenants sharing this railtail (see tenants.go)
+	Tenants        []TenantConfig `yaml:"tenants"`                                                   // Tenants, only configurable through the config file
+	TenantRequired bool           `yaml:"tenant_required" env:"TENANT_REQUIRED" env-default:"false"` // Refuse HTTP requests no tenant matches
+
+	// Session recording (TCP mode, see recording.go)
+	Record             bool          `yaml:"record" env:"RECORD" env-default:"false"`                          // Record the sessions of the main listener in TCP mode
+	RecordingDir       string        `yaml:"recording_dir" env:"RECORDING_DIR"`                                // Write recordings here; recording is unavailable if empty
+	RecordingKey       string        `yaml:"recording_key" env:"RECORDING_KEY"`                                // 32-byte key recordings are encrypted with, hex or base64 encoded
+	RecordingMaxMB     int           `yaml:"recording_max_mb" env:"RECORDING_MAX_MB" env-default:"100"`        // Size bound of each recording, in MiB
+	RecordingRetention time.Duration `yaml:"recording_retention" env:"RECORDING_RETENTION" env-default:"168h"` // Remove recordings older than this (0 = keep them)
+
+	// Dual target verification (HTTP mode, see verify.go)
+	VerifyTarget        string        `yaml:"verify_target" env:"VERIFY_TARGET"`                                    // Also send requests to this URL and compare its responses; disabled if empty
+	VerifyMethods       string        `yaml:"verify_methods" env:"VERIFY_METHODS" env-default:"GET,HEAD,OPTIONS"`   // Methods of the requests verified, comma-separated (* = all)
+	VerifyIgnoreHeaders string        `yaml:"verify_ignore_headers" env:"VERIFY_IGNORE_HEADERS" env-default:"Date"` // Response headers not compared, comma-separated
+	VerifySample        float64       `yaml:"verify_sample" env:"VERIFY_SAMPLE" env-default:"1"`                    // Fraction (0-1) of the requests verified
+	VerifyMaxBodyMB     int           `yaml:"verify_max_body_mb" env:"VERIFY_MAX_BODY_MB" env-default:"10"`         // Requests with bigger bodies are not verified, in MiB
+	VerifyTimeout       time.Duration `yaml:"verify_timeout" env:"VERIFY_TIMEOUT" env-default:"30s"`                // Timeout of the requests to the verified target
+
+	// Warnings about slow requests and large transfers
+	SlowRequestThreshold time.Duration `yaml:"slow_request_threshold" env:"SLOW_REQUEST_THRESHOLD" env-default:"0"` // Warn about HTTP requests taking longer than this (0 = disabled)
+	LargeTransferMB      int           `yaml:"large_transfer_mb" env:"LARGE_TRANSFER_MB" env-default:"0"`           // Warn about connections and requests moving more than this, in MiB (0 = disabled)
+	SizeMetrics          bool          `yaml:"size_metrics" env:"SIZE_METRICS" env-default:"false"`                 // Record histograms of HTTP request and response sizes by route and target
+
+	// Error budgets of the listeners
+	SLOObjective float64       `yaml:"slo_objective" env:"SLO_OBJECTIVE" env-default:"0"`    // Share (0-1) of connections and requests of each listener that must end without a deadline or failure (0 = disabled)
+	SLOWindow    time.Duration `yaml:"slo_window" env:"SLO_WINDOW" env-default:"720h"`       // Rolling window of the error budget
+	SLOBurnRate  float64       `yaml:"slo_burn_rate" env:"SLO_BURN_RATE" env-default:"14.4"` // Burn rate over the last hour (and 5 minutes) that fires an alert
+
+	// Resource leak watchdog
+	WatchdogInterval time.Duration `yaml:"watchdog_interval" env:"WATCHDOG_INTERVAL" env-default:"1m"`      // How often resources are checked against open connections (0 = disabled)
+	WatchdogHeapDump bool          `yaml:"watchdog_heap_dump" env:"WATCHDOG_HEAP_DUMP" env-default:"false"` // Write a heap profile to the state dir when a leak is suspected
+
+	// Profile dumps (on SIGQUIT or memory threshold)
+	ProfileRSSThresholdMB int    `yaml:"profile_rss_threshold_mb" env:"PROFILE_RSS_THRESHOLD_MB" env-default:"0"` // Dump profiles when resident memory exceeds this, in MiB (0 = disabled)
+	ProfileUploadURL      string `yaml:"profile_upload_url" env:"PROFILE_UPLOAD_URL"`                             // Also POST dumped profiles to this URL
+
+	// Debug packet capture
+	Capture        string `yaml:"capture" env:"CAPTURE"`                                 // Capture traffic to a file: pcap:<path>; disabled if empty
+	CaptureScope   string `yaml:"capture_scope" env:"CAPTURE_SCOPE" env-default:"both"`  // What is captured: listener, tailnet or both
+	CaptureSnaplen int    `yaml:"capture_snaplen" env:"CAPTURE_SNAPLEN" env-default:"0"` // Bytes kept of each packet (0 = whole packets)
+	CaptureSample  int    `yaml:"capture_sample" env:"CAPTURE_SAMPLE" env-default:"1"`   // Capture one in N connections (listener) or packets (tailnet)
+	CaptureMaxMB   int    `yaml:"capture_max_mb" env:"CAPTURE_MAX_MB" env-default:"100"` // Stop capturing once a file reaches this size, in MiB
+
+	// Taildrop file receiving
+	TaildropDir        string `yaml:"taildrop_dir" env:"TAILDROP_DIR"`                 // Store files sent to the node with Taildrop here; disabled if empty
+	TaildropForwardURL string `yaml:"taildrop_forward_url" env:"TAILDROP_FORWARD_URL"` // POST files sent to the node with Taildrop to this URL instead
+
+	// Event hooks (see hooks.go)
+	HookURL     string        `yaml:"hook_url" env:"HOOK_URL"`                                                                                  // POST events as JSON to this URL; disabled if empty
+	HookCommand string        `yaml:"hook_command" env:"HOOK_COMMAND"`                                                                          // Run this executable for every event; disabled if empty
+	HookEvents  []string      `yaml:"hook_events" env:"HOOK_EVENTS" env-separator:"," env-default:"target-unhealthy,target-healthy,tsnet-auth"` // Events delivered to the hooks
+	HookTimeout time.Duration `yaml:"hook_timeout" env:"HOOK_TIMEOUT" env-default:"10s"`                                                        // Time limit for delivering an event
+
+	// Usage export (see usage.go)
+	UsageExportFile     string        `yaml:"usage_export_file" env:"USAGE_EXPORT_FILE"`                          // Append the traffic of each tenant and listener to this file every interval; disabled if empty
+	UsageExportFormat   string        `yaml:"usage_export_format" env:"USAGE_EXPORT_FORMAT" env-default:"csv"`    // Format of the usage file: csv, or json (one report per line)
+	UsageExportURL      string        `yaml:"usage_export_url" env:"USAGE_EXPORT_URL"`                            // POST the traffic of each tenant and listener as JSON to this URL every interval; disabled if empty
+	UsageExportInterval time.Duration `yaml:"usage_export_interval" env:"USAGE_EXPORT_INTERVAL" env-default:"1h"` // How often usage is exported
+
+	// Railway conventions (see railway.go)
+	RailwayCompat bool `yaml:"railway_compat" env:"RAILWAY_COMPAT" env-default:"false"` // Default hostname and state dir from Railway's variables
+
+	// Admin configuration
+	AdminPort          string        `yaml:"admin_port" env:"ADMIN_PORT"`                                         // Port for the admin server (metrics, tunnels API); disabled if empty
+	AdminNetwork       string        `yaml:"admin_network" env:"ADMIN_NETWORK" env-default:"local"`               // Network the admin server listens on: local or tailnet
+	AdminToken         string        `yaml:"admin_token" env:"ADMIN_TOKEN"`                                       // Bearer token the admin APIs require on either network; required with ADMIN_NETWORK=local
+	AdminPublicMetrics bool          `yaml:"admin_public_metrics" env:"ADMIN_PUBLIC_METRICS" env-default:"false"` // Serve /metrics without ADMIN_TOKEN
+	AdminGRPCPort      string        `yaml:"admin_grpc_port" env:"ADMIN_GRPC_PORT"`                               // Port for the gRPC admin API, on ADMIN_NETWORK; disabled if empty
+	StatsHistory       time.Duration `yaml:"stats_history" env:"STATS_HISTORY" env-default:"15m"`                 // How much per-second traffic the admin API keeps in memory (0 = none)
+	DebugConsolePort   string        `yaml:"debug_console_port" env:"DEBUG_CONSOLE_PORT"`                         // Tailnet port of the read-only debug console; disabled if empty
+	DebugConsoleUsers  []string      `yaml:"debug_console_users" env:"DEBUG_CONSOLE_USERS" env-separator:","`     // Tailnet login names allowed in the debug console; empty allows anyone the ACLs let through
+
+	// Load balancing across multiple targets
+	StickySessions string `yaml:"sticky_sessions" env:"STICKY_SESSIONS"`                            // Keep clients on the same target: cookie, client-ip or header:<name>
+	StickyCookie   string `yaml:"sticky_cookie" env:"STICKY_COOKIE" env-default:"railtail_backend"` // Cookie name for cookie-based stickiness
+
+	LoadBalancing        string        `yaml:"load_balancing" env:"LOAD_BALANCING" env-default:"round-robin"`         // How targets are picked: round-robin or latency
+	LatencyProbeInterval time.Duration `yaml:"latency_probe_interval" env:"LATENCY_PROBE_INTERVAL" env-default:"30s"` // How often target latencies are probed when balancing by latency
+
+	// Concurrency caps toward each target
+	TargetMaxConcurrency int           `yaml:"target_max_concurrency" env:"TARGET_MAX_CONCURRENCY" env-default:"0"` // Requests (TCP: connections) in flight per target (0 = unlimited)
+	TargetQueueSize      int           `yaml:"target_queue_size" env:"TARGET_QUEUE_SIZE" env-default:"100"`         // Requests waiting for a slot per target; more are refused
+	TargetQueueTimeout   time.Duration `yaml:"target_queue_timeout" env:"TARGET_QUEUE_TIMEOUT" env-default:"10s"`   // How long requests wait for a slot
+
+	TargetAdaptiveConcurrency bool    `yaml:"target_adaptive_concurrency" env:"TARGET_ADAPTIVE_CONCURRENCY" env-default:"false"` // Adjust the limit to the target's latency, up to TargetMaxConcurrency
+	TargetLatencyTolerance    float64 `yaml:"target_latency_tolerance" env:"TARGET_LATENCY_TOLERANCE" env-default:"2"`           // Latency, relative to the baseline, taken as congestion
+
+	// Outlier detection across multiple targets
+	OutlierDetection         bool          `yaml:"outlier_detection" env:"OUTLIER_DETECTION" env-default:"false"`                  // Eject targets with outlying error rates or latency
+	OutlierInterval          time.Duration `yaml:"outlier_interval" env:"OUTLIER_INTERVAL" env-default:"10s"`                      // How often targets are evaluated
+	OutlierEjectionTime      time.Duration `yaml:"outlier_ejection_time" env:"OUTLIER_EJECTION_TIME" env-default:"30s"`            // Base ejection time, multiplied by consecutive ejections
+	OutlierErrorRate         float64       `yaml:"outlier_error_rate" env:"OUTLIER_ERROR_RATE" env-default:"0.5"`                  // Error rate (0-1) above which a target is ejected
+	OutlierLatencyFactor     float64       `yaml:"outlier_latency_factor" env:"OUTLIER_LATENCY_FACTOR" env-default:"3"`            // Eject targets whose p99 exceeds the others' median p99 by this factor
+	OutlierMinRequests       int           `yaml:"outlier_min_requests" env:"OUTLIER_MIN_REQUESTS" env-default:"20"`               // Requests per interval needed to evaluate a target
+	OutlierMaxEjectedPercent int           `yaml:"outlier_max_ejected_percent" env:"OUTLIER_MAX_EJECTED_PERCENT" env-default:"50"` // Upper bound of targets ejected at once
+
+	// Active health checks of TCP targets
+	HealthCheckInterval time.Duration `yaml:"health_check_interval" env:"HEALTH_CHECK_INTERVAL" env-default:"0"` // How often TCP targets are probed (0 = disabled)
+	HealthCheckTimeout  time.Duration `yaml:"health_check_timeout" env:"HEALTH_CHECK_TIMEOUT" env-default:"5s"`  // Time limit of a probe
+
+	// HTTP middleware and routes (HTTP and Tailnet Proxy modes)
+	HTTPMiddleware []string      `yaml:"http_middleware" env:"HTTP_MIDDLEWARE" env-separator:","` // Middleware chain for requests not matching a route
+	HostHeader     string        `yaml:"host_header" env:"HOST_HEADER"`                           // Host header of requests to the main target: target (default), preserve or a host
+	HTTPPlugins    []string      `yaml:"http_plugins" env:"HTTP_PLUGINS" env-separator:","`       // Filter plugins to load, usable as plugin:<name> middleware
+	Routes         []RouteConfig `yaml:"routes"`                                                  // Host/path routes, only configurable through the config file
+
+	UnmatchedRoute UnmatchedRouteConfig `yaml:"unmatched_route"` // What happens to requests matching no route, only configurable through the config file
+
+	// URL rules applied before routing (HTTP and Tailnet Proxy modes)
+	TrailingSlash string         `yaml:"trailing_slash" env:"TRAILING_SLASH"` // Redirect to add or remove trailing slashes
+	Redirects     []RedirectRule `yaml:"redirects"`                           // Redirect rules, only configurable through the config file
+	Rewrites      []RewriteRule  `yaml:"rewrites"`                            // Rewrite rules, only configurable through the config file
+
+	// JSON body transformations on the way to targets (HTTP and Tailnet Proxy modes)
+	Transforms []BodyTransform `yaml:"transforms"` // Only configurable through the config file
+
+	// Additional TCP tunnels, only configurable through the config file
+	Tunnels []TunnelConfig `yaml:"tunnels"`
+
+	// Names of targets -> comma-separated addresses, only configurable through the config file
+	Hosts map[string]string `yaml:"hosts"`
+
+	// Config file the configuration was loaded from, if any
+	ConfigFile string `yaml:"-" env:"CONFIG_FILE"`
+
+	// Refuse to start on configuration warnings
+	Strict bool `yaml:"strict" env:"STRICT" env-default:"false"`
 
 	// Derived fields (not directly set from environment or flags)
-	ForwardTrafficType ForwardTrafficType // Determined based on configuration
+	ForwardTrafficType ForwardTrafficType           `yaml:"-"` // Determined based on configuration
+	Targets            []string                     `yaml:"-"` // TargetAddr split into its targets
+	Sticky             stickyPolicy                 `yaml:"-"` // Parsed from StickySessions
+	TransportOverrides map[string]TransportSettings `yaml:"-"` // Parsed from HTTPTransportOverrides
+	ProxyHosts         map[string]proxyHost         `yaml:"-"` // Parsed from TailnetProxyHosts
+	ProxyAllowedHosts  []hostPattern                `yaml:"-"` // Compiled from TailnetProxyAllowedHosts
+	StaticHosts        map[string][]netip.Addr      `yaml:"-"` // Parsed from HostsFile and Hosts
+	TargetEnv          map[string]string            `yaml:"-"` // Read from TargetEnvFile
+	HeaderTargets      []string                     `yaml:"-"` // TargetHeaderAllowed split into its targets
+	Warnings           []error                      `yaml:"-"` // Settings that work but are likely mistakes
+}
+
+// TransportSettings returns the default outbound transport settings.
+func (c *Config) TransportSettings() TransportSettings {
+	return TransportSettings{
+		MaxIdleConns:        c.HTTPMaxIdleConns,
+		MaxIdleConnsPerHost: c.HTTPMaxIdleConnsPerHost,
+		MaxConnsPerHost:     c.HTTPMaxConnsPerHost,
+		IdleConnTimeout:     c.HTTPIdleConnTimeout,
+		DisableKeepAlives:   c.HTTPDisableKeepAlives,
+
+		TLSInsecureSkipVerify: c.InsecureSkipVerify,
+		TLSSPIFFE:             c.SPIFFEUpstream,
+		TLSSPIFFEIDs:          c.SPIFFEUpstreamIDs,
+
+		UpstreamProxy: c.UpstreamProxy,
+	}
+}
+
+// HealthSettings returns the active health checks of TCP targets, dialing them with
+// dial, or nil if they are disabled.
+func (c *Config) HealthSettings(dial dialFunc) *healthSettings {
+	if c.HealthCheckInterval <= 0 {
+		return nil
+	}
+
+	return &healthSettings{
+		interval: c.HealthCheckInterval,
+		timeout:  c.HealthCheckTimeout,
+		protocol: c.TCPProtocol,
+		dial:     dial,
+	}
+}
+
+// allRoutes returns the shared routes and the routes of every tenant.
+func (c *Config) allRoutes() []RouteConfig {
+	routes := c.Routes
+	for _, tc := range c.Tenants {
+		routes = append(routes[:len(routes):len(routes)], tc.Routes...)
+	}
+
+	return routes
+}
+
+// TCPOptions returns how connections are forwarded in TCP mode.
+func (c *Config) TCPOptions() tcpOptions {
+	proxyPeers, _ := parseProxyPeers(c.TCPAcceptProxyFrom) // checked by validateConfig
+	opts := tcpOptions{
+		proxyProtocol:     c.TCPProxyProtocol,
+		acceptProxy:       c.TCPAcceptProxyProtocol,
+		proxyPeers:        proxyPeers,
+		protocol:          c.TCPProtocol,
+		mqttTopics:        c.MQTTAllowedTopics,
+		idleTimeout:       c.TCPIdleTimeout,
+		deadClientTimeout: c.TCPDeadClientTimeout,
+		maxInflight:       int64(c.TCPMaxInflightKB) << 10,
+		sources:           newSourceLimiter(c.TCPMaxConnsPerIP, c.TCPConnRatePerIP, c.TCPConnBurstPerIP),
+		syslog:            c.SyslogSettings(),
+		record:            c.Record,
+		window:            c.AccessWindow(),
+		maintenance:       true,
+		requireToken:      c.RequireToken,
+	}
+
+	return opts.withProfile(c.TCPProfile)
+}
+
+// AccessWindow returns when the main listener accepts connections, or nil if always.
+func (c *Config) AccessWindow() *accessWindow {
+	window, _ := parseAccessWindow(c.AllowedHours)
+	return window
+}
+
+// SyslogSettings returns how messages are forwarded with the syslog protocol.
+func (c *Config) SyslogSettings() syslogSettings {
+	return syslogSettings{
+		batchSize:     c.SyslogBatchSize,
+		queueSize:     c.SyslogQueueSize,
+		spoolDir:      c.SyslogSpoolDir,
+		spoolMaxBytes: int64(c.SyslogSpoolMaxMB) << 20,
+	}
+}
+
+// WebhookSpoolSettings returns how POST requests are spooled in HTTP mode, or nil if
+// they are not.
+func (c *Config) WebhookSpoolSettings() *webhookSpoolSettings {
+	if c.WebhookSpoolDir == "" {
+		return nil
+	}
+
+	return &webhookSpoolSettings{
+		dir:          c.WebhookSpoolDir,
+		maxBytes:     int64(c.WebhookSpoolMaxMB) << 20,
+		maxBodyBytes: int64(c.WebhookSpoolMaxBodyMB) << 20,
+		hostHeader:   c.HostHeader,
+	}
+}
+
+// WebhookDedup returns how retries of requests to the main target are suppressed.
+func (c *Config) WebhookDedup() DedupConfig {
+	return DedupConfig{TTL: c.WebhookDedupTTL, Header: c.WebhookDedupHeader}
+}
+
+// RecordingSettings returns how sessions are recorded, or nil if recording is unavailable.
+func (c *Config) RecordingSettings() *recordingSettings {
+	if c.RecordingDir == "" {
+		return nil
+	}
+
+	key, _ := parseRecordingKey(c.RecordingKey)
+	return &recordingSettings{
+		dir:       c.RecordingDir,
+		key:       key,
+		maxBytes:  int64(c.RecordingMaxMB) << 20,
+		retention: c.RecordingRetention,
+	}
+}
+
+// VerifySettings returns how requests are verified against a second target in HTTP
+// mode, or nil if they are not.
+func (c *Config) VerifySettings() *verifySettings {
+	if c.VerifyTarget == "" {
+		return nil
+	}
+
+	settings := &verifySettings{
+		target:       strings.TrimSuffix(c.VerifyTarget, "/"),
+		sample:       c.VerifySample,
+		maxBodyBytes: int64(c.VerifyMaxBodyMB) << 20,
+		timeout:      c.VerifyTimeout,
+	}
+	if c.VerifyMethods != "*" {
+		for _, method := range splitList(c.VerifyMethods) {
+			settings.methods = append(settings.methods, strings.ToUpper(method))
+		}
+	}
+	for _, name := range splitList(c.VerifyIgnoreHeaders) {
+		settings.ignoreHeaders = append(settings.ignoreHeaders, http.CanonicalHeaderKey(name))
+	}
+
+	return settings
+}
+
+// PoolOptions returns how traffic is balanced when several targets are configured,
+// probing their latency with dial when balancing by latency.
+func (c *Config) PoolOptions(dial dialFunc) poolOptions {
+	opts := poolOptions{sticky: c.Sticky, cookie: c.StickyCookie}
+	if c.LoadBalancing == LoadBalancingLatency {
+		opts.latency = &latencySettings{interval: c.LatencyProbeInterval, dial: dial}
+	}
+	if c.TargetMaxConcurrency > 0 {
+		opts.concurrency = &concurrencySettings{
+			limit:        c.TargetMaxConcurrency,
+			queueSize:    c.TargetQueueSize,
+			queueTimeout: c.TargetQueueTimeout,
+
+			adaptive:         c.TargetAdaptiveConcurrency,
+			latencyTolerance: c.TargetLatencyTolerance,
+		}
+	}
+	if c.OutlierDetection {
+		opts.outlier = &outlierSettings{
+			interval:          c.OutlierInterval,
+			ejectionTime:      c.OutlierEjectionTime,
+			errorRate:         c.OutlierErrorRate,
+			latencyFactor:     c.OutlierLatencyFactor,
+			minRequests:       c.OutlierMinRequests,
+			maxEjectedPercent: c.OutlierMaxEjectedPercent,
+		}
+	}
+
+	return opts
+}
+
+// CaptureSettings returns the debug packet capture settings, or nil if traffic is not
+// captured.
+func (c *Config) CaptureSettings() *captureSettings {
+	if c.Capture == "" {
+		return nil
+	}
+
+	path, _ := parseCapture(c.Capture)
+	return &captureSettings{
+		path:     path,
+		scope:    c.CaptureScope,
+		snaplen:  c.CaptureSnaplen,
+		sample:   c.CaptureSample,
+		maxBytes: int64(c.CaptureMaxMB) << 20,
+	}
+}
+
+// ProxyOptions returns the settings of the Tailnet Proxy.
+func (c *Config) ProxyOptions() proxyOptions {
+	return proxyOptions{
+		hosts:           c.ProxyHosts,
+		searchDomain:    c.TailnetProxySearchDomain,
+		logSample:       c.TailnetProxyLogSample,
+		quiet:           c.TailnetProxyQuiet,
+		maxDestinations: c.TailnetProxyMaxDestinations,
+		allowedHosts:    c.ProxyAllowedHosts,
+		authToken:       c.TailnetProxyAuthToken,
+	}
 }
 
 // LoadConfig loads configuration from environment variables and command-line flags.
 // Environment variables are loaded first, then overridden by flags if provided.
+// Settings given neither way fall back to Railway's variables, then to defaults.
 // Returns the loaded config and any validation errors.
 func LoadConfig() (*Config, []error) {
 
@@ -60,8 +531,18 @@ func LoadConfig() (*Config, []error) {
 	// Override with command-line flags
 	parseFlags(cfg)
 
+	// Fill in what Railway's own variables tell us, unless configured explicitly
+	applyRailwayEnvironment(cfg)
+	applyDevDefaults(cfg)
+
 	// Determine the traffic type and validate configuration
 	validationErrors := validateConfig(cfg)
+	if len(validationErrors) == 0 {
+		cfg.Warnings = configWarnings(cfg)
+		if cfg.Strict {
+			validationErrors = append(validationErrors, cfg.Warnings...)
+		}
+	}
 
 	// Combine flagErrors from environment loading and validation
 	var flagErrors []error
@@ -75,13 +556,21 @@ func LoadConfig() (*Config, []error) {
 	return cfg, nil
 }
 
-// loadEnvironmentConfig loads configuration from environment variables.
+// loadEnvironmentConfig loads configuration from the config file, if one is given, and
+// environment variables. Environment variables take precedence over the file.
 func loadEnvironmentConfig() (*Config, []error) {
 	var cfg Config
 	var environmentErrors []error
 
-	err := cleanenv.ReadEnv(&cfg)
-	if err != nil {
+	if path := configFilePath(os.Args[1:]); path != "" {
+		if err := cleanenv.ReadConfig(path, &cfg); err != nil {
+			environmentErrors = append(
+				environmentErrors,
+				fmt.Errorf("error reading config file %s: %w", path, err),
+			)
+		}
+		cfg.ConfigFile = path
+	} else if err := cleanenv.ReadEnv(&cfg); err != nil {
 		environmentErrors = append(
 			environmentErrors,
 			fmt.Errorf("error reading environment config: %w", err),
@@ -91,10 +580,35 @@ func loadEnvironmentConfig() (*Config, []error) {
 	return &cfg, environmentErrors
 }
 
+// configFilePath returns the config file given with -config-file in args, falling back
+// to the CONFIG_FILE environment variable. The flag is looked up ahead of flag.Parse
+// because the file has to be loaded before flags are applied on top of it.
+func configFilePath(args []string) string {
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config-file" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+
+	return os.Getenv("CONFIG_FILE")
+}
+
 // parseFlags defines and parses command-line flags, updating the provided config.
 func parseFlags(cfg *Config) {
+	defineFlags(cfg)
+	flag.Parse()
+}
 
-	// Define flags, using current cfg values as defaults
+// defineFlags defines the command-line flags on flag.CommandLine, using the current cfg
+// values as defaults.
+func defineFlags(cfg *Config) {
 	flag.StringVar(
 		&cfg.TSHostname,
 		"ts-hostname",
@@ -107,18 +621,68 @@ func parseFlags(cfg *Config) {
 		cfg.ListenPort,
 		"Port to listen on.",
 	)
+	flag.StringVar(
+		&cfg.TailnetListenPort,
+		"tailnet-listen-port",
+		cfg.TailnetListenPort,
+		"Also serve the listener on this port of the tailnet node. Disabled if empty.",
+	)
 	flag.StringVar(
 		&cfg.TargetAddr,
 		"target-addr",
 		cfg.TargetAddr,
-		"Target Tailscale node address (e.g., 100.x.x.x:port or http://100.x.x.x:port).",
+		"Target Tailscale node address (e.g., 100.x.x.x:port or http://100.x.x.x:port). Separate several targets with commas to load balance.",
 	)
-	flag.BoolVar(
+	boolFlag(
 		&cfg.ProxyMode,
 		"proxy-mode",
-		cfg.ProxyMode,
 		"Enable Tailnet Proxy mode. TARGET_ADDR is ignored if true.",
 	)
+	flag.StringVar(
+		&cfg.TailnetProxyHosts,
+		"tailnet-proxy-hosts",
+		cfg.TailnetProxyHosts,
+		"Comma-separated host=host:port mappings for Tailnet Proxy mode (e.g., foo.internal=100.64.0.5:8443).",
+	)
+	flag.StringVar(
+		&cfg.TailnetProxySearchDomain,
+		"tailnet-proxy-search-domain",
+		cfg.TailnetProxySearchDomain,
+		"MagicDNS suffix appended to short host names in Tailnet Proxy mode (e.g., tailnet-name.ts.net).",
+	)
+	flag.DurationVar(
+		&cfg.TailnetProxyDNSCacheTTL,
+		"tailnet-proxy-dns-cache-ttl",
+		cfg.TailnetProxyDNSCacheTTL,
+		"How long MagicDNS names under the search domain are cached.",
+	)
+	flag.IntVar(
+		&cfg.TailnetProxyLogSample,
+		"tailnet-proxy-log-sample",
+		cfg.TailnetProxyLogSample,
+		"Log one in N forwarded requests per destination in Tailnet Proxy mode.",
+	)
+	boolFlag(
+		&cfg.TailnetProxyQuiet,
+		"tailnet-proxy-quiet",
+		"Only log failed requests in Tailnet Proxy mode.",
+	)
+	flag.IntVar(
+		&cfg.TailnetProxyMaxDestinations,
+		"tailnet-proxy-max-destinations",
+		cfg.TailnetProxyMaxDestinations,
+		"Destinations counted individually in Tailnet Proxy metrics, the rest are counted as other.",
+	)
+	listFlag(
+		&cfg.TailnetProxyAllowedHosts,
+		"tailnet-proxy-allowed-hosts",
+		"Comma-separated destinations the Tailnet Proxy may forward to (host, *.suffix, ~REGEX or CIDR). May be repeated.",
+	)
+	boolFlag(
+		&cfg.AllowOpenProxy,
+		"allow-open-proxy",
+		"Run the Tailnet Proxy without an allowlist or auth token.",
+	)
 	flag.StringVar(
 		&cfg.TSLoginServer,
 		"ts-login-server",
@@ -131,123 +695,1651 @@ func parseFlags(cfg *Config) {
 		cfg.TSStateDirPath,
 		"Directory to store Tailscale state.",
 	)
-	flag.BoolVar(
+	flag.StringVar(
+		&cfg.DERPRegion,
+		"derp-region",
+		cfg.DERPRegion,
+		"Home DERP region to pin, by ID or code (e.g. 4 or fra), instead of the one with the lowest latency.",
+	)
+	boolFlag(
+		&cfg.LogConnectionPaths,
+		"log-connection-paths",
+		"Log whether connections to targets go direct or through a DERP relay, and which.",
+	)
+	flag.DurationVar(
+		&cfg.TailnetMetricsInterval,
+		"tailnet-metrics-interval",
+		cfg.TailnetMetricsInterval,
+		"How often Tailscale engine statistics (traffic by path, peers, handshakes) are collected into metrics (0 = disabled).",
+	)
+	flag.StringVar(
+		&cfg.DialBackend,
+		"dial-backend",
+		cfg.DialBackend,
+		"What targets are dialed through: tailnet (the default), direct (the local network), loopback or a socks5:// proxy URL.",
+	)
+	boolFlag(
+		&cfg.NoTailscale,
+		"no-tailscale",
+		"Run without joining a tailnet, dialing targets with -dial-backend (direct by default), for local development.",
+	)
+	boolFlag(
 		&cfg.InsecureSkipVerify,
 		"insecure-skip-verify",
-		cfg.InsecureSkipVerify,
 		"Skip TLS certificate verification for HTTPS targets.",
 	)
-	// Note: TSAuthKey is intentionally not exposed as a flag for security reasons
-
-	// Parse command-line flags
-	flag.Parse()
-}
-
-// validateConfig performs validation checks on the configuration and determines
-// the ForwardTrafficType based on the configuration.
-func validateConfig(cfg *Config) []error {
-	var errors []error
-
-	// Validate required fields
-	if cfg.TSAuthKey == "" {
-		errors = append(errors, ErrMissingAuthKey)
-	}
-
-	// Determine ForwardTrafficType and validate accordingly
-	if cfg.ProxyMode {
-		cfg.ForwardTrafficType = ForwardTrafficTypeTailnetProxy
-	} else if cfg.TargetAddr == "" {
-		errors = append(errors, ErrMissingTargetAddr)
-	} else {
-		// Determine and validate the traffic type based on the target address
-		errors = append(errors, determineAndValidateTrafficType(cfg)...)
-	}
-
-	// Validate listen port
-	if err := validateListenPort(cfg.ListenPort); err != nil {
-		errors = append(errors, err)
-	}
-
-	return errors
-}
-
-// determineAndValidateTrafficType determines the ForwardTrafficType from the TargetAddr
-// and validates the address format accordingly.
-func determineAndValidateTrafficType(cfg *Config) []error {
-	var errors_ []error
-
-	// Determine type based on protocol prefix
-	protocol := ""
-	parts := strings.SplitN(cfg.TargetAddr, "://", 2)
-	if len(parts) > 1 {
-		protocol = strings.ToLower(parts[0])
-	}
-
-	switch protocol {
-	case "http":
-		cfg.ForwardTrafficType = ForwardTrafficTypeHTTP
-
-	case "https":
-		cfg.ForwardTrafficType = ForwardTrafficTypeHTTPS
-
-	default:
-		cfg.ForwardTrafficType = ForwardTrafficTypeTCP
-	}
-
-	// Validate based on type
-	if cfg.ForwardTrafficType == ForwardTrafficTypeHTTP || cfg.ForwardTrafficType == ForwardTrafficTypeHTTPS {
-		if err := validateHTTPAddress(cfg.TargetAddr); err != nil {
-			errors_ = append(errors_, err)
-		}
-	} else {
-		if err := validateTCPAddress(cfg.TargetAddr); err != nil {
-			errors_ = append(errors_, err)
-		}
-	}
-
-	return errors_
-}
-
-// validateHTTPAddress validates that the given address is a valid HTTP(S) URL.
-func validateHTTPAddress(addr string) error {
-	u, err := url.Parse(addr)
-	if err != nil {
-		return fmt.Errorf("%w: %w", ErrTargetAddrInvalid, err)
-	}
-
-	if u.Host == "" {
-		return fmt.Errorf("%w: missing host in URL (%s)", ErrTargetAddrInvalid, addr)
-	}
-
-	return nil
-}
-
-// validateTCPAddress validates that the given address is a valid TCP address (host:port).
-func validateTCPAddress(addr string) error {
-	_, _, err := net.SplitHostPort(addr)
-	if err != nil {
-		return fmt.Errorf("%w for TCP mode ('%s'): %w. Expected host:port",
-			ErrTargetAddrInvalid, addr, err)
-	}
-
-	return nil
-}
-
-// validateListenPort validates that the listen port is a valid port number.
-func validateListenPort(port string) error {
-	if port == "" {
-		return errors.New("LISTEN_PORT is required")
-	}
-
-	portNum, err := strconv.Atoi(port)
-	if err != nil {
-		return fmt.Errorf("%w: %s: %w", ErrListenPortInvalid, port, err)
-	}
-
-	if portNum < 1 || portNum > 65535 {
-		return fmt.Errorf("%w: %s: port must be between 1 and 65535",
-			ErrListenPortInvalid, port)
-	}
-
-	return nil
+	flag.IntVar(
+		&cfg.HTTPMaxIdleConns,
+		"http-max-idle-conns",
+		cfg.HTTPMaxIdleConns,
+		"Maximum idle upstream connections kept across all targets.",
+	)
+	flag.IntVar(
+		&cfg.HTTPMaxIdleConnsPerHost,
+		"http-max-idle-conns-per-host",
+		cfg.HTTPMaxIdleConnsPerHost,
+		"Maximum idle upstream connections kept per target.",
+	)
+	flag.IntVar(
+		&cfg.HTTPMaxConnsPerHost,
+		"http-max-conns-per-host",
+		cfg.HTTPMaxConnsPerHost,
+		"Maximum upstream connections per target (0 = unlimited).",
+	)
+	flag.DurationVar(
+		&cfg.HTTPIdleConnTimeout,
+		"http-idle-conn-timeout",
+		cfg.HTTPIdleConnTimeout,
+		"How long idle upstream connections are kept open.",
+	)
+	boolFlag(
+		&cfg.HTTPDisableKeepAlives,
+		"http-disable-keepalives",
+		"Disable upstream connection reuse.",
+	)
+	flag.StringVar(
+		&cfg.HTTPTransportOverrides,
+		"http-transport-overrides",
+		cfg.HTTPTransportOverrides,
+		"Per-target transport overrides (e.g., 100.x.x.x:443=max-idle-conns-per-host=16,idle-conn-timeout=30s;...).",
+	)
+	boolFlag(
+		&cfg.HTTPLogUpstreamConns,
+		"http-log-upstream-conns",
+		"Log whether each upstream request reused a connection, with dial/TLS timings.",
+	)
+	flag.StringVar(
+		&cfg.UpstreamProxy,
+		"upstream-proxy",
+		cfg.UpstreamProxy,
+		"HTTP or SOCKS5 proxy on the tailnet to reach HTTP targets through (e.g., socks5://100.x.x.x:1080).",
+	)
+	flag.StringVar(
+		&cfg.AdminPort,
+		"admin-port",
+		cfg.AdminPort,
+		"Port for the admin server exposing /metrics. Disabled if empty.",
+	)
+	flag.StringVar(
+		&cfg.AdminNetwork,
+		"admin-network",
+		cfg.AdminNetwork,
+		"Network the admin server listens on: local, or tailnet to only serve it to tailnet members.",
+	)
+	boolFlag(
+		&cfg.AdminPublicMetrics,
+		"admin-public-metrics",
+		"Serve /metrics on the admin server without ADMIN_TOKEN, for scrapers that cannot send it.",
+	)
+	flag.StringVar(
+		&cfg.AdminGRPCPort,
+		"admin-grpc-port",
+		cfg.AdminGRPCPort,
+		"Port for the gRPC admin API, on the admin network. Disabled if empty.",
+	)
+	flag.DurationVar(
+		&cfg.StatsHistory,
+		"stats-history",
+		cfg.StatsHistory,
+		"How much per-second traffic the admin API keeps in memory, for /admin/stats/history (0 = none).",
+	)
+	flag.StringVar(
+		&cfg.DebugConsolePort,
+		"debug-console-port",
+		cfg.DebugConsolePort,
+		"Tailnet port of the read-only debug console. Disabled if empty.",
+	)
+	listFlag(
+		&cfg.DebugConsoleUsers,
+		"debug-console-users",
+		"Comma-separated tailnet login names allowed in the debug console. May be repeated.",
+	)
+	flag.IntVar(
+		&cfg.AcceptWorkers,
+		"accept-workers",
+		cfg.AcceptWorkers,
+		"Parallel accept loops on the listener, each with its own SO_REUSEPORT socket on Linux.",
+	)
+	flag.IntVar(
+		&cfg.ListenBacklog,
+		"listen-backlog",
+		cfg.ListenBacklog,
+		"Kernel accept queue length of the listener (0 = system default). Linux only.",
+	)
+	flag.IntVar(
+		&cfg.BufferBudgetMB,
+		"buffer-budget-mb",
+		cfg.BufferBudgetMB,
+		"Buffer memory for connections in flight, in MiB. New connections are refused beyond it (0 = unlimited).",
+	)
+	flag.DurationVar(
+		&cfg.BufferBudgetWait,
+		"buffer-budget-wait",
+		cfg.BufferBudgetWait,
+		"How long new connections queue for buffer memory before being refused (0 = refuse right away).",
+	)
+	flag.DurationVar(
+		&cfg.MaxConnLifetime,
+		"max-conn-lifetime",
+		cfg.MaxConnLifetime,
+		"Close client connections once they are this old (0 = unlimited).",
+	)
+	flag.DurationVar(
+		&cfg.MaxConnLifetimeGrace,
+		"max-conn-lifetime-grace",
+		cfg.MaxConnLifetimeGrace,
+		"How long HTTP connections get to finish their requests past the maximum lifetime.",
+	)
+	flag.DurationVar(
+		&cfg.DrainTimeout,
+		"drain-timeout",
+		cfg.DrainTimeout,
+		"How long connections to a removed tunnel or a reloaded target get to finish before being closed (0 = never closed).",
+	)
+	flag.DurationVar(
+		&cfg.ReapIdleTCP,
+		"reap-idle-tcp",
+		cfg.ReapIdleTCP,
+		"Close TCP connections without traffic either way for this long, from the idle reaper (0 = never).",
+	)
+	flag.DurationVar(
+		&cfg.ReapIdleHTTP,
+		"reap-idle-http",
+		cfg.ReapIdleHTTP,
+		"Abort HTTP requests without traffic either way for this long, from the idle reaper (0 = never).",
+	)
+	boolFlag(
+		&cfg.StateDB,
+		"state-db",
+		"Keep runtime tunnels, tenant counters, the admin audit trail and spooled webhooks in a SQLite database in the state directory.",
+	)
+	flag.StringVar(
+		&cfg.WebhookSpoolDir,
+		"webhook-spool-dir",
+		cfg.WebhookSpoolDir,
+		"Spool POST requests to this directory while the target is unreachable, answering 202, and replay them later. Disabled if empty.",
+	)
+	flag.IntVar(
+		&cfg.WebhookSpoolMaxMB,
+		"webhook-spool-max-mb",
+		cfg.WebhookSpoolMaxMB,
+		"Size bound of the webhook spool, in MiB.",
+	)
+	flag.IntVar(
+		&cfg.WebhookSpoolMaxBodyMB,
+		"webhook-spool-max-body-mb",
+		cfg.WebhookSpoolMaxBodyMB,
+		"POST requests bigger than this, in MiB, are forwarded but never spooled.",
+	)
+	flag.DurationVar(
+		&cfg.WebhookDedupTTL,
+		"webhook-dedup-ttl",
+		cfg.WebhookDedupTTL,
+		"How long requests to the main target are remembered, to answer their retries without forwarding them. Disabled if 0.",
+	)
+	flag.StringVar(
+		&cfg.WebhookDedupHeader,
+		"webhook-dedup-header",
+		cfg.WebhookDedupHeader,
+		"Idempotency key header deduplicated requests are keyed by (e.g., Idempotency-Key). Keyed by their hash if empty.",
+	)
+	flag.StringVar(
+		&cfg.AllowedHours,
+		"allowed-hours",
+		cfg.AllowedHours,
+		`When the main listener accepts connections, like "Mon-Fri 08:00-18:00 Europe/Madrid". Always if empty.`,
+	)
+	boolFlag(
+		&cfg.RequireToken,
+		"require-token",
+		"Only accept clients of the main listener with a token minted through the admin API.",
+	)
+	flag.DurationVar(
+		&cfg.TokenMaxTTL,
+		"token-max-ttl",
+		cfg.TokenMaxTTL,
+		"Longest lifetime of the tunnel tokens minted through the admin API.",
+	)
+	boolFlag(
+		&cfg.TenantRequired,
+		"tenant-required",
+		"Refuse HTTP requests no tenant of the config file matches.",
+	)
+	boolFlag(
+		&cfg.Record,
+		"record",
+		"Record the sessions of the main listener in TCP mode to -recording-dir, encrypted with RECORDING_KEY.",
+	)
+	flag.StringVar(
+		&cfg.RecordingDir,
+		"recording-dir",
+		cfg.RecordingDir,
+		"Directory to write session recordings to. Recording is unavailable if empty.",
+	)
+	flag.IntVar(
+		&cfg.RecordingMaxMB,
+		"recording-max-mb",
+		cfg.RecordingMaxMB,
+		"Size bound of each recording, in MiB. The rest of longer sessions is not recorded.",
+	)
+	flag.DurationVar(
+		&cfg.RecordingRetention,
+		"recording-retention",
+		cfg.RecordingRetention,
+		"Remove recordings older than this. Kept forever if 0.",
+	)
+	flag.StringVar(
+		&cfg.VerifyTarget,
+		"verify-target",
+		cfg.VerifyTarget,
+		"Also send each request to this URL, serve the primary's response and log differences between the two. Disabled if empty.",
+	)
+	flag.StringVar(
+		&cfg.VerifyMethods,
+		"verify-methods",
+		cfg.VerifyMethods,
+		"Methods of the requests verified against -verify-target, comma-separated, or * for all.",
+	)
+	flag.StringVar(
+		&cfg.VerifyIgnoreHeaders,
+		"verify-ignore-headers",
+		cfg.VerifyIgnoreHeaders,
+		"Response headers not compared with -verify-target, comma-separated.",
+	)
+	flag.Float64Var(
+		&cfg.VerifySample,
+		"verify-sample",
+		cfg.VerifySample,
+		"Fraction (0-1) of the requests verified against -verify-target.",
+	)
+	flag.IntVar(
+		&cfg.VerifyMaxBodyMB,
+		"verify-max-body-mb",
+		cfg.VerifyMaxBodyMB,
+		"Requests with bodies bigger than this, in MiB, are not verified.",
+	)
+	flag.DurationVar(
+		&cfg.VerifyTimeout,
+		"verify-timeout",
+		cfg.VerifyTimeout,
+		"Timeout of the requests to -verify-target.",
+	)
+	flag.DurationVar(
+		&cfg.SlowRequestThreshold,
+		"slow-request-threshold",
+		cfg.SlowRequestThreshold,
+		"Log a warning for HTTP requests taking longer than this (0 = disabled).",
+	)
+	flag.IntVar(
+		&cfg.LargeTransferMB,
+		"large-transfer-mb",
+		cfg.LargeTransferMB,
+		"Log a warning for connections and requests moving more than this, in MiB (0 = disabled).",
+	)
+	flag.BoolVar(
+		&cfg.SizeMetrics,
+		"size-metrics",
+		cfg.SizeMetrics,
+		"Record histograms of HTTP request and response sizes by route and target.",
+	)
+	flag.Float64Var(
+		&cfg.SLOObjective,
+		"slo-objective",
+		cfg.SLOObjective,
+		"Share (0-1) of the connections and requests of each listener that must end without hitting a deadline or failing, e.g. 0.999 (0 = disabled).",
+	)
+	flag.DurationVar(
+		&cfg.SLOWindow,
+		"slo-window",
+		cfg.SLOWindow,
+		"Rolling window of the error budget of each listener.",
+	)
+	flag.Float64Var(
+		&cfg.SLOBurnRate,
+		"slo-burn-rate",
+		cfg.SLOBurnRate,
+		"Burn rate of the error budget, over the last hour and 5 minutes, that fires an alert.",
+	)
+	flag.DurationVar(
+		&cfg.WatchdogInterval,
+		"watchdog-interval",
+		cfg.WatchdogInterval,
+		"How often goroutines and file descriptors are checked against open connections (0 = disabled).",
+	)
+	boolFlag(
+		&cfg.WatchdogHeapDump,
+		"watchdog-heap-dump",
+		"Write a heap profile to the state dir when the watchdog suspects a leak (at most hourly).",
+	)
+	flag.IntVar(
+		&cfg.ProfileRSSThresholdMB,
+		"profile-rss-threshold-mb",
+		cfg.ProfileRSSThresholdMB,
+		"Dump heap and goroutine profiles when resident memory exceeds this, in MiB (0 = disabled).",
+	)
+	flag.StringVar(
+		&cfg.ProfileUploadURL,
+		"profile-upload-url",
+		cfg.ProfileUploadURL,
+		"Also POST dumped profiles to this URL.",
+	)
+	flag.StringVar(
+		&cfg.Capture,
+		"capture",
+		cfg.Capture,
+		"Capture traffic for debugging: pcap:<path>. Disabled if empty.",
+	)
+	flag.StringVar(
+		&cfg.CaptureScope,
+		"capture-scope",
+		cfg.CaptureScope,
+		"Traffic captured: listener (connections accepted on LISTEN_PORT), tailnet (packets of the Tailscale node) or both.",
+	)
+	flag.IntVar(
+		&cfg.CaptureSnaplen,
+		"capture-snaplen",
+		cfg.CaptureSnaplen,
+		"Bytes kept of each captured packet (0 = whole packets).",
+	)
+	flag.IntVar(
+		&cfg.CaptureSample,
+		"capture-sample",
+		cfg.CaptureSample,
+		"Capture one in N connections (listener) or packets (tailnet).",
+	)
+	flag.IntVar(
+		&cfg.CaptureMaxMB,
+		"capture-max-mb",
+		cfg.CaptureMaxMB,
+		"Stop capturing once a capture file reaches this size, in MiB.",
+	)
+	flag.StringVar(
+		&cfg.TaildropDir,
+		"taildrop-dir",
+		cfg.TaildropDir,
+		"Directory to store files sent to the node with Taildrop in. Disabled if empty.",
+	)
+	flag.StringVar(
+		&cfg.TaildropForwardURL,
+		"taildrop-forward-url",
+		cfg.TaildropForwardURL,
+		"URL to POST files sent to the node with Taildrop to, instead of storing them.",
+	)
+	flag.StringVar(
+		&cfg.HookURL,
+		"hook-url",
+		cfg.HookURL,
+		"URL to POST connection, target health and tailscale auth events to as JSON.",
+	)
+	flag.StringVar(
+		&cfg.HookCommand,
+		"hook-command",
+		cfg.HookCommand,
+		"Executable to run for every event, with the event as its argument and in RAILTAIL_* variables.",
+	)
+	listFlag(
+		&cfg.HookEvents,
+		"hook-events",
+		"Comma-separated events delivered to the hooks (conn-open, conn-close, target-unhealthy, target-healthy, tsnet-auth). May be repeated.",
+	)
+	flag.DurationVar(
+		&cfg.HookTimeout,
+		"hook-timeout",
+		cfg.HookTimeout,
+		"Time limit for delivering an event to the hooks.",
+	)
+	flag.StringVar(
+		&cfg.UsageExportFile,
+		"usage-export-file",
+		cfg.UsageExportFile,
+		"File the traffic of each tenant and listener is appended to every usage export interval.",
+	)
+	flag.StringVar(
+		&cfg.UsageExportFormat,
+		"usage-export-format",
+		cfg.UsageExportFormat,
+		"Format of the usage export file: csv, or json (one report per line).",
+	)
+	flag.StringVar(
+		&cfg.UsageExportURL,
+		"usage-export-url",
+		cfg.UsageExportURL,
+		"URL to POST the traffic of each tenant and listener to as JSON every usage export interval.",
+	)
+	flag.DurationVar(
+		&cfg.UsageExportInterval,
+		"usage-export-interval",
+		cfg.UsageExportInterval,
+		"How often usage is exported.",
+	)
+	boolFlag(
+		&cfg.SelfTest,
+		"self-test",
+		"Check every target end-to-end once the tailnet is up, before serving.",
+	)
+	flag.StringVar(
+		&cfg.SelfTestPath,
+		"self-test-path",
+		cfg.SelfTestPath,
+		"Path requested from HTTP targets by the self-test.",
+	)
+	flag.IntVar(
+		&cfg.SelfTestStatus,
+		"self-test-status",
+		cfg.SelfTestStatus,
+		"HTTP status expected by the self-test (0 = anything below 500).",
+	)
+	flag.DurationVar(
+		&cfg.SelfTestBannerTimeout,
+		"self-test-banner-timeout",
+		cfg.SelfTestBannerTimeout,
+		"How long the self-test waits for TCP targets to send a banner (0 = do not read one).",
+	)
+	flag.DurationVar(
+		&cfg.SelfTestTimeout,
+		"self-test-timeout",
+		cfg.SelfTestTimeout,
+		"Timeout of each self-test check.",
+	)
+	boolFlag(
+		&cfg.SelfTestExitOnFailure,
+		"self-test-exit-on-failure",
+		"Exit instead of serving when a self-test check fails.",
+	)
+	flag.IntVar(
+		&cfg.PrewarmConnections,
+		"prewarm-connections",
+		cfg.PrewarmConnections,
+		"Connections opened to every target once the tailnet is up, before serving (0 = disabled).",
+	)
+	flag.StringVar(
+		&cfg.PrewarmPath,
+		"prewarm-path",
+		cfg.PrewarmPath,
+		"Path of the HEAD requests pre-warming connections to HTTP targets.",
+	)
+	boolFlag(
+		&cfg.Strict,
+		"strict",
+		"Refuse to start on configuration warnings, e.g. for CI-validated deployments.",
+	)
+	boolFlag(
+		&cfg.RailwayCompat,
+		"railway-compat",
+		"Default the Tailscale hostname and state dir from RAILWAY_SERVICE_NAME and RAILWAY_VOLUME_MOUNT_PATH.",
+	)
+	flag.StringVar(
+		&cfg.TCPProxyProtocol,
+		"tcp-proxy-protocol",
+		cfg.TCPProxyProtocol,
+		"Send a PROXY protocol header (v1 or v2) with the client address to TCP targets.",
+	)
+	boolFlag(
+		&cfg.TCPAcceptProxyProtocol,
+		"tcp-accept-proxy-protocol",
+		"Read a PROXY protocol header (v1 or v2) from TCP clients and take the client address from it, e.g. behind another railtail.",
+	)
+	listFlag(
+		&cfg.TCPAcceptProxyFrom,
+		"tcp-accept-proxy-from",
+		"Comma-separated peers (IPs or CIDRs) trusted to send PROXY protocol headers, with -tcp-accept-proxy-protocol. May be repeated.",
+	)
+	flag.StringVar(
+		&cfg.TCPProtocol,
+		"tcp-protocol",
+		cfg.TCPProtocol,
+		"Application protocol of the TCP target (postgres, mysql, redis, smtp, syslog, mqtt or ftp), for protocol-aware idle handling, XCLIENT, syslog forwarding, MQTT inspection and FTP data connections.",
+	)
+	flag.StringVar(
+		&cfg.TCPProfile,
+		"tcp-profile",
+		cfg.TCPProfile,
+		"Tuning profile of TCP connections: broker, for the long-lived connections of AMQP and Kafka (no idle timeout, keepalives, bigger buffers), or desktop, for RDP and VNC (no Nagle, small buffers, response latency metrics), or bulk, for SMB and NFS (large buffers, write coalescing, throughput metrics).",
+	)
+	listFlag(
+		&cfg.MQTTAllowedTopics,
+		"mqtt-allowed-topics",
+		"Comma-separated topic filters MQTT 5 clients may use, passed on to the broker as user properties. May be repeated.",
+	)
+	flag.StringVar(
+		&cfg.FTPPassivePorts,
+		"ftp-passive-ports",
+		cfg.FTPPassivePorts,
+		"Local port range the data connections of FTP transfers in passive mode are accepted on, like 30000-30009.",
+	)
+	flag.StringVar(
+		&cfg.FTPPassiveAddress,
+		"ftp-passive-address",
+		cfg.FTPPassiveAddress,
+		"IPv4 address announced to FTP clients in PASV replies; the local address of the control connection if empty.",
+	)
+	flag.DurationVar(
+		&cfg.TCPIdleTimeout,
+		"tcp-idle-timeout",
+		cfg.TCPIdleTimeout,
+		"Close TCP connections without traffic for this long (0 = never).",
+	)
+	flag.DurationVar(
+		&cfg.TCPKeepalive,
+		"tcp-keepalive",
+		cfg.TCPKeepalive,
+		"Send TCP keepalives, and ping the target's tailnet peer, this often on open TCP connections (0 = disabled).",
+	)
+	flag.DurationVar(
+		&cfg.TCPDeadClientTimeout,
+		"tcp-dead-client-timeout",
+		cfg.TCPDeadClientTimeout,
+		"Close TCP connections, and the target's side, once the client stopped answering for this long (0 = system defaults).",
+	)
+	flag.IntVar(
+		&cfg.TCPMaxInflightKB,
+		"tcp-max-inflight-kb",
+		cfg.TCPMaxInflightKB,
+		"Read TCP connections ahead of the other side taking the data by up to this many KiB per direction (0 = copy as read).",
+	)
+	flag.IntVar(
+		&cfg.TCPMaxConnsPerIP,
+		"tcp-max-conns-per-ip",
+		cfg.TCPMaxConnsPerIP,
+		"TCP connections each client address may have open at once (0 = unlimited).",
+	)
+	flag.Float64Var(
+		&cfg.TCPConnRatePerIP,
+		"tcp-conn-rate-per-ip",
+		cfg.TCPConnRatePerIP,
+		"New TCP connections per second each client address may open (0 = unlimited).",
+	)
+	flag.IntVar(
+		&cfg.TCPConnBurstPerIP,
+		"tcp-conn-burst-per-ip",
+		cfg.TCPConnBurstPerIP,
+		"New TCP connections each client address may open at once above the rate (0 = the rate).",
+	)
+	flag.StringVar(
+		&cfg.TargetIPFamily,
+		"target-ip-family",
+		cfg.TargetIPFamily,
+		"Address family dialed for targets given by name (auto, ipv4, ipv6, prefer-ipv4, prefer-ipv6).",
+	)
+	flag.StringVar(
+		&cfg.HostsFile,
+		"hosts-file",
+		cfg.HostsFile,
+		"Hosts file, in the /etc/hosts format, resolving target names before MagicDNS and DNS.",
+	)
+	flag.StringVar(
+		&cfg.TargetEnvFile,
+		"target-env-file",
+		cfg.TargetEnvFile,
+		"Env file (NAME=VALUE lines) whose variables take precedence over the environment in target templates, re-read on SIGHUP.",
+	)
+	flag.StringVar(
+		&cfg.TargetHeader,
+		"target-header",
+		cfg.TargetHeader,
+		"Trusted request header naming the HTTP target to forward to, among -target-header-allowed.",
+	)
+	flag.StringVar(
+		&cfg.TargetHeaderAllowed,
+		"target-header-allowed",
+		cfg.TargetHeaderAllowed,
+		"Targets the target header may select, comma-separated HTTP(S) URLs.",
+	)
+	flag.IntVar(
+		&cfg.SyslogBatchSize,
+		"syslog-batch-size",
+		cfg.SyslogBatchSize,
+		"Syslog messages written to the target at once.",
+	)
+	flag.IntVar(
+		&cfg.SyslogQueueSize,
+		"syslog-queue-size",
+		cfg.SyslogQueueSize,
+		"Syslog messages held in memory while the target is unreachable.",
+	)
+	flag.StringVar(
+		&cfg.SyslogSpoolDir,
+		"syslog-spool-dir",
+		cfg.SyslogSpoolDir,
+		"Write syslog messages overflowing the queue to this directory until they are delivered. Dropped if empty.",
+	)
+	flag.IntVar(
+		&cfg.SyslogSpoolMaxMB,
+		"syslog-spool-max-mb",
+		cfg.SyslogSpoolMaxMB,
+		"Size bound of each syslog spool file, in MiB.",
+	)
+	flag.StringVar(
+		&cfg.TLSCertFile,
+		"tls-cert-file",
+		cfg.TLSCertFile,
+		"Certificate (PEM) to terminate TLS with on the listener, in HTTP and Tailnet Proxy modes.",
+	)
+	flag.StringVar(
+		&cfg.TLSKeyFile,
+		"tls-key-file",
+		cfg.TLSKeyFile,
+		"Key (PEM) of the listener certificate.",
+	)
+	flag.StringVar(
+		&cfg.HTTPRedirectPort,
+		"http-redirect-port",
+		cfg.HTTPRedirectPort,
+		"Port for a plain HTTP listener that redirects to HTTPS. Requires TLS termination.",
+	)
+	flag.DurationVar(
+		&cfg.HSTSMaxAge,
+		"hsts-max-age",
+		cfg.HSTSMaxAge,
+		"Send Strict-Transport-Security with this max-age on TLS responses. Disabled if 0.",
+	)
+	boolFlag(
+		&cfg.HSTSIncludeSubdomains,
+		"hsts-include-subdomains",
+		"Add includeSubDomains to the Strict-Transport-Security header.",
+	)
+	boolFlag(
+		&cfg.HSTSPreload,
+		"hsts-preload",
+		"Add preload to the Strict-Transport-Security header.",
+	)
+	flag.StringVar(
+		&cfg.TLSClientCAFile,
+		"tls-client-ca-file",
+		cfg.TLSClientCAFile,
+		"CA certificates (PEM) client certificates are verified against on the TLS listener.",
+	)
+	flag.StringVar(
+		&cfg.TLSClientAuth,
+		"tls-client-auth",
+		cfg.TLSClientAuth,
+		"Whether clients of the TLS listener must present a certificate (require) or may (optional).",
+	)
+	listFlag(
+		&cfg.ACMEDomains,
+		"acme-domains",
+		"Comma-separated public hostnames to obtain ACME certificates for, terminating TLS on the listener. May be repeated.",
+	)
+	flag.StringVar(
+		&cfg.ACMEEmail,
+		"acme-email",
+		cfg.ACMEEmail,
+		"Contact email of the ACME account.",
+	)
+	flag.StringVar(
+		&cfg.ACMEDirectoryURL,
+		"acme-directory-url",
+		cfg.ACMEDirectoryURL,
+		"ACME directory URL.",
+	)
+	flag.StringVar(
+		&cfg.ACMEChallenge,
+		"acme-challenge",
+		cfg.ACMEChallenge,
+		"ACME challenge: http-01 (with TLS-ALPN-01) or dns-01.",
+	)
+	flag.StringVar(
+		&cfg.ACMEDNSHook,
+		"acme-dns-hook",
+		cfg.ACMEDNSHook,
+		"Command called as '<hook> present|cleanup <fqdn> <value>' to manage dns-01 TXT records.",
+	)
+	flag.StringVar(
+		&cfg.SPIFFEEndpointSocket,
+		"spiffe-endpoint-socket",
+		cfg.SPIFFEEndpointSocket,
+		"SPIFFE Workload API address (unix:///path or tcp://ip:port) to fetch the SVID of railtail from.",
+	)
+	boolFlag(
+		&cfg.TLSClientSPIFFE,
+		"tls-client-spiffe",
+		"Verify client certificates of the TLS listener as SVIDs, against the bundles of the Workload API.",
+	)
+	boolFlag(
+		&cfg.SPIFFEUpstream,
+		"spiffe-upstream",
+		"Present the SVID of railtail to HTTPS targets, and verify their certificates as SVIDs.",
+	)
+	listFlag(
+		&cfg.SPIFFEUpstreamIDs,
+		"spiffe-upstream-ids",
+		"Comma-separated SPIFFE IDs HTTPS targets may present, exact or ending with *. May be repeated.",
+	)
+	flag.StringVar(
+		&cfg.StickySessions,
+		"sticky-sessions",
+		cfg.StickySessions,
+		"Keep clients on the same target when several are configured: cookie, client-ip or header:<name>.",
+	)
+	flag.StringVar(
+		&cfg.StickyCookie,
+		"sticky-cookie",
+		cfg.StickyCookie,
+		"Cookie name used by cookie-based sticky sessions.",
+	)
+	flag.StringVar(
+		&cfg.LoadBalancing,
+		"load-balancing",
+		cfg.LoadBalancing,
+		"How targets are picked when several are configured: round-robin or latency (lowest dial latency first).",
+	)
+	flag.DurationVar(
+		&cfg.LatencyProbeInterval,
+		"latency-probe-interval",
+		cfg.LatencyProbeInterval,
+		"How often target latencies are probed when balancing by latency.",
+	)
+	flag.IntVar(
+		&cfg.TargetMaxConcurrency,
+		"target-max-concurrency",
+		cfg.TargetMaxConcurrency,
+		"Requests (connections in TCP mode) in flight per target; more wait in a queue (0 = unlimited).",
+	)
+	flag.IntVar(
+		&cfg.TargetQueueSize,
+		"target-queue-size",
+		cfg.TargetQueueSize,
+		"Requests waiting for a slot per target, with TARGET_MAX_CONCURRENCY; more are refused.",
+	)
+	flag.DurationVar(
+		&cfg.TargetQueueTimeout,
+		"target-queue-timeout",
+		cfg.TargetQueueTimeout,
+		"How long requests wait for a slot toward their target before being refused.",
+	)
+	boolFlag(
+		&cfg.TargetAdaptiveConcurrency,
+		"target-adaptive-concurrency",
+		"Adjust the concurrency limit of each target to its latency, up to TARGET_MAX_CONCURRENCY.",
+	)
+	flag.Float64Var(
+		&cfg.TargetLatencyTolerance,
+		"target-latency-tolerance",
+		cfg.TargetLatencyTolerance,
+		"Latency, relative to the lowest seen recently, at which a target is taken to be congested.",
+	)
+	boolFlag(
+		&cfg.OutlierDetection,
+		"outlier-detection",
+		"Temporarily eject targets with outlying error rates or latency from load balancing.",
+	)
+	flag.DurationVar(
+		&cfg.OutlierInterval,
+		"outlier-interval",
+		cfg.OutlierInterval,
+		"How often targets are evaluated for outlier detection.",
+	)
+	flag.DurationVar(
+		&cfg.OutlierEjectionTime,
+		"outlier-ejection-time",
+		cfg.OutlierEjectionTime,
+		"Base time an outlier is ejected for, multiplied by its consecutive ejections.",
+	)
+	flag.Float64Var(
+		&cfg.OutlierErrorRate,
+		"outlier-error-rate",
+		cfg.OutlierErrorRate,
+		"Error rate (0-1) above which a target is ejected.",
+	)
+	flag.Float64Var(
+		&cfg.OutlierLatencyFactor,
+		"outlier-latency-factor",
+		cfg.OutlierLatencyFactor,
+		"Eject targets whose p99 latency exceeds the median p99 of the other targets by this factor.",
+	)
+	flag.IntVar(
+		&cfg.OutlierMinRequests,
+		"outlier-min-requests",
+		cfg.OutlierMinRequests,
+		"Requests a target needs within an interval to be evaluated.",
+	)
+	flag.IntVar(
+		&cfg.OutlierMaxEjectedPercent,
+		"outlier-max-ejected-percent",
+		cfg.OutlierMaxEjectedPercent,
+		"Upper bound, in percent, of the targets ejected at once.",
+	)
+	flag.DurationVar(
+		&cfg.HealthCheckInterval,
+		"health-check-interval",
+		cfg.HealthCheckInterval,
+		"How often TCP targets are probed, with the TCP_PROTOCOL handshake if set (0 = disabled).",
+	)
+	flag.DurationVar(
+		&cfg.HealthCheckTimeout,
+		"health-check-timeout",
+		cfg.HealthCheckTimeout,
+		"Time limit of a health check probe.",
+	)
+	listFlag(
+		&cfg.HTTPMiddleware,
+		"http-middleware",
+		"Comma-separated middleware chain for HTTP requests (e.g., recover,request-id,access-log). May be repeated.",
+	)
+	flag.StringVar(
+		&cfg.HostHeader,
+		"host-header",
+		cfg.HostHeader,
+		"Host header of requests to the main target: target (the target's host, the default), preserve (the client's) or a host.",
+	)
+	listFlag(
+		&cfg.HTTPPlugins,
+		"http-plugins",
+		"Comma-separated paths of filter plugins (.so) to load as plugin:<name> middleware. May be repeated.",
+	)
+	flag.StringVar(
+		&cfg.TrailingSlash,
+		"trailing-slash",
+		cfg.TrailingSlash,
+		"Redirect HTTP requests to add or remove trailing slashes (add, remove).",
+	)
+	flag.StringVar(
+		&cfg.ConfigFile,
+		"config-file",
+		cfg.ConfigFile,
+		"YAML, JSON or TOML config file. Environment variables and flags take precedence.",
+	)
+	// Note: TSAuthKey, TailnetProxyAuthToken, RecordingKey and AdminToken are intentionally
+	// not exposed as flags for security reasons
+}
+
+// validateConfig performs validation checks on the configuration and determines
+// the ForwardTrafficType based on the configuration.
+func validateConfig(cfg *Config) []error {
+	var errors []error
+
+	// Validate required fields
+	if cfg.TSAuthKey == "" && !cfg.NoTailscale {
+		errors = append(errors, ErrMissingAuthKey)
+	}
+
+	// Validate the dial backend; without a tailnet, targets are dialed directly unless
+	// a proxy is given, and nothing may need the tsnet node
+	if err := validateDialBackend(cfg.DialBackend); err != nil {
+		errors = append(errors, err)
+	}
+	if cfg.NoTailscale {
+		if cfg.DialBackend == "" {
+			cfg.DialBackend = DialBackendDirect
+		}
+		errors = append(errors, validateNoTailscale(cfg)...)
+	}
+
+	// Target templates are expanded with the env file over the environment
+	if cfg.TargetEnvFile != "" {
+		if vars, err := readEnvFile(cfg.TargetEnvFile); err != nil {
+			errors = append(errors, fmt.Errorf("TARGET_ENV_FILE: %w", err))
+		} else {
+			cfg.TargetEnv = vars
+		}
+	}
+
+	// Determine ForwardTrafficType and validate accordingly
+	if cfg.ProxyMode {
+		cfg.ForwardTrafficType = ForwardTrafficTypeTailnetProxy
+	} else if cfg.TargetAddr == "" {
+		errors = append(errors, ErrMissingTargetAddr)
+	} else {
+		// Determine and validate the traffic type based on the target address
+		errors = append(errors, determineAndValidateTrafficType(cfg)...)
+	}
+
+	// Validate listen port
+	if err := validateListenPort(cfg.ListenPort); err != nil {
+		errors = append(errors, err)
+	}
+	if cfg.TailnetListenPort != "" {
+		if err := validateListenPort(cfg.TailnetListenPort); err != nil {
+			errors = append(errors, fmt.Errorf("TAILNET_LISTEN_PORT: %w", err))
+		}
+	}
+	if cfg.AcceptWorkers < 1 || cfg.ListenBacklog < 0 {
+		errors = append(errors, fmt.Errorf("%w: ACCEPT_WORKERS must be at least 1 and LISTEN_BACKLOG not negative",
+			ErrListenPortInvalid))
+	}
+
+	// Validate memory budget
+	if cfg.BufferBudgetMB < 0 || cfg.BufferBudgetWait < 0 {
+		errors = append(errors, fmt.Errorf("BUFFER_BUDGET_MB and BUFFER_BUDGET_WAIT must not be negative"))
+	}
+
+	// Validate connection lifetime
+	if cfg.MaxConnLifetime < 0 || cfg.MaxConnLifetimeGrace < 0 {
+		errors = append(errors, fmt.Errorf("MAX_CONN_LIFETIME and MAX_CONN_LIFETIME_GRACE must not be negative"))
+	}
+	if cfg.DrainTimeout < 0 {
+		errors = append(errors, fmt.Errorf("DRAIN_TIMEOUT must not be negative"))
+	}
+	if cfg.ReapIdleTCP < 0 || cfg.ReapIdleHTTP < 0 {
+		errors = append(errors, fmt.Errorf("REAP_IDLE_TCP and REAP_IDLE_HTTP must not be negative"))
+	}
+
+	// Validate warning thresholds
+	if cfg.SlowRequestThreshold < 0 || cfg.LargeTransferMB < 0 {
+		errors = append(errors, fmt.Errorf("SLOW_REQUEST_THRESHOLD and LARGE_TRANSFER_MB must not be negative"))
+	}
+	if err := validateSLOSettings(cfg); err != nil {
+		errors = append(errors, err)
+	}
+
+	// Validate profile dumps
+	if cfg.Capture != "" {
+		if _, err := parseCapture(cfg.Capture); err != nil {
+			errors = append(errors, err)
+		}
+		switch cfg.CaptureScope {
+		case CaptureScopeListener, CaptureScopeTailnet, CaptureScopeBoth:
+		default:
+			errors = append(errors, fmt.Errorf("%w: CAPTURE_SCOPE must be listener, tailnet or both, got '%s'",
+				ErrCaptureInvalid, cfg.CaptureScope))
+		}
+		if cfg.CaptureSnaplen < 0 || cfg.CaptureSample < 1 || cfg.CaptureMaxMB < 1 {
+			errors = append(errors, fmt.Errorf("%w: CAPTURE_SNAPLEN must not be negative, CAPTURE_SAMPLE and CAPTURE_MAX_MB must be positive",
+				ErrCaptureInvalid))
+		}
+	}
+
+	if cfg.ProfileRSSThresholdMB < 0 {
+		errors = append(errors, fmt.Errorf("PROFILE_RSS_THRESHOLD_MB must not be negative"))
+	}
+	if cfg.ProfileUploadURL != "" {
+		if err := validateHTTPAddress(cfg.ProfileUploadURL); err != nil {
+			errors = append(errors, fmt.Errorf("PROFILE_UPLOAD_URL: %w", err))
+		}
+	}
+
+	// Validate self-test
+	if cfg.SelfTest {
+		if !strings.HasPrefix(cfg.SelfTestPath, "/") {
+			errors = append(errors, fmt.Errorf("SELF_TEST_PATH must start with /, got '%s'", cfg.SelfTestPath))
+		}
+		if cfg.SelfTestStatus != 0 && (cfg.SelfTestStatus < 100 || cfg.SelfTestStatus > 599) {
+			errors = append(errors, fmt.Errorf("SELF_TEST_STATUS must be an HTTP status, got %d", cfg.SelfTestStatus))
+		}
+		if cfg.SelfTestTimeout <= 0 || cfg.SelfTestBannerTimeout < 0 {
+			errors = append(errors, fmt.Errorf("SELF_TEST_TIMEOUT must be positive and SELF_TEST_BANNER_TIMEOUT not negative"))
+		}
+	}
+
+	// Validate pre-warming
+	if cfg.PrewarmConnections < 0 {
+		errors = append(errors, fmt.Errorf("PREWARM_CONNECTIONS must not be negative"))
+	}
+	if !strings.HasPrefix(cfg.PrewarmPath, "/") {
+		errors = append(errors, fmt.Errorf("PREWARM_PATH must start with /, got '%s'", cfg.PrewarmPath))
+	}
+
+	// Validate Tailnet Proxy access control
+	errors = append(errors, validateProxyAccess(cfg)...)
+
+	// Validate Tailnet Proxy host mappings
+	if hosts, err := parseProxyHosts(cfg.TailnetProxyHosts); err != nil {
+		errors = append(errors, fmt.Errorf("TAILNET_PROXY_HOSTS: %w", err))
+	} else {
+		cfg.ProxyHosts = hosts
+	}
+
+	if cfg.TailnetProxyDNSCacheTTL <= 0 {
+		errors = append(errors, fmt.Errorf("TAILNET_PROXY_DNS_CACHE_TTL must be positive"))
+	}
+	if cfg.TailnetProxyLogSample < 1 || cfg.TailnetProxyMaxDestinations < 0 {
+		errors = append(errors, fmt.Errorf("TAILNET_PROXY_LOG_SAMPLE must be at least 1 and TAILNET_PROXY_MAX_DESTINATIONS not negative"))
+	}
+
+	// Validate Taildrop
+	if cfg.TaildropDir != "" && cfg.TaildropForwardURL != "" {
+		errors = append(errors, fmt.Errorf("TAILDROP_DIR and TAILDROP_FORWARD_URL are mutually exclusive"))
+	}
+	if cfg.TaildropForwardURL != "" {
+		if err := validateHTTPAddress(cfg.TaildropForwardURL); err != nil {
+			errors = append(errors, fmt.Errorf("TAILDROP_FORWARD_URL: %w", err))
+		}
+	}
+
+	// Validate event hooks
+	errors = append(errors, validateHooks(cfg)...)
+	errors = append(errors, validateUsageExport(cfg)...)
+
+	// Validate TCP options
+	if err := validateProxyProtocol(cfg.TCPProxyProtocol); err != nil {
+		errors = append(errors, fmt.Errorf("TCP_PROXY_PROTOCOL: %w", err))
+	}
+	if err := validateTCPProtocol(cfg.TCPProtocol); err != nil {
+		errors = append(errors, fmt.Errorf("TCP_PROTOCOL: %w", err))
+	}
+	if cfg.TCPAcceptProxyProtocol && (cfg.TCPProtocol == TCPProtocolSyslog || cfg.TCPProtocol == TCPProtocolFTP) {
+		errors = append(errors, fmt.Errorf("TCP_ACCEPT_PROXY_PROTOCOL: %w: not supported with TCP_PROTOCOL=%s",
+			ErrProxyProtocolInvalid, cfg.TCPProtocol))
+	}
+	if _, err := parseProxyPeers(cfg.TCPAcceptProxyFrom); err != nil {
+		errors = append(errors, fmt.Errorf("TCP_ACCEPT_PROXY_FROM: %w", err))
+	}
+	if cfg.TCPAcceptProxyProtocol && len(cfg.TCPAcceptProxyFrom) == 0 {
+		errors = append(errors, fmt.Errorf("TCP_ACCEPT_PROXY_FROM: %w: required with TCP_ACCEPT_PROXY_PROTOCOL, "+
+			"or any client could spoof its address", ErrProxyPeersInvalid))
+	}
+	if err := validateTCPProfile(cfg.TCPProfile); err != nil {
+		errors = append(errors, fmt.Errorf("TCP_PROFILE: %w", err))
+	}
+	if len(cfg.MQTTAllowedTopics) > 0 && cfg.TCPProtocol != TCPProtocolMQTT {
+		errors = append(errors, fmt.Errorf("MQTT_ALLOWED_TOPICS requires TCP_PROTOCOL=mqtt"))
+	} else if err := validateMQTTTopics(cfg.MQTTAllowedTopics); err != nil {
+		errors = append(errors, fmt.Errorf("MQTT_ALLOWED_TOPICS: %w", err))
+	}
+	ftpTunnels := false
+	for _, t := range cfg.Tunnels {
+		ftpTunnels = ftpTunnels || t.Protocol == TCPProtocolFTP
+	}
+	if passive, err := newFTPPassivePorts(cfg.FTPPassivePorts, cfg.FTPPassiveAddress); err != nil {
+		errors = append(errors, fmt.Errorf("FTP_PASSIVE_PORTS: %w", err))
+	} else if passive == nil && (cfg.TCPProtocol == TCPProtocolFTP || ftpTunnels) {
+		errors = append(errors, fmt.Errorf("TCP_PROTOCOL=ftp and ftp tunnels require FTP_PASSIVE_PORTS"))
+	}
+	if cfg.TCPIdleTimeout < 0 || cfg.TCPKeepalive < 0 {
+		errors = append(errors, fmt.Errorf("TCP_IDLE_TIMEOUT and TCP_KEEPALIVE must not be negative"))
+	}
+	if cfg.TCPMaxInflightKB < 0 {
+		errors = append(errors, fmt.Errorf("TCP_MAX_INFLIGHT_KB must not be negative"))
+	}
+	if cfg.TCPMaxConnsPerIP < 0 || cfg.TCPConnRatePerIP < 0 || cfg.TCPConnBurstPerIP < 0 {
+		errors = append(errors, fmt.Errorf("TCP_MAX_CONNS_PER_IP, TCP_CONN_RATE_PER_IP and TCP_CONN_BURST_PER_IP must not be negative"))
+	}
+	// Keepalive probes are sent every ninth of it, in whole seconds
+	if cfg.TCPDeadClientTimeout != 0 && cfg.TCPDeadClientTimeout < 9*time.Second {
+		errors = append(errors, fmt.Errorf("TCP_DEAD_CLIENT_TIMEOUT must be 0 or at least 9s, got %s", cfg.TCPDeadClientTimeout))
+	}
+	switch cfg.TargetIPFamily {
+	case IPFamilyAuto, IPFamilyIPv4, IPFamilyIPv6, IPFamilyPreferIPv4, IPFamilyPreferIPv6:
+	default:
+		errors = append(errors, fmt.Errorf("TARGET_IP_FAMILY must be auto, ipv4, ipv6, prefer-ipv4 or prefer-ipv6, got '%s'",
+			cfg.TargetIPFamily))
+	}
+	errors = append(errors, validateTargetHeader(cfg)...)
+	if hosts, err := parseStaticHosts(cfg.HostsFile, cfg.Hosts); err != nil {
+		errors = append(errors, fmt.Errorf("HOSTS_FILE or hosts: %w", err))
+	} else {
+		cfg.StaticHosts = hosts
+	}
+	if cfg.SyslogBatchSize < 1 || cfg.SyslogQueueSize < 1 || cfg.SyslogSpoolMaxMB < 1 {
+		errors = append(errors, fmt.Errorf("SYSLOG_BATCH_SIZE, SYSLOG_QUEUE_SIZE and SYSLOG_SPOOL_MAX_MB must be at least 1"))
+	}
+
+	// Validate local TLS termination
+	errors = append(errors, validateListenerTLS(cfg)...)
+	errors = append(errors, validateACME(cfg)...)
+
+	// Validate admin port
+	if cfg.AdminPort != "" {
+		if err := validateListenPort(cfg.AdminPort); err != nil {
+			errors = append(errors, fmt.Errorf("ADMIN_PORT: %w", err))
+		}
+	}
+	if cfg.AdminGRPCPort != "" {
+		if err := validateListenPort(cfg.AdminGRPCPort); err != nil {
+			errors = append(errors, fmt.Errorf("ADMIN_GRPC_PORT: %w", err))
+		} else if cfg.AdminGRPCPort == cfg.AdminPort {
+			errors = append(errors, fmt.Errorf("ADMIN_GRPC_PORT must differ from ADMIN_PORT"))
+		}
+	}
+	if cfg.AdminNetwork != AdminNetworkLocal && cfg.AdminNetwork != AdminNetworkTailnet {
+		errors = append(errors, fmt.Errorf("ADMIN_NETWORK must be local or tailnet, got '%s'", cfg.AdminNetwork))
+	}
+	// Anyone reaching the port could otherwise add tunnels into the tailnet and mint tokens
+	if (cfg.AdminPort != "" || cfg.AdminGRPCPort != "") && cfg.AdminNetwork == AdminNetworkLocal && cfg.AdminToken == "" {
+		errors = append(errors, fmt.Errorf("ADMIN_TOKEN is required to serve the admin API with ADMIN_NETWORK=local, "+
+			"set it or ADMIN_NETWORK=tailnet"))
+	}
+	if cfg.StatsHistory < 0 || cfg.StatsHistory > 24*time.Hour {
+		errors = append(errors, fmt.Errorf("STATS_HISTORY must be between 0 and 24h, got %s", cfg.StatsHistory))
+	}
+	if cfg.DebugConsolePort != "" {
+		if err := validateListenPort(cfg.DebugConsolePort); err != nil {
+			errors = append(errors, fmt.Errorf("DEBUG_CONSOLE_PORT: %w", err))
+		}
+	}
+
+	// Load filter plugins, so that they can be referenced as middleware
+	if err := loadFilterPlugins(cfg.HTTPPlugins); err != nil {
+		errors = append(errors, err)
+	}
+
+	// Validate load balancing
+	if sticky, err := parseStickyPolicy(cfg.StickySessions); err != nil {
+		errors = append(errors, err)
+	} else {
+		cfg.Sticky = sticky
+	}
+	switch cfg.LoadBalancing {
+	case LoadBalancingRoundRobin:
+	case LoadBalancingLatency:
+		if cfg.LatencyProbeInterval <= 0 {
+			errors = append(errors, fmt.Errorf("LATENCY_PROBE_INTERVAL must be positive, got %s", cfg.LatencyProbeInterval))
+		}
+	default:
+		errors = append(errors, fmt.Errorf("%w: expected round-robin or latency, got '%s'",
+			ErrLoadBalancingInvalid, cfg.LoadBalancing))
+	}
+
+	if cfg.TargetMaxConcurrency < 0 || cfg.TargetQueueSize < 0 || cfg.TargetQueueTimeout <= 0 {
+		errors = append(errors, fmt.Errorf("TARGET_MAX_CONCURRENCY and TARGET_QUEUE_SIZE must not be negative and TARGET_QUEUE_TIMEOUT must be positive"))
+	}
+	if cfg.TargetAdaptiveConcurrency && cfg.TargetMaxConcurrency == 0 {
+		errors = append(errors, fmt.Errorf("TARGET_ADAPTIVE_CONCURRENCY requires TARGET_MAX_CONCURRENCY as the upper bound of the limit"))
+	}
+	if cfg.TargetLatencyTolerance <= 1 {
+		errors = append(errors, fmt.Errorf("TARGET_LATENCY_TOLERANCE must be greater than 1, got %g", cfg.TargetLatencyTolerance))
+	}
+
+	if cfg.OutlierDetection {
+		if err := validateOutlierSettings(cfg); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if cfg.WebhookSpoolDir != "" {
+		if cfg.ForwardTrafficType != ForwardTrafficTypeHTTP && cfg.ForwardTrafficType != ForwardTrafficTypeHTTPS {
+			errors = append(errors, fmt.Errorf("WEBHOOK_SPOOL_DIR only applies to HTTP mode"))
+		}
+		if cfg.WebhookSpoolMaxMB < 1 || cfg.WebhookSpoolMaxBodyMB < 1 {
+			errors = append(errors, fmt.Errorf("WEBHOOK_SPOOL_MAX_MB and WEBHOOK_SPOOL_MAX_BODY_MB must be at least 1"))
+		}
+	}
+	if err := cfg.WebhookDedup().validate(); err != nil {
+		errors = append(errors, fmt.Errorf("WEBHOOK_DEDUP_TTL: %w", err))
+	} else if cfg.WebhookDedupTTL > 0 && cfg.ForwardTrafficType != ForwardTrafficTypeHTTP && cfg.ForwardTrafficType != ForwardTrafficTypeHTTPS {
+		errors = append(errors, fmt.Errorf("WEBHOOK_DEDUP_TTL only applies to HTTP mode"))
+	}
+	if _, err := parseAccessWindow(cfg.AllowedHours); err != nil {
+		errors = append(errors, fmt.Errorf("ALLOWED_HOURS: %w", err))
+	} else if cfg.AllowedHours != "" && cfg.ForwardTrafficType == ForwardTrafficTypeTCP && cfg.TCPProtocol == TCPProtocolSyslog {
+		errors = append(errors, fmt.Errorf("ALLOWED_HOURS does not apply to syslog forwarding"))
+	}
+
+	recordsTunnels, tokensRequired := false, cfg.RequireToken
+	for _, t := range cfg.Tunnels {
+		recordsTunnels = recordsTunnels || t.Record
+		tokensRequired = tokensRequired || t.RequireToken
+	}
+	if tokensRequired && cfg.AdminPort == "" && cfg.AdminGRPCPort == "" {
+		errors = append(errors, fmt.Errorf("requiring tunnel tokens requires ADMIN_PORT or ADMIN_GRPC_PORT to be set, to mint them"))
+	}
+	if cfg.RequireToken && cfg.ForwardTrafficType == ForwardTrafficTypeTCP && cfg.TCPProtocol == TCPProtocolSyslog {
+		errors = append(errors, fmt.Errorf("REQUIRE_TOKEN does not apply to syslog forwarding"))
+	}
+	if cfg.TokenMaxTTL <= 0 {
+		errors = append(errors, fmt.Errorf("TOKEN_MAX_TTL must be positive, got %s", cfg.TokenMaxTTL))
+	}
+	if cfg.Record && cfg.ForwardTrafficType != ForwardTrafficTypeTCP {
+		errors = append(errors, fmt.Errorf("RECORD only applies to TCP mode"))
+	}
+	if (cfg.Record || recordsTunnels) && cfg.RecordingDir == "" {
+		errors = append(errors, ErrRecordingDisabled)
+	}
+	if cfg.RecordingDir != "" {
+		if _, err := parseRecordingKey(cfg.RecordingKey); err != nil {
+			errors = append(errors, err)
+		}
+		if cfg.RecordingMaxMB < 1 || cfg.RecordingRetention < 0 {
+			errors = append(errors, fmt.Errorf("RECORDING_MAX_MB must be at least 1 and RECORDING_RETENTION must not be negative"))
+		}
+	}
+	if cfg.VerifyTarget != "" {
+		if cfg.ForwardTrafficType != ForwardTrafficTypeHTTP && cfg.ForwardTrafficType != ForwardTrafficTypeHTTPS {
+			errors = append(errors, fmt.Errorf("VERIFY_TARGET only applies to HTTP mode"))
+		} else if trafficTypeOf(cfg.VerifyTarget) == ForwardTrafficTypeTCP {
+			errors = append(errors, fmt.Errorf("VERIFY_TARGET must be an HTTP(S) URL, got '%s'", cfg.VerifyTarget))
+		} else if err := validateHTTPAddress(cfg.VerifyTarget); err != nil {
+			errors = append(errors, fmt.Errorf("VERIFY_TARGET: %w", err))
+		}
+		if cfg.VerifySample <= 0 || cfg.VerifySample > 1 {
+			errors = append(errors, fmt.Errorf("VERIFY_SAMPLE must be in (0, 1], got %g", cfg.VerifySample))
+		}
+		if cfg.VerifyMaxBodyMB < 0 || cfg.VerifyTimeout <= 0 {
+			errors = append(errors, fmt.Errorf("VERIFY_MAX_BODY_MB must not be negative and VERIFY_TIMEOUT must be positive"))
+		}
+	}
+	if cfg.HealthCheckInterval < 0 || cfg.HealthCheckTimeout <= 0 {
+		errors = append(errors, fmt.Errorf("HEALTH_CHECK_INTERVAL must not be negative and HEALTH_CHECK_TIMEOUT must be positive"))
+	} else if cfg.HealthCheckInterval > 0 && cfg.ForwardTrafficType != ForwardTrafficTypeTCP {
+		errors = append(errors, fmt.Errorf("HEALTH_CHECK_INTERVAL only applies to TCP mode"))
+	}
+
+	// Validate middleware and routes
+	if _, err := middleware.Chain(cfg.HTTPMiddleware...); err != nil {
+		errors = append(errors, fmt.Errorf("HTTP_MIDDLEWARE: %w", err))
+	}
+	if err := validateHostHeader(cfg.HostHeader); err != nil {
+		errors = append(errors, fmt.Errorf("HOST_HEADER: %w", err))
+	}
+	for _, rc := range cfg.Routes {
+		if err := rc.validate(); err != nil {
+			errors = append(errors, err)
+		} else if len(rc.ClientIdentities) > 0 && cfg.TLSClientCAFile == "" && !cfg.TLSClientSPIFFE {
+			errors = append(errors, fmt.Errorf("%w: %s: client_identities requires TLS_CLIENT_CA_FILE or TLS_CLIENT_SPIFFE",
+				ErrRouteInvalid, rc.Name))
+		}
+	}
+
+	if err := cfg.UnmatchedRoute.validate(); err != nil {
+		errors = append(errors, err)
+	}
+
+	// Validate URL rules
+	if _, err := newURLRules(cfg); err != nil {
+		errors = append(errors, err)
+	}
+	if _, err := newBodyTransforms(cfg.Transforms); err != nil {
+		errors = append(errors, err)
+	}
+
+	// Validate tenants
+	tenantNames := make(map[string]bool)
+	for _, tc := range cfg.Tenants {
+		if err := tc.validate(); err != nil {
+			errors = append(errors, err)
+		} else if tenantNames[tc.Name] {
+			errors = append(errors, fmt.Errorf("%w: %s: name is used by another tenant", ErrTenantInvalid, tc.Name))
+		}
+		tenantNames[tc.Name] = true
+	}
+	if cfg.TenantRequired && len(cfg.Tenants) == 0 {
+		errors = append(errors, fmt.Errorf("TENANT_REQUIRED requires tenants in the config file"))
+	}
+
+	// Validate tunnels from the config file
+	for _, t := range cfg.Tunnels {
+		if err := t.validate(); err != nil {
+			errors = append(errors, fmt.Errorf("tunnel %d: %w", t.Listen, err))
+		} else if t.Tenant != "" && !tenantNames[t.Tenant] {
+			errors = append(errors, fmt.Errorf("tunnel %d: %w: %s", t.Listen, ErrTenantNotFound, t.Tenant))
+		}
+	}
+
+	// Validate outbound transport tuning
+	errors = append(errors, validateTransportSettings(cfg)...)
+	errors = append(errors, validateSPIFFE(cfg)...)
+
+	return errors
+}
+
+// determineAndValidateTrafficType determines the ForwardTrafficType from the TargetAddr
+// and validates the address format accordingly. TargetAddr may list several targets,
+// separated by commas, which must all be HTTP(S) URLs or all be TCP addresses.
+func determineAndValidateTrafficType(cfg *Config) []error {
+	var errors_ []error
+
+	cfg.Targets = splitList(cfg.TargetAddr)
+	if len(cfg.Targets) == 0 {
+		return []error{ErrMissingTargetAddr}
+	}
+
+	// Targets are validated as they expand now; templates are expanded again on every dial
+	expanded := make([]string, 0, len(cfg.Targets))
+	for _, target := range cfg.Targets {
+		target, err := cfg.expandTarget(target)
+		if err != nil {
+			errors_ = append(errors_, fmt.Errorf("%w: %w", ErrTargetAddrInvalid, err))
+			continue
+		}
+		expanded = append(expanded, target)
+	}
+	if len(expanded) == 0 {
+		return errors_
+	}
+
+	// Determine type based on protocol prefix of the first target
+	cfg.ForwardTrafficType = trafficTypeOf(expanded[0])
+
+	// Validate based on type
+	isHTTP := cfg.ForwardTrafficType == ForwardTrafficTypeHTTP || cfg.ForwardTrafficType == ForwardTrafficTypeHTTPS
+	for _, target := range expanded {
+		if targetIsHTTP := trafficTypeOf(target) != ForwardTrafficTypeTCP; targetIsHTTP != isHTTP {
+			errors_ = append(errors_, fmt.Errorf("%w: cannot mix HTTP(S) and TCP targets ('%s')",
+				ErrTargetAddrInvalid, target))
+			continue
+		}
+
+		if isHTTP {
+			if err := validateHTTPAddress(target); err != nil {
+				errors_ = append(errors_, err)
+			}
+		} else {
+			if err := validateTCPAddress(target); err != nil {
+				errors_ = append(errors_, err)
+			}
+		}
+	}
+
+	return errors_
+}
+
+// expandTarget expands the template of target with TARGET_ENV_FILE over the environment.
+func (cfg *Config) expandTarget(target string) (string, error) {
+	return expandTargetWith(target, func(name string) (string, bool) {
+		if value, ok := cfg.TargetEnv[name]; ok {
+			return value, true
+		}
+		return os.LookupEnv(name)
+	})
+}
+
+// validateTargetHeader validates the selection of HTTP targets from TARGET_HEADER.
+func validateTargetHeader(cfg *Config) []error {
+	cfg.HeaderTargets = nil
+	for _, target := range splitList(cfg.TargetHeaderAllowed) {
+		cfg.HeaderTargets = append(cfg.HeaderTargets, strings.TrimRight(target, "/"))
+	}
+	if cfg.TargetHeader == "" && len(cfg.HeaderTargets) == 0 {
+		return nil
+	}
+
+	isHTTP := cfg.ForwardTrafficType == ForwardTrafficTypeHTTP || cfg.ForwardTrafficType == ForwardTrafficTypeHTTPS
+	switch {
+	case !isHTTP:
+		return []error{fmt.Errorf("TARGET_HEADER requires HTTP(S) targets")}
+	case cfg.TargetHeader == "":
+		return []error{fmt.Errorf("TARGET_HEADER_ALLOWED requires TARGET_HEADER")}
+	case len(cfg.HeaderTargets) == 0:
+		return []error{fmt.Errorf("TARGET_HEADER requires TARGET_HEADER_ALLOWED, the targets it may select")}
+	}
+
+	var errors_ []error
+	for _, target := range cfg.HeaderTargets {
+		expanded, err := cfg.expandTarget(target)
+		if err == nil {
+			err = validateHTTPAddress(expanded)
+		}
+		if err == nil && trafficTypeOf(expanded) == ForwardTrafficTypeTCP {
+			err = fmt.Errorf("%w: an HTTP(S) URL is required (%s)", ErrTargetAddrInvalid, target)
+		}
+		if err != nil {
+			errors_ = append(errors_, fmt.Errorf("TARGET_HEADER_ALLOWED: %w", err))
+		}
+	}
+
+	return errors_
+}
+
+// trafficTypeOf determines the ForwardTrafficType of a single target address from its
+// protocol prefix.
+func trafficTypeOf(addr string) ForwardTrafficType {
+	protocol := ""
+	parts := strings.SplitN(addr, "://", 2)
+	if len(parts) > 1 {
+		protocol = strings.ToLower(parts[0])
+	}
+
+	switch protocol {
+	case "http":
+		return ForwardTrafficTypeHTTP
+
+	case "https":
+		return ForwardTrafficTypeHTTPS
+
+	default:
+		return ForwardTrafficTypeTCP
+	}
+}
+
+// validateHTTPAddress validates that the given address is a valid HTTP(S) URL. IPv6
+// hosts must be in brackets, like http://[fd7a:115c:a1e0::1]:8080.
+func validateHTTPAddress(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrTargetAddrInvalid, err)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("%w: missing host in URL (%s)", ErrTargetAddrInvalid, addr)
+	}
+	// url.Parse takes the last colon of an unbracketed IPv6 address for a port
+	if strings.Contains(u.Hostname(), ":") && !strings.HasPrefix(u.Host, "[") {
+		return fmt.Errorf("%w: IPv6 addresses must be in brackets, like http://[fd7a:115c:a1e0::1]:8080 (%s)",
+			ErrTargetAddrInvalid, addr)
+	}
+	if err := validateHost(u.Hostname()); err != nil {
+		return fmt.Errorf("%w: %w (%s)", ErrTargetAddrInvalid, err, addr)
+	}
+	if port := u.Port(); port != "" {
+		if err := validatePort(port); err != nil {
+			return fmt.Errorf("%w: %w (%s)", ErrTargetAddrInvalid, err, addr)
+		}
+	}
+
+	return nil
+}
+
+// validateTCPAddress validates that the given address is a valid TCP address (host:port).
+// IPv6 hosts must be in brackets, like [fd7a:115c:a1e0::1]:5432.
+func validateTCPAddress(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+			return fmt.Errorf("%w for TCP mode ('%s'): IPv6 addresses must be in brackets, like [fd7a:115c:a1e0::1]:5432",
+				ErrTargetAddrInvalid, addr)
+		}
+		return fmt.Errorf("%w for TCP mode ('%s'): %w. Expected host:port",
+			ErrTargetAddrInvalid, addr, err)
+	}
+	if host == "" {
+		return fmt.Errorf("%w for TCP mode ('%s'): missing host. Expected host:port", ErrTargetAddrInvalid, addr)
+	}
+	if err := validateHost(host); err != nil {
+		return fmt.Errorf("%w for TCP mode ('%s'): %w", ErrTargetAddrInvalid, addr, err)
+	}
+	if err := validatePort(port); err != nil {
+		return fmt.Errorf("%w for TCP mode ('%s'): %w", ErrTargetAddrInvalid, addr, err)
+	}
+
+	return nil
+}
+
+// validateHost checks that a host with colons, which can only be an IPv6 address, is
+// a valid one. Names are left for the resolver to judge.
+func validateHost(host string) error {
+	if !strings.Contains(host, ":") {
+		return nil
+	}
+	if _, err := netip.ParseAddr(host); err != nil {
+		return fmt.Errorf("invalid IPv6 address '%s'", host)
+	}
+
+	return nil
+}
+
+// validatePort checks that port is a port number, 1 to 65535.
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port '%s', must be between 1 and 65535", port)
+	}
+
+	return nil
+}
+
+// validateListenPort validates that the listen port is a valid port number.
+func validateListenPort(port string) error {
+	if port == "" {
+		return errors.New("LISTEN_PORT is required")
+	}
+
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrListenPortInvalid, port, err)
+	}
+
+	if portNum < 1 || portNum > 65535 {
+		return fmt.Errorf("%w: %s: port must be between 1 and 65535",
+			ErrListenPortInvalid, port)
+	}
+
+	return nil
+}
+
+// validateTransportSettings validates the outbound transport tuning and parses the
+// per-target overrides into cfg.TransportOverrides.
+func validateTransportSettings(cfg *Config) []error {
+	var errors_ []error
+
+	if cfg.HTTPMaxIdleConns < 0 || cfg.HTTPMaxIdleConnsPerHost < 0 || cfg.HTTPMaxConnsPerHost < 0 {
+		errors_ = append(errors_, errors.New("HTTP connection limits must not be negative"))
+	}
+
+	if cfg.UpstreamProxy != "" {
+		if err := validateUpstreamProxy(cfg.UpstreamProxy); err != nil {
+			errors_ = append(errors_, fmt.Errorf("UPSTREAM_PROXY: %w", err))
+		}
+	}
+
+	overrides, err := parseTransportOverrides(cfg.HTTPTransportOverrides, cfg.TransportSettings())
+	if err != nil {
+		errors_ = append(errors_, err)
+		overrides = make(map[string]TransportSettings)
+	}
+	cfg.TransportOverrides = overrides
+
+	// Routes with an upstream proxy reach their targets through it. Transports are picked
+	// by target, so routes sharing a target must agree on the proxy.
+	routeProxies := make(map[string]string)
+	for _, rc := range cfg.allRoutes() {
+		if rc.UpstreamProxy == "" {
+			continue
+		}
+		for _, target := range splitList(rc.Target) {
+			u, err := url.Parse(target)
+			if err != nil {
+				continue // reported with the route
+			}
+			key := targetKey(u.Scheme, u.Host)
+			if proxy, ok := routeProxies[key]; ok && proxy != rc.UpstreamProxy {
+				errors_ = append(errors_, fmt.Errorf("%w: %s: %s is reached through another upstream proxy by another route",
+					ErrRouteInvalid, rc.Name, key))
+				continue
+			}
+			routeProxies[key] = rc.UpstreamProxy
+
+			settings, ok := overrides[key]
+			if !ok {
+				settings = cfg.TransportSettings()
+			}
+			settings.UpstreamProxy = rc.UpstreamProxy
+			overrides[key] = settings
+		}
+	}
+
+	// Load certificates now, so unreadable files fail at startup with the other errors
+	for target, settings := range overrides {
+		if _, err := settings.TLSConfig(); err != nil {
+			errors_ = append(errors_, fmt.Errorf("%w: %s: %w", ErrTransportOverrideInvalid, target, err))
+		}
+	}
+
+	return errors_
+}
+
+// validateOutlierSettings checks the outlier detection thresholds.
+func validateOutlierSettings(cfg *Config) error {
+	switch {
+	case cfg.OutlierInterval <= 0 || cfg.OutlierEjectionTime <= 0:
+		return fmt.Errorf("%w: interval and ejection time must be positive", ErrOutlierSettingsInvalid)
+	case cfg.OutlierErrorRate <= 0 || cfg.OutlierErrorRate > 1:
+		return fmt.Errorf("%w: error rate must be within (0, 1], got %g", ErrOutlierSettingsInvalid, cfg.OutlierErrorRate)
+	case cfg.OutlierLatencyFactor != 0 && cfg.OutlierLatencyFactor <= 1:
+		return fmt.Errorf("%w: latency factor must be above 1 (or 0 to disable), got %g",
+			ErrOutlierSettingsInvalid, cfg.OutlierLatencyFactor)
+	case cfg.OutlierMinRequests < 1:
+		return fmt.Errorf("%w: min requests must be at least 1", ErrOutlierSettingsInvalid)
+	case cfg.OutlierMaxEjectedPercent < 0 || cfg.OutlierMaxEjectedPercent > 100:
+		return fmt.Errorf("%w: max ejected percent must be within [0, 100]", ErrOutlierSettingsInvalid)
+	}
+
+	return nil
+}
+
+// boolFlag registers a boolean flag along with its negation, -no-<name>, so that a
+// setting enabled by the environment or config file can be turned off explicitly.
+func boolFlag(p *bool, name, usage string) {
+	flag.BoolVar(p, name, *p, usage)
+	flag.Var(negatedBool{p}, "no-"+name, "Disable -"+name+".")
+}
+
+// negatedBool is a boolean flag.Value storing the inverse of its value.
+type negatedBool struct{ p *bool }
+
+func (b negatedBool) IsBoolFlag() bool { return true }
+
+func (b negatedBool) String() string {
+	if b.p == nil {
+		return "false"
+	}
+	return strconv.FormatBool(!*b.p)
+}
+
+func (b negatedBool) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*b.p = !v
+	return nil
+}
+
+// isExplicit reports whether a setting was given explicitly, as a command-line flag or
+// an environment variable. A variable set to an empty string counts as explicit.
+func isExplicit(flagName, env string) bool {
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == flagName {
+			explicit = true
+		}
+	})
+	if _, ok := os.LookupEnv(env); ok {
+		explicit = true
+	}
+
+	return explicit
+}
+
+// listFlag registers a comma-separated list flag. The flag may be repeated: the first
+// use replaces the value from the environment or config file, later uses append to it.
+func listFlag(p *[]string, name, usage string) {
+	set := false
+	flag.Func(name, usage, func(value string) error {
+		if !set {
+			*p, set = nil, true
+		}
+		*p = append(*p, splitList(value)...)
+		return nil
+	})
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
 }
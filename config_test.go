@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestValidateTCPAddress(t *testing.T) {
+	tests := []struct {
+		addr  string
+		valid bool
+	}{
+		{"db.tailnet.ts.net:5432", true},
+		{"100.64.0.1:5432", true},
+		{"[fd7a:115c:a1e0::1]:443", true},
+		{"[::1]:22", true},
+		{"[fd7a:115c:a1e0::1%eth0]:443", true},
+		{"fd7a:115c:a1e0::1:443", false}, // unbracketed
+		{"[fd7a:115c:a1e0::zz]:443", false},
+		{"[fd7a:115c:a1e0::1]", false}, // no port
+		{"[fd7a:115c:a1e0::1]:0", false},
+		{"[fd7a:115c:a1e0::1]:65536", false},
+		{"[fd7a:115c:a1e0::1]:https", false},
+		{":5432", false},
+		{"db", false},
+	}
+	for _, tt := range tests {
+		err := validateTCPAddress(tt.addr)
+		if tt.valid && err != nil {
+			t.Errorf("validateTCPAddress(%q) = %v, want nil", tt.addr, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrTargetAddrInvalid) {
+			t.Errorf("validateTCPAddress(%q) = %v, want %v", tt.addr, err, ErrTargetAddrInvalid)
+		}
+	}
+}
+
+func TestValidateHTTPAddress(t *testing.T) {
+	tests := []struct {
+		addr  string
+		valid bool
+	}{
+		{"http://web.tailnet.ts.net", true},
+		{"https://100.64.0.1:8443", true},
+		{"http://[fd7a:115c:a1e0::1]:8080", true},
+		{"http://[fd7a:115c:a1e0::1]", true},
+		{"https://[::1]:8443/api", true},
+		{"http://fd7a:115c:a1e0::1:8080", false}, // unbracketed
+		{"http://[fd7a:115c:a1e0::zz]:8080", false},
+		{"http://[fd7a:115c:a1e0::1]:0", false},
+		{"http://[fd7a:115c:a1e0::1]:70000", false},
+		{"http://", false},
+	}
+	for _, tt := range tests {
+		err := validateHTTPAddress(tt.addr)
+		if tt.valid && err != nil {
+			t.Errorf("validateHTTPAddress(%q) = %v, want nil", tt.addr, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrTargetAddrInvalid) {
+			t.Errorf("validateHTTPAddress(%q) = %v, want %v", tt.addr, err, ErrTargetAddrInvalid)
+		}
+	}
+}
+
+// parseArgs loads the config from the environment, then applies args as railtail's
+// command-line flags.
+func parseArgs(t *testing.T, args ...string) *Config {
+	t.Helper()
+
+	commandLine := flag.CommandLine
+	flag.CommandLine = flag.NewFlagSet("railtail", flag.ContinueOnError)
+	t.Cleanup(func() { flag.CommandLine = commandLine })
+	t.Setenv("CONFIG_FILE", "")
+
+	cfg, errs := loadEnvironmentConfig()
+	if len(errs) > 0 {
+		t.Fatalf("failed to load config: %v", errs)
+	}
+	defineFlags(cfg)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+
+	return cfg
+}
+
+// setenv sets the environment variable key to value for the test, or unsets it if value
+// is empty.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+
+	t.Setenv(key, value)
+	if value == "" {
+		_ = os.Unsetenv(key)
+	}
+}
+
+func TestListFlag(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want []string
+	}{
+		{"environment", "a.ts.net,*.b.ts.net", nil, []string{"a.ts.net", "*.b.ts.net"}},
+		{"comma-separated", "", []string{"-tailnet-proxy-allowed-hosts", "a.ts.net,,b.ts.net "},
+			[]string{"a.ts.net", "b.ts.net"}},
+		{"repeated", "", []string{"-tailnet-proxy-allowed-hosts=a.ts.net", "-tailnet-proxy-allowed-hosts=b.ts.net,c.ts.net"},
+			[]string{"a.ts.net", "b.ts.net", "c.ts.net"}},
+		{"flag replaces environment", "a.ts.net", []string{"-tailnet-proxy-allowed-hosts=b.ts.net"},
+			[]string{"b.ts.net"}},
+		{"repeated flag replaces environment", "a.ts.net",
+			[]string{"-tailnet-proxy-allowed-hosts=b.ts.net", "-tailnet-proxy-allowed-hosts=c.ts.net"},
+			[]string{"b.ts.net", "c.ts.net"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "TAILNET_PROXY_ALLOWED_HOSTS", tt.env)
+			cfg := parseArgs(t, tt.args...)
+			if !slices.Equal(cfg.TailnetProxyAllowedHosts, tt.want) {
+				t.Errorf("TailnetProxyAllowedHosts = %q, want %q", cfg.TailnetProxyAllowedHosts, tt.want)
+			}
+		})
+	}
+}
+
+func TestBoolFlag(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want bool
+	}{
+		{"default", "", nil, false},
+		{"environment", "true", nil, true},
+		{"without a value", "", []string{"-allow-open-proxy"}, true},
+		{"with a value", "true", []string{"-allow-open-proxy=false"}, false},
+		{"negated", "true", []string{"-no-allow-open-proxy"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "ALLOW_OPEN_PROXY", tt.env)
+			if cfg := parseArgs(t, tt.args...); cfg.AllowOpenProxy != tt.want {
+				t.Errorf("AllowOpenProxy = %v, want %v", cfg.AllowOpenProxy, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ilyakaznacheev/cleanenv"
+	"gopkg.in/yaml.v3"
+)
+
+// durationPattern matches the durations time.ParseDuration accepts, like 1m30s.
+const durationPattern = `^-?(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`
+
+// schemaDescriptions describe the config file keys without a flag to take the usage of.
+var schemaDescriptions = map[string]string{
+	"ts_authkey":               "Tailscale auth key. Better kept out of the file, in TS_AUTHKEY.",
+	"ts_statedir_path":         "Directory to store Tailscale state.",
+	"tailnet_proxy_auth_token": "Token clients must send as Proxy-Authorization in Tailnet Proxy mode.",
+	"recording_key":            "32-byte key recordings are encrypted with, hex or base64 encoded.",
+	"admin_token":              "Bearer token the admin APIs require. Better kept out of the file, in ADMIN_TOKEN.",
+	"routes":                   "Host and path routes of HTTP requests.",
+	"redirects":                "Redirect rules, applied before routing.",
+	"rewrites":                 "Rewrite rules, applied before routing.",
+	"transforms":               "JSON body transformations, applied on the way to the target.",
+	"tunnels":                  "Additional tunnels, each on a port of its own.",
+	"tenants":                  "Tenants sharing this railtail.",
+	"hosts":                    "Addresses of target names, comma-separated, resolved before MagicDNS and DNS.",
+}
+
+// unknownFieldMessage matches the errors of yaml.v3 about unknown keys, naming Go types.
+var unknownFieldMessage = regexp.MustCompile(`field (\S+) not found in type \S+`)
+
+const configUsage = "usage: railtail config schema | railtail config validate FILE"
+
+// configCommand implements `railtail config schema`, which prints a JSON Schema of the
+// config file for editors, and `railtail config validate FILE`, which checks a config file
+// offline for CI pipelines. It returns the process exit code.
+func configCommand(args []string) int {
+	switch {
+	case len(args) == 1 && args[0] == "schema":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(configSchema()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	case len(args) == 2 && args[0] == "validate":
+		return validateConfigCommand(args[1])
+	default:
+		fmt.Fprintln(os.Stderr, configUsage)
+		return 2
+	}
+}
+
+// validateConfigCommand checks the config file at path the way railtail checks its
+// configuration on start, without connecting to the tailnet, and reports keys railtail
+// does not know. Environment variables apply on top of the file, as at runtime.
+func validateConfigCommand(path string) int {
+	var cfg Config
+	if err := cleanenv.ReadConfig(path, &cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s: %v\n", path, err)
+		return 1
+	}
+	cfg.ConfigFile = path
+
+	errs := unknownConfigKeys(path)
+	// The auth key is a secret, usually given through the environment where railtail runs
+	errs = append(errs, slices.DeleteFunc(validateConfig(&cfg), func(err error) bool {
+		return errors.Is(err, ErrMissingAuthKey)
+	})...)
+
+	var warnings []error
+	if len(errs) == 0 {
+		warnings = configWarnings(&cfg)
+		if cfg.Strict {
+			errs, warnings = warnings, nil
+		}
+	}
+	for _, err := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "error:", err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+
+	fmt.Printf("%s is valid\n", path)
+	return 0
+}
+
+// unknownConfigKeys returns an error for the keys of a YAML config file that railtail does
+// not know, likely typos that would otherwise be ignored.
+func unknownConfigKeys(path string) []error {
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".yaml" && ext != ".yml" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []error{err}
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return []error{err}
+		}
+		errs := make([]error, 0, len(typeErr.Errors))
+		for _, msg := range typeErr.Errors {
+			msg = unknownFieldMessage.ReplaceAllString(msg, "unknown key $1")
+			errs = append(errs, fmt.Errorf("%s: %s", path, msg))
+		}
+		return errs
+	}
+
+	return nil
+}
+
+// configSchema returns the JSON Schema of the config file, built from the yaml and env
+// tags of Config, with the flag usages as descriptions.
+func configSchema() map[string]any {
+	defineFlags(&Config{})
+
+	schema := schemaOf(reflect.TypeOf(Config{}), "")
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "railtail configuration"
+
+	return schema
+}
+
+// schemaOf returns the JSON Schema of values of type t, defaulting to def, an env-default
+// tag value.
+func schemaOf(t reflect.Type, def string) map[string]any {
+	schema := map[string]any{}
+
+	switch {
+	case t == reflect.TypeOf(time.Duration(0)):
+		schema["type"] = "string"
+		schema["pattern"] = durationPattern
+		if def != "" {
+			schema["default"] = def
+		}
+	case t.Kind() == reflect.Bool:
+		schema["type"] = "boolean"
+		if v, err := strconv.ParseBool(def); err == nil {
+			schema["default"] = v
+		}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		schema["type"] = "integer"
+		if v, err := strconv.Atoi(def); err == nil {
+			schema["default"] = v
+		}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		schema["type"] = "number"
+		if v, err := strconv.ParseFloat(def, 64); err == nil {
+			schema["default"] = v
+		}
+	case t.Kind() == reflect.String:
+		schema["type"] = "string"
+		if def != "" {
+			schema["default"] = def
+		}
+	case t.Kind() == reflect.Slice:
+		schema["type"] = "array"
+		schema["items"] = schemaOf(t.Elem(), "")
+		if def != "" {
+			schema["default"] = splitList(def)
+		}
+	case t.Kind() == reflect.Map:
+		schema["type"] = "object"
+		schema["additionalProperties"] = schemaOf(t.Elem(), "")
+	case t.Kind() == reflect.Struct:
+		properties := map[string]any{}
+		for i := range t.NumField() {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+
+			property := schemaOf(field.Type, field.Tag.Get("env-default"))
+			if description, ok := schemaDescriptions[name]; ok {
+				property["description"] = description
+			} else if env := field.Tag.Get("env"); env != "" {
+				if f := flag.Lookup(strings.ReplaceAll(strings.ToLower(env), "_", "-")); f != nil {
+					property["description"] = f.Usage
+				}
+			}
+			properties[name] = property
+		}
+		schema["type"] = "object"
+		schema["properties"] = properties
+		schema["additionalProperties"] = false
+	}
+
+	return schema
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Kinds of tracked connections.
+const (
+	connKindTCP  = "tcp"
+	connKindHTTP = "http"
+)
+
+// conns tracks every connection and request currently being forwarded.
+var conns = newConnRegistry()
+
+// Traffic counters, kept around as they are updated on every read.
+var (
+	bytesInTotal = metrics.Default.Counter("railtail_bytes_total",
+		"Bytes forwarded, by direction.", "direction", "in")
+	bytesOutTotal = metrics.Default.Counter("railtail_bytes_total",
+		"Bytes forwarded, by direction.", "direction", "out")
+	uploadsActive = metrics.Default.Gauge("railtail_http_uploads_active",
+		"HTTP requests whose body is still being streamed to the target.")
+)
+
+// trackedConn is a connection (TCP) or request (HTTP) in the registry.
+type trackedConn struct {
+	id         uint64
+	kind       string
+	listener   string // listen port it was accepted on
+	remoteAddr string
+	target     string
+	request    string // method and path of HTTP requests
+	uploadSize int64  // Content-Length of HTTP request bodies, -1 if streamed without one
+	startedAt  time.Time
+
+	uploading atomic.Bool // the request body is still being read
+
+	bytesIn    atomic.Int64 // client -> target
+	bytesOut   atomic.Int64 // target -> client
+	lastActive atomic.Int64 // Unix nanoseconds of the last bytes forwarded either way
+
+	bufferedIn, bufferedOut atomic.Int64 // read and not written yet, see copyFlow
+	stalledIn, stalledOut   atomic.Int64 // nanoseconds writes blocked, see copyFlow
+
+	reaper atomic.Pointer[func()] // closes the connection for the idle reaper, see setReaper
+	closer atomic.Pointer[func()] // closes the connection once drained, see setCloser
+
+	draining atomic.Bool // its target or tunnel was removed, see connRegistry.drain
+
+	latency atomic.Pointer[responseLatency] // response latency of desktop connections, see setLatency
+	usage   *listenerCounters               // traffic of its listener, see usageExporter
+
+	reason   atomic.Pointer[string] // why it was closed, see setCloseReason
+	timedOut atomic.Bool            // it was closed for hitting a deadline, see setCloseCause
+
+	registry *connRegistry
+}
+
+// ConnSnapshot is a point-in-time view of a tracked connection.
+type ConnSnapshot struct {
+	ID         uint64       `json:"id"`
+	Kind       string       `json:"kind"`
+	RemoteAddr string       `json:"remote_addr"`
+	Target     string       `json:"target"`
+	StartedAt  time.Time    `json:"started_at"`
+	BytesIn    int64        `json:"bytes_in"`
+	BytesOut   int64        `json:"bytes_out"`
+	Request    string       `json:"request,omitempty"`     // method and path of HTTP requests
+	UploadSize int64        `json:"upload_size,omitempty"` // request body size, -1 if unknown; bytes_in is the progress
+	Uploading  bool         `json:"uploading,omitempty"`   // the request body is still being streamed
+	LastActive time.Time    `json:"last_active"`           // when bytes were last forwarded either way
+	Latency    *ConnLatency `json:"latency,omitempty"`     // response latency of desktop connections
+	Flow       *ConnFlow    `json:"flow,omitempty"`        // backpressure of TCP connections, once there is any
+}
+
+// ConnFlow is the backpressure of a TCP connection in each direction, see copyFlow.
+type ConnFlow struct {
+	BufferedIn   int64   `json:"buffered_in"`  // read from the client, not yet written to the target
+	BufferedOut  int64   `json:"buffered_out"` // read from the target, not yet written to the client
+	StalledInMs  float64 `json:"stalled_in_ms"`
+	StalledOutMs float64 `json:"stalled_out_ms"`
+}
+
+// connRegistry keeps the set of open connections.
+type connRegistry struct {
+	nextID atomic.Uint64
+
+	// Thresholds above which closed connections are logged as warnings (0 = disabled)
+	slowRequest   time.Duration
+	largeTransfer int64
+
+	// How long connections to removed targets get to finish (0 = as long as they need)
+	drainTimeout time.Duration
+
+	mu       sync.Mutex
+	conns    map[uint64]*trackedConn
+	watchers map[chan ConnEvent]struct{}
+}
+
+// ConnEvent is a connection opening or closing, as streamed to watchers.
+type ConnEvent struct {
+	Type   string       `json:"type"` // open or close
+	Conn   ConnSnapshot `json:"conn"`
+	Reason string       `json:"reason,omitempty"` // why it was closed
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[uint64]*trackedConn)}
+}
+
+// open registers a new connection, accepted on the listener with the local address
+// local. The caller must call close on the result when done.
+func (r *connRegistry) open(kind string, local net.Addr, remoteAddr, target string) *trackedConn {
+	return r.register(&trackedConn{kind: kind, listener: listenPort(local), remoteAddr: remoteAddr, target: target})
+}
+
+// openRequest registers an HTTP request forwarded to target, with the size of its body.
+// The caller must call close on the result when done.
+func (r *connRegistry) openRequest(req *http.Request, target string) *trackedConn {
+	c := &trackedConn{
+		kind:       connKindHTTP,
+		listener:   requestListener(req),
+		remoteAddr: req.RemoteAddr,
+		target:     target,
+		request:    req.Method + " " + req.URL.Path,
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 {
+		c.uploadSize = req.ContentLength
+		c.uploading.Store(true)
+		uploadsActive.Inc()
+	}
+
+	return r.register(c)
+}
+
+// register adds c to the registry.
+func (r *connRegistry) register(c *trackedConn) *trackedConn {
+	c.id = r.nextID.Add(1)
+	c.usage = listenerBytes.get(c.listener)
+	c.startedAt = time.Now()
+	c.lastActive.Store(c.startedAt.UnixNano())
+	c.registry = r
+
+	r.mu.Lock()
+	r.conns[c.id] = c
+	if len(r.watchers) > 0 {
+		r.notifyLocked(ConnEvent{Type: "open", Conn: c.snapshot()})
+	}
+	r.mu.Unlock()
+
+	metrics.Default.Counter("railtail_connections_total",
+		"Connections (TCP) and requests (HTTP) forwarded.", "kind", c.kind).Inc()
+	metrics.Default.Gauge("railtail_connections_active",
+		"Connections (TCP) and requests (HTTP) currently being forwarded.", "kind", c.kind).Inc()
+	connOpenedEvent(c)
+
+	return c
+}
+
+// setCloseReason records why the connection is being closed. The first reason set
+// wins, as closing one side makes the other fail too.
+func (c *trackedConn) setCloseReason(reason string) {
+	c.reason.CompareAndSwap(nil, &reason)
+}
+
+// setCloseCause records why the connection is being closed, like setCloseReason, and
+// whether it hit a deadline, from err, the error that ended it.
+func (c *trackedConn) setCloseCause(reason string, err error) {
+	if c.reason.CompareAndSwap(nil, &reason) && isTimeout(err) {
+		c.timedOut.Store(true)
+	}
+}
+
+// closeReason returns the reason set with setCloseReason, or CloseUnknown.
+func (c *trackedConn) closeReason() string {
+	if reason := c.reason.Load(); reason != nil {
+		return *reason
+	}
+
+	return CloseUnknown
+}
+
+// close removes the connection from the registry.
+func (c *trackedConn) close() {
+	c.uploaded()
+
+	c.registry.mu.Lock()
+	delete(c.registry.conns, c.id)
+	if len(c.registry.watchers) > 0 {
+		c.registry.notifyLocked(ConnEvent{Type: "close", Conn: c.snapshot(), Reason: c.closeReason()})
+	}
+	c.registry.mu.Unlock()
+
+	countClosed(c.kind, c.closeReason())
+	c.countDrained()
+	countOutcome(c.kind, c.listener, closeOutcome(c.closeReason(), c.timedOut.Load()))
+
+	metrics.Default.Gauge("railtail_connections_active",
+		"Connections (TCP) and requests (HTTP) currently being forwarded.", "kind", c.kind).Dec()
+	connClosedEvent(c)
+	c.checkThresholds()
+}
+
+// setDrainTimeout sets how long connections to removed targets get to finish before they
+// are closed, see drain. 0 leaves them open for as long as they need.
+func (r *connRegistry) setDrainTimeout(timeout time.Duration) {
+	r.drainTimeout = timeout
+}
+
+// setThresholds sets how long HTTP requests and how many bytes connections may take
+// before they are reported when closed. 0 disables either check.
+func (r *connRegistry) setThresholds(slowRequest time.Duration, largeTransfer int64) {
+	r.slowRequest = slowRequest
+	r.largeTransfer = largeTransfer
+}
+
+// checkThresholds warns about a closed request that took too long, or a closed
+// connection or request that moved too many bytes.
+func (c *trackedConn) checkThresholds() {
+	duration := time.Since(c.startedAt)
+	bytesIn, bytesOut := c.bytesIn.Load(), c.bytesOut.Load()
+
+	slow := c.kind == connKindHTTP && c.registry.slowRequest > 0 && duration > c.registry.slowRequest
+	large := c.registry.largeTransfer > 0 && bytesIn+bytesOut > c.registry.largeTransfer
+	if !slow && !large {
+		return
+	}
+
+	event := logger.Stderr.Warn().
+		Str("kind", c.kind).
+		Str("remote-addr", c.remoteAddr).
+		Str("target", c.target).
+		Str("reason", c.closeReason()).
+		Dur("duration", duration).
+		Int64("bytes-in", bytesIn).
+		Int64("bytes-out", bytesOut)
+	if c.request != "" {
+		event = event.Str("request", c.request)
+	}
+
+	if slow {
+		metrics.Default.Counter("railtail_slow_requests_total",
+			"HTTP requests that took longer than SLOW_REQUEST_THRESHOLD.").Inc()
+	}
+	if large {
+		metrics.Default.Counter("railtail_large_transfers_total",
+			"Connections (TCP) and requests (HTTP) that moved more than LARGE_TRANSFER_MB.", "kind", c.kind).Inc()
+	}
+
+	switch {
+	case slow && large:
+		event.Msg("slow request with large transfer")
+	case slow:
+		event.Msg("slow request")
+	default:
+		event.Msg("large transfer")
+	}
+}
+
+// countIn records n bytes sent from the client to the target.
+func (c *trackedConn) countIn(n int) {
+	if n > 0 {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+	c.bytesIn.Add(int64(n))
+	bytesInTotal.Add(uint64(n))
+	c.usage.in.Add(uint64(n))
+}
+
+// uploaded records that the request body was read to its end, or will not be anymore.
+func (c *trackedConn) uploaded() {
+	if c.uploading.CompareAndSwap(true, false) {
+		uploadsActive.Dec()
+	}
+}
+
+// countOut records n bytes sent from the target to the client.
+func (c *trackedConn) countOut(n int) {
+	if n > 0 {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+	c.bytesOut.Add(int64(n))
+	bytesOutTotal.Add(uint64(n))
+	c.usage.out.Add(uint64(n))
+}
+
+// setReaper sets how the idle reaper closes the connection. Connections without one are
+// never reaped.
+func (c *trackedConn) setReaper(reap func()) {
+	c.reaper.Store(&reap)
+}
+
+// setCloser sets how the connection is closed once its target was removed and it did
+// not drain in time. Connections without one are left open.
+func (c *trackedConn) setCloser(close func()) {
+	c.closer.Store(&close)
+}
+
+// setLatency sets the response latency measured for the connection.
+func (c *trackedConn) setLatency(l *responseLatency) {
+	c.latency.Store(l)
+}
+
+// Len returns the number of open connections.
+func (r *connRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.conns)
+}
+
+// Snapshot returns the open connections, oldest first.
+func (r *connRegistry) Snapshot() []ConnSnapshot {
+	r.mu.Lock()
+	list := make([]ConnSnapshot, 0, len(r.conns))
+	for _, c := range r.conns {
+		list = append(list, c.snapshot())
+	}
+	r.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	return list
+}
+
+// Watch returns a channel receiving the connections opened and closed from now on,
+// buffering up to size events, and the function to call to stop receiving them. Events
+// a watcher has no room for are dropped, so a slow watcher never holds connections up.
+func (r *connRegistry) Watch(size int) (<-chan ConnEvent, func()) {
+	ch := make(chan ConnEvent, size)
+
+	r.mu.Lock()
+	if r.watchers == nil {
+		r.watchers = make(map[chan ConnEvent]struct{})
+	}
+	r.watchers[ch] = struct{}{}
+	r.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.watchers, ch)
+			r.mu.Unlock()
+		})
+	}
+}
+
+// notifyLocked sends event to the watchers with room for it. r.mu is held.
+func (r *connRegistry) notifyLocked(event ConnEvent) {
+	for ch := range r.watchers {
+		select {
+		case ch <- event:
+		default:
+			metrics.Default.Counter("railtail_conn_events_dropped_total",
+				"Connection events dropped because a watcher could not keep up.").Inc()
+		}
+	}
+}
+
+func (c *trackedConn) snapshot() ConnSnapshot {
+	s := ConnSnapshot{
+		ID:         c.id,
+		Kind:       c.kind,
+		RemoteAddr: c.remoteAddr,
+		Target:     c.target,
+		StartedAt:  c.startedAt,
+		BytesIn:    c.bytesIn.Load(),
+		BytesOut:   c.bytesOut.Load(),
+		Request:    c.request,
+		UploadSize: c.uploadSize,
+		Uploading:  c.uploading.Load(),
+		LastActive: time.Unix(0, c.lastActive.Load()),
+	}
+	if l := c.latency.Load(); l != nil {
+		s.Latency = l.snapshot()
+	}
+	flow := ConnFlow{
+		BufferedIn:   c.bufferedIn.Load(),
+		BufferedOut:  c.bufferedOut.Load(),
+		StalledInMs:  milliseconds(time.Duration(c.stalledIn.Load())),
+		StalledOutMs: milliseconds(time.Duration(c.stalledOut.Load())),
+	}
+	if flow != (ConnFlow{}) {
+		s.Flow = &flow
+	}
+
+	return s
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	count func(int)
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count(n)
+	return n, err
+}
+
+// countingReadCloser is a countingReader for request bodies, calling eof, if set, once
+// they are read to their end.
+type countingReadCloser struct {
+	io.ReadCloser
+	count func(int)
+	eof   func()
+}
+
+func (r countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count(n)
+	if err == io.EOF && r.eof != nil {
+		r.eof()
+	}
+	return n, err
+}
+
+// countingResponseWriter counts the response bytes written through it.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	count func(int)
+}
+
+func (w countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.count(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (flushing, hijacking).
+func (w countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// trackRequests registers every request handled by next in the connection registry.
+// target reports where the request is forwarded to.
+func trackRequests(target func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trackRequest(w, r, target(r), next.ServeHTTP)
+	})
+}
+
+// trackRequest registers r, forwarded to target, in the connection registry while next
+// handles it.
+func trackRequest(w http.ResponseWriter, r *http.Request, target string, next http.HandlerFunc) {
+	c := conns.openRequest(r, target)
+	defer c.close()
+	// The client's context, not the one cancelled below once next returns
+	clientCtx := r.Context()
+	defer func() {
+		// Unless the handler said otherwise
+		if clientCtx.Err() != nil {
+			c.setCloseReason(CloseClientEOF)
+		}
+		c.setCloseReason(CloseCompleted)
+	}()
+
+	r = withTracked(r, c)
+	// Cancelling the request aborts forwarding it, should it be reaped
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+	c.setReaper(cancel)
+	c.setCloser(cancel)
+	if r.Body != nil {
+		r.Body = countingReadCloser{ReadCloser: r.Body, count: c.countIn, eof: c.uploaded}
+	}
+	next(countingResponseWriter{ResponseWriter: w, count: c.countOut}, r)
+}
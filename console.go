@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+	"tailscale.com/tsnet"
+)
+
+// consoleIdleTimeout closes console sessions left idle.
+const consoleIdleTimeout = 10 * time.Minute
+
+// consoleCommands are the console commands with their help, in the order listed by help.
+var consoleCommands = []struct{ name, help string }{
+	{"status", "tailscale node status"},
+	{"conns", "open connections"},
+	{"stats", "connection and byte counters"},
+	{"tunnels", "additional TCP tunnels"},
+	{"errors", "recently logged errors"},
+	{"goroutines", "stack traces of all goroutines"},
+	{"metrics", "metrics in Prometheus text format"},
+	{"help", "this list"},
+	{"quit", "close the session"},
+}
+
+// debugConsole is a read-only diagnostic console served on the tailnet only, so that who
+// may use it is governed by the tailnet's ACLs.
+type debugConsole struct {
+	ts      *tsnet.Server
+	cfg     *Config
+	tunnels *tunnelManager
+	users   []string // login names allowed in; empty allows anyone the ACLs let through
+}
+
+// serve listens for console sessions on port of the tailnet node. It is meant to
+// be started in its own goroutine.
+func (c *debugConsole) serve(port string) {
+	ln, err := c.ts.Listen("tcp", ":"+port)
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("console-port", port).
+			Msg("failed to start debug console")
+		return
+	}
+
+	logger.Stdout.Info().
+		Str("console-port", port).
+		Strs("console-users", c.users).
+		Msg("debug console listening on the tailnet")
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.session(conn)
+	}
+}
+
+// session runs one console session, after checking who is on the other end.
+func (c *debugConsole) session(conn net.Conn) {
+	defer conn.Close()
+
+	who := c.whoIs(conn.RemoteAddr().String())
+	if len(c.users) > 0 && !slices.Contains(c.users, who) {
+		logger.Stderr.Warn().
+			Str("remote-addr", conn.RemoteAddr().String()).
+			Str("user", who).
+			Msg("debug console access denied")
+		fmt.Fprintln(conn, "access denied")
+		return
+	}
+
+	logger.Stdout.Info().
+		Str("remote-addr", conn.RemoteAddr().String()).
+		Str("user", who).
+		Msg("debug console session started")
+	defer logger.Stdout.Info().
+		Str("remote-addr", conn.RemoteAddr().String()).
+		Str("user", who).
+		Msg("debug console session ended")
+
+	fmt.Fprintf(conn, "railtail debug console on %s, type help for commands\n", c.cfg.TSHostname)
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		fmt.Fprint(conn, "railtail> ")
+		_ = conn.SetReadDeadline(time.Now().Add(consoleIdleTimeout))
+		if !scanner.Scan() {
+			return
+		}
+
+		command := strings.TrimSpace(scanner.Text())
+		if command == "quit" || command == "exit" {
+			return
+		}
+		if err := c.run(conn, command); err != nil {
+			fmt.Fprintln(conn, "error:", err)
+		}
+	}
+}
+
+// run executes a console command, writing its output to w.
+func (c *debugConsole) run(w io.Writer, command string) error {
+	switch command {
+	case "":
+		return nil
+	case "status":
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		status, err := nodeStatus(ctx, c.ts, c.cfg)
+		if err != nil {
+			return err
+		}
+		return writeIndentedJSON(w, status)
+	case "conns":
+		return writeIndentedJSON(w, conns.Snapshot())
+	case "stats":
+		return writeIndentedJSON(w, map[string]any{
+			"active_connections": conns.Len(),
+			"bytes_in":           bytesInTotal.Value(),
+			"bytes_out":          bytesOutTotal.Value(),
+		})
+	case "tunnels":
+		return writeIndentedJSON(w, c.tunnels.List())
+	case "errors":
+		return writeIndentedJSON(w, logger.RecentErrors.Entries())
+	case "goroutines":
+		return pprof.Lookup("goroutine").WriteTo(w, 1)
+	case "metrics":
+		_, err := metrics.Default.WriteTo(w)
+		return err
+	case "help":
+		for _, cmd := range consoleCommands {
+			fmt.Fprintf(w, "  %-12s %s\n", cmd.name, cmd.help)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command '%s', type help for commands", command)
+	}
+}
+
+// whoIs returns the login name of the tailnet user at remoteAddr, or an empty string
+// for tagged nodes and when it cannot be determined.
+func (c *debugConsole) whoIs(remoteAddr string) string {
+	lc, err := localClient(c.ts)
+	if err != nil {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	who, err := lc.WhoIs(ctx, remoteAddr)
+	if err != nil || who.UserProfile == nil {
+		return ""
+	}
+
+	return who.UserProfile.LoginName
+}
+
+func writeIndentedJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers used to copy between connections. It is
+// twice io.Copy's default, halving the writes into the tailnet stack for bulk transfers.
+const copyBufferSize = 64 << 10
+
+// spliceChunk bounds each zero-copy transfer, so that byte counters stay live during
+// long transfers.
+const spliceChunk = 1 << 20
+
+var copyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// copyConn copies from src to dst until EOF, reporting the bytes copied to count as it
+// goes, and the backpressure to flow, if not nil. Between two kernel TCP sockets the data
+// is moved with splice(2) on Linux, without passing through user space nor flow; everything
+// else, such as tailnet connections, is copied through buffers of the pool buffers, or
+// read ahead into a buffer of flow's own, see copyAhead.
+func copyConn(dst, src net.Conn, buffers *sync.Pool, count func(int), flow *copyFlow) (int64, error) {
+	if flow != nil && flow.maxInflight > 0 {
+		return flow.copyAhead(struct{ io.Writer }{dst}, src, count)
+	}
+
+	dstTCP, ok1 := plainConn(dst).(*net.TCPConn)
+	srcTCP, ok2 := plainConn(src).(*net.TCPConn)
+	if ok1 && ok2 {
+		return spliceConn(dstTCP, srcTCP, count)
+	}
+
+	buf := buffers.Get().(*[]byte)
+	defer buffers.Put(buf)
+
+	// Hide any io.ReaderFrom/io.WriterTo so the pooled buffer is actually used
+	var w io.Writer = struct{ io.Writer }{dst}
+	if flow != nil {
+		w = flowWriter{Writer: dst, flow: flow}
+	}
+	return io.CopyBuffer(w, countingReader{Reader: src, count: count}, *buf)
+}
+
+// spliceConn copies between TCP sockets in chunks. (*net.TCPConn).ReadFrom uses splice
+// on Linux when the source is a TCP socket, possibly behind an io.LimitedReader.
+func spliceConn(dst, src *net.TCPConn, count func(int)) (int64, error) {
+	var total int64
+	for {
+		n, err := dst.ReadFrom(&io.LimitedReader{R: src, N: spliceChunk})
+		total += n
+		count(int(n))
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, nil // EOF
+		}
+	}
+}
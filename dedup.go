@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// ErrDedupInvalid is returned for dedup settings that cannot be applied.
+var ErrDedupInvalid = errors.New("dedup settings are invalid")
+
+const (
+	// dedupMaxEntries bounds the requests a dedup cache remembers. Requests beyond it are
+	// forwarded without deduplication until entries expire.
+	dedupMaxEntries = 100_000
+	// dedupMaxBody bounds the bodies hashed into keys; bigger requests are not deduplicated.
+	dedupMaxBody = 25 << 20
+	// dedupMaxResponse bounds the response bodies kept to answer duplicates with. Duplicates
+	// of requests with bigger responses get their status only.
+	dedupMaxResponse = 64 << 10
+	// dedupSweepInterval is how often expired entries are dropped.
+	dedupSweepInterval = time.Minute
+)
+
+// DedupConfig suppresses the retries of requests already forwarded, so that targets are
+// not hit twice when webhook providers retry a delivery.
+type DedupConfig struct {
+	TTL    time.Duration `yaml:"ttl"`    // How long forwarded requests are remembered; disabled if 0
+	Header string        `yaml:"header"` // Idempotency key header, like Idempotency-Key; the hash of the request if empty
+}
+
+// validate checks the dedup settings.
+func (c DedupConfig) validate() error {
+	if c.TTL < 0 {
+		return fmt.Errorf("%w: ttl must not be negative", ErrDedupInvalid)
+	}
+	if c.Header != "" && c.TTL == 0 {
+		return fmt.Errorf("%w: header requires a ttl", ErrDedupInvalid)
+	}
+
+	return nil
+}
+
+// dedupCache remembers the requests forwarded to a route (or the main target) by key, and
+// answers their duplicates itself: with the response of the first one, or 409 Conflict
+// while it is in flight. Requests the target failed, with a 5xx or 429 response or none,
+// are forgotten, so that their retries go through. A nil dedupCache forwards everything.
+type dedupCache struct {
+	route  string
+	ttl    time.Duration
+	header string
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+	swept   time.Time
+
+	replayed *metrics.Counter
+	inFlight *metrics.Counter
+	keys     *metrics.Gauge
+}
+
+// dedupEntry is what a dedupCache remembers of a request.
+type dedupEntry struct {
+	expires  time.Time
+	done     bool // the response is recorded
+	status   int
+	header   http.Header
+	body     []byte
+	complete bool // body is the whole response body
+}
+
+// newDedupCache returns the dedupCache of route (empty for the main target), or nil if
+// cfg disables deduplication.
+func newDedupCache(route string, cfg DedupConfig) *dedupCache {
+	if cfg.TTL <= 0 {
+		return nil
+	}
+
+	return &dedupCache{
+		route:   route,
+		ttl:     cfg.TTL,
+		header:  cfg.Header,
+		entries: make(map[string]*dedupEntry),
+		swept:   time.Now(),
+		replayed: metrics.Default.Counter("railtail_dedup_suppressed_total",
+			"Duplicate requests answered without forwarding them, by route and state of the first one.",
+			"route", route, "state", "replayed"),
+		inFlight: metrics.Default.Counter("railtail_dedup_suppressed_total",
+			"Duplicate requests answered without forwarding them, by route and state of the first one.",
+			"route", route, "state", "in-flight"),
+		keys: metrics.Default.Gauge("railtail_dedup_keys",
+			"Requests remembered to suppress their duplicates, by route.", "route", route),
+	}
+}
+
+// wrap returns next, answering the duplicates of the requests it already handled.
+// Requests of safe methods, without the idempotency header, or too big to hash go through.
+func (c *dedupCache) wrap(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, ok := c.key(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry, duplicate := c.claim(key)
+		if duplicate {
+			c.replay(w, r, entry)
+			return
+		}
+
+		rec := &dedupRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		c.settle(key, entry, rec)
+	})
+}
+
+// key returns the dedup key of r: its idempotency header, or the hash of its method, host,
+// URI and body. The body is read to hash it, and replaced for forwarding.
+func (c *dedupCache) key(r *http.Request) (string, bool) {
+	if c.header != "" {
+		value := r.Header.Get(c.header)
+		return value, value != ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, dedupMaxBody+1))
+	if err != nil || len(body) > dedupMaxBody {
+		// Forwarded as is, with what was read put back in front of the rest
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return "", false
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	r.ContentLength = int64(len(body))
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s %s\n", r.Method, r.Host, r.URL.RequestURI())
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// claim returns a copy of the entry of key and true if it is a duplicate, or a new entry
+// for it and false. The entry is nil when the cache is full.
+func (c *dedupCache) claim(key string) (*dedupEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.sweepLocked(now)
+	if entry, ok := c.entries[key]; ok && now.Before(entry.expires) {
+		snapshot := *entry
+		return &snapshot, true
+	}
+	if len(c.entries) >= dedupMaxEntries {
+		return nil, false
+	}
+
+	entry := &dedupEntry{expires: now.Add(c.ttl)}
+	c.entries[key] = entry
+	c.keys.Set(int64(len(c.entries)))
+
+	return entry, false
+}
+
+// settle records the response of the request of entry, or forgets the request if the
+// target failed it.
+func (c *dedupCache) settle(key string, entry *dedupEntry, rec *dedupRecorder) {
+	if entry == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if rec.status == 0 || rec.status >= http.StatusInternalServerError || rec.status == http.StatusTooManyRequests {
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+			c.keys.Set(int64(len(c.entries)))
+		}
+		return
+	}
+	entry.done = true
+	entry.status = rec.status
+	entry.header = rec.Header().Clone()
+	entry.body = rec.body.Bytes()
+	entry.complete = !rec.truncated
+}
+
+// replay answers r, a duplicate of the request of entry.
+func (c *dedupCache) replay(w http.ResponseWriter, r *http.Request, entry *dedupEntry) {
+	state := "replayed"
+	if !entry.done {
+		state = "in-flight"
+	}
+	logger.Stdout.Info().
+		Str("remote-addr", r.RemoteAddr).
+		Str("route", c.route).
+		Str("path", r.URL.Path).
+		Str("state", state).
+		Msg("duplicate request suppressed")
+
+	if !entry.done {
+		c.inFlight.Inc()
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "a request with the same key is in flight", http.StatusConflict)
+		return
+	}
+
+	c.replayed.Inc()
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	if !entry.complete {
+		w.Header().Del("Content-Length")
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(entry.body)))
+	}
+	w.WriteHeader(entry.status)
+	if entry.complete {
+		w.Write(entry.body)
+	}
+}
+
+// sweepLocked drops the expired entries, at most every dedupSweepInterval. It is called
+// with c.mu held.
+func (c *dedupCache) sweepLocked(now time.Time) {
+	if now.Sub(c.swept) < dedupSweepInterval {
+		return
+	}
+	c.swept = now
+
+	for key, entry := range c.entries {
+		if entry.done && now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.keys.Set(int64(len(c.entries)))
+}
+
+// dedupRecorder records the status and the start of the body of a response, to answer
+// duplicates with.
+type dedupRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *dedupRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *dedupRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if room := dedupMaxResponse - w.body.Len(); len(p) > room {
+		w.body.Write(p[:max(room, 0)])
+		w.truncated = true
+	} else {
+		w.body.Write(p)
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (flushing, hijacking).
+func (w *dedupRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// readCloser reads from a Reader and closes a Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// ErrDERPRegionUnknown is returned when DERP_REGION is not in the tailnet's DERP map.
+var ErrDERPRegionUnknown = errors.New("DERP region is not in the DERP map")
+
+// pathStatusTTL is how long the peer status used to find connection paths is reused.
+const pathStatusTTL = 5 * time.Second
+
+// tailnetPaths logs the path taken by every connection to a target, nil when disabled.
+var tailnetPaths *pathLookup
+
+// pinDERPRegion makes region (a region ID or code, e.g. 14 or "ams") the home DERP region
+// of the node, instead of the one with the lowest latency at the time. Peers relay
+// traffic to the node through its home region.
+func pinDERPRegion(ctx context.Context, ts *tsnet.Server, region string) error {
+	lc, err := localClient(ts)
+	if err != nil {
+		return err
+	}
+
+	derpMap, err := lc.CurrentDERPMap(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get DERP map: %w", err)
+	}
+
+	id := 0
+	for _, r := range derpMap.Regions {
+		if strconv.Itoa(r.RegionID) == region || strings.EqualFold(r.RegionCode, region) {
+			id = r.RegionID
+			region = fmt.Sprintf("%s (%s)", r.RegionCode, r.RegionName)
+			break
+		}
+	}
+	if id == 0 {
+		return fmt.Errorf("%w: %s", ErrDERPRegionUnknown, region)
+	}
+
+	body, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	if err := lc.DebugActionBody(ctx, "force-prefer-derp", bytes.NewReader(body)); err != nil {
+		return fmt.Errorf("failed to prefer DERP region: %w", err)
+	}
+
+	logger.Stdout.Info().
+		Int("region-id", id).
+		Str("region", region).
+		Msg("pinned home DERP region")
+
+	return nil
+}
+
+// pathLookup tells whether connections to tailnet peers go direct or through a DERP relay,
+// from the peer status of the node, refreshed at most every pathStatusTTL.
+type pathLookup struct {
+	ts *tsnet.Server
+
+	mu        sync.Mutex
+	status    *ipnstate.Status
+	fetchedAt time.Time
+	warned    map[string]time.Time // when bulk connections relayed to a peer were last warned about
+}
+
+func newPathLookup(ts *tsnet.Server) *pathLookup {
+	return &pathLookup{ts: ts, warned: make(map[string]time.Time)}
+}
+
+// logConn logs the path of conn, a connection dialed to target over the tailnet.
+func (l *pathLookup) logConn(conn net.Conn, target string) {
+	if l == nil {
+		return
+	}
+
+	peer, err := l.connPeer(conn)
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Msg("failed to get tailscale status")
+		return
+	}
+
+	event := logger.Stdout.Info().Str("target", target)
+	switch {
+	case peer == nil:
+		event = event.Str("path", "unknown")
+	case peer.CurAddr != "":
+		event = event.Str("peer", peer.HostName).Str("path", "direct").Str("endpoint", peer.CurAddr)
+	default:
+		event = event.Str("peer", peer.HostName).Str("path", "derp").Str("relay", peer.Relay)
+	}
+	event.Msg("tailnet connection path")
+}
+
+// connPeer returns the status of the peer conn was dialed to, or nil if there is none.
+func (l *pathLookup) connPeer(conn net.Conn) (*ipnstate.PeerStatus, error) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, nil
+	}
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok {
+		return nil, nil
+	}
+
+	return l.peer(ip.Unmap())
+}
+
+// peer returns the status of the peer at ip, or nil if there is none.
+func (l *pathLookup) peer(ip netip.Addr) (*ipnstate.PeerStatus, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.status == nil || time.Since(l.fetchedAt) > pathStatusTTL {
+		lc, err := localClient(l.ts)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		status, err := lc.Status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		l.status, l.fetchedAt = status, time.Now()
+	}
+
+	for _, peer := range l.status.Peer {
+		for _, peerIP := range peer.TailscaleIPs {
+			if peerIP == ip {
+				return peer, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// desktopCopyBufferSize is the size of the copy buffers of desktop connections. Input
+// events and screen updates are small; small buffers keep each write short, so that an
+// update is passed on as soon as it arrives instead of behind a bulk transfer.
+const desktopCopyBufferSize = 16 << 10
+
+var desktopCopyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, desktopCopyBufferSize)
+		return &b
+	},
+}
+
+// desktopLatencyBuckets are the bounds of the response latencies of desktop connections,
+// in seconds: from a workstation on the same network to one too slow to work on.
+var desktopLatencyBuckets = []float64{.001, .0025, .005, .01, .02, .035, .05, .075, .1, .15, .2, .3, .5, 1, 2}
+
+// ConnLatency is the response latency of a desktop connection, see responseLatency.
+// Percentiles are estimated with the bounds of desktopLatencyBuckets.
+type ConnLatency struct {
+	Samples uint64  `json:"samples"`
+	MeanMs  float64 `json:"mean_ms"`
+	P50Ms   float64 `json:"p50_ms"`
+	P99Ms   float64 `json:"p99_ms"`
+	MaxMs   float64 `json:"max_ms"`
+}
+
+// responseLatency measures how long the target of a desktop connection takes to respond
+// to its client: from the first bytes the client sends after the target last spoke (a
+// key press, a mouse move) to the next bytes of the target (the screen update). Remote
+// desktop servers also send unprompted, so this is how responsive the desktop feels more
+// than the round trip of the network alone.
+type responseLatency struct {
+	histogram *metrics.Histogram // of all the connections of the listener
+
+	mu      sync.Mutex
+	sent    time.Time // when the client spoke since the target last did, zero if it did not
+	samples uint64
+	sum     time.Duration
+	max     time.Duration
+	counts  []uint64 // one per bucket of desktopLatencyBuckets, plus +Inf
+}
+
+// newResponseLatency returns the responseLatency of a connection accepted on the
+// listener with the local address addr.
+func newResponseLatency(addr net.Addr) *responseLatency {
+	return &responseLatency{
+		histogram: metrics.Default.HistogramWithBuckets("railtail_tcp_response_latency_seconds",
+			"Time targets of desktop connections take to respond to their clients, by listen port.",
+			desktopLatencyBuckets, "listener", listenPort(addr)),
+		counts: make([]uint64, len(desktopLatencyBuckets)+1),
+	}
+}
+
+// client records data sent by the client.
+func (l *responseLatency) client(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sent.IsZero() {
+		l.sent = time.Now()
+	}
+}
+
+// target records n bytes sent by the target, the response to what the client sent if it
+// spoke last.
+func (l *responseLatency) target(n int) {
+	if n == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sent.IsZero() {
+		return
+	}
+	latency := time.Since(l.sent)
+	l.sent = time.Time{}
+
+	l.histogram.Observe(latency.Seconds())
+	l.samples++
+	l.sum += latency
+	l.max = max(l.max, latency)
+	l.counts[sort.SearchFloat64s(desktopLatencyBuckets, latency.Seconds())]++
+}
+
+// snapshot returns the latencies measured so far.
+func (l *responseLatency) snapshot() *ConnLatency {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := &ConnLatency{Samples: l.samples, MaxMs: milliseconds(l.max)}
+	if l.samples == 0 {
+		return s
+	}
+	s.MeanMs = milliseconds(l.sum / time.Duration(l.samples))
+	s.P50Ms = l.quantileLocked(0.5)
+	s.P99Ms = l.quantileLocked(0.99)
+
+	return s
+}
+
+// quantileLocked returns the upper bound of the bucket holding the quantile q of the
+// samples, in milliseconds, capped by the maximum. It is called with l.mu held.
+func (l *responseLatency) quantileLocked(q float64) float64 {
+	rank := max(uint64(math.Ceil(q*float64(l.samples))), 1)
+	var seen uint64
+	for i, n := range l.counts {
+		seen += n
+		if seen >= rank && i < len(desktopLatencyBuckets) {
+			return min(desktopLatencyBuckets[i]*1000, milliseconds(l.max))
+		}
+	}
+
+	return milliseconds(l.max)
+}
+
+// milliseconds returns d in milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// devHostname is the Tailscale hostname of railtail dev, unless configured.
+const devHostname = "railtail-dev"
+
+// devMode is set when railtail runs as `railtail dev`.
+var devMode bool
+
+// devCommand implements `railtail dev`, which runs railtail for local development: it
+// takes the same flags and environment as railtail, but does not need a real tailnet or
+// burn an auth key. See applyDevDefaults. It returns the process exit code.
+func devCommand(args []string) int {
+	os.Args = append(os.Args[:1], args...)
+	devMode = true
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	run(ctx)
+
+	return 0
+}
+
+// applyDevDefaults sets what railtail dev changes in the settings left at their
+// defaults. Without a control server (TS_LOGIN_SERVER), it runs without a tailnet
+// (NO_TAILSCALE) and dials every target on the loopback interface at its own port, so
+// that TARGET_ADDR=100.64.0.5:5432 reaches a database on localhost:5432. With one, such
+// as a Headscale container, it joins that tailnet as an ephemeral node, removed once it
+// goes offline, with its state in a temporary directory.
+func applyDevDefaults(cfg *Config) {
+	if !devMode {
+		return
+	}
+
+	if cfg.TSLoginServer == "" && !isExplicit("no-tailscale", "NO_TAILSCALE") {
+		cfg.NoTailscale = true
+	}
+	if cfg.NoTailscale && cfg.DialBackend == "" && !isExplicit("dial-backend", "DIAL_BACKEND") {
+		cfg.DialBackend = DialBackendLoopback
+	}
+
+	if isDefault("ts-hostname", "TS_HOSTNAME", cfg.TSHostname, defaultTSHostname) {
+		cfg.TSHostname = devHostname
+	}
+	if isDefault("ts-state-dir", "TS_STATEDIR_PATH", cfg.TSStateDirPath, defaultTSStateDirPath) {
+		cfg.TSStateDirPath = filepath.Join(os.TempDir(), devHostname)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/tsnet"
+)
+
+// Backends targets are dialed through (DIAL_BACKEND), besides SOCKS5 proxies given by URL.
+const (
+	DialBackendTailnet  = "tailnet"  // the tsnet node of railtail
+	DialBackendDirect   = "direct"   // the network of the container, for local development
+	DialBackendLoopback = "loopback" // the loopback interface, at the port of the target, for railtail dev
+)
+
+var (
+	// ErrDialBackendInvalid is returned for DIAL_BACKEND values that cannot be used.
+	ErrDialBackendInvalid = errors.New("dial backend is invalid")
+	// ErrNoTailnet is returned for what needs the tsnet node when railtail runs without
+	// one (NO_TAILSCALE).
+	ErrNoTailnet = errors.New("not connected to a tailnet (NO_TAILSCALE)")
+)
+
+// dialBackendSchemes are the URL schemes of SOCKS5 proxies as dial backends. Both resolve
+// names on the proxy.
+var dialBackendSchemes = []string{"socks5", "socks5h"}
+
+// directDialTimeout bounds the dials of the direct backend, like tsnet bounds its own.
+const directDialTimeout = 30 * time.Second
+
+// Dialer opens connections to targets. The tsnet node is one; without a tailnet, targets
+// are dialed on the local network or through a SOCKS5 proxy (see newDialBackend), which
+// lets routing and middleware be tried locally against plain services.
+type Dialer interface {
+	Dial(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// validateDialBackend checks a DIAL_BACKEND setting.
+func validateDialBackend(backend string) error {
+	switch backend {
+	case "", DialBackendTailnet, DialBackendDirect, DialBackendLoopback:
+		return nil
+	}
+
+	u, err := url.Parse(backend)
+	if err != nil || !slices.Contains(dialBackendSchemes, u.Scheme) || u.Host == "" {
+		return fmt.Errorf("%w: expected tailnet, direct, loopback or a socks5:// URL, got '%s'", ErrDialBackendInvalid, backend)
+	}
+
+	return nil
+}
+
+// validateNoTailscale checks that nothing configured needs the tsnet node, for railtail
+// running without one (NO_TAILSCALE).
+func validateNoTailscale(cfg *Config) []error {
+	var errs []error
+	if cfg.DialBackend == DialBackendTailnet {
+		errs = append(errs, fmt.Errorf("%w: DIAL_BACKEND=tailnet", ErrNoTailnet))
+	}
+
+	needs := []struct {
+		setting string
+		set     bool
+	}{
+		{"TAILNET_LISTEN_PORT", cfg.TailnetListenPort != ""},
+		{"ADMIN_NETWORK=tailnet", cfg.AdminNetwork == AdminNetworkTailnet},
+		{"DEBUG_CONSOLE_PORT", cfg.DebugConsolePort != ""},
+		{"TAILDROP_DIR or TAILDROP_FORWARD_URL", cfg.TaildropDir != "" || cfg.TaildropForwardURL != ""},
+		{"DERP_REGION", cfg.DERPRegion != ""},
+		{"LOG_CONNECTION_PATHS", cfg.LogConnectionPaths},
+		{"TAILNET_PROXY_SEARCH_DOMAIN", cfg.TailnetProxySearchDomain != ""},
+		{"CAPTURE_SCOPE other than listener", cfg.Capture != "" && cfg.CaptureScope != CaptureScopeListener},
+	}
+	for _, need := range needs {
+		if need.set {
+			errs = append(errs, fmt.Errorf("%w: %s needs the tailnet", ErrNoTailnet, need.setting))
+		}
+	}
+
+	return errs
+}
+
+// newDialBackend returns the Dialer of backend: ts, which is nil without a tailnet, a
+// dialer of the local network or of its loopback interface, or a SOCKS5 proxy, such as
+// the SOCKS5 server of a local tailscaled or an SSH tunnel.
+func newDialBackend(backend string, ts *tsnet.Server) (Dialer, error) {
+	switch backend {
+	case "", DialBackendTailnet:
+		if ts == nil {
+			return nil, fmt.Errorf("%w: %w", ErrDialBackendInvalid, ErrNoTailnet)
+		}
+		return ts, nil
+	case DialBackendDirect:
+		return directDialer{&net.Dialer{Timeout: directDialTimeout}}, nil
+	case DialBackendLoopback:
+		return loopbackDialer{directDialer{&net.Dialer{Timeout: directDialTimeout}}}, nil
+	}
+
+	u, err := url.Parse(backend)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDialBackendInvalid, err)
+	}
+	d, err := proxy.FromURL(u, &net.Dialer{Timeout: directDialTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDialBackendInvalid, err)
+	}
+
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s proxies cannot be dialed with a context", ErrDialBackendInvalid, u.Scheme)
+	}
+
+	return socksDialer{cd}, nil
+}
+
+// directDialer dials targets on the network of the container.
+type directDialer struct {
+	d *net.Dialer
+}
+
+// Dial implements the Dialer interface.
+func (d directDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.d.DialContext(ctx, network, addr)
+}
+
+// loopbackDialer dials every target on the loopback interface, at the port of the
+// target, standing in for the tailnet with services run locally.
+type loopbackDialer struct {
+	d directDialer
+}
+
+// Dial implements the Dialer interface.
+func (d loopbackDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.d.Dial(ctx, network, net.JoinHostPort("127.0.0.1", port))
+}
+
+// socksDialer dials targets through a SOCKS5 proxy.
+type socksDialer struct {
+	d proxy.ContextDialer
+}
+
+// Dial implements the Dialer interface.
+func (d socksDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.d.DialContext(ctx, network, addr)
+}
+
+// localClient returns the local client of the tsnet node ts, or ErrNoTailnet if railtail
+// runs without one.
+func localClient(ts *tsnet.Server) (*tailscale.LocalClient, error) {
+	if ts == nil {
+		return nil, ErrNoTailnet
+	}
+
+	return ts.LocalClient()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// dialDiagnosisInterval is how often failed dials to the same target are diagnosed.
+const dialDiagnosisInterval = time.Minute
+
+// dialDoctor diagnoses failed dials to targets, nil when the tailnet is not up yet.
+var dialDoctor *dialDiagnostics
+
+// dialDiagnostics explains why dials to targets fail, from the node's view of the
+// tailnet: a bare i/o timeout usually means the tailnet ACLs drop the connection, which
+// a look at the peers tells apart from a target that is offline or not listening.
+type dialDiagnostics struct {
+	ts *tsnet.Server
+
+	mu   sync.Mutex
+	last map[string]time.Time // when each target was last diagnosed
+}
+
+func newDialDiagnostics(ts *tsnet.Server) *dialDiagnostics {
+	return &dialDiagnostics{ts: ts, last: make(map[string]time.Time)}
+}
+
+// check logs a diagnosis of err, returned dialing target (host:port or a URL), in the
+// background, at most once per dialDiagnosisInterval for each target. Errors that speak
+// for themselves, like refused connections, are not diagnosed.
+func (d *dialDiagnostics) check(target string, err error) {
+	if d == nil || !errors.Is(err, ErrDial) || errors.Is(err, ErrRefused) || errors.Is(err, ErrTLS) {
+		return
+	}
+
+	d.mu.Lock()
+	if time.Since(d.last[target]) < dialDiagnosisInterval {
+		d.mu.Unlock()
+		return
+	}
+	d.last[target] = time.Now()
+	d.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		diagnosis, derr := diagnoseDial(ctx, d.ts, target, err)
+		if derr != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(derr), logger.ErrValue(derr)).
+				Str("target", target).
+				Msg("failed to diagnose dial")
+			return
+		}
+		logger.Stderr.Warn().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("target", target).
+			Str("diagnosis", diagnosis).
+			Msg("target unreachable")
+	}()
+}
+
+// diagnoseDial explains, in a sentence meant for humans, why dialing target failed
+// with err.
+func diagnoseDial(ctx context.Context, ts *tsnet.Server, target string, err error) (string, error) {
+	addr, aerr := dialAddr(target)
+	if aerr != nil {
+		return "", aerr
+	}
+	host, port, aerr := net.SplitHostPort(addr)
+	if aerr != nil {
+		return "", aerr
+	}
+
+	lc, lerr := localClient(ts)
+	if lerr != nil {
+		return "", lerr
+	}
+	status, serr := lc.Status(ctx)
+	if serr != nil {
+		return "", serr
+	}
+
+	self, identity := "this node", "this node's tags or user"
+	if status.Self != nil {
+		self = status.Self.HostName
+		identity = nodeIdentity(status, status.Self)
+	}
+
+	peer, via := findPeer(status, host)
+	switch {
+	case peer == nil:
+		return fmt.Sprintf("node %s cannot see %s: no tailnet peer has this address or name. "+
+			"Check that the address is right and that the tailnet ACLs let %s reach %s",
+			self, host, identity, net.JoinHostPort(host, port)), nil
+	case !peer.Online:
+		return fmt.Sprintf("peer %s (%s) is offline", peer.HostName, host), nil
+	case via != "":
+		return fmt.Sprintf("node %s sees subnet router %s for %s, but connecting to port %s failed (%v). "+
+			"Check that the tailnet ACLs let %s reach %s, and that the router reaches it",
+			self, peer.HostName, via, port, err, identity, net.JoinHostPort(host, port)), nil
+	default:
+		return fmt.Sprintf("node %s sees %s, but connecting to port %s failed (%v). "+
+			"Check that the tailnet ACLs let %s reach %s, and that something listens on it",
+			self, peer.HostName, port, err, identity, net.JoinHostPort(peer.HostName, port)), nil
+	}
+}
+
+// findPeer returns the peer host (a Tailscale IP, a MagicDNS name or an address routed
+// by a subnet router) belongs to, and the route it was found by, if any.
+func findPeer(status *ipnstate.Status, host string) (*ipnstate.PeerStatus, string) {
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		name := strings.ToLower(strings.TrimSuffix(host, "."))
+		for _, peer := range status.Peer {
+			dnsName := strings.ToLower(strings.TrimSuffix(peer.DNSName, "."))
+			if dnsName == name || strings.HasPrefix(dnsName, name+".") || strings.EqualFold(peer.HostName, name) {
+				return peer, ""
+			}
+		}
+		return nil, ""
+	}
+
+	for _, peer := range status.Peer {
+		for _, peerIP := range peer.TailscaleIPs {
+			if peerIP == ip.Unmap() {
+				return peer, ""
+			}
+		}
+	}
+	for _, peer := range status.Peer {
+		if peer.PrimaryRoutes == nil {
+			continue
+		}
+		for _, route := range peer.PrimaryRoutes.All() {
+			if route.Contains(ip.Unmap()) {
+				return peer, route.String()
+			}
+		}
+	}
+
+	return nil, ""
+}
+
+// nodeIdentity returns what the tailnet ACLs know node as: its tags, or its user.
+func nodeIdentity(status *ipnstate.Status, node *ipnstate.PeerStatus) string {
+	if node.Tags != nil && node.Tags.Len() > 0 {
+		return strings.Join(node.Tags.AsSlice(), ", ")
+	}
+	if user, ok := status.User[node.UserID]; ok {
+		return user.LoginName
+	}
+
+	return node.HostName
+}
+
+// doctorCommand implements `railtail doctor`. It brings up an ephemeral node with the
+// same configuration (and auth key) as railtail, dials every target from it, and
+// explains why those it cannot reach fail. It returns the process exit code.
+func doctorCommand(args []string) int {
+	os.Args = append(os.Args[:1], args...)
+	cfg, errs := LoadConfig()
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "configuration error:", err)
+		}
+		return 1
+	}
+
+	dir, err := os.MkdirTemp("", "railtail-doctor")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	// A node of its own, so that a running railtail keeps its state
+	ts := &tsnet.Server{
+		Hostname:   cfg.TSHostname + "-doctor",
+		AuthKey:    cfg.TSAuthKey,
+		ControlURL: cfg.TSLoginServer,
+		Ephemeral:  true,
+		Dir:        filepath.Join(dir, "railtail"),
+		UserLogf:   func(string, ...any) {},
+		Logf:       func(string, ...any) {},
+	}
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := ts.Up(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to bring tailscale server up:", err)
+		return 1
+	}
+
+	// Targets are dialed as railtail dials them
+	ipFamilies = newFamilyDialer(ts, cfg.TargetIPFamily)
+	staticHosts = newHostsTable(cfg.StaticHosts)
+	targetEnv.set(cfg.TargetEnv)
+	dial := targetDialer(ts.Dial)
+
+	targets := append([]string(nil), cfg.Targets...)
+	for _, t := range cfg.Tunnels {
+		if t.mode() != TunnelModeProxy {
+			targets = append(targets, splitList(t.Target)...)
+		}
+	}
+	if len(targets) == 0 {
+		fmt.Println("no targets to check")
+		return 0
+	}
+
+	failed := 0
+	for _, target := range targets {
+		addr, err := dialAddr(target)
+		if err == nil {
+			dialCtx, dialCancel := context.WithTimeout(ctx, 10*time.Second)
+			start := time.Now()
+			var conn net.Conn
+			if conn, err = dial(dialCtx, "tcp", addr); err == nil {
+				_ = conn.Close()
+				fmt.Printf("ok    %s (connected in %s)\n", target, time.Since(start).Round(time.Millisecond))
+			}
+			dialCancel()
+		}
+		if err == nil {
+			continue
+		}
+
+		failed++
+		err = classifyError(addr, true, err)
+		diagnosis, derr := diagnoseDial(ctx, ts, target, err)
+		if derr != nil || errors.Is(err, ErrRefused) || errors.Is(err, ErrTLS) {
+			diagnosis = err.Error()
+		}
+		fmt.Printf("FAIL  %s: %s\n", target, diagnosis)
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
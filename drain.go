@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// drainingConns counts the connections and requests to removed targets still open.
+var drainingConns = metrics.Default.Gauge("railtail_connections_draining",
+	"Connections (TCP) and requests (HTTP) to removed targets or tunnels still draining.")
+
+// drain lets the connections and requests open now that match finish on their own for
+// DRAIN_TIMEOUT, and closes those still open after it. New traffic is already sent
+// elsewhere by the caller; removal and target describe what was removed, for the logs.
+// Without a DRAIN_TIMEOUT, connections are left to finish on their own.
+func (r *connRegistry) drain(match func(*trackedConn) bool, removal, target string) {
+	if r.drainTimeout > 0 {
+		r.drainFor(match, removal, target, r.drainTimeout)
+	}
+}
+
+// drainFor is drain with a timeout of its own. With a timeout of 0, the connections are
+// closed right away.
+func (r *connRegistry) drainFor(match func(*trackedConn) bool, removal, target string, timeout time.Duration) {
+	var draining []*trackedConn
+	r.mu.Lock()
+	for _, c := range r.conns {
+		if match(c) && c.draining.CompareAndSwap(false, true) {
+			drainingConns.Inc()
+			draining = append(draining, c)
+		}
+	}
+	r.mu.Unlock()
+	if len(draining) == 0 {
+		return
+	}
+
+	logger.Stdout.Info().
+		Str("removal", removal).
+		Str("target", target).
+		Int("connections", len(draining)).
+		Dur("drain-timeout", timeout).
+		Msg("draining connections")
+	if timeout == 0 {
+		r.closeDraining(draining, removal, target)
+		return
+	}
+	time.AfterFunc(timeout, func() { r.closeDraining(draining, removal, target) })
+}
+
+// closeDraining closes the connections among draining still open.
+func (r *connRegistry) closeDraining(draining []*trackedConn, removal, target string) {
+	var open []*trackedConn
+	r.mu.Lock()
+	for _, c := range draining {
+		if _, ok := r.conns[c.id]; ok {
+			open = append(open, c)
+		}
+	}
+	r.mu.Unlock()
+	if len(open) == 0 {
+		return
+	}
+
+	// Closed outside the lock, as closing connections removes them from the registry
+	for _, c := range open {
+		c.setCloseReason(CloseDrained)
+		if closer := c.closer.Load(); closer != nil {
+			(*closer)()
+		}
+	}
+	logger.Stderr.Warn().
+		Str("removal", removal).
+		Str("target", target).
+		Int("connections", len(open)).
+		Msg("closed connections still draining")
+}
+
+// countDrained counts the end of c if it was draining: completed on its own, or closed at
+// the end of DRAIN_TIMEOUT.
+func (c *trackedConn) countDrained() {
+	if !c.draining.Load() {
+		return
+	}
+
+	drainingConns.Dec()
+	outcome := "completed"
+	if c.closeReason() == CloseDrained {
+		outcome = "forced"
+	}
+	metrics.Default.Counter("railtail_connections_drained_total",
+		"Connections (TCP) and requests (HTTP) to removed targets or tunnels that drained, by outcome: "+
+			"completed within DRAIN_TIMEOUT, or forced closed after it.",
+		"kind", c.kind, "outcome", outcome).Inc()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// ErrListenerTLSInvalid is returned for inconsistent local TLS settings.
+var ErrListenerTLSInvalid = errors.New("listener TLS settings are invalid")
+
+// validateListenerTLS checks the settings for terminating TLS on the local listener.
+func validateListenerTLS(cfg *Config) []error {
+	var errors_ []error
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		errors_ = append(errors_, fmt.Errorf("%w: TLS_CERT_FILE and TLS_KEY_FILE must be set together",
+			ErrListenerTLSInvalid))
+	}
+
+	if cfg.TLSCertFile == "" && len(cfg.ACMEDomains) == 0 {
+		if cfg.HTTPRedirectPort != "" || cfg.HSTSMaxAge > 0 || cfg.TLSClientCAFile != "" || cfg.TLSClientSPIFFE {
+			errors_ = append(errors_, fmt.Errorf("%w: HTTP_REDIRECT_PORT, HSTS_MAX_AGE, TLS_CLIENT_CA_FILE and TLS_CLIENT_SPIFFE require TLS_CERT_FILE or ACME_DOMAINS",
+				ErrListenerTLSInvalid))
+		}
+		return errors_
+	}
+
+	if cfg.ForwardTrafficType == ForwardTrafficTypeTCP {
+		errors_ = append(errors_, fmt.Errorf("%w: TLS can only be terminated in HTTP and Tailnet Proxy modes",
+			ErrListenerTLSInvalid))
+	}
+	if cfg.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			errors_ = append(errors_, fmt.Errorf("%w: %w", ErrListenerTLSInvalid, err))
+		}
+	}
+	if cfg.HTTPRedirectPort != "" {
+		if err := validateListenPort(cfg.HTTPRedirectPort); err != nil {
+			errors_ = append(errors_, fmt.Errorf("HTTP_REDIRECT_PORT: %w", err))
+		} else if cfg.HTTPRedirectPort == cfg.ListenPort {
+			errors_ = append(errors_, fmt.Errorf("%w: HTTP_REDIRECT_PORT must differ from LISTEN_PORT",
+				ErrListenerTLSInvalid))
+		}
+	}
+	if cfg.HSTSMaxAge < 0 {
+		errors_ = append(errors_, fmt.Errorf("%w: HSTS_MAX_AGE must not be negative", ErrListenerTLSInvalid))
+	}
+	if cfg.TLSClientCAFile != "" {
+		if _, err := loadClientCAs(cfg.TLSClientCAFile); err != nil {
+			errors_ = append(errors_, fmt.Errorf("%w: TLS_CLIENT_CA_FILE: %w", ErrListenerTLSInvalid, err))
+		}
+	}
+	if cfg.TLSClientSPIFFE {
+		if cfg.TLSClientCAFile != "" {
+			errors_ = append(errors_, fmt.Errorf("%w: TLS_CLIENT_CA_FILE and TLS_CLIENT_SPIFFE are exclusive",
+				ErrListenerTLSInvalid))
+		}
+		if cfg.SPIFFEEndpointSocket == "" {
+			errors_ = append(errors_, fmt.Errorf("%w: TLS_CLIENT_SPIFFE requires SPIFFE_ENDPOINT_SOCKET",
+				ErrListenerTLSInvalid))
+		}
+	}
+	switch cfg.TLSClientAuth {
+	case TLSClientAuthRequire, TLSClientAuthOptional:
+	default:
+		errors_ = append(errors_, fmt.Errorf("%w: TLS_CLIENT_AUTH must be require or optional, got '%s'",
+			ErrListenerTLSInvalid, cfg.TLSClientAuth))
+	}
+
+	return errors_
+}
+
+// listenerTLS returns the TLS configuration of the listener, using the configured
+// certificate or ACME, and verifying client certificates if configured, and a wrapper
+// for the handler of the plain HTTP listener.
+func listenerTLS(cfg *Config, stateDir string) (*tls.Config, func(http.Handler) http.Handler, error) {
+	var (
+		tlsConfig   *tls.Config
+		httpHandler = func(next http.Handler) http.Handler { return next }
+	)
+	if len(cfg.ACMEDomains) > 0 {
+		tlsConfig, httpHandler = newACMEConfig(cfg, filepath.Join(stateDir, "acme"))
+	} else {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+	}
+
+	if cfg.TLSClientCAFile != "" || cfg.TLSClientSPIFFE {
+		if err := requireClientCerts(tlsConfig, cfg); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return tlsConfig, httpHandler, nil
+}
+
+// hsts sets the Strict-Transport-Security header on every response of next.
+func hsts(cfg *Config, next http.Handler) http.Handler {
+	value := "max-age=" + strconv.Itoa(int(cfg.HSTSMaxAge.Seconds()))
+	if cfg.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if cfg.HSTSPreload {
+		value += "; preload"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpsRedirect redirects every request to the TLS listener on httpsPort.
+func httpsRedirect(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := hostOnly(r.Host)
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// serveHTTPSRedirect runs the plain HTTP server on addr. It is meant to be started in
+// its own goroutine.
+func serveHTTPSRedirect(addr string, handler http.Handler) {
+	logger.Stdout.Info().
+		Str("redirect-addr", addr).
+		Msg("starting http to https redirect server")
+
+	server := http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: 5 * time.Second,
+		Handler:           handler,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("redirect-addr", addr).
+			Msg("http to https redirect server stopped")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Categories of forwarding errors. A forwardError matches its category with errors.Is,
+// and ErrDial too when the target could not be connected to.
+var (
+	ErrDial      = errors.New("failed to connect to the target")
+	ErrTLS       = errors.New("TLS handshake with the target failed")
+	ErrTimeout   = errors.New("timed out")
+	ErrRefused   = errors.New("the target refused the connection")
+	ErrACLDenied = errors.New("the target is not reachable from this node over the tailnet")
+)
+
+// forwardError is an error forwarding to target, classified into a category.
+type forwardError struct {
+	category error // one of the categories above, or nil if none applies
+	dial     bool  // the target could not be connected to, nothing was sent
+	target   string
+	err      error
+}
+
+func (e *forwardError) Error() string {
+	switch {
+	case errors.Is(e.category, ErrACLDenied):
+		// The bare error is an i/o timeout or "no route to host", which says nothing useful
+		return e.target + ": " + e.category.Error() +
+			" (is it online, and do the tailnet ACLs let this node reach it?): " + e.err.Error()
+	case e.category != nil:
+		return e.target + ": " + e.category.Error() + ": " + e.err.Error()
+	default:
+		return e.err.Error()
+	}
+}
+
+func (e *forwardError) Unwrap() []error {
+	errs := []error{e.err}
+	if e.category != nil {
+		errs = append(errs, e.category)
+	}
+	if e.dial {
+		errs = append(errs, ErrDial)
+	}
+
+	return errs
+}
+
+// retryable reports whether the request or connection can be retried safely: it never
+// reached the target, and trying again may work.
+func (e *forwardError) retryable() bool {
+	return e.dial && !errors.Is(e.category, ErrACLDenied)
+}
+
+// classifyError classifies err, returned forwarding to target, into a forwardError,
+// unless it already is one. dial tells whether it happened connecting to the target;
+// errors of dialing over the tailnet are recognized as such anyway.
+func classifyError(target string, dial bool, err error) error {
+	if err == nil {
+		return nil
+	}
+	var fe *forwardError
+	if errors.As(err, &fe) {
+		return err
+	}
+
+	var (
+		opErr       *net.OpError
+		netErr      net.Error
+		recordErr   tls.RecordHeaderError
+		certErr     *tls.CertificateVerificationError
+		unknownAuth x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		alertErr    tls.AlertError
+	)
+	if errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "connect") {
+		dial = true
+	}
+
+	e := &forwardError{dial: dial, target: target, err: err}
+	message := err.Error()
+	switch {
+	case errors.As(err, &recordErr), errors.As(err, &certErr), errors.As(err, &unknownAuth),
+		errors.As(err, &hostnameErr), errors.As(err, &alertErr), strings.Contains(message, "tls: "):
+		e.category = ErrTLS
+	case errors.Is(err, syscall.ECONNREFUSED), strings.Contains(message, "connection was refused"),
+		strings.Contains(message, "connection refused"):
+		e.category = ErrRefused
+	case dial && (errors.Is(err, syscall.EHOSTUNREACH) || strings.Contains(message, "no route to host") ||
+		strings.Contains(message, "host is unreachable")):
+		// Netstack has no peer routing the address
+		e.category = ErrACLDenied
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		e.category = ErrTimeout
+	}
+
+	return e
+}
+
+// errorCategory returns the name of the category of err, for logs and metrics.
+func errorCategory(err error) string {
+	switch {
+	case errors.Is(err, ErrACLDenied):
+		return "acl-denied"
+	case errors.Is(err, ErrRefused):
+		return "refused"
+	case errors.Is(err, ErrTLS):
+		return "tls"
+	case errors.Is(err, ErrTimeout):
+		if errors.Is(err, ErrDial) {
+			return "dial-timeout"
+		}
+		return "timeout"
+	case errors.Is(err, ErrDial):
+		return "dial"
+	default:
+		return "other"
+	}
+}
+
+// isRetryable reports whether err, returned forwarding a request or connection, leaves
+// it safe to retry.
+func isRetryable(err error) bool {
+	var fe *forwardError
+	return errors.As(err, &fe) && fe.retryable()
+}
+
+// countForwardError counts a forwarding error of kind (tcp or http) by category.
+func countForwardError(kind string, err error) {
+	metrics.Default.Counter("railtail_forward_errors_total",
+		"Errors forwarding connections (TCP) and requests (HTTP), by category.",
+		"kind", kind, "category", errorCategory(err)).Inc()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+const (
+	// copyStallThreshold is how long a write of a TCP connection must block to count as a
+	// stall: the receiving side not taking data as fast as the sending side delivers it.
+	copyStallThreshold = 100 * time.Millisecond
+	// copyStallWarnThreshold is how long a single stall must last to be logged.
+	copyStallWarnThreshold = 10 * time.Second
+)
+
+// copyStallBuckets are the bounds of the stalls of TCP connections, in seconds.
+var copyStallBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// copyDirection is what the copies of TCP connections in a direction report to, kept
+// around as they are updated on every write.
+type copyDirection struct {
+	name     string
+	buffered *metrics.Gauge
+	stalls   *metrics.Histogram
+	paused   *metrics.Counter
+}
+
+var (
+	copyIn  = newCopyDirection("in")
+	copyOut = newCopyDirection("out")
+)
+
+func newCopyDirection(name string) *copyDirection {
+	return &copyDirection{
+		name: name,
+		buffered: metrics.Default.Gauge("railtail_copy_buffered_bytes",
+			"Bytes read from one side of TCP connections and not yet written to the other, by direction.",
+			"direction", name),
+		stalls: metrics.Default.HistogramWithBuckets("railtail_copy_stall_seconds",
+			"Writes of TCP connections blocked for 100ms or more, by direction.",
+			copyStallBuckets, "direction", name),
+		paused: metrics.Default.Counter("railtail_copy_reads_paused_total",
+			"Times reading a side of TCP connections paused with TCP_MAX_INFLIGHT_KB waiting for the other, by direction.",
+			"direction", name),
+	}
+}
+
+// copyFlow watches one direction of a TCP connection for backpressure: how much it read
+// and has not written yet, and how long its writes blocked, both in total and per
+// connection. With maxInflight set, it reads ahead of the writes by up to that many
+// bytes, see copyAhead.
+type copyFlow struct {
+	dir         *copyDirection
+	conn        *trackedConn
+	buffered    *atomic.Int64 // of conn, in this direction
+	stalled     *atomic.Int64 // of conn, in this direction, in nanoseconds
+	maxInflight int64
+}
+
+// newCopyFlows returns the flows of the client-to-target (in) and target-to-client (out)
+// directions of conn, reading ahead by up to maxInflight bytes each if not 0.
+func newCopyFlows(conn *trackedConn, maxInflight int64) (in, out *copyFlow) {
+	in = &copyFlow{dir: copyIn, conn: conn, buffered: &conn.bufferedIn, stalled: &conn.stalledIn, maxInflight: maxInflight}
+	out = &copyFlow{dir: copyOut, conn: conn, buffered: &conn.bufferedOut, stalled: &conn.stalledOut, maxInflight: maxInflight}
+
+	return in, out
+}
+
+// addBuffered records n more bytes (fewer if negative) read and waiting to be written.
+func (f *copyFlow) addBuffered(n int) {
+	f.buffered.Add(int64(n))
+	f.dir.buffered.Add(int64(n))
+}
+
+// write writes p to dst, recording a stall if it blocks for copyStallThreshold or more.
+func (f *copyFlow) write(dst io.Writer, p []byte) (int, error) {
+	start := time.Now()
+	n, err := dst.Write(p)
+	if blocked := time.Since(start); blocked >= copyStallThreshold {
+		f.stall(blocked)
+	}
+
+	return n, err
+}
+
+// stall records a write blocked for d.
+func (f *copyFlow) stall(d time.Duration) {
+	f.stalled.Add(int64(d))
+	f.dir.stalls.Observe(d.Seconds())
+	if d < copyStallWarnThreshold {
+		return
+	}
+
+	logger.Stderr.Warn().
+		Str("direction", f.dir.name).
+		Str("remote-addr", f.conn.remoteAddr).
+		Str("target", f.conn.target).
+		Dur("stalled", d).
+		Int64("buffered", f.buffered.Load()).
+		Msg("tcp connection stalled")
+}
+
+// flowWriter is a writer recording the backpressure of a copy to it, see copyFlow.write.
+type flowWriter struct {
+	io.Writer
+	flow *copyFlow
+}
+
+func (w flowWriter) Write(p []byte) (int, error) {
+	w.flow.addBuffered(len(p))
+	defer w.flow.addBuffered(-len(p))
+
+	return w.flow.write(w.Writer, p)
+}
+
+// copyAhead copies from src to dst like copyConn, reading ahead of the writes by up to
+// maxInflight bytes, so that a side slow to take data for a moment, like a peer relayed
+// through DERP, does not hold up the reads of the other right away. Reading pauses once
+// maxInflight bytes wait to be written, which pushes back on the sender through TCP flow
+// control.
+func (f *copyFlow) copyAhead(dst io.Writer, src io.Reader, count func(int)) (int64, error) {
+	ring := &flowRing{buf: make([]byte, f.maxInflight)}
+	ring.cond = sync.NewCond(&ring.mu)
+	go ring.fill(f, src, count)
+
+	return ring.drain(f, dst)
+}
+
+// flowRing holds the bytes read ahead by copyAhead, from start, in a ring buffer.
+type flowRing struct {
+	buf []byte
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	start int
+	n     int
+	rerr  error // the read side ended, io.EOF at the end of its data
+	werr  error // the write side failed
+}
+
+// fill reads from src into the ring until src ends, or the write side fails.
+func (r *flowRing) fill(f *copyFlow, src io.Reader, count func(int)) {
+	for {
+		r.mu.Lock()
+		if r.n == len(r.buf) && r.werr == nil {
+			f.dir.paused.Inc()
+			for r.n == len(r.buf) && r.werr == nil {
+				r.cond.Wait()
+			}
+		}
+		if r.werr != nil {
+			r.mu.Unlock()
+			return
+		}
+		// The free space up to the end of the buffer, which drain does not touch
+		end := (r.start + r.n) % len(r.buf)
+		free := min(len(r.buf)-r.n, len(r.buf)-end)
+		r.mu.Unlock()
+
+		n, err := src.Read(r.buf[end : end+free])
+		count(n)
+
+		r.mu.Lock()
+		if r.werr == nil {
+			r.n += n
+			f.addBuffered(n)
+		}
+		if err != nil {
+			r.rerr = err
+		}
+		r.cond.Broadcast()
+		r.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// drain writes what fill reads to dst, until the read side ends and everything read was
+// written, or a write fails.
+func (r *flowRing) drain(f *copyFlow, dst io.Writer) (int64, error) {
+	var total int64
+	for {
+		r.mu.Lock()
+		for r.n == 0 && r.rerr == nil {
+			r.cond.Wait()
+		}
+		if r.n == 0 {
+			err := r.rerr
+			r.mu.Unlock()
+			if err == io.EOF {
+				return total, nil
+			}
+			return total, err
+		}
+		// The filled bytes up to the end of the buffer, which fill does not touch
+		p := r.buf[r.start : r.start+min(r.n, len(r.buf)-r.start)]
+		r.mu.Unlock()
+
+		n, err := f.write(dst, p)
+		total += int64(n)
+		f.addBuffered(-n)
+
+		r.mu.Lock()
+		r.start = (r.start + n) % len(r.buf)
+		r.n -= n
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			r.werr = err
+			// What is left is never written
+			f.addBuffered(-r.n)
+		}
+		r.cond.Broadcast()
+		r.mu.Unlock()
+		if err != nil {
+			return total, err
+		}
+	}
+}
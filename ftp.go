@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+var (
+	// ErrFTPPassiveInvalid is returned for FTP passive port settings that cannot be used.
+	ErrFTPPassiveInvalid = errors.New("FTP passive ports are invalid")
+	// ErrFTPPassiveUnavailable is returned when no passive port is free for a transfer.
+	ErrFTPPassiveUnavailable = errors.New("no FTP passive port available")
+)
+
+const (
+	// ftpDataTimeout bounds the wait for a client to open the data connection it was told
+	// about in a passive-mode reply.
+	ftpDataTimeout = 30 * time.Second
+	// ftpDataDialTimeout bounds dialing the data port of the server.
+	ftpDataDialTimeout = 10 * time.Second
+)
+
+// ftpPassive is the pool of local ports FTP data connections are accepted on, set in
+// main. It is nil without FTP_PASSIVE_PORTS.
+var ftpPassive *ftpPassivePorts
+
+// ftpPassivePorts opens the data connections of FTP transfers in passive mode. Only the
+// control connection of an FTP session goes through the listener it was accepted by; the
+// server then tells the client, for each transfer, an address to open a data connection
+// to, which is on the tailnet. railtail listens on one of its own ports instead, and
+// forwards the connection it accepts there to the address the server gave.
+type ftpPassivePorts struct {
+	first, last int
+	address     net.IP // announced in PASV replies; the local address of the control connection if nil
+
+	mu    sync.Mutex
+	inUse map[int]bool
+}
+
+// newFTPPassivePorts returns the ftpPassivePorts of the port range ports, like
+// 30000-30009, announcing the IPv4 address address to PASV clients. It returns nil
+// without ports.
+func newFTPPassivePorts(ports, address string) (*ftpPassivePorts, error) {
+	if ports == "" {
+		if address != "" {
+			return nil, fmt.Errorf("%w: an address requires ports", ErrFTPPassiveInvalid)
+		}
+		return nil, nil
+	}
+
+	from, to, found := strings.Cut(ports, "-")
+	if !found {
+		to = from
+	}
+	first, err1 := strconv.Atoi(strings.TrimSpace(from))
+	last, err2 := strconv.Atoi(strings.TrimSpace(to))
+	if err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+		return nil, fmt.Errorf("%w: expected a port or a range like 30000-30009, got '%s'", ErrFTPPassiveInvalid, ports)
+	}
+	p := &ftpPassivePorts{first: first, last: last, inUse: make(map[int]bool)}
+	if address != "" {
+		if p.address = net.ParseIP(address).To4(); p.address == nil {
+			return nil, fmt.Errorf("%w: expected an IPv4 address, got '%s'", ErrFTPPassiveInvalid, address)
+		}
+	}
+
+	return p, nil
+}
+
+// announced returns the IPv4 address to tell PASV clients of the control connection
+// accepted on local, or nil if there is none.
+func (p *ftpPassivePorts) announced(local net.Addr) net.IP {
+	if p.address != nil {
+		return p.address
+	}
+	if tcpAddr, ok := local.(*net.TCPAddr); ok {
+		return tcpAddr.IP.To4()
+	}
+
+	return nil
+}
+
+// open listens on a free port for the data connection of client, forwarded to target
+// with dial, and returns the port. The port is given back once the client connected, or
+// after ftpDataTimeout.
+func (p *ftpPassivePorts) open(client net.Addr, target string, dial dialFunc) (int, error) {
+	if p == nil {
+		return 0, fmt.Errorf("%w: FTP_PASSIVE_PORTS is not set", ErrFTPPassiveUnavailable)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for port := p.first; port <= p.last; port++ {
+		if p.inUse[port] {
+			continue
+		}
+		listener, err := net.Listen("tcp", "[::]:"+strconv.Itoa(port))
+		if err != nil {
+			continue // taken by another process
+		}
+		p.inUse[port] = true
+		go p.serve(listener.(*net.TCPListener), port, client, target, dial)
+		return port, nil
+	}
+
+	return 0, ErrFTPPassiveUnavailable
+}
+
+// serve accepts the data connection of client on listener and forwards it to target.
+// Connections from other addresses are refused: any client could otherwise take over a
+// transfer by connecting first.
+func (p *ftpPassivePorts) serve(listener *net.TCPListener, port int, client net.Addr, target string, dial dialFunc) {
+	conn := p.accept(listener, port, client)
+	if conn == nil {
+		return
+	}
+
+	forwardFTPData(conn, target, dial)
+}
+
+// accept returns the first connection of client on listener, or nil if it did not
+// connect in time, and gives the port back.
+func (p *ftpPassivePorts) accept(listener *net.TCPListener, port int, client net.Addr) net.Conn {
+	defer func() {
+		_ = listener.Close()
+		p.mu.Lock()
+		delete(p.inUse, port)
+		p.mu.Unlock()
+	}()
+
+	_ = listener.SetDeadline(time.Now().Add(ftpDataTimeout))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			countFTPData("timeout")
+			logger.Stderr.Warn().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("remote-addr", client.String()).
+				Int("port", port).
+				Msg("FTP data connection not opened")
+			return nil
+		}
+		if !net.ParseIP(hostOnly(conn.RemoteAddr().String())).Equal(net.ParseIP(hostOnly(client.String()))) {
+			countFTPData("refused")
+			logger.Stderr.Warn().
+				Str("remote-addr", conn.RemoteAddr().String()).
+				Str("client-addr", client.String()).
+				Int("port", port).
+				Msg("FTP data connection refused: not from the client of the transfer")
+			_ = conn.Close()
+			continue
+		}
+		return conn
+	}
+}
+
+// forwardFTPData forwards the data connection conn to target, the data port of the
+// server, until both sides are done.
+func forwardFTPData(conn net.Conn, target string, dial dialFunc) {
+	defer conn.Close()
+
+	tracked := conns.open(connKindTCP, conn.LocalAddr(), conn.RemoteAddr().String(), target)
+	defer tracked.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ftpDataDialTimeout)
+	server, err := dial(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		countFTPData("failed")
+		tracked.setCloseReason(CloseDialFailed)
+		logger.Stderr.Warn().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("remote-addr", conn.RemoteAddr().String()).
+			Str("target-addr", target).
+			Msg("failed to dial FTP data port")
+		return
+	}
+	defer server.Close()
+	countFTPData("forwarded")
+
+	// Transfers go one way, ending with a close; the other way only carries that close
+	var g errgroup.Group
+	for _, pipe := range []struct {
+		dst, src         net.Conn
+		count            func(int)
+		reason           string
+		srcSide, dstSide string
+	}{
+		{server, conn, tracked.countIn, CloseClientEOF, "client", "upstream"},
+		{conn, server, tracked.countOut, CloseUpstreamEOF, "upstream", "client"},
+	} {
+		g.Go(func() error {
+			if _, err := copyConn(pipe.dst, pipe.src, &copyBuffers, pipe.count, nil); err != nil {
+				tracked.setCloseCause(copyFailureReason(err, pipe.srcSide, pipe.dstSide), err)
+				_ = conn.Close()
+				_ = server.Close()
+				return err
+			}
+			tracked.setCloseReason(pipe.reason)
+			if c, ok := pipe.dst.(interface{ CloseWrite() error }); ok {
+				return c.CloseWrite()
+			}
+			return pipe.dst.Close()
+		})
+	}
+	_ = g.Wait()
+}
+
+// countFTPData counts a data connection by result.
+func countFTPData(result string) {
+	metrics.Default.Counter("railtail_ftp_data_connections_total",
+		"Data connections of FTP transfers in passive mode, by result.", "result", result).Inc()
+}
+
+// ftpControl reads the replies of an FTP server on its control connection, opening a
+// passive port for each passive-mode reply (227 to PASV, 229 to EPSV) and pointing the
+// client there instead. Data connections are always dialed to the host of the server,
+// whatever address the reply names, so that a server cannot have railtail connect
+// anywhere else. Once the connection switches to TLS, with AUTH TLS or from the start,
+// the replies cannot be read anymore and are passed on as they are.
+type ftpControl struct {
+	net.Conn
+	r      *bufio.Reader
+	client net.Conn // the control connection of the client
+	host   string   // host of the server, where data connections are dialed
+	dial   dialFunc
+
+	pending   []byte
+	err       error
+	started   bool
+	midLine   bool // the last line read was longer than the buffer
+	encrypted bool
+}
+
+// newFTPControl returns conn, the control connection to the server at target, rewriting
+// the passive-mode replies for client.
+func newFTPControl(conn, client net.Conn, target string, dial dialFunc) *ftpControl {
+	return &ftpControl{Conn: conn, r: bufio.NewReader(conn), client: client, host: hostOnly(target), dial: dial}
+}
+
+// Read implements the io.Reader interface.
+func (c *ftpControl) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.encrypted {
+			return c.r.Read(p)
+		}
+
+		line, err := c.r.ReadSlice('\n')
+		if !c.started && len(line) > 0 {
+			c.started = true
+			c.encrypted = line[0] == tlsHandshakeRecord // implicit TLS
+		}
+		if !c.encrypted && !c.midLine {
+			line = c.reply(line)
+		}
+		c.midLine = errors.Is(err, bufio.ErrBufferFull)
+		if c.midLine {
+			err = nil
+		}
+		c.pending, c.err = line, err
+		if len(c.pending) == 0 {
+			return 0, c.err
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// reply returns line, a reply of the server, as it is passed on to the client.
+func (c *ftpControl) reply(line []byte) []byte {
+	var port int
+	var ok, extended bool
+	switch {
+	case bytes.HasPrefix(line, []byte("234")):
+		c.encrypted = true // AUTH TLS accepted, TLS starts after this reply
+		return line
+	case bytes.HasPrefix(line, []byte("227 ")):
+		port, ok = parsePASVReply(line)
+	case bytes.HasPrefix(line, []byte("229 ")):
+		port, ok = parseEPSVReply(line)
+		extended = true
+	default:
+		return line
+	}
+	if !ok {
+		return line
+	}
+
+	var ip net.IP
+	if !extended {
+		if ip = ftpPassive.announced(c.client.LocalAddr()); ip == nil {
+			return c.refuse(errors.New("no IPv4 address to announce, set FTP_PASSIVE_ADDRESS"))
+		}
+	}
+	local, err := ftpPassive.open(c.client.RemoteAddr(), net.JoinHostPort(c.host, strconv.Itoa(port)), c.dial)
+	if err != nil {
+		return c.refuse(err)
+	}
+
+	logger.Stdout.Debug().
+		Str("remote-addr", c.client.RemoteAddr().String()).
+		Str("target-addr", net.JoinHostPort(c.host, strconv.Itoa(port))).
+		Int("port", local).
+		Msg("FTP passive port opened")
+	if extended {
+		return fmt.Appendf(nil, "229 Entering Extended Passive Mode (|||%d|)\r\n", local)
+	}
+	return fmt.Appendf(nil, "227 Entering Passive Mode (%d,%d,%d,%d,%d,%d).\r\n",
+		ip[0], ip[1], ip[2], ip[3], local>>8, local&0xff)
+}
+
+// refuse returns the reply failing a transfer no passive port could be opened for.
+func (c *ftpControl) refuse(err error) []byte {
+	countFTPData("failed")
+	logger.Stderr.Warn().
+		Str(logger.ErrAttr(err), logger.ErrValue(err)).
+		Str("remote-addr", c.client.RemoteAddr().String()).
+		Msg("FTP passive port not opened")
+
+	return []byte("425 Can't open data connection.\r\n")
+}
+
+// parsePASVReply returns the port of a 227 reply, "227 Entering Passive Mode
+// (h1,h2,h3,h4,p1,p2)": the first six comma-separated numbers of the reply. The address
+// is ignored, see ftpControl.
+func parsePASVReply(line []byte) (int, bool) {
+	text := string(line[4:])
+	start := strings.IndexFunc(text, func(r rune) bool { return r >= '0' && r <= '9' })
+	if start < 0 {
+		return 0, false
+	}
+	end := strings.IndexFunc(text[start:], func(r rune) bool { return (r < '0' || r > '9') && r != ',' })
+	if end >= 0 {
+		text = text[start : start+end]
+	} else {
+		text = text[start:]
+	}
+
+	fields := strings.Split(text, ",")
+	if len(fields) != 6 {
+		return 0, false
+	}
+	var n [6]int
+	for i, field := range fields {
+		v, err := strconv.Atoi(field)
+		if err != nil || v > 255 {
+			return 0, false
+		}
+		n[i] = v
+	}
+	port := n[4]<<8 | n[5]
+
+	return port, port > 0
+}
+
+// parseEPSVReply returns the port of a 229 reply, "229 Entering Extended Passive Mode
+// (|||port|)", where | may be any delimiter.
+func parseEPSVReply(line []byte) (int, bool) {
+	text := string(line)
+	open := strings.IndexByte(text, '(')
+	if open < 0 || len(text) < open+5 {
+		return 0, false
+	}
+	d := text[open+1]
+	if text[open+2] != d || text[open+3] != d {
+		return 0, false
+	}
+	digits, rest, found := strings.Cut(text[open+4:], string(d))
+	if !found || !strings.HasPrefix(rest, ")") {
+		return 0, false
+	}
+	port, err := strconv.Atoi(digits)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, false
+	}
+
+	return port, true
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeTailnet is a Dialer standing in for the tsnet node in tests: the tailnet addresses
+// of peers lead to services listening on the loopback interface, and every other address
+// is unreachable.
+type fakeTailnet struct {
+	mu     sync.Mutex
+	peers  map[string]string // tailnet host:port -> loopback host:port
+	dialed []string
+}
+
+// newFakeTailnet returns a tailnet without peers.
+func newFakeTailnet() *fakeTailnet {
+	return &fakeTailnet{peers: make(map[string]string)}
+}
+
+// addPeer makes addr on the tailnet reach what listens on ln.
+func (n *fakeTailnet) addPeer(addr string, ln net.Listener) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.peers[addr] = ln.Addr().String()
+}
+
+// Dial implements the Dialer interface.
+func (n *fakeTailnet) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	n.dialed = append(n.dialed, addr)
+	local, ok := n.peers[addr]
+	n.mu.Unlock()
+
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("%s: %w", addr, syscall.EHOSTUNREACH)}
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, local)
+}
+
+// dials returns the addresses dialed so far.
+func (n *fakeTailnet) dials() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return slices.Clone(n.dialed)
+}
+
+// echoPeer listens on the loopback interface and sends back what each connection sends,
+// closing its end once the client closed its own.
+func echoPeer(t *testing.T) net.Listener {
+	t.Helper()
+
+	ln := listenLoopback(t)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+// httpPeer serves handler on the loopback interface.
+func httpPeer(t *testing.T, handler http.Handler) net.Listener {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	return srv.Listener
+}
+
+// dialObserver records what fwdTCP tells it about dialing the target.
+type dialObserver struct {
+	mu     sync.Mutex
+	calls  int
+	failed bool
+}
+
+func (o *dialObserver) observe(_ time.Duration, failed bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.calls++
+	o.failed = failed
+}
+
+// forwardTCPVia forwards a connection accepted on a loopback listener to targetAddr with
+// fwdTCP, dialing through dialer, and returns the address of the listener and fwdTCP's
+// result.
+func forwardTCPVia(t *testing.T, dialer Dialer, targetAddr string, opts tcpOptions, o *dialObserver) (string, <-chan error) {
+	t.Helper()
+
+	ln := listenLoopback(t)
+	results := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		results <- fwdTCP(conn, dialer, targetAddr, opts, o.observe)
+	}()
+
+	return ln.Addr().String(), results
+}
+
+// forwardHTTPVia forwards the requests of a loopback server to targetAddr with fwdHttp,
+// dialing through dialer, and returns the URL of the server and fwdHttp's results.
+func forwardHTTPVia(t *testing.T, dialer Dialer, targetAddr string) (string, <-chan error) {
+	t.Helper()
+
+	transport, err := newTargetTransport(dialer.Dial, TransportSettings{}, nil, false)
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	client := &http.Client{Transport: transport}
+
+	results := make(chan error, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results <- fwdHttp(client, targetAddr, w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL, results
+}
+
+// result waits for the next of results.
+func result(t *testing.T, results <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-results:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the forwarding to end")
+		return nil
+	}
+}
+
+func TestFwdTCPThroughTailnet(t *testing.T) {
+	tailnet := newFakeTailnet()
+	tailnet.addPeer("db.tailnet.ts.net:5432", echoPeer(t))
+	var o dialObserver
+	addr, results := forwardTCPVia(t, tailnet, "db.tailnet.ts.net:5432", tcpOptions{}, &o)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial railtail: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The end of the request is passed on, and the answer still comes back
+	if _, err := conn.Write([]byte("SELECT 1")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("failed to close the write side: %v", err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(got) != "SELECT 1" {
+		t.Errorf("read %q, want %q", got, "SELECT 1")
+	}
+
+	if err := result(t, results); err != nil {
+		t.Errorf("fwdTCP = %v, want nil", err)
+	}
+	if dials := tailnet.dials(); !slices.Equal(dials, []string{"db.tailnet.ts.net:5432"}) {
+		t.Errorf("dialed %v, want the target", dials)
+	}
+	if o.calls != 1 || o.failed {
+		t.Errorf("dial observed %d times, failed %v; want once, not failed", o.calls, o.failed)
+	}
+}
+
+func TestFwdTCPUnreachableTarget(t *testing.T) {
+	tailnet := newFakeTailnet()
+	var o dialObserver
+	addr, results := forwardTCPVia(t, tailnet, "gone.tailnet.ts.net:5432", tcpOptions{}, &o)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial railtail: %v", err)
+	}
+	defer conn.Close()
+
+	err = result(t, results)
+	if reason := closeReasonOf(err); reason != CloseDialFailed {
+		t.Errorf("close reason = %q, want %q (err: %v)", reason, CloseDialFailed, err)
+	}
+	if !closedWithin(conn, 5*time.Second) {
+		t.Error("client connection was left open")
+	}
+	if o.calls != 1 || !o.failed {
+		t.Errorf("dial observed %d times, failed %v; want once, failed", o.calls, o.failed)
+	}
+}
+
+func TestFwdHTTPThroughTailnet(t *testing.T) {
+	tailnet := newFakeTailnet()
+	tailnet.addPeer("web.tailnet.ts.net:8080", httpPeer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "%s %s host=%s proxy-authorization=%q body=%s",
+			r.Method, r.URL.RequestURI(), r.Host, r.Header.Get("Proxy-Authorization"), body)
+	})))
+	url, results := forwardHTTPVia(t, tailnet, "http://web.tailnet.ts.net:8080")
+
+	req, err := http.NewRequest(http.MethodPost, url+"/api/items?page=2", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+
+	want := `POST /api/items?page=2 host=web.tailnet.ts.net:8080 proxy-authorization="" body=hello`
+	if res.StatusCode != http.StatusOK || string(body) != want {
+		t.Errorf("got %d %q, want 200 %q", res.StatusCode, body, want)
+	}
+	if err := result(t, results); err != nil {
+		t.Errorf("fwdHttp = %v, want nil", err)
+	}
+}
+
+func TestFwdHTTPUnreachableTarget(t *testing.T) {
+	url, results := forwardHTTPVia(t, newFakeTailnet(), "http://gone.tailnet.ts.net:8080")
+
+	res, err := http.Get(url + "/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", res.StatusCode, http.StatusBadGateway)
+	}
+	if err := result(t, results); err == nil {
+		t.Error("fwdHttp = nil, want the dial error")
+	}
+}
+
+func TestTailnetProxyThroughTailnet(t *testing.T) {
+	tailnet := newFakeTailnet()
+	tailnet.addPeer("web.tailnet.ts.net:8080", httpPeer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s%s", r.Host, r.URL.Path)
+	})))
+
+	transport, err := newTargetTransport(tailnet.Dial, TransportSettings{}, nil, false)
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	proxy := NewTailnetProxy(&http.Client{Transport: transport}, false, proxyOptions{
+		searchDomain: "tailnet.ts.net",
+		logSample:    1,
+		quiet:        true,
+		allowedHosts: []hostPattern{mustCompileHostPattern(t, "*.tailnet.ts.net")},
+	})
+	srv := httptest.NewServer(proxy)
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		host   string
+		status int
+		body   string
+	}{
+		{"web.tailnet.ts.net:8080", http.StatusOK, "web.tailnet.ts.net:8080/status"},
+		{"web:8080", http.StatusOK, "web.tailnet.ts.net:8080/status"}, // short name
+		{"example.com", http.StatusForbidden, ""},
+		{"gone.tailnet.ts.net", http.StatusBadGateway, ""},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/status", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tt.host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request for %s failed: %v", tt.host, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+
+		if res.StatusCode != tt.status || tt.body != "" && string(body) != tt.body {
+			t.Errorf("request for %s: got %d %q, want %d %q", tt.host, res.StatusCode, body, tt.status, tt.body)
+		}
+	}
+
+	if slices.Contains(tailnet.dials(), "example.com:80") {
+		t.Error("a destination that is not allowed was dialed")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// healthCheckFailures is how many probes in a row must fail before a target is taken
+// out of load balancing. A single successful probe brings it back.
+const healthCheckFailures = 2
+
+// healthSettings configures active health checks of a targetPool.
+type healthSettings struct {
+	interval time.Duration
+	timeout  time.Duration
+	protocol string // probe spoken to the targets, see probeProtocol
+	dial     dialFunc
+}
+
+// targetProbe is the active health check state of a target.
+type targetProbe struct {
+	mu       sync.Mutex
+	failures int
+	down     bool
+}
+
+// isDown reports whether the target failed its health checks. It is always false when
+// health checks are disabled.
+func (t *poolTarget) isDown() bool {
+	if t.probe == nil {
+		return false
+	}
+
+	t.probe.mu.Lock()
+	defer t.probe.mu.Unlock()
+
+	return t.probe.down
+}
+
+// checkHealth probes every target of the pool every interval, starting right away. It
+// runs for the life of the pool.
+func (p *targetPool) checkHealth(settings *healthSettings) {
+	ticker := time.NewTicker(settings.interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, t := range p.targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.checkHealth(settings)
+			}()
+		}
+		wg.Wait()
+
+		<-ticker.C
+	}
+}
+
+// checkHealth probes the target once, and takes it out of or back into load balancing
+// when its health changes.
+func (t *poolTarget) checkHealth(settings *healthSettings) {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.timeout)
+	defer cancel()
+
+	start := time.Now()
+	detail, err := t.probeOnce(ctx, settings)
+	latency := time.Since(start)
+
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	metrics.Default.Counter("railtail_health_checks_total",
+		"Active health checks of targets, by result.", "target", t.addr, "result", result).Inc()
+
+	t.probe.mu.Lock()
+	wasDown := t.probe.down
+	if err != nil {
+		t.probe.failures++
+	} else {
+		t.probe.failures = 0
+	}
+	t.probe.down = t.probe.failures >= healthCheckFailures
+	down := t.probe.down
+	t.probe.mu.Unlock()
+
+	switch {
+	case down && !wasDown:
+		targetHealthyGauge(t.addr).Set(0)
+		logger.Stderr.Warn().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("target", t.addr).
+			Str("protocol", settings.protocol).
+			Msg("target failed its health checks")
+		hooks.emit(HookTargetUnhealthy, map[string]string{
+			"target": t.addr,
+			"reason": "health-check",
+			"error":  err.Error(),
+		})
+	case !down && wasDown:
+		targetHealthyGauge(t.addr).Set(1)
+		logger.Stdout.Info().
+			Str("target", t.addr).
+			Str("detail", detail).
+			Dur("latency", latency).
+			Msg("target passed its health check")
+		hooks.emit(HookTargetHealthy, map[string]string{"target": t.addr, "reason": "health-check"})
+	case !down:
+		targetHealthyGauge(t.addr).Set(1)
+	}
+}
+
+// probeOnce connects to the target and runs the protocol probe.
+func (t *poolTarget) probeOnce(ctx context.Context, settings *healthSettings) (string, error) {
+	conn, err := settings.dial(ctx, "tcp", t.addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	return probeProtocol(conn, settings.protocol)
+}
+
+func targetHealthyGauge(addr string) *metrics.Gauge {
+	return metrics.Default.Gauge("railtail_target_healthy",
+		"Whether the target passes its active health checks.", "target", addr)
+}
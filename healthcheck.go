@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"tailscale.com/tsnet"
+)
+
+// healthcheckTimeout bounds the whole `railtail healthcheck` run.
+const healthcheckTimeout = 5 * time.Second
+
+// healthz reports whether the tailscale node is running, or healthy without a tailnet
+// (NO_TAILSCALE). It backs the admin server's /healthz endpoint.
+func healthz(ts *tsnet.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ts == nil {
+			writeJSON(w, http.StatusOK, map[string]string{"backend_state": "NoTailscale"})
+			return
+		}
+		lc, err := localClient(ts)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		st, err := lc.StatusWithoutPeers(ctx)
+		if err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+
+		status := http.StatusOK
+		if st.BackendState != "Running" {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, map[string]string{"backend_state": st.BackendState})
+	}
+}
+
+// healthcheckCommand implements `railtail healthcheck`, for container health checks in
+// images without curl. It reads the same environment (or config file) as railtail and
+// queries /healthz on the admin server, or only checks that LISTEN_PORT accepts
+// connections if the admin server is disabled or only served on the tailnet. It returns
+// the process exit code.
+func healthcheckCommand() int {
+	cfg, errs := loadEnvironmentConfig()
+	if len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, "unhealthy:", errs[0])
+		return 1
+	}
+	applyRailwayEnvironment(cfg)
+
+	if err := healthcheck(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "unhealthy:", err)
+		return 1
+	}
+
+	return 0
+}
+
+func healthcheck(cfg *Config) error {
+	// An admin server on the tailnet is out of reach from inside the container
+	if cfg.AdminPort == "" || cfg.AdminNetwork == AdminNetworkTailnet {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", cfg.ListenPort), healthcheckTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := &http.Client{Timeout: healthcheckTimeout}
+	resp, err := client.Get("http://" + net.JoinHostPort("localhost", cfg.AdminPort) + "/healthz")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("/healthz returned %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+	"tailscale.com/tsnet"
+)
+
+// Hook events.
+const (
+	HookConnOpen        = "conn-open"
+	HookConnClose       = "conn-close"
+	HookTargetUnhealthy = "target-unhealthy"
+	HookTargetHealthy   = "target-healthy"
+	HookTSAuth          = "tsnet-auth"
+	HookSLOBurn         = "slo-burn"
+)
+
+// hookEvents lists every event hooks can subscribe to.
+var hookEvents = []string{HookConnOpen, HookConnClose, HookTargetUnhealthy, HookTargetHealthy, HookTSAuth, HookSLOBurn}
+
+// ErrHookInvalid is returned for hook settings that cannot be used.
+var ErrHookInvalid = errors.New("hook settings are invalid")
+
+// hookQueueSize bounds the events waiting for delivery; further events are dropped.
+const hookQueueSize = 256
+
+// unhealthyAfter is how many connections or requests in a row must fail before a
+// target is reported unhealthy.
+const unhealthyAfter = 3
+
+// backendPollInterval is how often the tailscale backend state is checked for the
+// tsnet-auth event.
+const backendPollInterval = 15 * time.Second
+
+// hooks delivers events to the configured webhook and command, nil when neither is set.
+var hooks *hookDispatcher
+
+// hookEvent is what hooks receive: the JSON body of the webhook, and the standard
+// input of the command.
+type hookEvent struct {
+	Event    string            `json:"event"`
+	Time     time.Time         `json:"time"`
+	Hostname string            `json:"hostname"`
+	Data     map[string]string `json:"data,omitempty"`
+}
+
+// hookDispatcher delivers events in the background, one at a time and in order.
+type hookDispatcher struct {
+	url      string
+	command  string
+	events   map[string]bool
+	hostname string
+	timeout  time.Duration
+	client   *http.Client
+
+	mu     sync.RWMutex // guards closing the queue
+	closed bool
+	queue  chan hookEvent
+	done   chan struct{}
+}
+
+// validateHooks checks the hook settings.
+func validateHooks(cfg *Config) []error {
+	var errors_ []error
+
+	if cfg.HookURL != "" {
+		if err := validateHTTPAddress(cfg.HookURL); err != nil {
+			errors_ = append(errors_, fmt.Errorf("HOOK_URL: %w", err))
+		}
+	}
+	for _, event := range cfg.HookEvents {
+		if !slices.Contains(hookEvents, event) {
+			errors_ = append(errors_, fmt.Errorf("%w: unknown event '%s' in HOOK_EVENTS (expected %s)",
+				ErrHookInvalid, event, strings.Join(hookEvents, ", ")))
+		}
+	}
+	if cfg.HookTimeout <= 0 {
+		errors_ = append(errors_, fmt.Errorf("%w: HOOK_TIMEOUT must be positive", ErrHookInvalid))
+	}
+
+	return errors_
+}
+
+// newHookDispatcher starts delivering events to the hooks of cfg, or returns nil if no
+// hook is configured.
+func newHookDispatcher(cfg *Config) *hookDispatcher {
+	if cfg.HookURL == "" && cfg.HookCommand == "" {
+		return nil
+	}
+
+	d := &hookDispatcher{
+		url:      cfg.HookURL,
+		command:  cfg.HookCommand,
+		events:   make(map[string]bool, len(cfg.HookEvents)),
+		hostname: cfg.TSHostname,
+		timeout:  cfg.HookTimeout,
+		client:   &http.Client{Timeout: cfg.HookTimeout},
+		queue:    make(chan hookEvent, hookQueueSize),
+		done:     make(chan struct{}),
+	}
+	for _, event := range cfg.HookEvents {
+		d.events[event] = true
+	}
+	go d.run()
+
+	return d
+}
+
+// wants reports whether event is delivered to the hooks. Callers check it before
+// building the event data.
+func (d *hookDispatcher) wants(event string) bool {
+	return d != nil && d.events[event]
+}
+
+// emit queues event for delivery. It never blocks: events are dropped when the queue
+// is full, so that a slow hook cannot hold up traffic.
+func (d *hookDispatcher) emit(event string, data map[string]string) {
+	if !d.wants(event) {
+		return
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+
+	select {
+	case d.queue <- hookEvent{Event: event, Time: time.Now().UTC(), Hostname: d.hostname, Data: data}:
+	default:
+		hookDeliveries(event, "dropped").Inc()
+	}
+}
+
+// drain stops accepting events and waits, up to the hook timeout, for the queued ones
+// to be delivered. It is meant for shutdown.
+func (d *hookDispatcher) drain() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-d.done:
+	case <-time.After(d.timeout):
+	}
+}
+
+// run delivers queued events until the queue is closed.
+func (d *hookDispatcher) run() {
+	defer close(d.done)
+
+	for e := range d.queue {
+		if err := d.deliver(e); err != nil {
+			hookDeliveries(e.Event, "failed").Inc()
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("event", e.Event).
+				Msg("failed to deliver hook event")
+			continue
+		}
+		hookDeliveries(e.Event, "ok").Inc()
+	}
+}
+
+// deliver sends e to the webhook and runs the command, whichever are configured.
+func (d *hookDispatcher) deliver(e hookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	var errs []error
+	if d.url != "" {
+		errs = append(errs, d.post(ctx, body))
+	}
+	if d.command != "" {
+		errs = append(errs, d.exec(ctx, e, body))
+	}
+
+	return errors.Join(errs...)
+}
+
+// post sends the event as JSON to the webhook.
+func (d *hookDispatcher) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("hook webhook failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// exec runs the command with the event name as its argument, the event as JSON on its
+// standard input, and its fields in RAILTAIL_* environment variables.
+func (d *hookDispatcher) exec(ctx context.Context, e hookEvent, body []byte) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, d.command, e.Event)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), hookEnv(e)...)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook command %s: %w: %s", e.Event, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// hookEnv returns the environment describing e to the hook command, e.g.
+// RAILTAIL_EVENT=conn-close and RAILTAIL_REMOTE_ADDR=10.0.0.1:5432.
+func hookEnv(e hookEvent) []string {
+	env := []string{
+		"RAILTAIL_EVENT=" + e.Event,
+		"RAILTAIL_TIME=" + e.Time.Format(time.RFC3339),
+		"RAILTAIL_HOSTNAME=" + e.Hostname,
+	}
+	for key, value := range e.Data {
+		env = append(env, "RAILTAIL_"+strings.ToUpper(key)+"="+value)
+	}
+
+	return env
+}
+
+func hookDeliveries(event, result string) *metrics.Counter {
+	return metrics.Default.Counter("railtail_hook_events_total",
+		"Events delivered to hooks, by event and result.", "event", event, "result", result)
+}
+
+// connOpenedEvent emits the conn-open event for c.
+func connOpenedEvent(c *trackedConn) {
+	if !hooks.wants(HookConnOpen) {
+		return
+	}
+
+	hooks.emit(HookConnOpen, map[string]string{
+		"id":          strconv.FormatUint(c.id, 10),
+		"kind":        c.kind,
+		"remote_addr": c.remoteAddr,
+		"target":      c.target,
+	})
+}
+
+// connClosedEvent emits the conn-close event for c.
+func connClosedEvent(c *trackedConn) {
+	if !hooks.wants(HookConnClose) {
+		return
+	}
+
+	hooks.emit(HookConnClose, map[string]string{
+		"id":          strconv.FormatUint(c.id, 10),
+		"kind":        c.kind,
+		"remote_addr": c.remoteAddr,
+		"target":      c.target,
+		"duration":    time.Since(c.startedAt).String(),
+		"bytes_in":    strconv.FormatInt(c.bytesIn.Load(), 10),
+		"bytes_out":   strconv.FormatInt(c.bytesOut.Load(), 10),
+		"reason":      c.closeReason(),
+	})
+}
+
+// targetHealth follows the consecutive failures of a target, to tell hooks when it
+// stops and starts working.
+type targetHealth struct {
+	mu        sync.Mutex
+	failures  int
+	unhealthy bool
+}
+
+// observeHealth records whether a connection or request to the target failed, emitting
+// target-unhealthy after unhealthyAfter failures in a row and target-healthy on the
+// first success after that.
+func (t *poolTarget) observeHealth(failed bool) {
+	if !hooks.wants(HookTargetUnhealthy) && !hooks.wants(HookTargetHealthy) {
+		return
+	}
+
+	t.health.mu.Lock()
+	if failed {
+		t.health.failures++
+	} else {
+		t.health.failures = 0
+	}
+	failures := t.health.failures
+	changed := (failures >= unhealthyAfter) != t.health.unhealthy
+	t.health.unhealthy = failures >= unhealthyAfter
+	t.health.mu.Unlock()
+
+	switch {
+	case !changed:
+	case failed:
+		hooks.emit(HookTargetUnhealthy, map[string]string{
+			"target":   t.addr,
+			"reason":   "failures",
+			"failures": strconv.Itoa(failures),
+		})
+	default:
+		hooks.emit(HookTargetHealthy, map[string]string{"target": t.addr, "reason": "success"})
+	}
+}
+
+// watchBackendState emits the tsnet-auth event whenever the state of the tailscale
+// backend changes (Running, NeedsLogin, ...), until ctx is cancelled. It is meant to be
+// started in its own goroutine.
+func watchBackendState(ctx context.Context, ts *tsnet.Server) {
+	if !hooks.wants(HookTSAuth) {
+		return
+	}
+
+	lc, err := localClient(ts)
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Msg("failed to get tailscale local client")
+		return
+	}
+
+	ticker := time.NewTicker(backendPollInterval)
+	defer ticker.Stop()
+
+	previous := ""
+	for {
+		st, err := lc.StatusWithoutPeers(ctx)
+		if err == nil && st.BackendState != previous {
+			hooks.emit(HookTSAuth, map[string]string{
+				"state":          st.BackendState,
+				"previous_state": previous,
+				"auth_url":       st.AuthURL,
+			})
+			previous = st.BackendState
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
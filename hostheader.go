@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Host headers of requests forwarded to HTTP targets (HOST_HEADER, host_header of routes),
+// besides an explicit host.
+const (
+	HostHeaderTarget   = "target"   // the host of the target URL
+	HostHeaderPreserve = "preserve" // the host the client sent, for virtual hosting targets
+)
+
+// ErrHostHeaderInvalid is returned for Host header settings that cannot be used.
+var ErrHostHeaderInvalid = errors.New("host header is invalid")
+
+// hostHeaderKey is the context key of the Host header setting of a request.
+type hostHeaderKey struct{}
+
+// validateHostHeader checks a Host header setting: target, preserve or a host[:port].
+func validateHostHeader(value string) error {
+	switch value {
+	case "", HostHeaderTarget, HostHeaderPreserve:
+		return nil
+	}
+
+	host := value
+	if h, _, err := net.SplitHostPort(value); err == nil {
+		host = h
+	}
+	if host == "" || strings.ContainsAny(value, "/ \t\r\n@?#") {
+		return fmt.Errorf("%w: expected target, preserve or a host, got '%s'", ErrHostHeaderInvalid, value)
+	}
+
+	return nil
+}
+
+// withHostHeader returns next forwarding requests with the Host header of setting.
+func withHostHeader(setting string, next http.Handler) http.Handler {
+	if setting == "" || setting == HostHeaderTarget {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), hostHeaderKey{}, setting)))
+	})
+}
+
+// hostHeaderOf returns the Host header setting of the request with ctx.
+func hostHeaderOf(ctx context.Context) string {
+	setting, _ := ctx.Value(hostHeaderKey{}).(string)
+	return setting
+}
+
+// outboundHost returns the Host header of a request from a client that sent clientHost,
+// forwarded to a target URL with the host targetHost, for setting. The TLS server name
+// of HTTPS targets is always targetHost.
+func outboundHost(setting, clientHost, targetHost string) string {
+	switch setting {
+	case "", HostHeaderTarget:
+		return targetHost
+	case HostHeaderPreserve:
+		return clientHost
+	default:
+		return setting
+	}
+}
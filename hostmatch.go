@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// ErrHostPattern is returned for host patterns that cannot be compiled.
+var ErrHostPattern = errors.New("invalid host pattern")
+
+// hostPattern is the compiled host condition of routes, redirects and rewrites. Patterns
+// are one of:
+//
+//   - a host name or IP address, matched case-insensitively
+//   - *.example.com, matching the subdomains of example.com (not example.com itself)
+//   - ~REGEX, a regular expression matched case-insensitively against the whole host
+//   - a CIDR like 10.0.0.0/8 or fd7a:115c:a1e0::/48, matching hosts given as an IP address
+//     in the range
+//
+// The zero hostPattern matches any host.
+type hostPattern struct {
+	pattern string
+	exact   string         // lowercase host
+	suffix  string         // lowercase, with the leading dot
+	re      *regexp.Regexp // anchored
+	prefix  netip.Prefix
+}
+
+// compileHostPattern compiles pattern, empty to match any host.
+func compileHostPattern(pattern string) (hostPattern, error) {
+	p := hostPattern{pattern: pattern}
+
+	switch {
+	case pattern == "":
+	case strings.HasPrefix(pattern, "~"):
+		expr := strings.TrimPrefix(pattern, "~")
+		if expr == "" {
+			return p, fmt.Errorf("%w %q: empty regular expression", ErrHostPattern, pattern)
+		}
+		// Compiled alone first, for errors to quote the expression as written
+		if _, err := regexp.Compile(expr); err != nil {
+			return p, fmt.Errorf("%w %q: %w", ErrHostPattern, pattern, err)
+		}
+		p.re = regexp.MustCompile(`(?i)^(?:` + expr + `)$`)
+	case strings.Contains(pattern, "/"):
+		prefix, err := netip.ParsePrefix(pattern)
+		if err != nil {
+			return p, fmt.Errorf("%w %q: %w", ErrHostPattern, pattern, err)
+		}
+		p.prefix = prefix.Masked()
+	case strings.HasPrefix(pattern, "*."):
+		suffix := strings.TrimPrefix(pattern, "*")
+		if len(suffix) < 2 {
+			return p, fmt.Errorf("%w %q: a domain is required after *.", ErrHostPattern, pattern)
+		}
+		if strings.Contains(suffix, "*") {
+			return p, fmt.Errorf("%w %q: wildcards are only allowed as the first label", ErrHostPattern, pattern)
+		}
+		p.suffix = strings.ToLower(suffix)
+	default:
+		if strings.ContainsAny(pattern, "*:/ ") && !isIPAddress(pattern) {
+			return p, fmt.Errorf("%w %q: not a host name; wildcards are written *.example.com and regular expressions ~REGEX", ErrHostPattern, pattern)
+		}
+		p.exact = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(pattern, "["), "]"))
+	}
+
+	return p, nil
+}
+
+// match reports whether host, without port, matches the pattern.
+func (p hostPattern) match(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(host)
+	case p.prefix.IsValid():
+		addr, err := netip.ParseAddr(host)
+		return err == nil && p.prefix.Contains(addr.Unmap())
+	case p.suffix != "":
+		return len(host) > len(p.suffix) && strings.HasSuffix(strings.ToLower(host), p.suffix)
+	case p.exact != "":
+		return strings.EqualFold(host, p.exact)
+	default:
+		return true
+	}
+}
+
+// String returns the pattern as configured.
+func (p hostPattern) String() string {
+	return p.pattern
+}
+
+func isIPAddress(s string) bool {
+	_, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	return err == nil
+}
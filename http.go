@@ -6,12 +6,118 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
 )
 
+// newForwardHandler returns a handler forwarding every request to a target of pool, for
+// route (empty for the main target) in metrics. With a spool, POST requests the target
+// cannot be reached for are spooled instead of failing (see webhookSpool).
+func newForwardHandler(route string, outboundClient *http.Client, pool *targetPool, spool *webhookSpool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := pool.pickHTTP(w, r)
+		targetAddr := target.addr
+
+		logClientIdentity(logger.Stdout.Info(), r).
+			Str("remote-addr", r.RemoteAddr).
+			Str("target", targetAddr).
+			Msg("forwarding")
+
+		trackRequest(w, r, targetAddr, func(w http.ResponseWriter, r *http.Request) {
+			// Wait for a slot if the target is at its concurrency limit
+			if err := target.limiter.acquire(r.Context()); err != nil {
+				logger.Stderr.Warn().
+					Str(logger.ErrAttr(err), logger.ErrValue(err)).
+					Str("remote-addr", r.RemoteAddr).
+					Str("target", targetAddr).
+					Str("reason", CloseLimitExceeded).
+					Msg("request refused")
+				setRequestCloseReason(r, CloseLimitExceeded)
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Error proxying request: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			defer target.limiter.release()
+
+			sw := &statusRecorder{ResponseWriter: w, start: time.Now()}
+
+			var err error
+			if spool != nil && r.Method == http.MethodPost {
+				err = spool.forward(targetAddr, sw, r)
+			} else {
+				err = fwdHttp(outboundClient, targetAddr, sw, r)
+			}
+			target.observe(sw.latency(), err != nil || sw.status >= http.StatusInternalServerError)
+			if err == nil {
+				sizeMetrics.observe(route, targetAddr, r)
+			}
+
+			if err != nil {
+				err = classifyError(targetAddr, false, err)
+				countForwardError(connKindHTTP, err)
+				dialDoctor.check(targetAddr, err)
+				reason := httpFailureReason(r, err)
+				setRequestCloseCause(r, reason, err)
+				logClientIdentity(logger.StderrWithSource.Error(), r).
+					Str(logger.ErrAttr(err), logger.ErrValue(err)).
+					Str("remote-addr", r.RemoteAddr).
+					Str("target", targetAddr).
+					Str("reason", reason).
+					Str("category", errorCategory(err)).
+					Bool("retryable", isRetryable(err)).
+					Msg("failed to forward http request")
+			}
+		})
+	})
+}
+
+// statusRecorder records the status code of a response and how long it took to start.
+type statusRecorder struct {
+	http.ResponseWriter
+	start    time.Time
+	status   int
+	headerAt time.Time
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.headerAt = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (flushing, hijacking).
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// latency is the time to the response headers, so streamed bodies don't count as slow.
+func (w *statusRecorder) latency() time.Duration {
+	if w.status == 0 {
+		return time.Since(w.start)
+	}
+	return w.headerAt.Sub(w.start)
+}
+
 // fwdHttp forwards an HTTP request to the target and returns any error.
 func fwdHttp(outboundClient *http.Client, targetAddr string,
 	w http.ResponseWriter, r *http.Request) error {
 
+	targetAddr, err := expandTarget(targetAddr)
+	if err != nil {
+		http.Error(w, "Error proxying request: "+err.Error(), http.StatusBadGateway)
+		return err
+	}
+
 	var (
 		mu          sync.Mutex
 		proxyError  error
@@ -30,15 +136,21 @@ func fwdHttp(outboundClient *http.Client, targetAddr string,
 			}
 
 			req.URL = targetURL
-			req.Host = targetURL.Host
+			req.Host = outboundHost(hostHeaderOf(req.Context()), req.Host, targetURL.Host)
 
 			for _, h := range hopHeaders {
 				req.Header.Del(h)
 			}
 		},
-		Transport: outboundClient.Transport,
+		Transport:      outboundClient.Transport,
+		ModifyResponse: runResponseHooks,
 		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
-			http.Error(w, "Error proxying request: "+err.Error(), http.StatusBadGateway)
+			err = classifyError(targetAddr, false, err)
+			status := http.StatusBadGateway
+			if errors.Is(err, ErrTimeout) {
+				status = http.StatusGatewayTimeout
+			}
+			http.Error(w, "Error proxying request: "+err.Error(), status)
 			mu.Lock()
 			proxyError = err
 			mu.Unlock()
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// idleWatch closes forwarded TCP connections that carried no traffic for the idle
+// timeout. With an application protocol set, connections waiting for a reply (the
+// client spoke last, e.g. a long query) are left alone, and idle connections are closed
+// the way the protocol's own servers do, so connection pools see an orderly shutdown.
+type idleWatch struct {
+	timeout  time.Duration
+	protocol string
+
+	mu              sync.Mutex
+	last            time.Time
+	clientSpokeLast bool
+	sniffed         bool
+	encrypted       bool // the client negotiated TLS, railtail cannot speak the protocol
+}
+
+func newIdleWatch(timeout time.Duration, protocol string) *idleWatch {
+	return &idleWatch{timeout: timeout, protocol: protocol, last: time.Now()}
+}
+
+// client records data sent by the client. The first data tells whether the connection
+// is encrypted, or any data for SMTP and FTP, where clients can switch to TLS later on.
+func (w *idleWatch) client(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.last = time.Now()
+	w.clientSpokeLast = true
+	if !w.sniffed || ((w.protocol == TCPProtocolSMTP || w.protocol == TCPProtocolFTP) && !w.encrypted) {
+		w.sniffed = true
+		w.encrypted = protocolEncrypted(w.protocol, p)
+	}
+}
+
+// target records n bytes sent by the target.
+func (w *idleWatch) target(n int) {
+	if n == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.last = time.Now()
+	w.clientSpokeLast = false
+}
+
+// run closes clientConn and targetConn once the connection is idle, calling closing
+// first, until ctx is cancelled. It is meant to be started in its own goroutine.
+func (w *idleWatch) run(ctx context.Context, clientConn, targetConn net.Conn, closing func()) {
+	timer := time.NewTimer(w.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		w.mu.Lock()
+		idle := time.Since(w.last)
+		waiting := w.protocol != TCPProtocolNone && w.clientSpokeLast
+		encrypted := w.encrypted
+		w.mu.Unlock()
+
+		if waiting {
+			timer.Reset(w.timeout)
+			continue
+		}
+		if idle < w.timeout {
+			timer.Reset(w.timeout - idle)
+			continue
+		}
+
+		metrics.Default.Counter("railtail_tcp_idle_closed_total",
+			"TCP connections closed after TCP_IDLE_TIMEOUT without traffic.").Inc()
+		logger.Stdout.Info().
+			Str("remote-addr", clientConn.RemoteAddr().String()).
+			Str("protocol", w.protocol).
+			Dur("idle", idle).
+			Msg("closing idle connection")
+
+		closing()
+		if !encrypted {
+			clientGoodbye, targetGoodbye := protocolGoodbye(w.protocol)
+			writeGoodbye(clientConn, clientGoodbye)
+			writeGoodbye(targetConn, targetGoodbye)
+		}
+		_ = clientConn.Close()
+		_ = targetConn.Close()
+		return
+	}
+}
+
+// writeGoodbye sends msg on conn, if any, without waiting long for a peer that stopped
+// reading.
+func writeGoodbye(conn net.Conn, msg []byte) {
+	if msg == nil {
+		return
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = conn.Write(msg)
+}
+
+// sniffingConn passes the data read from a connection to observe before returning it.
+type sniffingConn struct {
+	net.Conn
+	observe func([]byte)
+}
+
+func (c sniffingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.observe(p[:n])
+	return n, err
+}
@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"io"
 	"os"
 	"time"
 
@@ -37,9 +38,13 @@ func init() {
 		TimeFormat: time.RFC3339,
 	}
 
-	// Create loggers with appropriate outputs
-	Stdout = zerolog.New(consoleWriter).With().Timestamp().Logger()
-	StdoutWithSource = zerolog.New(consoleWriter).With().Timestamp().Caller().Logger()
-	Stderr = zerolog.New(consoleErrWriter).With().Timestamp().Logger()
-	StderrWithSource = zerolog.New(consoleErrWriter).With().Timestamp().Caller().Logger()
+	// Create loggers with appropriate outputs, all feeding Tail for live log streams
+	outWriter := io.MultiWriter(consoleWriter, Tail)
+	Stdout = zerolog.New(outWriter).With().Timestamp().Logger()
+	StdoutWithSource = zerolog.New(outWriter).With().Timestamp().Caller().Logger()
+	// Stderr loggers also feed RecentErrors, surfaced by the admin dashboard
+	errWriter := io.MultiWriter(consoleErrWriter, RecentErrors, Tail)
+
+	Stderr = zerolog.New(errWriter).With().Timestamp().Logger()
+	StderrWithSource = zerolog.New(errWriter).With().Timestamp().Caller().Logger()
 }
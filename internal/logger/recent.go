@@ -0,0 +1,53 @@
+package logger
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// RecentErrors keeps the latest entries logged through the Stderr loggers
+var RecentErrors = NewRecent(50)
+
+// Recent is an io.Writer keeping the last few JSON log entries written to it
+type Recent struct {
+	mu      sync.Mutex
+	entries []map[string]any
+	next    int
+	full    bool
+}
+
+// NewRecent creates a Recent holding up to size entries
+func NewRecent(size int) *Recent {
+	return &Recent{entries: make([]map[string]any, size)}
+}
+
+// Write stores a single JSON log entry, overwriting the oldest one when full
+func (r *Recent) Write(p []byte) (int, error) {
+	var entry map[string]any
+	if err := json.Unmarshal(p, &entry); err != nil {
+		return len(p), nil // Not a log entry, nothing worth keeping
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+
+	return len(p), nil
+}
+
+// Entries returns the stored entries, oldest first
+func (r *Recent) Entries() []map[string]any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]map[string]any(nil), r.entries[:r.next]...)
+	}
+
+	return append(append([]map[string]any(nil), r.entries[r.next:]...), r.entries[:r.next]...)
+}
@@ -0,0 +1,63 @@
+package logger
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Tail receives every entry logged through the global loggers, for live log streams
+var Tail = &Broadcast{}
+
+// Broadcast is an io.Writer passing the JSON log entries written to it on to its
+// subscribers. Subscribers too slow to keep up miss entries rather than slow logging down.
+type Broadcast struct {
+	active atomic.Int32 // subscribers, to skip copying entries when there are none
+
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+}
+
+// Write passes a copy of a single JSON log entry to every subscriber with room for it
+func (b *Broadcast) Write(p []byte) (int, error) {
+	if b.active.Load() == 0 {
+		return len(p), nil
+	}
+
+	entry := append([]byte(nil), p...)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+
+	return len(p), nil
+}
+
+// Subscribe returns a channel receiving the entries logged from now on, buffering up to
+// size of them, and the function to call to stop receiving them
+func (b *Broadcast) Subscribe(size int) (<-chan []byte, func()) {
+	ch := make(chan []byte, size)
+
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[chan []byte]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	b.active.Add(1)
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			b.active.Add(-1)
+		})
+	}
+}
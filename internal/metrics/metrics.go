@@ -0,0 +1,255 @@
+// Package metrics provides lightweight counters, gauges and histograms that can be
+// exposed in the Prometheus text format without pulling in the Prometheus client.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric types, as named in the Prometheus exposition format.
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// DefaultBuckets are histogram buckets (in seconds) suited to network latencies.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// SizeBuckets are histogram buckets (in bytes) suited to payload sizes, from 256 B to 1 GiB.
+var SizeBuckets = []float64{1 << 8, 1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28, 1 << 30}
+
+// Default is the process-wide registry.
+var Default = NewRegistry()
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) { c.v.Add(n) }
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v atomic.Int64
+}
+
+// Set sets the gauge to n.
+func (g *Gauge) Set(n int64) { g.v.Store(n) }
+
+// Add adds n (which may be negative) to the gauge.
+func (g *Gauge) Add(n int64) { g.v.Add(n) }
+
+// Inc increments the gauge by one.
+func (g *Gauge) Inc() { g.v.Add(1) }
+
+// Dec decrements the gauge by one.
+func (g *Gauge) Dec() { g.v.Add(-1) }
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 { return g.v.Load() }
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64 // one per bucket, plus +Inf
+	count   atomic.Uint64
+	sumBits atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)+1),
+	}
+}
+
+// Observe records a single value.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64frombits(old) + v
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 { return h.count.Load() }
+
+// Sum returns the sum of all observations.
+func (h *Histogram) Sum() float64 { return math.Float64frombits(h.sumBits.Load()) }
+
+// series is a single labelled instance of a metric.
+type series struct {
+	labels string // rendered label set, e.g. `target="a:80",reused="true"`
+	metric any    // *Counter, *Gauge or *Histogram
+}
+
+// family groups all series sharing a metric name.
+type family struct {
+	name, help, typ string
+	series          map[string]*series
+}
+
+// Registry holds a set of metric families.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter returns the counter for name and the given label pairs, creating it if needed.
+// Labels are passed as alternating names and values.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return r.get(name, help, typeCounter, labels, func() any { return &Counter{} }).(*Counter)
+}
+
+// Gauge returns the gauge for name and the given label pairs, creating it if needed.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return r.get(name, help, typeGauge, labels, func() any { return &Gauge{} }).(*Gauge)
+}
+
+// Histogram returns the histogram for name and the given label pairs, creating it with
+// DefaultBuckets if needed.
+func (r *Registry) Histogram(name, help string, labels ...string) *Histogram {
+	return r.HistogramWithBuckets(name, help, DefaultBuckets, labels...)
+}
+
+// HistogramWithBuckets is like Histogram but uses the given (sorted) buckets when creating it.
+func (r *Registry) HistogramWithBuckets(name, help string, buckets []float64, labels ...string) *Histogram {
+	return r.get(name, help, typeHistogram, labels, func() any { return newHistogram(buckets) }).(*Histogram)
+}
+
+func (r *Registry) get(name, help, typ string, labels []string, create func() any) any {
+	key := renderLabels(labels)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ, series: make(map[string]*series)}
+		r.families[name] = f
+	}
+	if f.typ != typ {
+		panic(fmt.Sprintf("metrics: %s registered as %s, requested as %s", name, f.typ, typ))
+	}
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key, metric: create()}
+		f.series[key] = s
+	}
+
+	return s.metric
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		writeFamily(&b, r.families[name])
+	}
+	r.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Handler returns an http.Handler serving the registry in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+func writeFamily(b *strings.Builder, f *family) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		switch m := s.metric.(type) {
+		case *Counter:
+			fmt.Fprintf(b, "%s%s %d\n", f.name, braces(s.labels), m.Value())
+		case *Gauge:
+			fmt.Fprintf(b, "%s%s %d\n", f.name, braces(s.labels), m.Value())
+		case *Histogram:
+			var cumulative uint64
+			for i, upper := range m.buckets {
+				cumulative += m.counts[i].Load()
+				fmt.Fprintf(b, "%s_bucket%s %d\n", f.name,
+					braces(joinLabels(s.labels, fmt.Sprintf(`le="%g"`, upper))), cumulative)
+			}
+			cumulative += m.counts[len(m.buckets)].Load()
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, braces(joinLabels(s.labels, `le="+Inf"`)), cumulative)
+			fmt.Fprintf(b, "%s_sum%s %g\n", f.name, braces(s.labels), m.Sum())
+			fmt.Fprintf(b, "%s_count%s %d\n", f.name, braces(s.labels), m.Count())
+		}
+	}
+}
+
+// renderLabels renders alternating name/value pairs as a Prometheus label set.
+func renderLabels(labels []string) string {
+	if len(labels)%2 != 0 {
+		panic("metrics: labels must be name/value pairs")
+	}
+
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// RequestIDHeader is the header carrying the request ID set by the request-id middleware.
+const RequestIDHeader = "X-Request-Id"
+
+func init() {
+	Register("request-id", RequestID)
+	Register("recover", Recover)
+	Register("access-log", AccessLog)
+}
+
+// RequestID sets an X-Request-Id header on requests that don't carry one, and echoes it
+// back on the response.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			var b [12]byte
+			_, _ = rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Recover turns panics in next into 500 responses instead of dropping the connection.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec) // Deliberate abort, let net/http handle it
+			}
+
+			logger.StderrWithSource.Error().
+				Interface("panic", rec).
+				Str("remote-addr", r.RemoteAddr).
+				Str("path", r.URL.Path).
+				Msg("recovered from panic")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AccessLog logs every request once it has been served, with its status and duration.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(sw, r)
+
+		logger.Stdout.Info().
+			Str("remote-addr", r.RemoteAddr).
+			Str("method", r.Method).
+			Str("host", r.Host).
+			Str("path", r.URL.Path).
+			Int("status", sw.status).
+			Int64("bytes", sw.bytes).
+			Dur("duration", time.Since(start)).
+			Msg("request served")
+	})
+}
+
+// statusWriter records the status code and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (flushing, hijacking).
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
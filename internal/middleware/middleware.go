@@ -0,0 +1,76 @@
+// Package middleware provides named HTTP middleware that can be chained from configuration.
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ErrUnknown is returned when a chain references a middleware that is not registered.
+var ErrUnknown = errors.New("unknown middleware")
+
+// Middleware wraps an http.Handler with additional behavior.
+type Middleware func(next http.Handler) http.Handler
+
+var (
+	mu       sync.RWMutex
+	registry = make(map[string]Middleware)
+)
+
+// Register makes a middleware available under name. It panics if name is already taken,
+// so it is meant to be called from init functions.
+func Register(name string, m Middleware) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("middleware: %s registered twice", name))
+	}
+	registry[name] = m
+}
+
+// Lookup returns the middleware registered under name.
+func Lookup(name string) (Middleware, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	m, ok := registry[name]
+	return m, ok
+}
+
+// Names returns the names of all registered middleware, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Chain composes the named middleware into one. The first name is the outermost, so it
+// sees the request first and the response last.
+func Chain(names ...string) (Middleware, error) {
+	chain := make([]Middleware, 0, len(names))
+	for _, name := range names {
+		m, ok := Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknown, name)
+		}
+		chain = append(chain, m)
+	}
+
+	return func(next http.Handler) http.Handler {
+		for i := len(chain) - 1; i >= 0; i-- {
+			next = chain[i](next)
+		}
+		return next
+	}, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/tsnet"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// Address families of targets given by name (TARGET_IP_FAMILY).
+const (
+	IPFamilyAuto       = "auto"        // dial the address the name resolves to first
+	IPFamilyIPv4       = "ipv4"        // only dial IPv4 addresses
+	IPFamilyIPv6       = "ipv6"        // only dial IPv6 addresses
+	IPFamilyPreferIPv4 = "prefer-ipv4" // dial IPv4 addresses first, then IPv6 ones
+	IPFamilyPreferIPv6 = "prefer-ipv6" // dial IPv6 addresses first, then IPv4 ones
+)
+
+// ErrIPFamily is returned when a target has no address in the family TARGET_IP_FAMILY allows.
+var ErrIPFamily = errors.New("no address in the allowed IP family")
+
+// familyPeersTTL is how long the Tailscale IPs of the tailnet peers are cached.
+const familyPeersTTL = 30 * time.Second
+
+// ipFamilies orders the addresses of targets by family, nil to dial targets as tsnet
+// resolves them.
+var ipFamilies *familyDialer
+
+// familyDialer dials targets given by name at their addresses in the preferred family
+// first, falling back to the others unless the family is strict. MagicDNS names resolve
+// to both Tailscale IPs of the peer, other names through DNS. tsnet alone dials the IPv4
+// address of peers, and the first address DNS returns.
+type familyDialer struct {
+	ts       *tsnet.Server
+	family   string
+	resolver *net.Resolver
+
+	mu        sync.Mutex
+	peers     map[string][]netip.Addr // lowercase MagicDNS names (FQDN and host name) -> Tailscale IPs
+	refreshed time.Time
+}
+
+// newFamilyDialer returns the familyDialer of family, or nil for IPFamilyAuto.
+func newFamilyDialer(ts *tsnet.Server, family string) *familyDialer {
+	if family == "" || family == IPFamilyAuto {
+		return nil
+	}
+
+	return &familyDialer{ts: ts, family: family, resolver: net.DefaultResolver}
+}
+
+// wrap returns next dialing in the preferred family.
+func (d *familyDialer) wrap(next dialFunc) dialFunc {
+	if d == nil {
+		return next
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return next(ctx, network, addr)
+		}
+
+		if ip, err := netip.ParseAddr(host); err == nil {
+			if len(d.order([]netip.Addr{ip})) == 0 {
+				return nil, fmt.Errorf("%w (%s): %s", ErrIPFamily, d.family, addr)
+			}
+			return next(ctx, network, addr)
+		}
+
+		ips := d.order(d.resolve(ctx, host))
+		if len(ips) == 0 {
+			if d.family == IPFamilyIPv4 || d.family == IPFamilyIPv6 {
+				return nil, fmt.Errorf("%w (%s): %s", ErrIPFamily, d.family, addr)
+			}
+			// Let tsnet resolve it and report the failure
+			return next(ctx, network, addr)
+		}
+
+		var firstErr error
+		for _, ip := range ips {
+			conn, err := next(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		return nil, firstErr
+	}
+}
+
+// order returns the addresses in ips the family allows, preferred ones first.
+func (d *familyDialer) order(ips []netip.Addr) []netip.Addr {
+	ordered := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if d.family == IPFamilyIPv4 && !ip.Is4() || d.family == IPFamilyIPv6 && !ip.Is6() {
+			continue
+		}
+		ordered = append(ordered, ip)
+	}
+
+	if d.family == IPFamilyPreferIPv4 || d.family == IPFamilyPreferIPv6 {
+		want6 := d.family == IPFamilyPreferIPv6
+		// Stable, so that the addresses of a family keep the resolver's order
+		slices.SortStableFunc(ordered, func(a, b netip.Addr) int {
+			switch {
+			case a.Is6() == b.Is6():
+				return 0
+			case a.Is6() == want6:
+				return -1
+			default:
+				return 1
+			}
+		})
+	}
+
+	return ordered
+}
+
+// resolve returns the addresses of host: the Tailscale IPs of the peer if it is a
+// MagicDNS name, else those DNS returns. Failures return nothing.
+func (d *familyDialer) resolve(ctx context.Context, host string) []netip.Addr {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips := d.peer(ctx, name); len(ips) > 0 {
+		return ips
+	}
+
+	ips, err := d.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil
+	}
+	return ips
+}
+
+// peer returns the Tailscale IPs of the peer named name, refreshing the peer list when
+// it is stale.
+func (d *familyDialer) peer(ctx context.Context, name string) []netip.Addr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if time.Since(d.refreshed) > familyPeersTTL {
+		if err := d.refresh(ctx); err != nil {
+			logger.Stderr.Warn().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("failed to refresh tailnet peer addresses")
+		}
+	}
+
+	return d.peers[name]
+}
+
+// refresh rebuilds the peer addresses from the node's status. It is called with d.mu
+// held.
+func (d *familyDialer) refresh(ctx context.Context) error {
+	// Failed refreshes are not retried before the next ttl either
+	d.refreshed = time.Now()
+	if d.ts == nil {
+		return nil // without a tailnet, names only resolve through DNS
+	}
+
+	lc, err := localClient(d.ts)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	st, err := lc.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	peers := make(map[string][]netip.Addr, 2*len(st.Peer))
+	for _, peer := range st.Peer {
+		if peer.DNSName == "" || len(peer.TailscaleIPs) == 0 {
+			continue
+		}
+		fqdn := strings.ToLower(strings.TrimSuffix(peer.DNSName, "."))
+		peers[fqdn] = peer.TailscaleIPs
+		if short, _, ok := strings.Cut(fqdn, "."); ok {
+			peers[short] = peer.TailscaleIPs
+		}
+	}
+	d.peers = peers
+
+	return nil
+}
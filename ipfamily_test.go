@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+// recordingDial returns a dialFunc recording the addresses it is asked for, which fails
+// for those in refuse.
+func recordingDial(dialed *[]string, refuse ...string) dialFunc {
+	return func(_ context.Context, _, addr string) (net.Conn, error) {
+		*dialed = append(*dialed, addr)
+		if slices.Contains(refuse, addr) {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}
+}
+
+// familyDialerWithPeer returns the familyDialer of family, with the MagicDNS name db
+// resolving to a Tailscale IPv4 and IPv6 address.
+func familyDialerWithPeer(family string) *familyDialer {
+	d := newFamilyDialer(nil, family)
+	d.peers = map[string][]netip.Addr{
+		"db": {netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")},
+	}
+	d.refreshed = time.Now()
+
+	return d
+}
+
+func TestFamilyDialerOrder(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("fd7a:115c:a1e0::1"),
+		netip.MustParseAddr("100.64.0.1"),
+		netip.MustParseAddr("::ffff:10.0.0.1"),
+		netip.MustParseAddr("2001:db8::1"),
+	}
+
+	tests := []struct {
+		family string
+		want   []string
+	}{
+		{IPFamilyIPv4, []string{"100.64.0.1", "10.0.0.1"}},
+		{IPFamilyIPv6, []string{"fd7a:115c:a1e0::1", "2001:db8::1"}},
+		{IPFamilyPreferIPv4, []string{"100.64.0.1", "10.0.0.1", "fd7a:115c:a1e0::1", "2001:db8::1"}},
+		{IPFamilyPreferIPv6, []string{"fd7a:115c:a1e0::1", "2001:db8::1", "100.64.0.1", "10.0.0.1"}},
+	}
+	for _, tt := range tests {
+		d := newFamilyDialer(nil, tt.family)
+		var got []string
+		for _, ip := range d.order(ips) {
+			got = append(got, ip.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("order for %s = %v, want %v", tt.family, got, tt.want)
+		}
+	}
+}
+
+func TestNewFamilyDialerAuto(t *testing.T) {
+	if d := newFamilyDialer(nil, IPFamilyAuto); d != nil {
+		t.Fatal("auto should dial targets as they resolve")
+	}
+}
+
+func TestFamilyDialerWrap(t *testing.T) {
+	tests := []struct {
+		name   string
+		family string
+		addr   string
+		refuse []string
+		want   []string
+		err    error
+	}{
+		{"prefer IPv6", IPFamilyPreferIPv6, "db:5432", nil, []string{"[fd7a:115c:a1e0::1]:5432"}, nil},
+		{"prefer IPv4", IPFamilyPreferIPv4, "db:5432", nil, []string{"100.64.0.1:5432"}, nil},
+		{"fall back to IPv4", IPFamilyPreferIPv6, "db:5432", []string{"[fd7a:115c:a1e0::1]:5432"},
+			[]string{"[fd7a:115c:a1e0::1]:5432", "100.64.0.1:5432"}, nil},
+		{"IPv6 only", IPFamilyIPv6, "DB.:5432", nil, []string{"[fd7a:115c:a1e0::1]:5432"}, nil},
+		{"IPv6 literal", IPFamilyPreferIPv4, "[fd7a:115c:a1e0::2]:443", nil, []string{"[fd7a:115c:a1e0::2]:443"}, nil},
+		{"IPv6 literal with IPv4 only", IPFamilyIPv4, "[fd7a:115c:a1e0::2]:443", nil, nil, ErrIPFamily},
+		{"IPv4 literal with IPv6 only", IPFamilyIPv6, "100.64.0.2:443", nil, nil, ErrIPFamily},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dialed []string
+			conn, err := familyDialerWithPeer(tt.family).wrap(recordingDial(&dialed, tt.refuse...))(
+				context.Background(), "tcp", tt.addr)
+			if conn != nil {
+				_ = conn.Close()
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if !slices.Equal(dialed, tt.want) {
+				t.Errorf("dialed %v, want %v", dialed, tt.want)
+			}
+		})
+	}
+}
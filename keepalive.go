@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// tcpKeepalive is the process-wide keepalive of forwarded TCP connections, nil when
+// disabled.
+var tcpKeepalive *keepalive
+
+var (
+	keepalivePingsOK = metrics.Default.Counter("railtail_keepalive_pings_total",
+		"Tailnet pings keeping the path to the targets of open TCP connections alive, by result.", "result", "ok")
+	keepalivePingsFailed = metrics.Default.Counter("railtail_keepalive_pings_total",
+		"Tailnet pings keeping the path to the targets of open TCP connections alive, by result.", "result", "failed")
+)
+
+// keepalive keeps idle TCP connections from being dropped by NATs and firewalls on the
+// way. Both ends get TCP keepalives where the connection supports them, and the tailnet
+// peer of the target is pinged (disco ping, not seen by the target) every interval
+// while connections to it are open, which keeps the WireGuard path and its NAT
+// mappings warm.
+type keepalive struct {
+	ts       *tsnet.Server
+	interval time.Duration
+
+	mu    sync.Mutex
+	peers map[netip.Addr]*keptPeer
+}
+
+// keptPeer is a tailnet peer being pinged.
+type keptPeer struct {
+	conns  int
+	cancel context.CancelFunc
+}
+
+// newKeepalive creates a keepalive of interval, or returns nil if interval is 0.
+func newKeepalive(ts *tsnet.Server, interval time.Duration) *keepalive {
+	if interval <= 0 {
+		return nil
+	}
+
+	return &keepalive{ts: ts, interval: interval, peers: make(map[netip.Addr]*keptPeer)}
+}
+
+// hold keeps the connection between client and target alive. The caller must call the
+// returned function when the connection ends.
+func (k *keepalive) hold(client, target net.Conn) (release func()) {
+	if k == nil {
+		return func() {}
+	}
+
+	setTCPKeepalive(client, k.interval)
+	setTCPKeepalive(target, k.interval)
+
+	addr, ok := target.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return func() {}
+	}
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok {
+		return func() {}
+	}
+	ip = ip.Unmap()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	peer := k.peers[ip]
+	if peer == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		peer = &keptPeer{cancel: cancel}
+		k.peers[ip] = peer
+		go k.ping(ctx, ip)
+	}
+	peer.conns++
+
+	return func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+
+		if peer.conns--; peer.conns == 0 {
+			peer.cancel()
+			delete(k.peers, ip)
+		}
+	}
+}
+
+// ping pings the peer at ip every interval until ctx is cancelled.
+func (k *keepalive) ping(ctx context.Context, ip netip.Addr) {
+	if k.ts == nil {
+		return // no tailnet to ping the peer on
+	}
+	lc, err := localClient(k.ts)
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Msg("failed to get tailscale local client")
+		return
+	}
+
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		_, err := lc.Ping(pingCtx, ip, tailcfg.PingDisco)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			keepalivePingsFailed.Inc()
+			if !failing {
+				logger.Stderr.Warn().
+					Str(logger.ErrAttr(err), logger.ErrValue(err)).
+					Str("peer", ip.String()).
+					Msg("keepalive ping failed")
+			}
+		} else {
+			keepalivePingsOK.Inc()
+		}
+		failing = err != nil
+	}
+}
+
+// setTCPKeepalive enables TCP keepalives of period on conn, if it supports them.
+func setTCPKeepalive(conn net.Conn, period time.Duration) {
+	c, ok := conn.(interface {
+		SetKeepAlive(bool) error
+		SetKeepAlivePeriod(time.Duration) error
+	})
+	if !ok {
+		return
+	}
+
+	_ = c.SetKeepAlive(true)
+	_ = c.SetKeepAlivePeriod(period)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Load balancing policies.
+const (
+	LoadBalancingRoundRobin = "round-robin"
+	LoadBalancingLatency    = "latency"
+)
+
+// ErrLoadBalancingInvalid is returned for load balancing policies that are not supported.
+var ErrLoadBalancingInvalid = errors.New("load balancing policy is invalid")
+
+// Latency-aware balancing: probe results are smoothed with latencySmoothing (the weight of
+// the newest sample), and targets within latencyMargin of the fastest share its traffic, so
+// replicas in the same region do not flap over a millisecond of jitter.
+const (
+	latencyProbeTimeout = 5 * time.Second
+	latencySmoothing    = 0.3
+	latencyMargin       = 1.25
+)
+
+// latencySettings configures latency-aware balancing of a targetPool.
+type latencySettings struct {
+	interval time.Duration // how often targets are probed
+	dial     dialFunc
+}
+
+// targetLatency is the dial latency of a target, measured by the latency probes.
+type targetLatency struct {
+	mu       sync.Mutex
+	average  time.Duration // smoothed over the probes
+	measured bool          // false until a probe succeeds, and after a probe fails
+}
+
+// dialLatency returns the smoothed dial latency of the target, and false if it is unknown.
+func (t *poolTarget) dialLatency() (time.Duration, bool) {
+	if t.latency == nil {
+		return 0, false
+	}
+
+	t.latency.mu.Lock()
+	defer t.latency.mu.Unlock()
+
+	return t.latency.average, t.latency.measured
+}
+
+// fastest returns the targets whose dial latency is within latencyMargin of the lowest,
+// or nil if no target has been measured.
+func fastest(targets []*poolTarget) []*poolTarget {
+	lowest := time.Duration(-1)
+	for _, t := range targets {
+		if latency, ok := t.dialLatency(); ok && (lowest < 0 || latency < lowest) {
+			lowest = latency
+		}
+	}
+	if lowest < 0 {
+		return nil
+	}
+
+	var fast []*poolTarget
+	for _, t := range targets {
+		if latency, ok := t.dialLatency(); ok && float64(latency) <= latencyMargin*float64(lowest) {
+			fast = append(fast, t)
+		}
+	}
+
+	return fast
+}
+
+// probeLatency dials every target of the pool every interval, starting right away, to
+// keep their latencies current as paths over the tailnet change (DERP, then direct). It
+// runs for the life of the pool.
+func (p *targetPool) probeLatency(settings *latencySettings) {
+	ticker := time.NewTicker(settings.interval)
+	defer ticker.Stop()
+
+	var preferred string
+	for {
+		var wg sync.WaitGroup
+		for _, t := range p.targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.probeLatency(settings)
+			}()
+		}
+		wg.Wait()
+
+		var addrs []string
+		for _, t := range fastest(p.targets) {
+			addrs = append(addrs, t.addr)
+		}
+		if current := strings.Join(addrs, ","); current != "" && current != preferred {
+			logger.Stdout.Info().
+				Strs("targets", addrs).
+				Msg("preferring the lowest latency targets")
+			preferred = current
+		}
+
+		<-ticker.C
+	}
+}
+
+// probeLatency dials the target once, and folds the time it took into its latency.
+func (t *poolTarget) probeLatency(settings *latencySettings) {
+	ctx, cancel := context.WithTimeout(context.Background(), latencyProbeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	addr, err := dialAddr(t.addr)
+	if err == nil {
+		var conn net.Conn
+		if conn, err = settings.dial(ctx, "tcp", addr); err == nil {
+			_ = conn.Close()
+		}
+	}
+	latency := time.Since(start)
+
+	t.latency.mu.Lock()
+	defer t.latency.mu.Unlock()
+
+	if err != nil {
+		if t.latency.measured {
+			logger.Stderr.Warn().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("target", t.addr).
+				Msg("latency probe failed")
+		}
+		t.latency.measured = false
+		return
+	}
+
+	if t.latency.measured {
+		latency = time.Duration(latencySmoothing*float64(latency) + (1-latencySmoothing)*float64(t.latency.average))
+	}
+	t.latency.average, t.latency.measured = latency, true
+
+	metrics.Default.Gauge("railtail_target_dial_latency_microseconds",
+		"Dial latency of the target, smoothed over the latency probes.", "target", t.addr).
+		Set(latency.Microseconds())
+}
+
+// dialAddr returns the host:port dialed to reach target, a TCP address or an HTTP(S) URL.
+func dialAddr(target string) (string, error) {
+	target, err := expandTarget(target)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(target, "://") {
+		return target, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrTargetAddrInvalid, err)
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	}
+
+	return net.JoinHostPort(u.Hostname(), "80"), nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// connLifetime is the process-wide maximum connection lifetime, nil when unlimited.
+var connLifetime *lifetimeLimit
+
+// lifetimeLimit closes forwarded connections once they reach a maximum age, which some
+// security policies require and which spreads long-lived clients over the targets again
+// after a failover.
+type lifetimeLimit struct {
+	max   time.Duration
+	grace time.Duration // how long HTTP connections get to finish their requests
+}
+
+// newLifetimeLimit creates a limit of maxAge, or returns nil if maxAge is 0.
+func newLifetimeLimit(maxAge, grace time.Duration) *lifetimeLimit {
+	if maxAge <= 0 {
+		return nil
+	}
+
+	return &lifetimeLimit{max: maxAge, grace: grace}
+}
+
+// enforce calls closeConn once a TCP connection opened now reaches the lifetime. The
+// caller must call the returned function when the connection ends.
+func (l *lifetimeLimit) enforce(remoteAddr, target string, closeConn func()) (stop func() bool) {
+	if l == nil {
+		return func() bool { return false }
+	}
+
+	timer := time.AfterFunc(l.max, func() {
+		lifetimeExpired(connKindTCP).Inc()
+		logger.Stdout.Info().
+			Str("remote-addr", remoteAddr).
+			Str("target", target).
+			Dur("max-conn-lifetime", l.max).
+			Msg("closing connection at its maximum lifetime")
+		closeConn()
+	})
+
+	return timer.Stop
+}
+
+// connOpenedKey is the context key under which limitHTTP stores when the client
+// connection of a request was opened.
+type connOpenedKey struct{}
+
+// limitHTTP applies the lifetime to the client connections of server. Once a
+// connection reaches it, responses ask the client to reconnect ("Connection: close"),
+// and connections still open after the grace period are closed.
+func (l *lifetimeLimit) limitHTTP(server *http.Server) {
+	if l == nil {
+		return
+	}
+
+	var (
+		mu     sync.Mutex
+		timers = make(map[net.Conn]*time.Timer)
+	)
+	server.ConnContext = func(ctx context.Context, _ net.Conn) context.Context {
+		return context.WithValue(ctx, connOpenedKey{}, time.Now())
+	}
+	server.ConnState = func(c net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch state {
+		case http.StateNew:
+			timers[c] = time.AfterFunc(l.max+l.grace, func() {
+				mu.Lock()
+				delete(timers, c)
+				mu.Unlock()
+
+				lifetimeExpired(connKindHTTP).Inc()
+				_ = c.Close()
+			})
+		case http.StateClosed:
+			// Hijacked connections (WebSockets) keep their timer until it fires
+			if timer, ok := timers[c]; ok {
+				timer.Stop()
+				delete(timers, c)
+			}
+		}
+	}
+
+	next := server.Handler
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opened, ok := r.Context().Value(connOpenedKey{}).(time.Time); ok && time.Since(opened) >= l.max {
+			w.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func lifetimeExpired(kind string) *metrics.Counter {
+	return metrics.Default.Counter("railtail_conn_lifetime_expired_total",
+		"Client connections closed at MAX_CONN_LIFETIME.", "kind", kind)
+}
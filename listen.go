@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"strconv"
+)
+
+// listen opens the local listeners on addr, one per accept worker so that accepting
+// connections is not bottlenecked on a single loop. Where SO_REUSEPORT is supported
+// each worker gets its own socket and the kernel spreads connections across them;
+// elsewhere the workers share one socket. backlog overrides the kernel accept queue
+// length when positive.
+func listen(addr string, workers, backlog int) ([]net.Listener, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	listeners := make([]net.Listener, 0, workers)
+	for i := 0; i < workers; i++ {
+		if i > 0 && !reusePortSupported {
+			listeners = append(listeners, listeners[0])
+			continue
+		}
+
+		l, err := listenTCP(addr, workers > 1, backlog)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// serveAll runs serve on every listener and returns the first result.
+func serveAll(listeners []net.Listener, serve func(net.Listener) error) error {
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) { errc <- serve(l) }(l)
+	}
+
+	return <-errc
+}
+
+// listenPort returns the port of addr, the local address of a connection: the port of
+// the listener it was accepted by.
+func listenPort(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return strconv.Itoa(tcpAddr.Port)
+	}
+	if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+		return port
+	}
+
+	return addr.String()
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+// listenTCP listens on addr, with SO_REUSEPORT if reusePort is set.
+func listenTCP(addr string, reusePort bool, backlog int) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if backlog <= 0 {
+		return l, nil
+	}
+
+	// Go always listens with the system maximum (somaxconn). Linux lets listen() be
+	// called again on a listening socket to change the backlog.
+	raw, err := l.(*net.TCPListener).SyscallConn()
+	if err == nil {
+		ctrlErr := raw.Control(func(fd uintptr) {
+			err = unix.Listen(int(fd), backlog)
+		})
+		if ctrlErr != nil {
+			err = ctrlErr
+		}
+	}
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
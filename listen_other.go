@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+)
+
+const reusePortSupported = false
+
+// listenTCP listens on addr. SO_REUSEPORT and the backlog are only tuned on Linux.
+func listenTCP(addr string, _ bool, _ int) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
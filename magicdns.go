@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"tailscale.com/tsnet"
+)
+
+// expandShortName appends searchDomain to host when it is a bare short name, keeping
+// any port. IP addresses and names with a dot are returned unchanged.
+func expandShortName(host, searchDomain string) string {
+	if searchDomain == "" {
+		return host
+	}
+
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, ""
+	}
+	if name == "" || strings.Contains(name, ".") || strings.ContainsAny(name, ":[") {
+		return host
+	}
+
+	name += "." + strings.Trim(searchDomain, ".")
+	if port != "" {
+		return net.JoinHostPort(name, port)
+	}
+	return name
+}
+
+// magicDNSCache resolves names in a MagicDNS domain to tailnet IPs from the node's peer
+// list, refreshed at most every ttl, so proxied requests skip a DNS lookup per dial.
+type magicDNSCache struct {
+	ts     *tsnet.Server
+	suffix string // names resolved through the cache, without leading or trailing dot
+	ttl    time.Duration
+
+	mu        sync.Mutex
+	addrs     map[string]string // lowercase FQDN -> tailnet IP
+	refreshed time.Time
+}
+
+func newMagicDNSCache(ts *tsnet.Server, suffix string, ttl time.Duration) *magicDNSCache {
+	return &magicDNSCache{ts: ts, suffix: strings.ToLower(strings.Trim(suffix, ".")), ttl: ttl}
+}
+
+// dial wraps next, dialing the cached tailnet IP of names in the domain. Names missing
+// from the peer list are left to next.
+func (c *magicDNSCache) dial(next dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return next(ctx, network, addr)
+		}
+
+		name := strings.ToLower(strings.TrimSuffix(host, "."))
+		if !strings.HasSuffix(name, "."+c.suffix) {
+			return next(ctx, network, addr)
+		}
+		if ip, ok := c.lookup(ctx, name); ok {
+			addr = net.JoinHostPort(ip, port)
+		}
+
+		return next(ctx, network, addr)
+	}
+}
+
+// lookup returns the tailnet IP of name, refreshing the peer list when it is stale.
+func (c *magicDNSCache) lookup(ctx context.Context, name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.refreshed) > c.ttl {
+		if err := c.refresh(ctx); err != nil {
+			logger.Stderr.Warn().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("failed to refresh magicdns cache")
+		}
+	}
+
+	ip, ok := c.addrs[name]
+	return ip, ok
+}
+
+// refresh rebuilds the cache from the node's peer list. It is called with c.mu held.
+func (c *magicDNSCache) refresh(ctx context.Context) error {
+	// Failed refreshes are not retried before the next ttl either
+	c.refreshed = time.Now()
+
+	lc, err := localClient(c.ts)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	st, err := lc.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	addrs := make(map[string]string, len(st.Peer))
+	for _, peer := range st.Peer {
+		if peer.DNSName == "" || len(peer.TailscaleIPs) == 0 {
+			continue
+		}
+		addrs[strings.ToLower(strings.TrimSuffix(peer.DNSName, "."))] = peer.TailscaleIPs[0].String()
+	}
+	c.addrs = addrs
+
+	return nil
+}
@@ -6,7 +6,9 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/rmonvfer/railtail/internal/logger"
@@ -14,6 +16,34 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "service":
+			os.Exit(serviceCommand(os.Args[2:]))
+		case "healthcheck":
+			os.Exit(healthcheckCommand())
+		case "doctor":
+			os.Exit(doctorCommand(os.Args[2:]))
+		case "recording":
+			os.Exit(recordingCommand(os.Args[2:]))
+		case "config":
+			os.Exit(configCommand(os.Args[2:]))
+		case "top":
+			os.Exit(topCommand(os.Args[2:]))
+		case "dev":
+			os.Exit(devCommand(os.Args[2:]))
+		}
+	}
+
+	// SIGTERM also covers console close and system shutdown events on Windows
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	run(ctx)
+}
+
+// run starts railtail and serves until ctx is cancelled.
+func run(ctx context.Context) {
 	cfg, errs := LoadConfig()
 	if len(errs) > 0 {
 		logger.StderrWithSource.Error().
@@ -21,29 +51,75 @@ func main() {
 			Msg("configuration error(s) found")
 		os.Exit(1)
 	}
+	for _, warning := range cfg.Warnings {
+		logger.Stderr.Warn().
+			Str(logger.ErrAttr(warning), logger.ErrValue(warning)).
+			Msg("configuration warning")
+	}
+
+	hooks = newHookDispatcher(cfg)
+	defer hooks.drain()
+
+	if statsHistory = newStatsRing(cfg.StatsHistory); statsHistory != nil {
+		go statsHistory.run(ctx)
+	}
+
+	// Without a tailnet (NO_TAILSCALE) ts stays nil, and targets are dialed with the
+	// dial backend only
+	var ts *tsnet.Server
+	if !cfg.NoTailscale {
+		ts = &tsnet.Server{
+			Hostname:     cfg.TSHostname,
+			AuthKey:      cfg.TSAuthKey,
+			RunWebClient: false,
+			Ephemeral:    devMode,
+			ControlURL:   cfg.TSLoginServer,
+			UserLogf: func(format string, v ...any) {
+				logger.Stdout.Info().Msgf(format, v...)
+			},
+			Dir: filepath.Join(cfg.TSStateDirPath, "railtail"),
+		}
+
+		// Block until the node is fully online (30 s cap).
+		upCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		if _, err := ts.Up(upCtx); err != nil { // Up waits, unlike Start.
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("failed to bring tailscale server up")
+			hooks.emit(HookTSAuth, map[string]string{"state": "failed", "error": err.Error()})
+			hooks.drain()
+			os.Exit(1)
+		}
+		defer ts.Close()
+		go watchBackendState(ctx, ts)
 
-	ts := &tsnet.Server{
-		Hostname:     cfg.TSHostname,
-		AuthKey:      cfg.TSAuthKey,
-		RunWebClient: false,
-		Ephemeral:    false,
-		ControlURL:   cfg.TSLoginServer,
-		UserLogf: func(format string, v ...any) {
-			logger.Stdout.Info().Msgf(format, v...)
-		},
-		Dir: filepath.Join(cfg.TSStateDirPath, "railtail"),
+		if cfg.DERPRegion != "" {
+			if err := pinDERPRegion(ctx, ts, cfg.DERPRegion); err != nil {
+				logger.StderrWithSource.Error().
+					Str(logger.ErrAttr(err), logger.ErrValue(err)).
+					Msg("failed to pin DERP region")
+				os.Exit(1)
+			}
+		}
 	}
 
-	// Block until the node is fully online (30 s cap).
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	if _, err := ts.Up(ctx); err != nil { // Up waits, unlike Start.
+	backend, err := newDialBackend(cfg.DialBackend, ts)
+	if err != nil {
 		logger.StderrWithSource.Error().
 			Str(logger.ErrAttr(err), logger.ErrValue(err)).
-			Msg("failed to bring tailscale server up")
+			Msg("failed to set up the dial backend")
 		os.Exit(1)
 	}
-	defer ts.Close()
+	// What looks at the tailnet paths of target connections, pings their peers or asks
+	// the node why a dial failed only applies when targets are dialed through the node
+	dialNode, backendName := ts, cfg.DialBackend
+	if backendName == "" {
+		backendName = DialBackendTailnet
+	}
+	if backendName != DialBackendTailnet {
+		dialNode = nil
+	}
 
 	listenAddr := "[::]:" + cfg.ListenPort
 	stateDir := filepath.Join(cfg.TSStateDirPath, "railtail")
@@ -54,6 +130,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	if cfg.StateDB {
+		store, err := openStateStore(stateDir)
+		if err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("failed to open state database")
+			os.Exit(1)
+		}
+		stateDB = store
+		defer stateDB.close()
+	}
+
 	tsLoginServer := cfg.TSLoginServer
 	if tsLoginServer == "" {
 		tsLoginServer = "using_default"
@@ -61,13 +149,16 @@ func main() {
 	logger.Stdout.Info().
 		Str("ts-hostname", cfg.TSHostname).
 		Str("listen-addr", listenAddr).
+		Int("accept-workers", cfg.AcceptWorkers).
 		Str("target-addr", cfg.TargetAddr).
 		Str("ts-login-server", tsLoginServer).
 		Str("ts-state-dir", stateDir).
+		Str("dial-backend", redactedProxy(backendName)).
+		Bool("dev", devMode).
 		Bool("insecure-skip-verify", cfg.InsecureSkipVerify).
 		Msg("🚀 Starting railtail")
 
-	listener, err := net.Listen("tcp", listenAddr)
+	listeners, err := listen(listenAddr, cfg.AcceptWorkers, cfg.ListenBacklog)
 	if err != nil {
 		logger.StderrWithSource.Error().
 			Str(logger.ErrAttr(err), logger.ErrValue(err)).
@@ -75,14 +166,252 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Custom transport: tailnet dialer, no 5-min tsnet timeout.
-	transport := &http.Transport{
-		DialContext:     ts.Dial,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify},
-		IdleConnTimeout: 90 * time.Second,
+	// Capture below listener TLS, so that HTTPS still sees the TLS connections
+	if settings := cfg.CaptureSettings(); settings != nil {
+		if err := startCapture(ctx, ts, *settings, listeners); err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("failed to start capture")
+			os.Exit(1)
+		}
+	}
+
+	// The SVID is needed before the listener verifies client SVIDs with its bundles
+	if cfg.SPIFFEEndpointSocket != "" {
+		svids, err := newSVIDSource(cfg.SPIFFEEndpointSocket)
+		if err == nil {
+			go svids.watch(ctx)
+			err = svids.wait(ctx, svidFetchTimeout)
+		}
+		if err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("failed to fetch SVID")
+			os.Exit(1)
+		}
+		workloadSVIDs = svids
+	}
+
+	if cfg.TLSCertFile != "" || len(cfg.ACMEDomains) > 0 {
+		tlsConfig, plainHandler, err := listenerTLS(cfg, stateDir)
+		if err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("failed to load listener certificate")
+			os.Exit(1)
+		}
+		for i, l := range listeners {
+			listeners[i] = tls.NewListener(l, tlsConfig)
+		}
+
+		if cfg.HTTPRedirectPort != "" {
+			go serveHTTPSRedirect("[::]:"+cfg.HTTPRedirectPort, plainHandler(httpsRedirect(cfg.ListenPort)))
+		}
+	}
+
+	// Also serve on the tailnet node, after TLS: tailnet clients already get WireGuard
+	if cfg.TailnetListenPort != "" {
+		ln, err := ts.Listen("tcp", ":"+cfg.TailnetListenPort)
+		if err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("tailnet-listen-port", cfg.TailnetListenPort).
+				Msg("failed to start tailnet listener")
+			os.Exit(1)
+		}
+		listeners = append(listeners, ln)
+
+		logger.Stdout.Info().
+			Str("tailnet-listen-addr", cfg.TSHostname+":"+cfg.TailnetListenPort).
+			Msg("also listening on the tailnet")
+	}
+
+	if cfg.TailnetMetricsInterval > 0 && ts != nil {
+		go newTailnetStats(ts).run(ctx, cfg.TailnetMetricsInterval)
+	}
+
+	if cfg.WatchdogInterval > 0 {
+		go newWatchdog(cfg.WatchdogInterval, cfg.WatchdogHeapDump, stateDir).run()
+	}
+
+	profiles := &profileDumper{dir: stateDir, uploadURL: cfg.ProfileUploadURL}
+	go profiles.watchSignals()
+	if cfg.ProfileRSSThresholdMB > 0 {
+		go profiles.watchRSS(int64(cfg.ProfileRSSThresholdMB) << 20)
+	}
+
+	if cfg.TaildropDir != "" || cfg.TaildropForwardURL != "" {
+		receiver := &taildropReceiver{ts: ts, dir: cfg.TaildropDir, forwardURL: cfg.TaildropForwardURL}
+		go receiver.run(ctx)
+	}
+
+	conns.setThresholds(cfg.SlowRequestThreshold, int64(cfg.LargeTransferMB)<<20)
+	conns.setDrainTimeout(cfg.DrainTimeout)
+	sizeMetrics = newSizeHistograms(cfg.SizeMetrics)
+	slo = newSLOTracker(cfg.SLOObjective, cfg.SLOWindow, cfg.SLOBurnRate)
+	go slo.run(ctx)
+	connLifetime = newLifetimeLimit(cfg.MaxConnLifetime, cfg.MaxConnLifetimeGrace)
+	go conns.reap(ctx, reapPolicy{tcp: cfg.ReapIdleTCP, http: cfg.ReapIdleHTTP})
+	budget = newBufferBudget(int64(cfg.BufferBudgetMB)<<20, cfg.BufferBudgetWait)
+	tcpKeepalive = newKeepalive(dialNode, cfg.TCPKeepalive)
+	brokerKeepalive = tcpKeepalive
+	if cfg.TCPKeepalive <= 0 || cfg.TCPKeepalive > brokerKeepaliveInterval {
+		brokerKeepalive = newKeepalive(dialNode, brokerKeepaliveInterval)
+	}
+	ftpPassive, _ = newFTPPassivePorts(cfg.FTPPassivePorts, cfg.FTPPassiveAddress)
+	ipFamilies = newFamilyDialer(dialNode, cfg.TargetIPFamily)
+	staticHosts = newHostsTable(cfg.StaticHosts)
+	staticHosts.log()
+	targetEnv.set(cfg.TargetEnv)
+	templated := append(append([]string(nil), cfg.Targets...), cfg.HeaderTargets...)
+	logTargetExpansions(templated)
+	if cfg.TargetEnvFile != "" {
+		go reloadTargetEnv(ctx, cfg.TargetEnvFile, templated)
+	}
+	if dialNode != nil {
+		dialDoctor = newDialDiagnostics(dialNode)
+	}
+	tunnelTokens = newTokenStore(cfg.TokenMaxTTL)
+	tenants = newTenantSet(cfg.Tenants, cfg.TenantRequired)
+	stateDB.keepCounters(tenants.counters())
+	if dialNode != nil {
+		bulkPaths = newPathLookup(dialNode)
+		if cfg.LogConnectionPaths {
+			tailnetPaths = bulkPaths
+		}
+	}
+	if settings := cfg.RecordingSettings(); settings != nil {
+		store, err := newRecordingStore(*settings, ctx.Done())
+		if err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("failed to set up session recording")
+			os.Exit(1)
+		}
+		recordings = store
+	}
+
+	// Custom transport: dial backend, no 5-min tsnet timeout, pools tunable per target.
+	dial := dialFunc(backend.Dial)
+	// Resolve MagicDNS names under the search domain from the peer list
+	if cfg.ForwardTrafficType == ForwardTrafficTypeTailnetProxy && cfg.TailnetProxySearchDomain != "" {
+		dial = newMagicDNSCache(ts, cfg.TailnetProxySearchDomain, cfg.TailnetProxyDNSCacheTTL).dial(dial)
+	}
+	// Resolve static hosts, and dial targets given by name in the preferred address family
+	dial = targetDialer(dial)
+	targetDial := targetDialer(backend.Dial)
+	transport, err := newTargetTransport(
+		dial,
+		cfg.TransportSettings(),
+		cfg.TransportOverrides,
+		cfg.HTTPLogUpstreamConns,
+	)
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Msg("failed to create upstream transport")
+		os.Exit(1)
 	}
 	httpClient := &http.Client{Transport: transport}
 
+	for target, settings := range cfg.TransportOverrides {
+		logger.Stdout.Info().
+			Str("target", target).
+			Int("max-idle-conns-per-host", settings.MaxIdleConnsPerHost).
+			Int("max-conns-per-host", settings.MaxConnsPerHost).
+			Dur("idle-conn-timeout", settings.IdleConnTimeout).
+			Bool("disable-keepalives", settings.DisableKeepAlives).
+			Bool("tls-skip-verify", settings.TLSInsecureSkipVerify).
+			Str("tls-server-name", settings.TLSServerName).
+			Bool("tls-client-cert", settings.TLSCertFile != "").
+			Str("upstream-proxy", redactedProxy(settings.UpstreamProxy)).
+			Msg("using transport overrides")
+	}
+
+	if cfg.SelfTest && !runSelfTest(ctx, cfg, backend, httpClient) && cfg.SelfTestExitOnFailure {
+		os.Exit(1)
+	}
+	if cfg.PrewarmConnections > 0 {
+		prewarm(ctx, cfg, backend, httpClient)
+	}
+
+	tunnelDefaults := tcpOptions{
+		idleTimeout:       cfg.TCPIdleTimeout,
+		deadClientTimeout: cfg.TCPDeadClientTimeout,
+		maxInflight:       int64(cfg.TCPMaxInflightKB) << 10,
+		syslog:            cfg.SyslogSettings(),
+	}
+	tunnels := newTunnelManager(backend, cfg.ConfigFile, tunnelDefaults, newTunnelHandler(cfg, httpClient, targetDial))
+	for _, t := range cfg.Tunnels {
+		if err := tunnels.Restore(t); err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Int("listen-port", t.Listen).
+				Msg("failed to start tunnel")
+			os.Exit(1)
+		}
+	}
+	saved, err := stateDB.tunnels()
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Msg("failed to load saved tunnels")
+	}
+	for _, t := range saved {
+		// The port may be taken by a tunnel added to the config file since
+		if err := tunnels.Resume(t); err != nil {
+			logger.Stderr.Warn().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Int("listen-port", t.Listen).
+				Msg("failed to resume saved tunnel")
+		}
+	}
+	usage := newUsageExporter(cfg, tunnels)
+	defer usage.close()
+	schedules, err := newScheduler(tunnels)
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Msg("failed to load schedules")
+	}
+	go schedules.run(ctx)
+
+	if cfg.AdminPort != "" {
+		ln, err := adminListener(ts, cfg, cfg.AdminPort)
+		if err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("admin-port", cfg.AdminPort).
+				Msg("failed to start admin listener")
+			os.Exit(1)
+		}
+		go serveAdmin(ln, cfg.AdminNetwork, requireAdminToken(cfg.AdminToken, cfg.AdminPublicMetrics, newAdminMux(ts, cfg, tunnels, schedules)))
+	}
+	if cfg.AdminGRPCPort != "" {
+		ln, err := adminListener(ts, cfg, cfg.AdminGRPCPort)
+		if err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("admin-grpc-port", cfg.AdminGRPCPort).
+				Msg("failed to start gRPC admin listener")
+			os.Exit(1)
+		}
+		go serveGRPCAdmin(ln, cfg.AdminNetwork, newGRPCAdmin(ts, cfg, tunnels))
+	}
+	if cfg.DebugConsolePort != "" {
+		console := &debugConsole{ts: ts, cfg: cfg, tunnels: tunnels, users: cfg.DebugConsoleUsers}
+		go console.serve(cfg.DebugConsolePort)
+	}
+
+	// Stop accepting connections on shutdown, which returns from the serve calls below
+	go func() {
+		<-ctx.Done()
+		logger.Stdout.Info().Msg("shutting down")
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}()
+
 	switch cfg.ForwardTrafficType {
 	case ForwardTrafficTypeTailnetProxy:
 		logger.Stdout.Info().
@@ -94,9 +423,10 @@ func main() {
 			IdleTimeout:       0,
 			ReadHeaderTimeout: 5 * time.Second,
 			WriteTimeout:      0,
-			Handler:           NewTailnetProxy(httpClient, cfg.InsecureSkipVerify),
+			Handler:           httpHandler(cfg, httpClient, targetDial),
 		}
-		if err := server.Serve(listener); err != nil {
+		connLifetime.limitHTTP(&server)
+		if err := serveAll(listeners, server.Serve); err != nil && ctx.Err() == nil {
 			logger.StderrWithSource.Error().
 				Str(logger.ErrAttr(err), logger.ErrValue(err)).
 				Msg("failed to start tailnet proxy server")
@@ -113,22 +443,10 @@ func main() {
 			IdleTimeout:       0,
 			ReadHeaderTimeout: 5 * time.Second,
 			WriteTimeout:      0,
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				logger.Stdout.Info().
-					Str("remote-addr", r.RemoteAddr).
-					Str("target", cfg.TargetAddr).
-					Msg("forwarding")
-
-				if err := fwdHttp(httpClient, cfg.TargetAddr, w, r); err != nil {
-					logger.StderrWithSource.Error().
-						Str(logger.ErrAttr(err), logger.ErrValue(err)).
-						Str("remote-addr", r.RemoteAddr).
-						Str("target", cfg.TargetAddr).
-						Msg("failed to forward http request")
-				}
-			}),
-		}
-		if err := server.Serve(listener); err != nil {
+			Handler:           httpHandler(cfg, httpClient, targetDial),
+		}
+		connLifetime.limitHTTP(&server)
+		if err := serveAll(listeners, server.Serve); err != nil && ctx.Err() == nil {
 			logger.StderrWithSource.Error().
 				Str(logger.ErrAttr(err), logger.ErrValue(err)).
 				Msg("failed to start http server")
@@ -139,26 +457,58 @@ func main() {
 		logger.Stdout.Info().
 			Str("listen-addr", listenAddr).
 			Str("target-addr", cfg.TargetAddr).
+			Str("proxy-protocol", cfg.TCPProxyProtocol).
+			Bool("accept-proxy-protocol", cfg.TCPAcceptProxyProtocol).
+			Str("protocol", cfg.TCPProtocol).
+			Str("profile", cfg.TCPProfile).
+			Dur("idle-timeout", cfg.TCPIdleTimeout).
+			Int("max-inflight-kb", cfg.TCPMaxInflightKB).
 			Msg("running in TCP tunnel mode")
 
-		for {
-			conn, err := listener.Accept()
+		opts := cfg.PoolOptions(targetDial)
+		opts.health = cfg.HealthSettings(targetDial)
+		pool := newTargetPool(cfg.Targets, opts)
+		if cfg.TCPProtocol == TCPProtocolSyslog {
+			forwarder, err := newSyslogForwarder(backend, pool, cfg.SyslogSettings(), "main")
 			if err != nil {
 				logger.StderrWithSource.Error().
 					Str(logger.ErrAttr(err), logger.ErrValue(err)).
-					Msg("failed to accept connection")
-				continue
+					Msg("failed to start syslog forwarding")
+				os.Exit(1)
 			}
-
-			go func(c net.Conn) {
-				_ = c.SetDeadline(time.Now().Add(5 * time.Minute))
-				if err := fwdTCP(c, ts, cfg.TargetAddr); err != nil {
-					logger.StderrWithSource.Error().
-						Str(logger.ErrAttr(err), logger.ErrValue(err)).
-						Str("remote-addr", c.RemoteAddr().String()).
-						Msg("forwarding failed")
-				}
-			}(conn)
+			_ = serveAll(listeners, func(l net.Listener) error {
+				serveSyslog(l, forwarder)
+				return nil
+			})
+			return
 		}
+		// Shared by the listeners, for the per-client-address limits to span them
+		tcpOpts := cfg.TCPOptions()
+		_ = serveAll(listeners, func(l net.Listener) error {
+			serveTCP(l, backend, pool, tcpOpts)
+			return nil
+		})
 	}
 }
+
+// httpHandler builds the handler for the HTTP modes, exiting if it cannot be built.
+func httpHandler(cfg *Config, httpClient *http.Client, dial dialFunc) http.Handler {
+	handler, err := newHTTPHandler(cfg, httpClient, dial)
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Msg("failed to build http handler")
+		os.Exit(1)
+	}
+
+	if cfg.RequireToken {
+		handler = requireToken(handler)
+	}
+	handler = limitHours(cfg.AccessWindow(), handler)
+	handler = duringMaintenance(handler)
+	if cfg.HSTSMaxAge > 0 {
+		handler = hsts(cfg, handler)
+	}
+
+	return handler
+}
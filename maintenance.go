@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// defaultMaintenanceMessage is what clients are told during maintenance, unless set.
+const defaultMaintenanceMessage = "down for maintenance"
+
+// maintenance is the maintenance mode of the main listener, set through the admin API or
+// by schedules. Tunnels keep working during maintenance, so that it can be done through
+// them.
+var maintenance = &maintenanceMode{}
+
+// MaintenanceStatus is the maintenance mode, as shown by the admin API.
+type MaintenanceStatus struct {
+	Active  bool       `json:"active"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	Until   *time.Time `json:"until,omitempty"` // when it ends on its own, if ever
+}
+
+// maintenanceMode refuses the connections and requests of the main listener while on:
+// HTTP clients get 503 Service Unavailable, with a Retry-After header when it ends on its
+// own, and TCP connections are closed right away.
+type maintenanceMode struct {
+	mu      sync.Mutex
+	active  bool
+	message string
+	since   time.Time
+	until   time.Time // zero if it lasts until turned off
+}
+
+// start turns maintenance on for duration, until turned off if 0, telling clients
+// message.
+func (m *maintenanceMode) start(duration time.Duration, message string) MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if !m.active {
+		m.since = now
+	}
+	m.active, m.message, m.until = true, message, time.Time{}
+	if m.message == "" {
+		m.message = defaultMaintenanceMessage
+	}
+	if duration > 0 {
+		m.until = now.Add(duration)
+	}
+
+	event := logger.Stdout.Info().Str("message", m.message)
+	if !m.until.IsZero() {
+		event = event.Time("until", m.until)
+	}
+	event.Msg("maintenance started")
+	metrics.Default.Gauge("railtail_maintenance_active",
+		"1 while the main listener is in maintenance mode.").Set(1)
+
+	return m.statusLocked(now)
+}
+
+// stop turns maintenance off.
+func (m *maintenanceMode) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.active {
+		return
+	}
+	m.active = false
+	logger.Stdout.Info().Dur("lasted", time.Since(m.since)).Msg("maintenance ended")
+	metrics.Default.Gauge("railtail_maintenance_active",
+		"1 while the main listener is in maintenance mode.").Set(0)
+}
+
+// check returns whether connections are refused at now, and what to tell clients. It
+// ends maintenance that lasted its duration.
+func (m *maintenanceMode) check(now time.Time) (until time.Time, message string, on bool) {
+	m.mu.Lock()
+	active, until, message := m.active, m.until, m.message
+	m.mu.Unlock()
+
+	if active && !until.IsZero() && !now.Before(until) {
+		m.stop()
+		return time.Time{}, "", false
+	}
+
+	return until, message, active
+}
+
+// Status returns the maintenance mode.
+func (m *maintenanceMode) Status() MaintenanceStatus {
+	m.check(time.Now())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.statusLocked(time.Now())
+}
+
+// statusLocked returns the maintenance mode at now. m.mu must be held.
+func (m *maintenanceMode) statusLocked(now time.Time) MaintenanceStatus {
+	if !m.active {
+		return MaintenanceStatus{}
+	}
+
+	status := MaintenanceStatus{Active: true, Message: m.message}
+	since := m.since
+	status.Since = &since
+	if !m.until.IsZero() && m.until.After(now) {
+		until := m.until
+		status.Until = &until
+	}
+
+	return status
+}
+
+// logMaintenanceRefused logs that a connection of kind from remoteAddr was refused
+// during maintenance, and counts it.
+func logMaintenanceRefused(kind, remoteAddr string) {
+	countClosed(kind, CloseMaintenance)
+	logger.Stderr.Warn().
+		Str("remote-addr", remoteAddr).
+		Str("reason", CloseMaintenance).
+		Msg("connection refused during maintenance")
+}
+
+// duringMaintenance returns handler answering requests with 503 Service Unavailable
+// during maintenance.
+func duringMaintenance(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		until, message, on := maintenance.check(time.Now())
+		if !on {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		logMaintenanceRefused(connKindHTTP, r.RemoteAddr)
+		if !until.IsZero() {
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(time.Until(until).Seconds()))))
+		}
+		http.Error(w, "Service Unavailable: "+message, http.StatusServiceUnavailable)
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+const (
+	// mirrorQueueLen bounds the chunks of client traffic waiting to be copied to a mirror
+	// target. Once a chunk does not fit, the connection stops being mirrored: a slow mirror
+	// never slows the client down, and never gets a stream with a gap in it.
+	mirrorQueueLen = 64
+	// mirrorDialTimeout bounds how long a mirror target gets to accept a connection.
+	mirrorDialTimeout = 10 * time.Second
+	// mirrorFlushTimeout bounds how long the traffic still queued for a mirror target gets
+	// to be sent once the connection ends.
+	mirrorFlushTimeout = 5 * time.Second
+)
+
+// errMirrorBehind stops mirroring a connection whose mirror target could not keep up.
+var errMirrorBehind = errors.New("the mirror target fell behind")
+
+var (
+	mirrorSentBytes = metrics.Default.Counter("railtail_mirror_bytes_total",
+		"Bytes of client traffic copied to mirror targets, by result.", "result", "sent")
+	mirrorDroppedBytes = metrics.Default.Counter("railtail_mirror_bytes_total",
+		"Bytes of client traffic copied to mirror targets, by result.", "result", "dropped")
+)
+
+// withMirror returns o copying what clients send to the target mirror too, if set.
+func (o tcpOptions) withMirror(mirror string) tcpOptions {
+	o.mirror = mirror
+	return o
+}
+
+// mirrorConn is a connection to a mirror target, which gets a copy of what the client of
+// a connection sends, and whose replies are discarded.
+type mirrorConn struct {
+	addr   string
+	chunks chan []byte
+
+	stopped atomic.Bool // the mirror fell behind or failed, see stop
+
+	mu      sync.Mutex
+	conn    net.Conn // once dialed
+	closing bool     // the connection ended, see close
+}
+
+// openMirror starts copying what the client sends to the mirror target addr, sending it
+// preamble, such as the PROXY header the target got, first. The mirror is dialed with dial
+// in the background, so that an unreachable one does not hold up the connection; what the
+// client sends meanwhile is queued. Failing to reach the mirror is logged and leaves the
+// connection unmirrored.
+func openMirror(ctx context.Context, dial dialFunc, addr string, preamble []byte) *mirrorConn {
+	m := &mirrorConn{addr: addr, chunks: make(chan []byte, mirrorQueueLen)}
+	if len(preamble) > 0 {
+		m.chunks <- preamble
+	}
+	// The mirror still gets what was queued once the connection ends
+	go m.run(context.WithoutCancel(ctx), dial)
+
+	return m
+}
+
+// observe queues a copy of p, read from the client, for the mirror target.
+func (m *mirrorConn) observe(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	if m.stopped.Load() {
+		mirrorDroppedBytes.Add(uint64(len(p)))
+		return
+	}
+
+	select {
+	case m.chunks <- bytes.Clone(p):
+	default:
+		mirrorDroppedBytes.Add(uint64(len(p)))
+		m.stop(errMirrorBehind)
+	}
+}
+
+// stop stops mirroring the connection for good, closing the connection to the mirror
+// target, if dialed, and logs why.
+func (m *mirrorConn) stop(err error) {
+	if !m.stopped.CompareAndSwap(false, true) {
+		return
+	}
+
+	m.mu.Lock()
+	if m.conn != nil {
+		_ = m.conn.Close()
+	}
+	m.mu.Unlock()
+
+	logger.Stderr.Warn().
+		Str(logger.ErrAttr(err), logger.ErrValue(err)).
+		Str("mirror-addr", m.addr).
+		Msg("stopped mirroring the connection")
+}
+
+// run dials the mirror target and sends it the queued chunks until close, or until
+// mirroring stops; what is queued after that is dropped.
+func (m *mirrorConn) run(ctx context.Context, dial dialFunc) {
+	defer func() {
+		for chunk := range m.chunks {
+			mirrorDroppedBytes.Add(uint64(len(chunk)))
+		}
+	}()
+
+	dialCtx, cancel := context.WithTimeout(ctx, mirrorDialTimeout)
+	conn, err := dial(dialCtx, "tcp", m.addr)
+	cancel()
+	if err != nil {
+		m.stop(fmt.Errorf("failed to dial mirror target: %w", err))
+		return
+	}
+	defer conn.Close()
+
+	m.mu.Lock()
+	m.conn = conn
+	if m.closing {
+		_ = conn.SetWriteDeadline(time.Now().Add(mirrorFlushTimeout))
+	}
+	m.mu.Unlock()
+	// Stopped before the connection was there to close
+	if m.stopped.Load() {
+		return
+	}
+	go func() { _, _ = io.Copy(io.Discard, conn) }()
+
+	for chunk := range m.chunks {
+		if m.stopped.Load() {
+			mirrorDroppedBytes.Add(uint64(len(chunk)))
+			continue
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			mirrorDroppedBytes.Add(uint64(len(chunk)))
+			m.stop(fmt.Errorf("failed to write to mirror target: %w", err))
+			continue
+		}
+		mirrorSentBytes.Add(uint64(len(chunk)))
+	}
+}
+
+// close sends what is still queued, for up to mirrorFlushTimeout, and closes the mirror
+// connection, without holding up the caller. observe must not be called after it.
+func (m *mirrorConn) close() {
+	m.mu.Lock()
+	m.closing = true
+	if m.conn != nil {
+		_ = m.conn.SetWriteDeadline(time.Now().Add(mirrorFlushTimeout))
+	}
+	m.mu.Unlock()
+	close(m.chunks)
+}
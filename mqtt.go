@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// MQTT packets railtail reads or writes.
+const (
+	mqttConnect    = 0x10 // first byte of CONNECT packets
+	mqttConnack    = 0x20
+	mqttDisconnect = 0xe0
+)
+
+const (
+	// mqttConnectTimeout bounds the wait for the CONNECT packet of a client.
+	mqttConnectTimeout = 10 * time.Second
+	// mqttMaxConnect bounds the CONNECT packets read, will message included.
+	mqttMaxConnect = 256 << 10
+	// CONNACK return codes of MQTT 3.1 and 3.1.1.
+	mqttServerUnavailable = 0x03
+	mqttNotAuthorized     = 0x05
+)
+
+// User properties railtail adds to the CONNECT packets of MQTT 5 clients, for a broker
+// plugin to enforce. Properties of these names sent by clients are removed.
+const (
+	mqttPropertyPrefix       = "railtail-"
+	mqttPropertyAllowedTopic = "railtail-allowed-topic" // one per topic filter of MQTT_ALLOWED_TOPICS
+	mqttPropertyClientAddr   = "railtail-client-addr"   // ip:port of the client
+)
+
+// ErrMQTTRefused is returned for MQTT clients refused before reaching the broker.
+var ErrMQTTRefused = errors.New("MQTT client refused")
+
+// ErrMQTTTopicInvalid is returned for MQTT topic filters that are not valid.
+var ErrMQTTTopicInvalid = errors.New("MQTT topic filter is invalid")
+
+// validateMQTTTopics checks the topic filters of MQTT_ALLOWED_TOPICS: levels separated by
+// /, where + stands for a whole level and # for the remaining levels, last.
+func validateMQTTTopics(topics []string) error {
+	for _, topic := range topics {
+		if topic == "" || strings.ContainsRune(topic, 0) {
+			return fmt.Errorf("%w: '%s'", ErrMQTTTopicInvalid, topic)
+		}
+		levels := strings.Split(topic, "/")
+		for i, level := range levels {
+			if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+				return fmt.Errorf("%w: '%s': # must be the whole last level", ErrMQTTTopicInvalid, topic)
+			}
+			if strings.Contains(level, "+") && level != "+" {
+				return fmt.Errorf("%w: '%s': + must be a whole level", ErrMQTTTopicInvalid, topic)
+			}
+		}
+	}
+
+	return nil
+}
+
+// countMQTTConnect counts the CONNECT of an MQTT client, by what railtail made of it:
+// forwarded, refused, or uninspected (TLS).
+func countMQTTConnect(result string) {
+	metrics.Default.Counter("railtail_mqtt_connects_total",
+		"MQTT clients connecting, by whether they were forwarded, refused or not inspected (TLS).", "result", result).Inc()
+}
+
+// mqttConnectInfo is what railtail reads of a CONNECT packet.
+type mqttConnectInfo struct {
+	level     byte // protocol level: 3 (MQTT 3.1), 4 (3.1.1) or 5
+	clientID  string
+	username  string
+	keepAlive uint16
+	clean     bool
+
+	props    []byte // the properties of MQTT 5 packets
+	propsAt  int    // where the length of the properties starts in the packet
+	propsEnd int    // where the properties end
+}
+
+// version returns the MQTT version of the protocol level of the packet.
+func (c mqttConnectInfo) version() string {
+	switch c.level {
+	case 3:
+		return "3.1"
+	case 4:
+		return "3.1.1"
+	default:
+		return "5"
+	}
+}
+
+// mqttHandshake reads the CONNECT packet of the MQTT client on conn, logs who connects,
+// and returns what to send the broker first: the packet, with the topic filters of topics
+// and the client address added as user properties for MQTT 5 clients. With topics set,
+// clients they cannot be passed on to are refused: MQTT 3.1 and 3.1.1 clients with a
+// "not authorized" CONNACK, TLS clients by closing. Without, TLS clients are forwarded
+// as they are.
+func mqttHandshake(conn net.Conn, topics []string) ([]byte, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return nil, err
+	}
+	if first[0] != mqttConnect {
+		if len(topics) > 0 {
+			countMQTTConnect("refused")
+			return nil, fmt.Errorf("%w: the client does not start with a plain CONNECT (TLS?), "+
+				"so its topics cannot be restricted", ErrMQTTRefused)
+		}
+		countMQTTConnect("uninspected")
+		return first, nil
+	}
+
+	packet, err := readMQTTPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+	info, err := parseMQTTConnect(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	event := logger.Stdout.Info().
+		Str("remote-addr", conn.RemoteAddr().String()).
+		Str("client-id", info.clientID).
+		Str("mqtt-version", info.version()).
+		Uint16("keepalive", info.keepAlive).
+		Bool("clean", info.clean)
+	if info.username != "" {
+		event = event.Str("username", info.username)
+	}
+
+	if info.level < 5 {
+		if len(topics) > 0 {
+			countMQTTConnect("refused")
+			event.Msg("MQTT client refused: topics can only be restricted for MQTT 5 clients")
+			_, _ = conn.Write([]byte{mqttConnack, 2, 0, mqttNotAuthorized})
+			return nil, fmt.Errorf("%w: MQTT %s client %s, topics can only be restricted for MQTT 5",
+				ErrMQTTRefused, info.version(), info.clientID)
+		}
+		countMQTTConnect("forwarded")
+		event.Msg("MQTT client connecting")
+		return appendMQTTPacket(nil, mqttConnect, packet), nil
+	}
+
+	properties := [][2]string{{mqttPropertyClientAddr, conn.RemoteAddr().String()}}
+	for _, topic := range topics {
+		properties = append(properties, [2]string{mqttPropertyAllowedTopic, topic})
+	}
+	packet, err = info.withProperties(packet, properties)
+	if err != nil {
+		return nil, err
+	}
+	countMQTTConnect("forwarded")
+	event.Int("allowed-topics", len(topics)).Msg("MQTT client connecting")
+
+	return appendMQTTPacket(nil, mqttConnect, packet), nil
+}
+
+// readMQTTPacket reads the rest of a packet whose first byte was read: its remaining
+// length, then as many bytes.
+func readMQTTPacket(r io.Reader) ([]byte, error) {
+	length, multiplier := 0, 1
+	b := make([]byte, 1)
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("malformed MQTT remaining length")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		length += int(b[0]&0x7f) * multiplier
+		multiplier *= 128
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+	if length > mqttMaxConnect {
+		return nil, fmt.Errorf("MQTT CONNECT packet is over %d bytes", mqttMaxConnect)
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+// appendMQTTPacket appends the packet of type first and body to b.
+func appendMQTTPacket(b []byte, first byte, body []byte) []byte {
+	b = append(b, first)
+	b = appendMQTTVarint(b, len(body))
+
+	return append(b, body...)
+}
+
+// appendMQTTVarint appends n as an MQTT variable byte integer to b.
+func appendMQTTVarint(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// parseMQTTConnect parses the body of a CONNECT packet.
+func parseMQTTConnect(packet []byte) (mqttConnectInfo, error) {
+	var info mqttConnectInfo
+	p := &mqttParser{b: packet}
+
+	name := p.string()
+	info.level = p.byte()
+	flags := p.byte()
+	info.keepAlive = p.uint16()
+	if p.err != nil {
+		return info, p.err
+	}
+	switch {
+	case name == "MQIsdp" && info.level == 3, name == "MQTT" && (info.level == 4 || info.level == 5):
+	default:
+		return info, fmt.Errorf("unsupported MQTT protocol %q level %d", name, info.level)
+	}
+	if flags&0x01 != 0 {
+		return info, errors.New("malformed MQTT CONNECT: reserved flag set")
+	}
+	info.clean = flags&0x02 != 0
+
+	if info.level == 5 {
+		info.propsAt = p.i
+		info.props = p.binaryOf(p.varint())
+		info.propsEnd = p.i
+	}
+	info.clientID = p.string()
+	if flags&0x04 != 0 { // will
+		if info.level == 5 {
+			p.binaryOf(p.varint())
+		}
+		p.string()
+		p.binary()
+	}
+	if flags&0x80 != 0 {
+		info.username = p.string()
+	}
+	if flags&0x40 != 0 {
+		p.binary()
+	}
+	if p.err != nil {
+		return info, p.err
+	}
+
+	return info, nil
+}
+
+// withProperties returns packet, the body of the CONNECT packet of info, with the user
+// properties of railtail replaced by properties.
+func (c mqttConnectInfo) withProperties(packet []byte, properties [][2]string) ([]byte, error) {
+	var props []byte
+	p := &mqttParser{b: c.props}
+	for p.i < len(p.b) && p.err == nil {
+		start := p.i
+		id := p.byte()
+		if id == 0x26 { // user property
+			name := p.string()
+			p.string()
+			if strings.HasPrefix(strings.ToLower(name), mqttPropertyPrefix) {
+				continue
+			}
+		} else {
+			p.skipProperty(id)
+		}
+		props = append(props, p.b[start:p.i]...)
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	for _, property := range properties {
+		props = append(props, 0x26)
+		props = appendMQTTString(props, property[0])
+		props = appendMQTTString(props, property[1])
+	}
+
+	body := append([]byte(nil), packet[:c.propsAt]...)
+	body = appendMQTTVarint(body, len(props))
+	body = append(body, props...)
+
+	return append(body, packet[c.propsEnd:]...), nil
+}
+
+// appendMQTTString appends s, prefixed with its length, to b.
+func appendMQTTString(b []byte, s string) []byte {
+	return append(append(b, byte(len(s)>>8), byte(len(s))), s...)
+}
+
+// mqttParser reads the fields of an MQTT packet, remembering the first error.
+type mqttParser struct {
+	b   []byte
+	i   int
+	err error
+}
+
+func (p *mqttParser) binaryOf(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if n < 0 || len(p.b)-p.i < n {
+		p.err = errors.New("malformed MQTT CONNECT: truncated")
+		return nil
+	}
+	b := p.b[p.i : p.i+n]
+	p.i += n
+
+	return b
+}
+
+func (p *mqttParser) byte() byte {
+	if b := p.binaryOf(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *mqttParser) uint16() uint16 {
+	if b := p.binaryOf(2); b != nil {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return 0
+}
+
+// binary reads binary data or a string, prefixed with its length.
+func (p *mqttParser) binary() []byte {
+	return p.binaryOf(int(p.uint16()))
+}
+
+func (p *mqttParser) string() string {
+	return string(p.binary())
+}
+
+func (p *mqttParser) varint() int {
+	n, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		b := p.byte()
+		n += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			return n
+		}
+	}
+	if p.err == nil {
+		p.err = errors.New("malformed MQTT CONNECT: variable byte integer")
+	}
+
+	return 0
+}
+
+// skipProperty skips the value of the MQTT 5 property id.
+func (p *mqttParser) skipProperty(id byte) {
+	switch id {
+	case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2a:
+		p.binaryOf(1)
+	case 0x13, 0x21, 0x22, 0x23:
+		p.binaryOf(2)
+	case 0x02, 0x11, 0x18, 0x27:
+		p.binaryOf(4)
+	case 0x0b:
+		p.varint()
+	case 0x03, 0x08, 0x09, 0x12, 0x15, 0x16, 0x1a, 0x1c, 0x1f:
+		p.binary()
+	default:
+		if p.err == nil {
+			p.err = fmt.Errorf("malformed MQTT CONNECT: unknown property 0x%02x", id)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// maxLatencySamples bounds the latencies kept per target and interval.
+const maxLatencySamples = 1024
+
+// maxEjectionMultiplier bounds how much repeated ejections extend the ejection time.
+const maxEjectionMultiplier = 10
+
+// outlierSettings configures outlier detection for a targetPool.
+type outlierSettings struct {
+	interval          time.Duration
+	ejectionTime      time.Duration
+	errorRate         float64
+	latencyFactor     float64 // 0 disables latency-based ejection
+	minRequests       int
+	maxEjectedPercent int
+}
+
+// targetStats are the outlier detection counters of a target.
+type targetStats struct {
+	mu           sync.Mutex
+	requests     int
+	errors       int
+	latencies    []time.Duration
+	ejected      bool
+	ejectedUntil time.Time
+	ejections    int // consecutive ejections, reset once the target evaluates healthy
+}
+
+// observe records a request or connection to the target, for outlier detection (when
+// enabled), adaptive concurrency (when enabled) and the target health hooks.
+func (t *poolTarget) observe(latency time.Duration, failed bool) {
+	t.observeHealth(failed)
+	t.limiter.sample(latency, failed)
+	if t.stats == nil {
+		return
+	}
+
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+
+	t.stats.requests++
+	if failed {
+		t.stats.errors++
+	}
+	if len(t.stats.latencies) < maxLatencySamples {
+		t.stats.latencies = append(t.stats.latencies, latency)
+	} else {
+		t.stats.latencies[t.stats.requests%maxLatencySamples] = latency
+	}
+}
+
+// isEjected reports whether the target is currently ejected from load balancing.
+func (t *poolTarget) isEjected() bool {
+	if t.stats == nil {
+		return false
+	}
+
+	t.stats.mu.Lock()
+	defer t.stats.mu.Unlock()
+
+	return t.stats.ejected
+}
+
+// targetSample is what a target did during the last interval.
+type targetSample struct {
+	target   *poolTarget
+	requests int
+	errors   int
+	p99      time.Duration
+}
+
+// detectOutliers evaluates the pool every interval. It runs for the life of the pool.
+func (p *targetPool) detectOutliers(settings *outlierSettings) {
+	ticker := time.NewTicker(settings.interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		p.evaluateOutliers(settings, now)
+	}
+}
+
+// evaluateOutliers returns targets whose ejection expired to the pool, then ejects
+// targets whose error rate or p99 latency over the last interval stand out.
+func (p *targetPool) evaluateOutliers(settings *outlierSettings, now time.Time) {
+	var (
+		samples []targetSample
+		ejected int
+	)
+	for _, t := range p.targets {
+		t.stats.mu.Lock()
+		if t.stats.ejected && now.After(t.stats.ejectedUntil) {
+			t.stats.ejected = false
+			targetEjectedGauge(t.addr).Set(0)
+			logger.Stdout.Info().
+				Str("target", t.addr).
+				Msg("outlier returned to the pool")
+			hooks.emit(HookTargetHealthy, map[string]string{"target": t.addr, "reason": "outlier-returned"})
+		}
+
+		if t.stats.ejected {
+			ejected++
+		} else if t.stats.requests >= settings.minRequests {
+			samples = append(samples, targetSample{
+				target:   t,
+				requests: t.stats.requests,
+				errors:   t.stats.errors,
+				p99:      percentile(t.stats.latencies, 0.99),
+			})
+		}
+
+		t.stats.requests, t.stats.errors = 0, 0
+		t.stats.latencies = t.stats.latencies[:0]
+		t.stats.mu.Unlock()
+	}
+
+	// Never eject the whole pool
+	maxEjected := len(p.targets) * settings.maxEjectedPercent / 100
+	if maxEjected >= len(p.targets) {
+		maxEjected = len(p.targets) - 1
+	}
+
+	for i, s := range samples {
+		reason := ""
+		if float64(s.errors)/float64(s.requests) >= settings.errorRate {
+			reason = "error-rate"
+		} else if settings.latencyFactor > 0 {
+			others := make([]time.Duration, 0, len(samples)-1)
+			for j, o := range samples {
+				if j != i {
+					others = append(others, o.p99)
+				}
+			}
+			if median := percentile(others, 0.5); median > 0 &&
+				float64(s.p99) > settings.latencyFactor*float64(median) {
+				reason = "latency"
+			}
+		}
+
+		s.target.stats.mu.Lock()
+		switch {
+		case reason == "":
+			s.target.stats.ejections = 0
+		case ejected < maxEjected:
+			ejected++
+			s.target.stats.ejections++
+			multiplier := min(s.target.stats.ejections, maxEjectionMultiplier)
+			s.target.stats.ejected = true
+			s.target.stats.ejectedUntil = now.Add(settings.ejectionTime * time.Duration(multiplier))
+
+			targetEjectedGauge(s.target.addr).Set(1)
+			metrics.Default.Counter("railtail_outlier_ejections_total",
+				"Targets ejected from load balancing by outlier detection.",
+				"target", s.target.addr, "reason", reason).Inc()
+			logger.Stderr.Warn().
+				Str("target", s.target.addr).
+				Str("reason", reason).
+				Int("requests", s.requests).
+				Int("errors", s.errors).
+				Dur("p99", s.p99).
+				Time("ejected-until", s.target.stats.ejectedUntil).
+				Msg("ejecting outlier target")
+			hooks.emit(HookTargetUnhealthy, map[string]string{"target": s.target.addr, "reason": "outlier-" + reason})
+		}
+		s.target.stats.mu.Unlock()
+	}
+}
+
+func targetEjectedGauge(addr string) *metrics.Gauge {
+	return metrics.Default.Gauge("railtail_target_ejected",
+		"Whether the target is ejected from load balancing by outlier detection.", "target", addr)
+}
+
+// percentile returns the q-th quantile (0-1) of durations, or 0 if there are none.
+func percentile(durations []time.Duration, q float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sorted := slices.Clone(durations)
+	slices.Sort(sorted)
+
+	return sorted[int(q*float64(len(sorted)-1))]
+}
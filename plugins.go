@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/middleware"
+)
+
+// ErrPluginsUnsupported is returned when railtail was built without plugin support.
+var ErrPluginsUnsupported = errors.New("filter plugins require a cgo-enabled build on Linux, macOS or FreeBSD")
+
+// filterHooks are the hooks exported by a filter plugin. Either may be nil.
+//
+// A plugin is a Go package main built with -buildmode=plugin that exports:
+//
+//	// FilterRequest inspects (and may modify) the request before it is forwarded.
+//	// Returning false stops the request; the filter must have written a response.
+//	func FilterRequest(w http.ResponseWriter, r *http.Request) bool
+//
+//	// FilterResponse inspects (and may modify) the upstream response. Returning an
+//	// error replaces the response with a 502.
+//	func FilterResponse(resp *http.Response) error
+type filterHooks struct {
+	request  func(http.ResponseWriter, *http.Request) bool
+	response func(*http.Response) error
+}
+
+// loadFilterPlugins opens every plugin in paths and registers it as the middleware
+// "plugin:<file name without extension>".
+func loadFilterPlugins(paths []string) error {
+	for _, path := range paths {
+		hooks, err := openFilterPlugin(path)
+		if err != nil {
+			return fmt.Errorf("failed to load plugin %s: %w", path, err)
+		}
+		if hooks.request == nil && hooks.response == nil {
+			return fmt.Errorf("plugin %s exports neither FilterRequest nor FilterResponse", path)
+		}
+
+		name := "plugin:" + strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		middleware.Register(name, hooks.middleware)
+
+		logger.Stdout.Info().
+			Str("plugin", path).
+			Str("middleware", name).
+			Bool("filters-requests", hooks.request != nil).
+			Bool("filters-responses", hooks.response != nil).
+			Msg("filter plugin loaded")
+	}
+
+	return nil
+}
+
+// middleware runs the plugin's request filter, and schedules its response filter to run
+// on the upstream response.
+func (h filterHooks) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.request != nil && !h.request(w, r) {
+			return
+		}
+		if h.response != nil {
+			r = r.WithContext(withResponseHook(r.Context(), h.response))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseHooksKey is the context key for the response hooks of a request.
+type responseHooksKey struct{}
+
+// withResponseHook adds a hook run by fwdHttp on the upstream response.
+func withResponseHook(ctx context.Context, hook func(*http.Response) error) context.Context {
+	hooks, _ := ctx.Value(responseHooksKey{}).([]func(*http.Response) error)
+	hooks = append(hooks[:len(hooks):len(hooks)], hook)
+
+	return context.WithValue(ctx, responseHooksKey{}, hooks)
+}
+
+// runResponseHooks runs the response hooks attached to the request of resp, innermost
+// middleware first, like a regular middleware chain would see the response.
+func runResponseHooks(resp *http.Response) error {
+	hooks, _ := resp.Request.Context().Value(responseHooksKey{}).([]func(*http.Response) error)
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i](resp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build cgo && (linux || darwin || freebsd)
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"plugin"
+)
+
+// openFilterPlugin opens the Go plugin at path and looks up its filter hooks.
+func openFilterPlugin(path string) (filterHooks, error) {
+	var hooks filterHooks
+
+	p, err := plugin.Open(path)
+	if err != nil {
+		return hooks, err
+	}
+
+	if sym, err := p.Lookup("FilterRequest"); err == nil {
+		fn, ok := sym.(func(http.ResponseWriter, *http.Request) bool)
+		if !ok {
+			return hooks, fmt.Errorf("FilterRequest has type %T", sym)
+		}
+		hooks.request = fn
+	}
+
+	if sym, err := p.Lookup("FilterResponse"); err == nil {
+		fn, ok := sym.(func(*http.Response) error)
+		if !ok {
+			return hooks, fmt.Errorf("FilterResponse has type %T", sym)
+		}
+		hooks.response = fn
+	}
+
+	return hooks, nil
+}
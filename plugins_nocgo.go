@@ -0,0 +1,8 @@
+//go:build !cgo || !(linux || darwin || freebsd)
+
+package main
+
+// openFilterPlugin always fails: the plugin package needs cgo.
+func openFilterPlugin(string) (filterHooks, error) {
+	return filterHooks{}, ErrPluginsUnsupported
+}
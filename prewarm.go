@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// prewarmTimeout bounds how long pre-warming holds up the start.
+const prewarmTimeout = 15 * time.Second
+
+// prewarm opens PREWARM_CONNECTIONS connections to every target as soon as the tailnet
+// is up, so that the first requests after a deploy do not pay for the path discovery
+// (DERP, then direct) and handshakes. HTTP targets get HEAD requests for PREWARM_PATH,
+// which leave their connections idle in the pool, up to HTTP_MAX_IDLE_CONNS_PER_HOST.
+// TCP targets are dialed and the connections closed right away, as servers expecting a
+// handshake would time idle ones out; the tailnet path stays warm. Tailnet Proxies have
+// no fixed target, so nothing is pre-warmed for them.
+func prewarm(ctx context.Context, cfg *Config, dialer Dialer, client *http.Client) {
+	ctx, cancel := context.WithTimeout(ctx, prewarmTimeout)
+	defer cancel()
+
+	var (
+		httpTargets []string
+		tcpTargets  []string
+	)
+	switch cfg.ForwardTrafficType {
+	case ForwardTrafficTypeHTTP, ForwardTrafficTypeHTTPS:
+		httpTargets = append(httpTargets, cfg.Targets...)
+	case ForwardTrafficTypeTCP:
+		tcpTargets = append(tcpTargets, cfg.Targets...)
+	}
+	for _, t := range cfg.Tunnels {
+		switch t.mode() {
+		case TunnelModeTCP:
+			tcpTargets = append(tcpTargets, t.Target)
+		case TunnelModeHTTP:
+			httpTargets = append(httpTargets, splitList(t.Target)...)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, target := range httpTargets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prewarmTarget(ctx, target, cfg.PrewarmConnections, func(ctx context.Context) error {
+				req, err := http.NewRequestWithContext(ctx, http.MethodHead,
+					strings.TrimSuffix(target, "/")+cfg.PrewarmPath, nil)
+				if err != nil {
+					return err
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					return err
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				return resp.Body.Close()
+			})
+		}()
+	}
+	for _, target := range tcpTargets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prewarmTarget(ctx, target, cfg.PrewarmConnections, func(ctx context.Context) error {
+				conn, err := targetDialer(dialer.Dial)(ctx, "tcp", target)
+				if err != nil {
+					return err
+				}
+				return conn.Close()
+			})
+		}()
+	}
+	wg.Wait()
+}
+
+// prewarmTarget runs open n times concurrently, and logs how it went.
+func prewarmTarget(ctx context.Context, target string, n int, open func(context.Context) error) {
+	var (
+		wg      sync.WaitGroup
+		opened  atomic.Int64
+		lastErr atomic.Value
+	)
+	start := time.Now()
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := open(ctx); err != nil {
+				lastErr.Store(err)
+				return
+			}
+			opened.Add(1)
+		}()
+	}
+	wg.Wait()
+
+	if err, _ := lastErr.Load().(error); err != nil {
+		logger.Stderr.Warn().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("target", target).
+			Int64("opened", opened.Load()).
+			Int("connections", n).
+			Dur("latency", time.Since(start)).
+			Msg("failed to pre-warm connections")
+		return
+	}
+
+	logger.Stdout.Info().
+		Str("target", target).
+		Int("connections", n).
+		Dur("latency", time.Since(start)).
+		Msg("pre-warmed connections")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// rssCheckInterval is how often resident memory is compared with the threshold.
+const rssCheckInterval = 10 * time.Second
+
+// profileDumper writes heap and goroutine profiles for post-mortem analysis.
+type profileDumper struct {
+	dir       string // state dir the profiles are written to
+	uploadURL string // where profiles are also POSTed; disabled if empty
+}
+
+// dump writes the profiles, uploads them if configured and logs where they went.
+func (d *profileDumper) dump(reason string) {
+	for _, name := range []string{"heap", "goroutine"} {
+		path, err := writeProfile(d.dir, name)
+		if err == nil && d.uploadURL != "" {
+			err = uploadProfile(d.uploadURL, path)
+		}
+		if err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("profile", name).
+				Str("reason", reason).
+				Msg("failed to dump profile")
+			continue
+		}
+
+		logger.Stdout.Info().
+			Str("profile", name).
+			Str("path", path).
+			Bool("uploaded", d.uploadURL != "").
+			Str("reason", reason).
+			Msg("profile dumped")
+	}
+}
+
+// watchSignals dumps profiles on every SIGQUIT, instead of Go's default of printing all
+// stacks and exiting.
+func (d *profileDumper) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGQUIT)
+
+	for range signals {
+		d.dump("signal")
+	}
+}
+
+// watchRSS dumps profiles when resident memory exceeds threshold bytes. It dumps again
+// only after memory went back below the threshold, so a plateau yields a single dump.
+func (d *profileDumper) watchRSS(threshold int64) {
+	ticker := time.NewTicker(rssCheckInterval)
+	defer ticker.Stop()
+
+	above := false
+	for range ticker.C {
+		rss := residentMemory()
+		if rss < 0 {
+			return // not available on this platform
+		}
+
+		if rss > threshold && !above {
+			logger.Stderr.Warn().
+				Int64("rss-bytes", rss).
+				Int64("threshold-bytes", threshold).
+				Msg("resident memory above threshold")
+			d.dump("rss")
+		}
+		above = rss > threshold
+	}
+}
+
+// residentMemory returns the resident set size of the process, or -1 where it is unknown.
+func residentMemory() int64 {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return -1
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return -1
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return -1
+	}
+
+	return pages * int64(os.Getpagesize())
+}
+
+// uploadProfile POSTs the profile at path to url, naming it in Content-Disposition.
+func uploadProfile(url, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)}))
+
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("profile upload failed: %s", resp.Status)
+	}
+
+	return nil
+}
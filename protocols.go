@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Application protocols spoken through TCP tunnels. Knowing the protocol lets railtail
+// handle idle connections the way the client and target expect, and introduce clients to
+// SMTP relays (see smtpXClient) and MQTT brokers (see mqttHandshake), and carry the data
+// connections of FTP transfers (see ftpControl). Syslog connections are not forwarded as
+// they are, but message by message (see syslogForwarder).
+const (
+	TCPProtocolNone     = ""
+	TCPProtocolPostgres = "postgres"
+	TCPProtocolMySQL    = "mysql"
+	TCPProtocolRedis    = "redis"
+	TCPProtocolSMTP     = "smtp"
+	TCPProtocolSyslog   = "syslog"
+	TCPProtocolMQTT     = "mqtt"
+	TCPProtocolFTP      = "ftp"
+)
+
+// ErrTCPProtocolInvalid is returned for unsupported TCP application protocols.
+var ErrTCPProtocolInvalid = errors.New("TCP protocol is invalid")
+
+// validateTCPProtocol checks a TCP application protocol setting.
+func validateTCPProtocol(protocol string) error {
+	switch protocol {
+	case TCPProtocolNone, TCPProtocolPostgres, TCPProtocolMySQL, TCPProtocolRedis, TCPProtocolSMTP, TCPProtocolSyslog,
+		TCPProtocolMQTT, TCPProtocolFTP:
+		return nil
+	default:
+		return fmt.Errorf("%w: expected postgres, mysql, redis, smtp, syslog, mqtt or ftp, got '%s'", ErrTCPProtocolInvalid, protocol)
+	}
+}
+
+// Requests clients send first to switch a connection to TLS.
+const (
+	postgresSSLRequestCode    = 80877103
+	postgresGSSENCRequestCode = 80877104
+	mysqlSSLRequestLength     = 32   // a handshake response carrying only the capability flags
+	tlsHandshakeRecord        = 0x16 // first byte of a TLS ClientHello
+)
+
+// protocolEncrypted reports whether the first bytes a client sent show that it
+// negotiates TLS (or GSSAPI encryption) with the target, in which case railtail cannot
+// speak the protocol on the connection. SMTP and FTP clients switch to TLS later on, with
+// STARTTLS and AUTH TLS, so for them it is asked about everything the client sends.
+func protocolEncrypted(protocol string, first []byte) bool {
+	switch protocol {
+	case TCPProtocolSMTP:
+		return len(first) >= 8 && strings.EqualFold(string(first[:8]), "STARTTLS") ||
+			len(first) > 0 && first[0] == tlsHandshakeRecord
+	case TCPProtocolFTP:
+		return len(first) >= 4 && strings.EqualFold(string(first[:4]), "AUTH") ||
+			len(first) > 0 && first[0] == tlsHandshakeRecord
+	case TCPProtocolPostgres:
+		if len(first) < 8 || binary.BigEndian.Uint32(first) != 8 {
+			return false
+		}
+		code := binary.BigEndian.Uint32(first[4:])
+		return code == postgresSSLRequestCode || code == postgresGSSENCRequestCode
+	case TCPProtocolMySQL:
+		// 3-byte payload length and a sequence number, ahead of the first packet
+		return len(first) >= 4 && int(first[0])|int(first[1])<<8|int(first[2])<<16 == mysqlSSLRequestLength
+	default:
+		return len(first) > 0 && first[0] == tlsHandshakeRecord
+	}
+}
+
+// protocolGoodbye returns what to send the client and the target when railtail closes
+// an idle connection, so that both see an orderly shutdown instead of an unexpected EOF.
+// Either may be nil.
+func protocolGoodbye(protocol string) (client, target []byte) {
+	switch protocol {
+	case TCPProtocolPostgres:
+		// The FATAL error PostgreSQL sends on idle_session_timeout, and a Terminate message
+		return postgresError("FATAL", "57P05", "terminating connection due to idle-session timeout"),
+			[]byte{'X', 0, 0, 0, 4}
+	case TCPProtocolMySQL:
+		// The error MySQL sends on wait_timeout (ER_CLIENT_INTERACTION_TIMEOUT), and COM_QUIT
+		return mysqlError(4031, "HY000", "The client was disconnected by the server because of inactivity."),
+			[]byte{1, 0, 0, 0, 0x01}
+	case TCPProtocolRedis:
+		// Redis clients would take anything unsolicited for the reply to their next command
+		return nil, []byte("QUIT\r\n")
+	case TCPProtocolSMTP:
+		// The reply Postfix sends on its own timeout, and QUIT
+		return []byte("421 4.4.2 Error: timeout exceeded\r\n"), []byte("QUIT\r\n")
+	case TCPProtocolFTP:
+		// The reply vsftpd sends on its own idle session timeout, and QUIT
+		return []byte("421 Timeout.\r\n"), []byte("QUIT\r\n")
+	default:
+		return nil, nil
+	}
+}
+
+// postgresError encodes a PostgreSQL ErrorResponse message.
+func postgresError(severity, code, message string) []byte {
+	var fields []byte
+	for _, f := range []struct {
+		kind  byte
+		value string
+	}{{'S', severity}, {'V', severity}, {'C', code}, {'M', message}} {
+		fields = append(fields, f.kind)
+		fields = append(fields, f.value...)
+		fields = append(fields, 0)
+	}
+	fields = append(fields, 0)
+
+	msg := []byte{'E', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(fields)))
+
+	return append(msg, fields...)
+}
+
+// mysqlError encodes a MySQL ERR packet.
+func mysqlError(code uint16, state, message string) []byte {
+	payload := []byte{0xff, byte(code), byte(code >> 8), '#'}
+	payload = append(payload, state...)
+	payload = append(payload, message...)
+
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), 0}
+
+	return append(header, payload...)
+}
+
+// Redis replies meaning the server is up but cannot serve commands yet.
+var redisUnavailableReplies = []string{"-LOADING", "-BUSY", "-MASTERDOWN"}
+
+// probeProtocol checks that the server on conn speaks protocol and is responsive, without
+// authenticating: Redis must answer a PING (an authentication error will do), PostgreSQL
+// must answer an SSLRequest, MySQL must send its greeting, SMTP servers must greet with
+// 220, MQTT brokers must answer a CONNECT (refusing it will do, but not as unavailable),
+// and FTP servers must greet with 220. With no protocol, the connection being open is
+// enough. It returns a short description of the answer.
+func probeProtocol(conn net.Conn, protocol string) (string, error) {
+	switch protocol {
+	case TCPProtocolRedis:
+		if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+			return "", err
+		}
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("no reply to PING: %w", err)
+		}
+		reply = strings.TrimSpace(reply)
+		for _, prefix := range redisUnavailableReplies {
+			if strings.HasPrefix(reply, prefix) {
+				return "", fmt.Errorf("redis unavailable: %s", reply)
+			}
+		}
+		if !strings.HasPrefix(reply, "+") && !strings.HasPrefix(reply, "-") {
+			return "", fmt.Errorf("unexpected reply to PING: %q", reply)
+		}
+		return reply, nil
+
+	case TCPProtocolPostgres:
+		request := make([]byte, 8)
+		binary.BigEndian.PutUint32(request, 8)
+		binary.BigEndian.PutUint32(request[4:], postgresSSLRequestCode)
+		if _, err := conn.Write(request); err != nil {
+			return "", err
+		}
+		answer := make([]byte, 1)
+		if _, err := io.ReadFull(conn, answer); err != nil {
+			return "", fmt.Errorf("no answer to SSLRequest: %w", err)
+		}
+		if answer[0] != 'S' && answer[0] != 'N' {
+			return "", fmt.Errorf("unexpected answer to SSLRequest: %q", answer)
+		}
+		return "ssl " + map[byte]string{'S': "supported", 'N': "not supported"}[answer[0]], nil
+
+	case TCPProtocolMySQL:
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return "", fmt.Errorf("no greeting: %w", err)
+		}
+		length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		if length == 0 {
+			return "", errors.New("empty greeting")
+		}
+		payload := make([]byte, min(length, 1024))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return "", fmt.Errorf("truncated greeting: %w", err)
+		}
+		switch payload[0] {
+		case 0x0a: // protocol version 10, followed by the NUL-terminated server version
+			version, _, _ := strings.Cut(string(payload[1:]), "\x00")
+			return "mysql " + version, nil
+		case 0xff: // ERR packet (e.g. too many connections): error code, then the message
+			if len(payload) < 3 {
+				return "", errors.New("mysql error")
+			}
+			return "", fmt.Errorf("mysql error %d: %s", binary.LittleEndian.Uint16(payload[1:]), payload[3:])
+		default:
+			return "", fmt.Errorf("unexpected greeting (protocol %d)", payload[0])
+		}
+
+	case TCPProtocolSMTP:
+		greeting, err := readSMTPReply(bufio.NewReader(conn))
+		if err != nil {
+			return "", fmt.Errorf("no greeting: %w", err)
+		}
+		if greeting.code != 220 {
+			return "", fmt.Errorf("smtp unavailable: %s", strings.TrimSpace(string(greeting.raw)))
+		}
+		_, _ = conn.Write([]byte("QUIT\r\n"))
+		return "220 " + greeting.lines[0], nil
+
+	case TCPProtocolMQTT:
+		// An MQTT 3.1.1 CONNECT with a clean session and no client ID, which brokers assign
+		connect := appendMQTTPacket(nil, mqttConnect, []byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 0, 0, 0})
+		if _, err := conn.Write(connect); err != nil {
+			return "", err
+		}
+		connack := make([]byte, 4)
+		if _, err := io.ReadFull(conn, connack); err != nil {
+			return "", fmt.Errorf("no answer to CONNECT: %w", err)
+		}
+		if connack[0] != mqttConnack || connack[1] != 2 {
+			return "", fmt.Errorf("unexpected answer to CONNECT: %x", connack)
+		}
+		if connack[3] == mqttServerUnavailable {
+			return "", errors.New("mqtt broker unavailable")
+		}
+		_, _ = conn.Write([]byte{mqttDisconnect, 0})
+		return fmt.Sprintf("connack %d", connack[3]), nil
+
+	case TCPProtocolFTP:
+		greeting, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("no greeting: %w", err)
+		}
+		greeting = strings.TrimSpace(greeting)
+		if !strings.HasPrefix(greeting, "220") {
+			return "", fmt.Errorf("ftp unavailable: %s", greeting)
+		}
+		_, _ = conn.Write([]byte("QUIT\r\n"))
+		return greeting, nil
+
+	default:
+		return "connected", nil
+	}
+}
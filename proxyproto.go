@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// PROXY protocol versions sent ahead of forwarded TCP connections.
+const (
+	ProxyProtocolNone = ""
+	ProxyProtocolV1   = "v1"
+	ProxyProtocolV2   = "v2"
+)
+
+var (
+	// ErrProxyProtocolInvalid is returned for unsupported PROXY protocol versions.
+	ErrProxyProtocolInvalid = errors.New("PROXY protocol version is invalid")
+	// ErrProxyHeaderInvalid is returned for clients that did not start with a valid PROXY
+	// protocol header, with TCP_ACCEPT_PROXY_PROTOCOL.
+	ErrProxyHeaderInvalid = errors.New("PROXY protocol header is invalid")
+	// ErrProxyPeerUntrusted is returned for clients outside TCP_ACCEPT_PROXY_FROM, with
+	// TCP_ACCEPT_PROXY_PROTOCOL.
+	ErrProxyPeerUntrusted = errors.New("peer is not trusted to send a PROXY protocol header")
+	// ErrProxyPeersInvalid is returned for invalid TCP_ACCEPT_PROXY_FROM settings.
+	ErrProxyPeersInvalid = errors.New("trusted PROXY protocol peers are invalid")
+)
+
+const (
+	// proxyHeaderTimeout bounds how long clients may take to send their PROXY header.
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyHeaderV1MaxLen is the longest v1 header, CRLF included, per the specification.
+	proxyHeaderV1MaxLen = 107
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// validateProxyProtocol checks a PROXY protocol version setting.
+func validateProxyProtocol(version string) error {
+	switch version {
+	case ProxyProtocolNone, ProxyProtocolV1, ProxyProtocolV2:
+		return nil
+	default:
+		return fmt.Errorf("%w: expected v1 or v2, got '%s'", ErrProxyProtocolInvalid, version)
+	}
+}
+
+// writeProxyHeader writes a PROXY protocol header announcing a connection from src to
+// dst, so the target can see the real client address.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case ProxyProtocolV1:
+		header = proxyHeaderV1(src, dst)
+	case ProxyProtocolV2:
+		header = proxyHeaderV2(src, dst)
+	default:
+		return nil
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+// proxyAddrs returns src and dst as TCP addresses of the same family, or false if the
+// connection cannot be described (e.g. mixed families).
+func proxyAddrs(src, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 || (s.IP.To4() == nil) != (d.IP.To4() == nil) {
+		return nil, nil, false
+	}
+
+	return s, d, true
+}
+
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	s, d, ok := proxyAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP6"
+	if s.IP.To4() != nil {
+		family = "TCP4"
+	}
+
+	return []byte("PROXY " + family + " " + s.IP.String() + " " + d.IP.String() + " " +
+		strconv.Itoa(s.Port) + " " + strconv.Itoa(d.Port) + "\r\n")
+}
+
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+
+	s, d, ok := proxyAddrs(src, dst)
+	if !ok {
+		// LOCAL command, no address block
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+
+	var (
+		family   byte
+		srcIP    = s.IP.To4()
+		dstIP    = d.IP.To4()
+		addrSize = 12
+	)
+	if srcIP != nil {
+		family = 0x11 // TCP over IPv4
+	} else {
+		family, srcIP, dstIP, addrSize = 0x21, s.IP.To16(), d.IP.To16(), 36 // TCP over IPv6
+	}
+
+	header = append(header, 0x21, family) // version 2, PROXY command
+	header = binary.BigEndian.AppendUint16(header, uint16(addrSize))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(s.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(d.Port))
+
+	return header
+}
+
+// logProxyHeaderRejected logs and counts a client refused for its PROXY header.
+func logProxyHeaderRejected(remoteAddr string, err error) {
+	countClosed(connKindTCP, CloseClientError)
+	logger.Stderr.Warn().
+		Str(logger.ErrAttr(err), logger.ErrValue(err)).
+		Str("remote-addr", remoteAddr).
+		Str("reason", CloseClientError).
+		Msg("connection refused for its PROXY protocol header")
+}
+
+// proxiedConn is a client connection that started with a PROXY protocol header: its
+// remote address is the client the header announced, such as the client of an earlier
+// railtail hop, and the address that client connected to is kept for the header sent on.
+type proxiedConn struct {
+	net.Conn
+	src, dst net.Addr
+}
+
+// RemoteAddr returns the client announced by the PROXY header.
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.src
+}
+
+// NetConn returns the connection the header was read from, see tcpConnOf.
+func (c *proxiedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite closes the write side of the connection, where it supports it.
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// parseProxyPeers parses peers trusted to send PROXY protocol headers, IPs or CIDRs.
+func parseProxyPeers(peers []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(peers))
+	for _, peer := range peers {
+		if addr, err := netip.ParseAddr(peer); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(peer)
+		if err != nil {
+			return nil, fmt.Errorf("%w: expected an IP or CIDR, got '%s'", ErrProxyPeersInvalid, peer)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// acceptProxyHeader reads the PROXY protocol header, v1 or v2, conn starts with, and
+// returns conn reporting the client it announces as its remote address. Only peers in
+// trusted may announce another client: others are refused, so that clients cannot spoof
+// their address. Headers that describe no client (UNKNOWN, LOCAL), such as health checks,
+// leave conn as it is. Nothing past the header is read.
+func acceptProxyHeader(conn net.Conn, trusted []netip.Prefix) (net.Conn, error) {
+	if !proxyPeerTrusted(conn.RemoteAddr(), trusted) {
+		return conn, fmt.Errorf("%w: %s", ErrProxyPeerUntrusted, conn.RemoteAddr())
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	src, dst, err := readProxyHeader(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil || src == nil {
+		return conn, err
+	}
+
+	return &proxiedConn{Conn: conn, src: src, dst: dst}, nil
+}
+
+// proxyPeerTrusted reports whether the peer at addr is in trusted.
+func proxyPeerTrusted(addr net.Addr, trusted []netip.Prefix) bool {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// originalDst returns the address the client of conn connected to: the one announced by
+// its PROXY header, if any, or the local address of conn.
+func originalDst(conn net.Conn) net.Addr {
+	if pc, ok := conn.(*proxiedConn); ok {
+		return pc.dst
+	}
+
+	return conn.LocalAddr()
+}
+
+// plainConn returns the connection under a proxiedConn, for zero-copy transfers and
+// socket options, which the header being already read makes safe.
+func plainConn(conn net.Conn) net.Conn {
+	if pc, ok := conn.(*proxiedConn); ok {
+		return pc.Conn
+	}
+
+	return conn
+}
+
+// readProxyHeader reads a PROXY protocol header from r and returns the addresses it
+// announces, nil for headers describing no client.
+func readProxyHeader(r io.Reader) (src, dst net.Addr, err error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeaderInvalid, err)
+	}
+
+	switch first[0] {
+	case 'P':
+		return readProxyHeaderV1(r)
+	case proxyProtocolV2Signature[0]:
+		return readProxyHeaderV2(r)
+	default:
+		return nil, nil, fmt.Errorf("%w: no header", ErrProxyHeaderInvalid)
+	}
+}
+
+// readProxyHeaderV1 reads the rest of a v1 header, whose "P" was read, a byte at a time
+// so that nothing the client sends after it is consumed.
+func readProxyHeaderV1(r io.Reader) (net.Addr, net.Addr, error) {
+	line := []byte{'P'}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyHeaderV1MaxLen {
+			return nil, nil, fmt.Errorf("%w: v1 header too long", ErrProxyHeaderInvalid)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeaderInvalid, err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[0] == "PROXY" && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || fields[0] != "PROXY" || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("%w: malformed v1 header", ErrProxyHeaderInvalid)
+	}
+
+	src, err1 := parseProxyAddr(fields[2], fields[4])
+	dst, err2 := parseProxyAddr(fields[3], fields[5])
+	if err := errors.Join(err1, err2); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeaderInvalid, err)
+	}
+
+	return src, dst, nil
+}
+
+// parseProxyAddr parses the address and port of a v1 header.
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr == nil || err != nil {
+		return nil, fmt.Errorf("bad address %s port %s", ip, port)
+	}
+
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readProxyHeaderV2 reads the rest of a v2 header, whose first byte was read.
+func readProxyHeaderV2(r io.Reader) (net.Addr, net.Addr, error) {
+	fixed := make([]byte, 15)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeaderInvalid, err)
+	}
+	if !bytes.Equal(fixed[:11], proxyProtocolV2Signature[1:]) || fixed[11]>>4 != 2 {
+		return nil, nil, fmt.Errorf("%w: malformed v2 header", ErrProxyHeaderInvalid)
+	}
+
+	block := make([]byte, binary.BigEndian.Uint16(fixed[13:]))
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeaderInvalid, err)
+	}
+
+	// LOCAL command, or a family other than TCP; TLVs past the addresses are skipped
+	if fixed[11]&0x0f == 0 {
+		return nil, nil, nil
+	}
+	var size int
+	switch fixed[12] {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(block) < 2*size+4 {
+		return nil, nil, fmt.Errorf("%w: short v2 address block", ErrProxyHeaderInvalid)
+	}
+
+	src := &net.TCPAddr{IP: net.IP(block[:size]), Port: int(binary.BigEndian.Uint16(block[2*size:]))}
+	dst := &net.TCPAddr{IP: net.IP(block[size : 2*size]), Port: int(binary.BigEndian.Uint16(block[2*size+2:]))}
+
+	return src, dst, nil
+}
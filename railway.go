@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+)
+
+// Defaults of the settings Railway's variables can stand in for.
+const (
+	defaultListenPort     = "8080"
+	defaultTSHostname     = "railtail"
+	defaultTSStateDirPath = "/tmp/railtail"
+)
+
+// applyRailwayEnvironment maps the variables Railway injects into deployments onto
+// settings that were left at their defaults. Explicit settings (flags, environment or
+// config file) always win.
+//
+// PORT is always honored, as Railway routes public traffic to it. With RAILWAY_COMPAT
+// enabled, the Tailscale hostname follows the service name and the Tailscale state is
+// kept on the service's volume, so it survives redeploys.
+func applyRailwayEnvironment(cfg *Config) {
+	if port := os.Getenv("PORT"); port != "" && isDefault("listen-port", "LISTEN_PORT", cfg.ListenPort, defaultListenPort) {
+		cfg.ListenPort = port
+	}
+
+	if !cfg.RailwayCompat {
+		return
+	}
+
+	if name := os.Getenv("RAILWAY_SERVICE_NAME"); name != "" && isDefault("ts-hostname", "TS_HOSTNAME", cfg.TSHostname, defaultTSHostname) {
+		cfg.TSHostname = name
+	}
+	if dir := os.Getenv("RAILWAY_VOLUME_MOUNT_PATH"); dir != "" &&
+		isDefault("ts-state-dir", "TS_STATEDIR_PATH", cfg.TSStateDirPath, defaultTSStateDirPath) {
+		cfg.TSStateDirPath = dir
+	}
+}
+
+// isDefault reports whether a setting was left at its default: it was given neither as
+// a flag nor as an environment variable, and the config file did not change it.
+func isDefault(flagName, env, value, defaultValue string) bool {
+	return !isExplicit(flagName, env) && value == defaultValue
+}
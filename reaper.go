@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// maxReapInterval bounds how often the reaper looks for idle connections.
+const maxReapInterval = 30 * time.Second
+
+// reapPolicy is how long connections of each kind may go without traffic before the
+// reaper closes them, 0 to never reap them.
+type reapPolicy struct {
+	tcp  time.Duration
+	http time.Duration
+}
+
+// after returns how long connections of kind may stay idle, 0 for ever.
+func (p reapPolicy) after(kind string) time.Duration {
+	if kind == connKindHTTP {
+		return p.http
+	}
+
+	return p.tcp
+}
+
+// interval returns how often to look for idle connections: a quarter of the shortest
+// idle time, so that connections are reaped at most a quarter late, but no less often
+// than maxReapInterval and no more than every second.
+func (p reapPolicy) interval() time.Duration {
+	shortest := maxReapInterval * 4
+	for _, d := range []time.Duration{p.tcp, p.http} {
+		if d > 0 && d < shortest {
+			shortest = d
+		}
+	}
+
+	return max(shortest/4, time.Second)
+}
+
+// reap closes the connections idle for longer than policy allows until ctx is done, all
+// from one goroutine, however many connections are open. It is a backstop for
+// connections the per-connection idle timeouts do not cover, like those of tunnels
+// without one and HTTP requests stalled mid-transfer.
+func (r *connRegistry) reap(ctx context.Context, policy reapPolicy) {
+	if policy.tcp <= 0 && policy.http <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(policy.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.reapIdle(now, policy)
+		}
+	}
+}
+
+// reapIdle closes the connections idle at now for longer than policy allows.
+func (r *connRegistry) reapIdle(now time.Time, policy reapPolicy) {
+	type idleConn struct {
+		conn *trackedConn
+		idle time.Duration
+		reap func()
+	}
+
+	var idle []idleConn
+	r.mu.Lock()
+	for _, c := range r.conns {
+		after := policy.after(c.kind)
+		if after <= 0 {
+			continue
+		}
+		reap := c.reaper.Load()
+		if reap == nil {
+			continue
+		}
+		if d := now.Sub(time.Unix(0, c.lastActive.Load())); d > after {
+			idle = append(idle, idleConn{conn: c, idle: d, reap: *reap})
+		}
+	}
+	r.mu.Unlock()
+
+	// Closed outside the lock, as closing connections removes them from the registry
+	for _, ic := range idle {
+		ic.conn.setCloseReason(CloseIdleTimeout)
+		metrics.Default.Counter("railtail_connections_reaped_total",
+			"Connections (TCP) and requests (HTTP) closed by the idle reaper.", "kind", ic.conn.kind).Inc()
+		logger.Stdout.Info().
+			Str("kind", ic.conn.kind).
+			Str("remote-addr", ic.conn.remoteAddr).
+			Str("target", ic.conn.target).
+			Dur("idle", ic.idle).
+			Msg("reaping idle connection")
+		ic.reap()
+	}
+}
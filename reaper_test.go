@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// forwardedConn is a TCP connection forwarded by fwdTCP between loopback listeners: the
+// client end, and the end the target accepted.
+type forwardedConn struct {
+	client   net.Conn
+	upstream net.Conn
+	done     chan error // fwdTCP's result
+}
+
+// forwardTCP forwards one connection to a loopback target with opts, and exchanges a byte
+// each way so that both copies are running when it returns.
+func forwardTCP(t *testing.T, opts tcpOptions) *forwardedConn {
+	t.Helper()
+
+	target := listenLoopback(t)
+	front := listenLoopback(t)
+
+	fc := &forwardedConn{done: make(chan error, 1)}
+	go func() {
+		conn, err := front.Accept()
+		if err != nil {
+			fc.done <- err
+			return
+		}
+		fc.done <- fwdTCP(conn, directDialer{&net.Dialer{}}, target.Addr().String(), opts,
+			func(time.Duration, bool) {})
+	}()
+
+	var err error
+	if fc.client, err = net.Dial("tcp", front.Addr().String()); err != nil {
+		t.Fatalf("failed to dial railtail: %v", err)
+	}
+	t.Cleanup(func() { _ = fc.client.Close() })
+
+	if fc.upstream, err = target.Accept(); err != nil {
+		t.Fatalf("failed to accept upstream connection: %v", err)
+	}
+	t.Cleanup(func() { _ = fc.upstream.Close() })
+
+	exchange(t, fc.client, fc.upstream)
+	exchange(t, fc.upstream, fc.client)
+
+	return fc
+}
+
+// listenLoopback listens on a free port of the loopback interface for the test.
+func listenLoopback(t *testing.T) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	return ln
+}
+
+// exchange writes a byte to from and checks it arrives at to.
+func exchange(t *testing.T, from, to net.Conn) {
+	t.Helper()
+
+	if _, err := from.Write([]byte{'x'}); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	_ = to.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer to.SetReadDeadline(time.Time{})
+	if _, err := io.ReadFull(to, make([]byte, 1)); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+}
+
+// closedWithin reports whether the peer of conn closed it within wait.
+func closedWithin(conn net.Conn, wait time.Duration) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(wait))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, err := conn.Read(make([]byte, 1))
+	var netErr net.Error
+	return err != nil && !(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func TestReapClosesIdleUpstream(t *testing.T) {
+	fc := forwardTCP(t, tcpOptions{})
+	policy := reapPolicy{tcp: time.Minute}
+
+	// Not idle for long enough yet
+	conns.reapIdle(time.Now(), policy)
+	if closedWithin(fc.upstream, 100*time.Millisecond) {
+		t.Fatal("upstream connection was closed before the idle timeout")
+	}
+
+	conns.reapIdle(time.Now().Add(2*policy.tcp), policy)
+	if !closedWithin(fc.upstream, 5*time.Second) {
+		t.Fatal("upstream connection was left open after the idle timeout")
+	}
+	if !closedWithin(fc.client, 5*time.Second) {
+		t.Fatal("client connection was left open after the idle timeout")
+	}
+
+	// Reaped connections are closed on purpose, not failed
+	select {
+	case err := <-fc.done:
+		if err != nil {
+			t.Errorf("fwdTCP = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fwdTCP did not return after the connection was reaped")
+	}
+}
+
+func TestReapExemptsBrokerProfile(t *testing.T) {
+	fc := forwardTCP(t, tcpOptions{}.withProfile(TCPProfileBroker))
+	policy := reapPolicy{tcp: time.Minute}
+
+	conns.reapIdle(time.Now().Add(time.Hour), policy)
+	if closedWithin(fc.upstream, 200*time.Millisecond) {
+		t.Fatal("broker connection was reaped")
+	}
+
+	// Still forwarding both ways
+	exchange(t, fc.client, fc.upstream)
+	exchange(t, fc.upstream, fc.client)
+}
+
+func TestReapPolicyInterval(t *testing.T) {
+	tests := []struct {
+		policy reapPolicy
+		want   time.Duration
+	}{
+		{reapPolicy{}, maxReapInterval},
+		{reapPolicy{tcp: time.Minute}, 15 * time.Second},
+		{reapPolicy{tcp: time.Hour, http: 20 * time.Second}, 5 * time.Second},
+		{reapPolicy{http: time.Second}, time.Second},
+		{reapPolicy{tcp: 10 * time.Minute}, maxReapInterval},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.interval(); got != tt.want {
+			t.Errorf("interval of %+v = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestClientAbortClosesUpstream(t *testing.T) {
+	fc := forwardTCP(t, tcpOptions{})
+	aborts := clientAborts.Value()
+
+	// Reset the connection rather than closing it cleanly
+	resetConn(fc.client)
+	if !closedWithin(fc.upstream, 5*time.Second) {
+		t.Fatal("upstream connection was left open after the client aborted")
+	}
+
+	select {
+	case err := <-fc.done:
+		if reason := closeReasonOf(err); reason != CloseClientAbort {
+			t.Errorf("close reason = %q, want %q (err: %v)", reason, CloseClientAbort, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fwdTCP did not return after the client aborted")
+	}
+	if got := clientAborts.Value() - aborts; got != 1 {
+		t.Errorf("client aborts counted = %d, want 1", got)
+	}
+}
+
+func TestUpstreamAbortResetsClient(t *testing.T) {
+	fc := forwardTCP(t, tcpOptions{})
+
+	resetConn(fc.upstream)
+	_ = fc.client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := fc.client.Read(make([]byte, 1))
+	if !isAbort(err) {
+		t.Fatalf("client read = %v, want a reset", err)
+	}
+
+	select {
+	case err := <-fc.done:
+		if reason := closeReasonOf(err); reason != CloseUpstreamAbort {
+			t.Errorf("close reason = %q, want %q (err: %v)", reason, CloseUpstreamAbort, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fwdTCP did not return after the upstream aborted")
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Recording errors.
+var (
+	ErrRecordingKeyInvalid = errors.New("RECORDING_KEY must be 32 bytes, hex or base64 encoded")
+	ErrRecordingNotFound   = errors.New("no such recording")
+	ErrRecordingActive     = errors.New("the session is still being recorded")
+	ErrRecordingCorrupt    = errors.New("recording is corrupt or was encrypted with another key")
+	ErrRecordingDisabled   = errors.New("recording sessions requires RECORDING_DIR and RECORDING_KEY to be set")
+)
+
+// Recordings are files of frames, each sealed with AES-256-GCM under a key derived from
+// RECORDING_KEY and a random salt of the file, and a nonce counting the frames:
+//
+//	magic | salt (32 bytes) | { length (uint32) | sealed frame }...
+//
+// A sealed frame holds its kind (a byte), the time in Unix nanoseconds (int64) and data:
+// the session's metadata as JSON first, then what each side sent, and an end frame.
+const (
+	recordingMagic = "RAILTAIL-REC1\n"
+	recordingExt   = ".rec"
+
+	frameMeta      byte = 0 // metadata of the session, as JSON
+	frameClient    byte = 1 // data sent by the client
+	frameTarget    byte = 2 // data sent by the target
+	frameEnd       byte = 3 // the session ended
+	frameTruncated byte = 4 // the recording reached its size bound, the session went on
+)
+
+// recordingSettings configures the recording of TCP sessions.
+type recordingSettings struct {
+	dir       string        // where recordings are written
+	key       []byte        // 32 bytes, recordings are encrypted with
+	maxBytes  int64         // size bound of each recording
+	retention time.Duration // recordings older than this are removed; kept forever if 0
+}
+
+// parseRecordingKey decodes a 32-byte key, hex or base64 encoded.
+func parseRecordingKey(s string) ([]byte, error) {
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+
+	return nil, ErrRecordingKeyInvalid
+}
+
+// RecordingInfo is the admin API representation of a recording.
+type RecordingInfo struct {
+	ID        string    `json:"id"`
+	Listen    string    `json:"listen"`
+	Client    string    `json:"client"`
+	Target    string    `json:"target"`
+	StartedAt time.Time `json:"started_at"`
+	Size      int64     `json:"size_bytes"`
+	Active    bool      `json:"active"`
+}
+
+// recordings records sessions, nil when no TCP tunnel records them.
+var recordings *recordingStore
+
+// recordingStore writes recordings of TCP sessions for break-glass forensics, and lists,
+// serves and expires them.
+type recordingStore struct {
+	settings recordingSettings
+
+	mu     sync.Mutex
+	active map[string]bool // IDs of the recordings being written
+
+	recorded, truncated *metrics.Counter
+}
+
+// newRecordingStore creates the recordings directory, and removes the recordings past
+// their retention every hour, if any, until stop is closed.
+func newRecordingStore(settings recordingSettings, stop <-chan struct{}) (*recordingStore, error) {
+	if err := os.MkdirAll(settings.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create recordings dir: %w", err)
+	}
+
+	s := &recordingStore{
+		settings: settings,
+		active:   make(map[string]bool),
+
+		recorded: metrics.Default.Counter("railtail_recordings_total",
+			"Sessions recorded, and recordings cut short by RECORDING_MAX_MB.", "result", "recorded"),
+		truncated: metrics.Default.Counter("railtail_recordings_total",
+			"Sessions recorded, and recordings cut short by RECORDING_MAX_MB.", "result", "truncated"),
+	}
+	if settings.retention > 0 {
+		go s.expireLoop(stop)
+	}
+
+	return s, nil
+}
+
+// start starts recording a session of client to target through the listener at listen.
+// Failing to, it logs why and returns nil, which records nothing: recording never keeps
+// a session from going through.
+func (s *recordingStore) start(listen, client, target string) *recording {
+	if s == nil {
+		return nil
+	}
+
+	started := time.Now()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	id := fmt.Sprintf("%d-%s", started.UnixNano(), hex.EncodeToString(suffix))
+
+	rec, err := s.create(id)
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("client", client).
+			Str("target", target).
+			Msg("failed to start recording session")
+		return nil
+	}
+
+	meta, _ := json.Marshal(RecordingInfo{ID: id, Listen: listen, Client: client, Target: target, StartedAt: started})
+	rec.write(frameMeta, meta)
+	rec.mu.Lock()
+	_ = rec.w.Flush() // for the recording to be listed while it is written
+	rec.mu.Unlock()
+
+	s.mu.Lock()
+	s.active[id] = true
+	s.mu.Unlock()
+	s.recorded.Inc()
+
+	logger.Stdout.Info().
+		Str("recording", id).
+		Str("client", client).
+		Str("target", target).
+		Msg("recording session")
+
+	return rec
+}
+
+// create creates the recording file of id, writing its header.
+func (s *recordingStore) create(id string) (*recording, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := recordingCipher(s.settings.key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.settings.dir, id+recordingExt), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(append([]byte(recordingMagic), salt...)); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &recording{
+		store: s,
+		id:    id,
+		file:  f,
+		w:     bufio.NewWriter(f),
+		aead:  aead,
+		size:  int64(len(recordingMagic) + len(salt)),
+	}, nil
+}
+
+// path returns the file of the recording id, checking it is a well-formed ID.
+func (s *recordingStore) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", fmt.Errorf("%w: %s", ErrRecordingNotFound, id)
+	}
+	path := filepath.Join(s.settings.dir, id+recordingExt)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrRecordingNotFound, id)
+	}
+
+	return path, nil
+}
+
+// List returns the recordings, newest first.
+func (s *recordingStore) List() ([]RecordingInfo, error) {
+	entries, err := os.ReadDir(s.settings.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := []RecordingInfo{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), recordingExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := readRecordingInfo(filepath.Join(s.settings.dir, entry.Name()), s.settings.key)
+		if err != nil {
+			info = RecordingInfo{ID: id}
+		}
+		if fi, err := entry.Info(); err == nil {
+			info.Size = fi.Size()
+			if info.StartedAt.IsZero() {
+				info.StartedAt = fi.ModTime()
+			}
+		}
+		info.ID, info.Active = id, s.active[id]
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].StartedAt.After(infos[j].StartedAt) })
+
+	return infos, nil
+}
+
+// Open opens the recording id, encrypted as stored, for downloading it.
+func (s *recordingStore) Open(id string) (*os.File, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+// Remove removes the recording id, unless it is still being written.
+func (s *recordingStore) Remove(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[id] {
+		return fmt.Errorf("%w: %s", ErrRecordingActive, id)
+	}
+
+	return os.Remove(path)
+}
+
+// expireLoop removes the recordings past their retention every hour until stop is closed.
+func (s *recordingStore) expireLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		s.expire()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expire removes the recordings last written to before the retention period.
+func (s *recordingStore) expire() {
+	entries, err := os.ReadDir(s.settings.dir)
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Msg("failed to expire recordings")
+		return
+	}
+
+	cutoff := time.Now().Add(-s.settings.retention)
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), recordingExt)
+		if !ok {
+			continue
+		}
+		if fi, err := entry.Info(); err != nil || fi.ModTime().After(cutoff) {
+			continue
+		}
+		if err := s.Remove(id); err == nil {
+			logger.Stdout.Info().Str("recording", id).Msg("recording expired")
+		}
+	}
+}
+
+// recording is a session being recorded.
+type recording struct {
+	store *recordingStore
+	id    string
+
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	aead  cipher.AEAD
+	frame uint64 // frames written, the nonce of the next one
+	size  int64
+	full  bool // the size bound was reached
+	err   error
+}
+
+// client records data sent by the client.
+func (r *recording) client(p []byte) {
+	if r != nil && len(p) > 0 {
+		r.write(frameClient, p)
+	}
+}
+
+// target records data sent by the target.
+func (r *recording) target(p []byte) {
+	if r != nil && len(p) > 0 {
+		r.write(frameTarget, p)
+	}
+}
+
+// write seals a frame of kind with data, unless the recording failed or is full.
+func (r *recording) write(kind byte, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil || r.full {
+		return
+	}
+
+	// Keep room for the end frame
+	size := 4 + 9 + int64(len(data)) + int64(r.aead.Overhead())
+	if kind != frameEnd && kind != frameTruncated && r.size+size > r.store.settings.maxBytes-64 {
+		r.full = true
+		r.seal(frameTruncated, nil)
+		r.store.truncated.Inc()
+		logger.Stderr.Warn().
+			Str("recording", r.id).
+			Int64("max-bytes", r.store.settings.maxBytes).
+			Msg("recording reached its size bound, the rest of the session is not recorded")
+		return
+	}
+	r.seal(kind, data)
+}
+
+// seal writes a frame. r.mu is held.
+func (r *recording) seal(kind byte, data []byte) {
+	plain := make([]byte, 9, 9+len(data))
+	plain[0] = kind
+	binary.BigEndian.PutUint64(plain[1:], uint64(time.Now().UnixNano()))
+	plain = append(plain, data...)
+
+	nonce := make([]byte, r.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], r.frame)
+	r.frame++
+	sealed := r.aead.Seal(nil, nonce, plain, nil)
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := r.w.Write(length[:]); err != nil {
+		r.err = err
+		return
+	}
+	if _, err := r.w.Write(sealed); err != nil {
+		r.err = err
+		return
+	}
+	r.size += int64(len(length) + len(sealed))
+}
+
+// close writes the end frame and closes the recording file.
+func (r *recording) close() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	if r.err == nil {
+		r.seal(frameEnd, nil)
+	}
+	if err := r.w.Flush(); err != nil && r.err == nil {
+		r.err = err
+	}
+	if err := r.file.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+	err := r.err
+	r.mu.Unlock()
+
+	r.store.mu.Lock()
+	delete(r.store.active, r.id)
+	r.store.mu.Unlock()
+
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("recording", r.id).
+			Msg("failed to write recording")
+	}
+}
+
+// recordingCipher returns the cipher of a recording with salt.
+func recordingCipher(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("railtail recording"))
+	mac.Write(salt)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// recordingReader reads the frames of a recording.
+type recordingReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	frame uint64
+}
+
+func newRecordingReader(r io.Reader, key []byte) (*recordingReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(recordingMagic)+32)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(recordingMagic)]) != recordingMagic {
+		return nil, ErrRecordingCorrupt
+	}
+	aead, err := recordingCipher(key, header[len(recordingMagic):])
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordingReader{r: br, aead: aead}, nil
+}
+
+// next returns the next frame, or io.EOF at the end of the file.
+func (rr *recordingReader) next() (kind byte, at time.Time, data []byte, err error) {
+	var length [4]byte
+	if _, err := io.ReadFull(rr.r, length[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, time.Time{}, nil, ErrRecordingCorrupt
+		}
+		return 0, time.Time{}, nil, err
+	}
+	sealed := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(rr.r, sealed); err != nil {
+		return 0, time.Time{}, nil, ErrRecordingCorrupt
+	}
+
+	nonce := make([]byte, rr.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], rr.frame)
+	rr.frame++
+	plain, err := rr.aead.Open(sealed[:0], nonce, sealed, nil)
+	if err != nil || len(plain) < 9 {
+		return 0, time.Time{}, nil, ErrRecordingCorrupt
+	}
+
+	return plain[0], time.Unix(0, int64(binary.BigEndian.Uint64(plain[1:9]))), plain[9:], nil
+}
+
+// readRecordingInfo reads the metadata of the recording at path.
+func readRecordingInfo(path string, key []byte) (RecordingInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	defer f.Close()
+
+	rr, err := newRecordingReader(f, key)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	kind, _, data, err := rr.next()
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	if kind != frameMeta {
+		return RecordingInfo{}, ErrRecordingCorrupt
+	}
+
+	var info RecordingInfo
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// recordingCommand implements `railtail recording decode [-side client|target] FILE`,
+// decrypting a recording with RECORDING_KEY. It writes a transcript of the session, or
+// with -side, only the raw bytes sent by that side. It returns the process exit code.
+func recordingCommand(args []string) int {
+	if len(args) == 0 || args[0] != "decode" {
+		fmt.Fprintln(os.Stderr, "usage: railtail recording decode [-side client|target] FILE")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("recording decode", flag.ContinueOnError)
+	side := fs.String("side", "", "Only write the raw bytes sent by this side (client or target).")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: railtail recording decode [-side client|target] FILE")
+		return 2
+	}
+
+	key, err := parseRecordingKey(os.Getenv("RECORDING_KEY"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	if err := decodeRecording(os.Stdout, f, key, *side); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// decodeRecording writes the recording read from r to w, as a transcript, or the raw
+// bytes sent by side.
+func decodeRecording(w io.Writer, r io.Reader, key []byte, side string) error {
+	rr, err := newRecordingReader(r, key)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	for {
+		kind, at, data, err := rr.next()
+		if errors.Is(err, io.EOF) {
+			_, _ = fmt.Fprintln(out, "=== recording ends without an end frame: railtail stopped while recording")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case side == "client" && kind == frameClient, side == "target" && kind == frameTarget:
+			_, _ = out.Write(data)
+			continue
+		case side != "":
+			if kind == frameEnd {
+				return nil
+			}
+			continue
+		}
+
+		stamp := at.UTC().Format(time.RFC3339Nano)
+		switch kind {
+		case frameMeta:
+			_, _ = fmt.Fprintf(out, "=== %s session %s\n", stamp, data)
+		case frameClient:
+			_, _ = fmt.Fprintf(out, "=== %s client -> target, %d bytes\n", stamp, len(data))
+			_, _ = out.Write(data)
+			_, _ = fmt.Fprintln(out)
+		case frameTarget:
+			_, _ = fmt.Fprintf(out, "=== %s target -> client, %d bytes\n", stamp, len(data))
+			_, _ = out.Write(data)
+			_, _ = fmt.Fprintln(out)
+		case frameTruncated:
+			_, _ = fmt.Fprintf(out, "=== %s recording reached its size bound, the rest of the session is not recorded\n", stamp)
+		case frameEnd:
+			_, _ = fmt.Fprintf(out, "=== %s session ended\n", stamp)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// Trailing slash policies.
+const (
+	TrailingSlashIgnore = ""
+	TrailingSlashAdd    = "add"
+	TrailingSlashRemove = "remove"
+)
+
+// ErrURLRuleInvalid is returned for rewrite and redirect rules that cannot be compiled.
+var ErrURLRuleInvalid = errors.New("url rule is invalid")
+
+// RewriteRule rewrites matching requests before they are routed and proxied.
+type RewriteRule struct {
+	Host    string `yaml:"host"`     // Request host pattern to match (see hostPattern); empty matches any host
+	Path    string `yaml:"path"`     // Regular expression the request path must match; empty matches any path
+	Replace string `yaml:"replace"`  // New path, may reference groups of Path ($1, ${name}); empty keeps the path
+	SetHost string `yaml:"set_host"` // New request host; empty keeps the host
+}
+
+// RedirectRule answers matching requests with a redirect instead of proxying them.
+type RedirectRule struct {
+	Host   string `yaml:"host"`   // Request host pattern to match (see hostPattern); empty matches any host
+	Path   string `yaml:"path"`   // Regular expression the request path must match; empty matches any path
+	To     string `yaml:"to"`     // Redirect location, may reference groups of Path ($1, ${name})
+	HTTPS  bool   `yaml:"https"`  // Redirect plain HTTP requests to the same URL over HTTPS (when To is empty)
+	Status int    `yaml:"status"` // 301 or 308 (default), 302 and 307 are accepted too
+}
+
+// urlMatcher is the compiled host/path condition shared by rewrites and redirects.
+type urlMatcher struct {
+	host hostPattern
+	path *regexp.Regexp
+}
+
+func newURLMatcher(host, pattern string) (urlMatcher, error) {
+	var m urlMatcher
+	hp, err := compileHostPattern(host)
+	if err != nil {
+		return m, fmt.Errorf("%w: %w", ErrURLRuleInvalid, err)
+	}
+	m.host = hp
+	if pattern == "" {
+		return m, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return m, fmt.Errorf("%w: %w", ErrURLRuleInvalid, err)
+	}
+	m.path = re
+
+	return m, nil
+}
+
+// match reports whether r matches, expanding template with the path's capture groups.
+func (m urlMatcher) match(r *http.Request, template string) (string, bool) {
+	if !m.host.match(hostOnly(r.Host)) {
+		return "", false
+	}
+	if m.path == nil {
+		return template, true
+	}
+
+	groups := m.path.FindStringSubmatchIndex(r.URL.Path)
+	if groups == nil {
+		return "", false
+	}
+
+	return string(m.path.ExpandString(nil, template, r.URL.Path, groups)), true
+}
+
+type compiledRewrite struct {
+	urlMatcher
+	RewriteRule
+}
+
+type compiledRedirect struct {
+	urlMatcher
+	RedirectRule
+}
+
+// urlRules applies redirects, the trailing slash policy and rewrites, in that order.
+type urlRules struct {
+	redirects     []compiledRedirect
+	trailingSlash string
+	rewrites      []compiledRewrite
+}
+
+// newURLRules compiles the URL rules of cfg.
+func newURLRules(cfg *Config) (*urlRules, error) {
+	rules := &urlRules{trailingSlash: cfg.TrailingSlash}
+
+	switch cfg.TrailingSlash {
+	case TrailingSlashIgnore, TrailingSlashAdd, TrailingSlashRemove:
+	default:
+		return nil, fmt.Errorf("%w: TRAILING_SLASH must be add or remove, got '%s'",
+			ErrURLRuleInvalid, cfg.TrailingSlash)
+	}
+
+	for i, rule := range cfg.Redirects {
+		m, err := newURLMatcher(rule.Host, rule.Path)
+		if err != nil {
+			return nil, fmt.Errorf("redirect %d: %w", i, err)
+		}
+		if rule.To == "" && !rule.HTTPS {
+			return nil, fmt.Errorf("redirect %d: %w: either to or https is required", i, ErrURLRuleInvalid)
+		}
+		switch rule.Status {
+		case 0:
+			rule.Status = http.StatusPermanentRedirect
+		case http.StatusMovedPermanently, http.StatusFound,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return nil, fmt.Errorf("redirect %d: %w: unsupported status %d", i, ErrURLRuleInvalid, rule.Status)
+		}
+		rules.redirects = append(rules.redirects, compiledRedirect{urlMatcher: m, RedirectRule: rule})
+	}
+
+	for i, rule := range cfg.Rewrites {
+		m, err := newURLMatcher(rule.Host, rule.Path)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite %d: %w", i, err)
+		}
+		if rule.Replace == "" && rule.SetHost == "" {
+			return nil, fmt.Errorf("rewrite %d: %w: either replace or set_host is required", i, ErrURLRuleInvalid)
+		}
+		rules.rewrites = append(rules.rewrites, compiledRewrite{urlMatcher: m, RewriteRule: rule})
+	}
+
+	return rules, nil
+}
+
+// empty reports whether there is nothing to apply.
+func (u *urlRules) empty() bool {
+	return len(u.redirects) == 0 && len(u.rewrites) == 0 && u.trailingSlash == TrailingSlashIgnore
+}
+
+// middleware applies the rules before handing the request to next.
+func (u *urlRules) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if location, status, ok := u.redirect(r); ok {
+			logger.Stdout.Info().
+				Str("remote-addr", r.RemoteAddr).
+				Str("path", r.URL.Path).
+				Str("location", location).
+				Int("status", status).
+				Msg("redirecting")
+			http.Redirect(w, r, location, status)
+			return
+		}
+
+		u.rewrite(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirect returns where r should be redirected to, if anywhere.
+func (u *urlRules) redirect(r *http.Request) (string, int, bool) {
+	for _, rule := range u.redirects {
+		location, ok := rule.match(r, rule.To)
+		if !ok {
+			continue
+		}
+
+		if rule.To == "" {
+			// Scheme upgrade. Behind Railway's edge TLS is terminated upstream of us,
+			// so X-Forwarded-Proto tells whether the client already used HTTPS.
+			if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+				continue
+			}
+			return "https://" + r.Host + r.URL.RequestURI(), rule.Status, true
+		}
+
+		if r.URL.RawQuery != "" && !strings.Contains(location, "?") {
+			location += "?" + r.URL.RawQuery
+		}
+		return location, rule.Status, true
+	}
+
+	p := r.URL.Path
+	switch u.trailingSlash {
+	case TrailingSlashAdd:
+		// Paths that look like files (/app.js) are left alone.
+		if !strings.HasSuffix(p, "/") && path.Ext(p) == "" {
+			return withQuery(p+"/", r), http.StatusPermanentRedirect, true
+		}
+	case TrailingSlashRemove:
+		if p != "/" && strings.HasSuffix(p, "/") {
+			return withQuery(strings.TrimRight(p, "/"), r), http.StatusPermanentRedirect, true
+		}
+	}
+
+	return "", 0, false
+}
+
+// rewrite applies the first matching rewrite rule to r.
+func (u *urlRules) rewrite(r *http.Request) {
+	for _, rule := range u.rewrites {
+		newPath, ok := rule.match(r, rule.Replace)
+		if !ok {
+			continue
+		}
+
+		if rule.Replace != "" {
+			r.URL.Path = newPath
+			r.URL.RawPath = ""
+		}
+		if rule.SetHost != "" {
+			r.Host = rule.SetHost
+		}
+		return
+	}
+}
+
+// withQuery appends the query string of r to p.
+func withQuery(p string, r *http.Request) string {
+	if p == "" {
+		p = "/"
+	}
+	if r.URL.RawQuery == "" {
+		return p
+	}
+
+	return p + "?" + r.URL.RawQuery
+}
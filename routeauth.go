@@ -0,0 +1,605 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// Authentication requirements of routes.
+const (
+	RouteAuthNone  = "none"  // anyone may use the route
+	RouteAuthToken = "token" // a bearer token among the route's tokens
+	RouteAuthBasic = "basic" // HTTP basic auth with a user of the route
+	RouteAuthOIDC  = "oidc"  // a bearer JWT of an OIDC issuer, optionally in one of the route's groups
+	RouteAuthHMAC  = "hmac"  // a webhook signature made with one of the route's secrets (see signature.go)
+)
+
+var (
+	// ErrRouteAuthInvalid is returned for authentication requirements that cannot be enforced.
+	ErrRouteAuthInvalid = errors.New("route auth is invalid")
+	// ErrOIDCToken is returned for bearer tokens an OIDC route does not accept.
+	ErrOIDCToken = errors.New("invalid OIDC token")
+)
+
+// oidcLeeway is the clock skew tolerated checking the validity period of OIDC tokens.
+const oidcLeeway = time.Minute
+
+// oidcKeysTTL is how long the signing keys of an issuer are cached. Tokens signed with an
+// unknown key refresh them sooner, at most once per oidcKeysMinRefresh.
+const (
+	oidcKeysTTL        = time.Hour
+	oidcKeysMinRefresh = time.Minute
+)
+
+// RouteAuth is the authentication requirement of a route, checked inside its middleware
+// chain, before the request is forwarded. Credentials of token and basic routes are
+// railtail's own, so the Authorization header is removed before forwarding; OIDC tokens
+// and webhook signatures are passed on, for the target to use.
+type RouteAuth struct {
+	Type   string            `yaml:"type"`   // none (default), token, basic, oidc or hmac
+	Realm  string            `yaml:"realm"`  // Realm of the WWW-Authenticate challenge; defaults to the route name
+	Tokens []string          `yaml:"tokens"` // token: bearer tokens accepted
+	Users  map[string]string `yaml:"users"`  // basic: user -> password, or its bcrypt hash
+
+	Issuer      string   `yaml:"issuer"`       // oidc: issuer URL, whose discovery document gives the signing keys
+	Audience    string   `yaml:"audience"`     // oidc: audience tokens must be issued for, such as railtail's client ID
+	Groups      []string `yaml:"groups"`       // oidc: groups the token must carry one of; any if empty
+	GroupsClaim string   `yaml:"groups_claim"` // oidc: claim listing the groups of the token (default groups)
+
+	Scheme    string        `yaml:"scheme"`    // hmac: custom (default), github, stripe or slack
+	Secrets   []string      `yaml:"secrets"`   // hmac: secrets requests may be signed with, several while rotating
+	Header    string        `yaml:"header"`    // hmac custom: header carrying the signature
+	Algorithm string        `yaml:"algorithm"` // hmac custom: sha1, sha256 (default) or sha512
+	Encoding  string        `yaml:"encoding"`  // hmac custom: hex (default) or base64
+	Prefix    string        `yaml:"prefix"`    // hmac custom: text before the signature in the header, like sha256=
+	Tolerance time.Duration `yaml:"tolerance"` // hmac stripe and slack: how far signed timestamps may be from now (default 5m)
+}
+
+// validate checks that the requirement can be enforced.
+func (a RouteAuth) validate() error {
+	switch a.Type {
+	case "", RouteAuthNone:
+	case RouteAuthToken:
+		if len(a.Tokens) == 0 {
+			return fmt.Errorf("%w: token auth requires tokens", ErrRouteAuthInvalid)
+		}
+		if slices.Contains(a.Tokens, "") {
+			return fmt.Errorf("%w: tokens cannot be empty", ErrRouteAuthInvalid)
+		}
+	case RouteAuthBasic:
+		if len(a.Users) == 0 {
+			return fmt.Errorf("%w: basic auth requires users", ErrRouteAuthInvalid)
+		}
+		for user, password := range a.Users {
+			if user == "" || strings.Contains(user, ":") {
+				return fmt.Errorf("%w: invalid user name '%s'", ErrRouteAuthInvalid, user)
+			}
+			if password == "" {
+				return fmt.Errorf("%w: user %s has no password", ErrRouteAuthInvalid, user)
+			}
+		}
+	case RouteAuthOIDC:
+		u, err := url.Parse(a.Issuer)
+		if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+			return fmt.Errorf("%w: issuer must be an http(s) URL, got '%s'", ErrRouteAuthInvalid, a.Issuer)
+		}
+		// Public issuers sign tokens for every application they serve
+		if a.Audience == "" {
+			return fmt.Errorf("%w: oidc auth requires an audience", ErrRouteAuthInvalid)
+		}
+	case RouteAuthHMAC:
+		return a.validateSignature()
+	default:
+		return fmt.Errorf("%w: unknown type '%s', must be one of: %s, %s, %s, %s, %s",
+			ErrRouteAuthInvalid, a.Type, RouteAuthNone, RouteAuthToken, RouteAuthBasic, RouteAuthOIDC, RouteAuthHMAC)
+	}
+
+	return nil
+}
+
+// routeAuth enforces the RouteAuth of a route. A nil routeAuth lets every request in.
+type routeAuth struct {
+	route string
+	cfg   RouteAuth
+	oidc  *oidcVerifier
+}
+
+// newRouteAuth returns the enforcer of the requirement cfg of route, nil if the route is
+// public.
+func newRouteAuth(route string, cfg RouteAuth) *routeAuth {
+	if cfg.Type == "" || cfg.Type == RouteAuthNone {
+		return nil
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = route
+	}
+
+	a := &routeAuth{route: route, cfg: cfg}
+	if cfg.Type == RouteAuthOIDC {
+		a.oidc = newOIDCVerifier(cfg)
+	}
+
+	return a
+}
+
+// wrap returns next, refusing the requests without the credentials the route requires:
+// with 401 Unauthorized and a challenge, or 403 Forbidden for OIDC tokens of none of the
+// route's groups. Forged webhooks get 401 without a challenge.
+func (a *routeAuth) wrap(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, err := a.check(r)
+		if err != nil {
+			countClosed(connKindHTTP, CloseUnauthorized)
+			logger.Stderr.Warn().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("remote-addr", r.RemoteAddr).
+				Str("route", a.route).
+				Str("auth", a.cfg.Type).
+				Str("path", r.URL.Path).
+				Msg("request refused by route auth")
+
+			if status == http.StatusUnauthorized && a.cfg.Type != RouteAuthHMAC {
+				w.Header().Set("WWW-Authenticate", a.challenge())
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		if a.cfg.Type == RouteAuthToken || a.cfg.Type == RouteAuthBasic {
+			r.Header.Del("Authorization")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check returns the status refusing r and why, or a nil error if r may go through.
+func (a *routeAuth) check(r *http.Request) (int, error) {
+	switch a.cfg.Type {
+	case RouteAuthToken:
+		token, ok := bearerToken(r)
+		if !ok {
+			return http.StatusUnauthorized, errors.New("missing bearer token")
+		}
+		for _, candidate := range a.cfg.Tokens {
+			if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+				return http.StatusOK, nil
+			}
+		}
+		return http.StatusUnauthorized, errors.New("unknown bearer token")
+	case RouteAuthBasic:
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			return http.StatusUnauthorized, errors.New("missing basic auth credentials")
+		}
+		if !checkPassword(a.cfg.Users[user], password) {
+			return http.StatusUnauthorized, fmt.Errorf("wrong credentials for user '%s'", user)
+		}
+		return http.StatusOK, nil
+	case RouteAuthOIDC:
+		token, ok := bearerToken(r)
+		if !ok {
+			return http.StatusUnauthorized, errors.New("missing bearer token")
+		}
+		claims, err := a.oidc.verify(token)
+		if err != nil {
+			return http.StatusUnauthorized, err
+		}
+		if !a.oidc.inGroups(claims) {
+			return http.StatusForbidden, fmt.Errorf("subject '%v' is in none of the groups %s",
+				claims["sub"], strings.Join(a.cfg.Groups, ", "))
+		}
+		return http.StatusOK, nil
+	case RouteAuthHMAC:
+		return a.checkSignature(r)
+	}
+
+	return http.StatusOK, nil
+}
+
+// challenge returns the WWW-Authenticate header of the route's 401 responses.
+func (a *routeAuth) challenge() string {
+	realm := strings.ReplaceAll(a.cfg.Realm, `"`, `'`)
+	if a.cfg.Type == RouteAuthBasic {
+		return `Basic realm="` + realm + `", charset="UTF-8"`
+	}
+
+	return `Bearer realm="` + realm + `"`
+}
+
+// bearerToken returns the bearer token of the Authorization header of r.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+		return "", false
+	}
+
+	return strings.TrimSpace(token), true
+}
+
+// checkPassword reports whether password matches want, a password or its bcrypt hash. An
+// empty want, of an unknown user, matches nothing.
+func checkPassword(want, password string) bool {
+	if strings.HasPrefix(want, "$2a$") || strings.HasPrefix(want, "$2b$") || strings.HasPrefix(want, "$2y$") {
+		return bcrypt.CompareHashAndPassword([]byte(want), []byte(password)) == nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1 && want != ""
+}
+
+// oidcVerifier verifies the signed JWTs of an OIDC issuer, with the keys published at the
+// jwks_uri of its discovery document.
+type oidcVerifier struct {
+	issuer      string
+	audience    string
+	groups      []string
+	groupsClaim string
+	client      *http.Client
+
+	fetches singleflight.Group // fetches of the keys, shared by the requests waiting for them
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // by key ID
+	fetched time.Time
+}
+
+func newOIDCVerifier(cfg RouteAuth) *oidcVerifier {
+	claim := cfg.GroupsClaim
+	if claim == "" {
+		claim = "groups"
+	}
+
+	return &oidcVerifier{
+		issuer:      strings.TrimSuffix(cfg.Issuer, "/"),
+		audience:    cfg.Audience,
+		groups:      cfg.Groups,
+		groupsClaim: claim,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// verify checks the signature, issuer, audience and validity period of token, and returns
+// its claims.
+func (v *oidcVerifier) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", ErrOIDCToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %w", ErrOIDCToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %w", ErrOIDCToken, err)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrOIDCToken, err)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %w", ErrOIDCToken, err)
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.issuer {
+		return nil, fmt.Errorf("%w: issued by '%s'", ErrOIDCToken, iss)
+	}
+	if !claimContains(claims["aud"], v.audience) {
+		return nil, fmt.Errorf("%w: not issued for audience '%s'", ErrOIDCToken, v.audience)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("%w: no expiry", ErrOIDCToken)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return nil, fmt.Errorf("%w: expired", ErrOIDCToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrOIDCToken)
+	}
+
+	return claims, nil
+}
+
+// inGroups reports whether the claims list one of the required groups, if any.
+func (v *oidcVerifier) inGroups(claims map[string]any) bool {
+	if len(v.groups) == 0 {
+		return true
+	}
+	for _, group := range v.groups {
+		if claimContains(claims[v.groupsClaim], group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// key returns the signing key kid of the issuer. Stale keys are refreshed in the
+// background, while keys not including kid are fetched before answering; either way,
+// requests are only held up by a slow issuer when they need it.
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	key, ok, fetched := v.cached(kid)
+	switch {
+	case ok && time.Since(fetched) > oidcKeysTTL:
+		v.refresh()
+	case !ok && time.Since(fetched) > oidcKeysMinRefresh:
+		if res := <-v.refresh(); res.Err != nil {
+			return nil, fmt.Errorf("fetching the signing keys of %s: %w", v.issuer, res.Err)
+		}
+		key, ok, _ = v.cached(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown signing key '%s'", ErrOIDCToken, kid)
+	}
+
+	return key, nil
+}
+
+// cached returns the cached signing key kid, if any, and when the keys were fetched.
+func (v *oidcVerifier) cached(kid string) (crypto.PublicKey, bool, time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if key, ok := v.keys[kid]; ok {
+		return key, true, v.fetched
+	}
+	// Issuers with a single key may leave the key ID out
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true, v.fetched
+		}
+	}
+
+	return nil, false, v.fetched
+}
+
+// refresh fetches the keys, or joins the fetch already going on, and returns where its
+// result is delivered.
+func (v *oidcVerifier) refresh() <-chan singleflight.Result {
+	return v.fetches.DoChan("keys", func() (any, error) {
+		err := v.fetchKeys()
+		if err != nil {
+			logger.Stderr.Warn().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("issuer", v.issuer).
+				Msg("failed to refresh OIDC signing keys")
+		}
+		return nil, err
+	})
+}
+
+// fetchKeys fetches the signing keys of the issuer through its discovery document, and
+// caches them.
+func (v *oidcVerifier) fetchKeys() error {
+	keys, err := v.loadKeys()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// Failed fetches are not retried before oidcKeysMinRefresh either
+	v.fetched = time.Now()
+	if err != nil {
+		return err
+	}
+	v.keys = keys
+
+	return nil
+}
+
+// loadKeys loads the signing keys of the issuer through its discovery document.
+func (v *oidcVerifier) loadKeys() (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != v.issuer {
+		return nil, fmt.Errorf("discovery document is of issuer '%s'", discovery.Issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Keys of types railtail does not support are skipped
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing key in the JWKS")
+	}
+
+	return keys, nil
+}
+
+func (v *oidcVerifier) getJSON(url string, dst any) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+// jwk is a public key of a JSON Web Key Set, RSA or EC.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31 {
+			return nil, errors.New("unsupported RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+// verifyJWTSignature verifies the signature of signed, the header and claims of a JWT,
+// made with alg by key.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[min(len(alg), 2):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s with a non-RSA key", alg)
+		}
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(pub, hash, digest, signature, nil)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+	case strings.HasPrefix(alg, "ES"):
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s with a non-EC key", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("malformed ECDSA signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	default:
+		// Including "none"
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+}
+
+func decodeJWTPart(part string, dst any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, dst)
+}
+
+// claimContains reports whether claim, a string or a list of strings, contains want.
+func claimContains(claim any, want string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == want
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
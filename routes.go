@@ -0,0 +1,357 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+	"github.com/rmonvfer/railtail/internal/middleware"
+)
+
+// ErrRouteInvalid is returned for routes that cannot be served.
+var ErrRouteInvalid = errors.New("route is invalid")
+
+// unmatchedRouteName is the route of requests forwarded to the default backend of
+// unmatched_route, in metrics.
+const unmatchedRouteName = "unmatched"
+
+// RouteConfig sends matching HTTP requests to their own target, through their own
+// middleware chain. Routes are only configurable through the config file.
+type RouteConfig struct {
+	Name       string    `yaml:"name"`        // Name used in logs
+	Host       string    `yaml:"host"`        // Request host pattern to match (see hostPattern); empty matches any host
+	PathPrefix string    `yaml:"path_prefix"` // Request path prefix to match; empty matches any path
+	Target     string    `yaml:"target"`      // HTTP(S) URL(s) to forward matching requests to, comma-separated; host:port with command
+	Middleware []string  `yaml:"middleware"`  // Middleware chain, outermost first
+	Auth       RouteAuth `yaml:"auth"`        // Credentials requests must carry; none by default
+
+	ClientIdentities []string `yaml:"client_identities"` // Client certificate identities to match, exact or with a trailing *; any client if empty
+
+	Dedup DedupConfig `yaml:"dedup"` // Suppression of retried requests; disabled by default
+
+	UpstreamProxy string `yaml:"upstream_proxy"` // HTTP or SOCKS5 proxy on the tailnet to reach the target through
+
+	HostHeader string `yaml:"host_header"` // Host header of forwarded requests: target (default), preserve or a host
+
+	Command *RouteCommand `yaml:"command"` // Exchange with Target over TCP instead of forwarding requests to it
+}
+
+// validate checks the route's target and middleware.
+func (rc RouteConfig) validate() error {
+	if rc.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrRouteInvalid)
+	}
+	targets := splitList(rc.Target)
+	if len(targets) == 0 {
+		return fmt.Errorf("%w: %s: target is required", ErrRouteInvalid, rc.Name)
+	}
+	if _, err := compileHostPattern(rc.Host); err != nil {
+		return fmt.Errorf("%w: %s: host: %w", ErrRouteInvalid, rc.Name, err)
+	}
+	if rc.Command != nil {
+		if err := rc.validateCommand(targets); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrRouteInvalid, rc.Name, err)
+		}
+	} else {
+		for _, target := range targets {
+			if err := validateHTTPAddress(target); err != nil {
+				return fmt.Errorf("%w: %s: %w", ErrRouteInvalid, rc.Name, err)
+			}
+		}
+	}
+	if _, err := middleware.Chain(rc.Middleware...); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrRouteInvalid, rc.Name, err)
+	}
+	if err := rc.Auth.validate(); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrRouteInvalid, rc.Name, err)
+	}
+	if err := rc.Dedup.validate(); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrRouteInvalid, rc.Name, err)
+	}
+	if rc.UpstreamProxy != "" {
+		if err := validateUpstreamProxy(rc.UpstreamProxy); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrRouteInvalid, rc.Name, err)
+		}
+	}
+	if err := validateHostHeader(rc.HostHeader); err != nil {
+		return fmt.Errorf("%w: %s: host_header: %w", ErrRouteInvalid, rc.Name, err)
+	} else if rc.HostHeader != "" && rc.Command != nil {
+		return fmt.Errorf("%w: %s: commands take no host_header", ErrRouteInvalid, rc.Name)
+	}
+
+	return nil
+}
+
+// validateCommand checks the command of the route and its targets: one TCP address,
+// reached directly.
+func (rc RouteConfig) validateCommand(targets []string) error {
+	if len(targets) > 1 {
+		return fmt.Errorf("%w: commands take a single target", ErrCommandInvalid)
+	}
+	if err := validateTCPAddress(targets[0]); err != nil {
+		return err
+	}
+	if rc.UpstreamProxy != "" {
+		return fmt.Errorf("%w: commands cannot go through upstream_proxy", ErrCommandInvalid)
+	}
+
+	return rc.Command.validate()
+}
+
+// UnmatchedRouteConfig says what happens to requests matching no route, when routes are
+// configured, instead of going to TARGET_ADDR (or the Tailnet Proxy): they are answered
+// with Status, or forwarded to a default backend, Target. Only configurable through the
+// config file.
+type UnmatchedRouteConfig struct {
+	Status      int    `yaml:"status"`       // Answer with this status, 404 or 421
+	Body        string `yaml:"body"`         // Body of the answer; a short explanation by default
+	ContentType string `yaml:"content_type"` // Content type of Body; text/plain by default
+	Target      string `yaml:"target"`       // HTTP(S) URL(s) to forward the requests to instead, comma-separated
+}
+
+// validate checks that the settings pick one of the status and the target.
+func (u UnmatchedRouteConfig) validate() error {
+	switch {
+	case u.Status != 0 && u.Target != "":
+		return fmt.Errorf("%w: unmatched_route: status and target are exclusive", ErrRouteInvalid)
+	case u.Status != 0 && u.Status != http.StatusNotFound && u.Status != http.StatusMisdirectedRequest:
+		return fmt.Errorf("%w: unmatched_route: status must be 404 or 421, got %d", ErrRouteInvalid, u.Status)
+	case u.Status == 0 && (u.Body != "" || u.ContentType != ""):
+		return fmt.Errorf("%w: unmatched_route: body and content_type need a status", ErrRouteInvalid)
+	}
+	for _, target := range splitList(u.Target) {
+		if err := validateHTTPAddress(target); err != nil {
+			return fmt.Errorf("%w: unmatched_route: %w", ErrRouteInvalid, err)
+		}
+	}
+
+	return nil
+}
+
+// handler returns the handler answering unmatched requests with the status, nil if the
+// requests are forwarded. explanation is the body of the answer when none is configured.
+func (u UnmatchedRouteConfig) handler(explanation string) http.Handler {
+	if u.Status == 0 {
+		return nil
+	}
+
+	body, contentType := u.Body, u.ContentType
+	if body == "" {
+		body, contentType = fmt.Sprintf("%s: %s\n", http.StatusText(u.Status), explanation), ""
+	}
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.Default.Counter("railtail_unmatched_requests_total",
+			"Requests matching no route, answered with the status of unmatched_route.",
+			"status", strconv.Itoa(u.Status)).Inc()
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(u.Status)
+		_, _ = io.WriteString(w, body)
+	})
+}
+
+// route is a RouteConfig with its host pattern compiled and its handler built.
+type route struct {
+	RouteConfig
+	host    hostPattern
+	handler http.Handler
+}
+
+// matches reports whether r should be served by the route.
+func (rt route) matches(r *http.Request) bool {
+	if len(rt.ClientIdentities) > 0 && !matchIdentity(clientIdentity(r.TLS), rt.ClientIdentities) {
+		return false
+	}
+
+	return rt.host.match(hostOnly(r.Host)) && strings.HasPrefix(r.URL.Path, rt.PathPrefix)
+}
+
+// router serves requests through the first matching route, or the fallback handler.
+type router struct {
+	routes   []route
+	fallback http.Handler
+}
+
+// ServeHTTP implements the http.Handler interface
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, route := range rt.routes {
+		if route.matches(r) {
+			route.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	rt.fallback.ServeHTTP(w, r)
+}
+
+// newHTTPHandler builds the handler for the HTTP and Tailnet Proxy modes: redirect and
+// rewrite rules, then the configured routes, then the mode's own handler wrapped in
+// HTTP_MIDDLEWARE. Targets are dialed with dial to probe their latency, when balancing by
+// latency.
+func newHTTPHandler(cfg *Config, httpClient *http.Client, dial dialFunc) (http.Handler, error) {
+	transforms, err := newBodyTransforms(cfg.Transforms)
+	if err != nil {
+		return nil, err
+	}
+
+	var fallback http.Handler
+	if cfg.ForwardTrafficType == ForwardTrafficTypeTailnetProxy {
+		fallback = transforms.wrap(trackRequests(
+			func(r *http.Request) string { return r.Host },
+			NewTailnetProxy(httpClient, cfg.InsecureSkipVerify, cfg.ProxyOptions()),
+		))
+	} else {
+		pool := newTargetPool(cfg.Targets, cfg.PoolOptions(dial))
+
+		var spool *webhookSpool
+		if settings := cfg.WebhookSpoolSettings(); settings != nil {
+			if spool, err = newWebhookSpool(httpClient, pool, *settings); err != nil {
+				return nil, err
+			}
+		}
+		fallback = withHostHeader(cfg.HostHeader, newForwardHandler("", httpClient, pool, spool))
+		if cfg.TargetHeader != "" {
+			selected := make(map[string]http.Handler, len(cfg.HeaderTargets))
+			for _, target := range cfg.HeaderTargets {
+				selected[target] = withHostHeader(cfg.HostHeader,
+					newForwardHandler("", httpClient, newTargetPool([]string{target}, cfg.PoolOptions(dial)), nil))
+			}
+			fallback = newTargetSelector(cfg.TargetHeader, selected, fallback)
+		}
+		// Before verification, so that the verified target gets the transformed bodies too
+		fallback = transforms.wrap(fallback)
+		if settings := cfg.VerifySettings(); settings != nil {
+			fallback = newVerifier(httpClient, *settings).wrap(fallback)
+		}
+		fallback = newDedupCache("", cfg.WebhookDedup()).wrap(fallback)
+	}
+
+	chain, err := middleware.Chain(cfg.HTTPMiddleware...)
+	if err != nil {
+		return nil, err
+	}
+
+	// With routes, requests matching none may be kept from the main target
+	if len(cfg.Routes) > 0 {
+		if unmatched := cfg.UnmatchedRoute.handler("no route matches the request"); unmatched != nil {
+			fallback = unmatched
+		} else if cfg.UnmatchedRoute.Target != "" {
+			logger.Stdout.Info().
+				Str("target", cfg.UnmatchedRoute.Target).
+				Msg("default backend of unmatched requests configured")
+			fallback = transforms.wrap(withHostHeader(cfg.HostHeader, newForwardHandler(unmatchedRouteName, httpClient,
+				newTargetPool(splitList(cfg.UnmatchedRoute.Target), cfg.PoolOptions(dial)), nil)))
+		}
+	}
+
+	rt := &router{fallback: chain(fallback)}
+	for _, rc := range cfg.Routes {
+		r, err := newRoute(cfg, httpClient, dial, rc, "")
+		if err != nil {
+			return nil, err
+		}
+		rt.routes = append(rt.routes, r)
+	}
+
+	var handler http.Handler = rt
+	if tenants != nil {
+		// Tenants with routes of their own are served by them only
+		scoped := make(map[string]http.Handler)
+		for _, tc := range cfg.Tenants {
+			if len(tc.Routes) == 0 {
+				continue
+			}
+			var routes []route
+			for _, rc := range tc.Routes {
+				r, err := newRoute(cfg, httpClient, dial, rc, tc.Name)
+				if err != nil {
+					return nil, err
+				}
+				routes = append(routes, r)
+			}
+			scoped[tc.Name] = newTenantRouter(tc.Name, routes, cfg.UnmatchedRoute)
+		}
+		handler = tenants.handler(rt, scoped)
+	}
+	if budget != nil {
+		handler = admitRequests(handler)
+	}
+
+	rules, err := newURLRules(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if rules.empty() {
+		return handler, nil
+	}
+
+	return rules.middleware(handler), nil
+}
+
+// newRoute builds the handler of the route rc, of tenant if not empty.
+func newRoute(cfg *Config, httpClient *http.Client, dial dialFunc, rc RouteConfig, tenant string) (route, error) {
+	chain, err := middleware.Chain(rc.Middleware...)
+	if err != nil {
+		return route{}, fmt.Errorf("%w: %s: %w", ErrRouteInvalid, rc.Name, err)
+	}
+	host, err := compileHostPattern(rc.Host)
+	if err != nil {
+		return route{}, fmt.Errorf("%w: %s: host: %w", ErrRouteInvalid, rc.Name, err)
+	}
+	transforms, err := newBodyTransforms(cfg.Transforms)
+	if err != nil {
+		return route{}, err
+	}
+
+	logger.Stdout.Info().
+		Str("route", rc.Name).
+		Str("tenant", tenant).
+		Str("host", rc.Host).
+		Str("path-prefix", rc.PathPrefix).
+		Str("target", rc.Target).
+		Strs("middleware", rc.Middleware).
+		Str("auth", cmp.Or(rc.Auth.Type, RouteAuthNone)).
+		Strs("client-identities", rc.ClientIdentities).
+		Dur("dedup-ttl", rc.Dedup.TTL).
+		Str("upstream-proxy", redactedProxy(rc.UpstreamProxy)).
+		Str("host-header", cmp.Or(rc.HostHeader, HostHeaderTarget)).
+		Bool("command", rc.Command != nil).
+		Msg("route configured")
+
+	var handler http.Handler
+	if rc.Command != nil {
+		handler = newCommandHandler(rc, dial)
+	} else {
+		handler = withHostHeader(rc.HostHeader,
+			newForwardHandler(rc.Name, httpClient, newTargetPool(splitList(rc.Target), cfg.PoolOptions(dial)), nil))
+	}
+
+	return route{
+		RouteConfig: rc,
+		host:        host,
+		// Bodies are transformed after auth and dedup, which need them as the client sent them
+		handler: chain(newRouteAuth(rc.Name, rc.Auth).wrap(newDedupCache(rc.Name, rc.Dedup).wrap(transforms.wrap(handler)))),
+	}, nil
+}
+
+// hostOnly strips the port from a host[:port] string, and the brackets around an IPv6
+// address.
+func hostOnly(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+	}
+
+	return host
+}
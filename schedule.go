@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Actions of schedules.
+const (
+	ScheduleActionSwitch         = "tunnel-switch"   // switch the target of a tunnel, see tunnelManager.Switch
+	ScheduleActionMaintenance    = "maintenance"     // put the main listener in maintenance, for duration if set
+	ScheduleActionMaintenanceEnd = "maintenance-end" // take the main listener out of maintenance
+)
+
+var (
+	// ErrScheduleInvalid is returned for schedules that cannot be run.
+	ErrScheduleInvalid = errors.New("schedule is invalid")
+	// ErrScheduleNotFound is returned for schedules that do not exist.
+	ErrScheduleNotFound = errors.New("no such schedule")
+)
+
+// scheduleTick is how often schedules are checked for being due.
+const scheduleTick = time.Second
+
+// ScheduleConfig is a configuration change made at set times, as sent to the admin API:
+// on a cron schedule, or once at a time.
+type ScheduleConfig struct {
+	Cron     string     `json:"cron,omitempty"`      // minute hour day-of-month month day-of-week, like "0 2 * * *"
+	At       *time.Time `json:"at,omitempty"`        // the time of a single run, instead of cron
+	TimeZone string     `json:"time_zone,omitempty"` // of cron, UTC by default
+	Action   string     `json:"action"`              // tunnel-switch, maintenance or maintenance-end
+	Note     string     `json:"note,omitempty"`
+
+	// tunnel-switch: the tunnel and how to switch its target
+	Listen int `json:"listen,omitempty"`
+	TargetSwitchRequest
+
+	// maintenance: how long it lasts (until maintenance-end if empty), and what clients are told
+	Duration string `json:"duration,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// Schedule is a saved ScheduleConfig, as listed by the admin API.
+type Schedule struct {
+	ID int64 `json:"id"`
+	ScheduleConfig
+	CreatedAt time.Time  `json:"created_at"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	NextRun   *time.Time `json:"next_run,omitempty"`
+}
+
+// validate checks the schedule and its action, and returns its cron schedule, nil for a
+// single run.
+func (c ScheduleConfig) validate() (*cronSchedule, error) {
+	var cron *cronSchedule
+	switch {
+	case c.Cron != "" && c.At != nil:
+		return nil, fmt.Errorf("%w: set either cron or at", ErrScheduleInvalid)
+	case c.Cron != "":
+		var err error
+		if cron, err = parseCron(c.Cron, c.TimeZone); err != nil {
+			return nil, err
+		}
+		if cron.next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("%w: cron '%s' never runs", ErrScheduleInvalid, c.Cron)
+		}
+	case c.At != nil:
+		if c.TimeZone != "" {
+			return nil, fmt.Errorf("%w: time_zone only applies to cron, at carries its own", ErrScheduleInvalid)
+		}
+	default:
+		return nil, fmt.Errorf("%w: set cron or at", ErrScheduleInvalid)
+	}
+
+	switch c.Action {
+	case ScheduleActionSwitch:
+		if err := validateListenPort(strconv.Itoa(c.Listen)); err != nil {
+			return nil, fmt.Errorf("%w: listen: %w", ErrScheduleInvalid, err)
+		}
+		if _, _, err := c.TargetSwitchRequest.parse(0); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrScheduleInvalid, err)
+		}
+	case ScheduleActionMaintenance:
+		if c.Duration != "" {
+			if d, err := time.ParseDuration(c.Duration); err != nil || d <= 0 {
+				return nil, fmt.Errorf("%w: duration '%s'", ErrScheduleInvalid, c.Duration)
+			}
+		}
+	case ScheduleActionMaintenanceEnd:
+	default:
+		return nil, fmt.Errorf("%w: expected action tunnel-switch, maintenance or maintenance-end, got '%s'",
+			ErrScheduleInvalid, c.Action)
+	}
+	if c.Action != ScheduleActionSwitch && (c.Listen != 0 || c.TargetSwitchRequest != (TargetSwitchRequest{})) {
+		return nil, fmt.Errorf("%w: listen, target, policy, drain_timeout and mirror_for only apply to tunnel-switch", ErrScheduleInvalid)
+	}
+	if c.Action != ScheduleActionMaintenance && (c.Duration != "" || c.Message != "") {
+		return nil, fmt.Errorf("%w: duration and message only apply to maintenance", ErrScheduleInvalid)
+	}
+
+	return cron, nil
+}
+
+// scheduler makes the configuration changes of the schedules saved in the state
+// database when they are due. Runs of cron schedules missed while railtail was down are
+// skipped; single runs missed are made late, when railtail starts.
+type scheduler struct {
+	tunnels *tunnelManager
+
+	mu        sync.Mutex
+	schedules map[int64]*scheduled
+}
+
+// scheduled is a Schedule the scheduler waits on.
+type scheduled struct {
+	Schedule
+	cron *cronSchedule // nil for single runs
+	next time.Time
+}
+
+// newScheduler returns a scheduler of the schedules saved in the state database, whose
+// tunnel switches are made on tunnels.
+func newScheduler(tunnels *tunnelManager) (*scheduler, error) {
+	s := &scheduler{tunnels: tunnels, schedules: make(map[int64]*scheduled)}
+
+	saved, err := stateDB.schedules()
+	if err != nil {
+		return s, err
+	}
+	now := time.Now()
+	for _, sc := range saved {
+		cron, err := sc.validate()
+		if err != nil {
+			logger.Stderr.Warn().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Int64("schedule", sc.ID).
+				Msg("skipping invalid saved schedule")
+			continue
+		}
+		s.schedules[sc.ID] = newScheduled(sc, cron, now)
+	}
+
+	return s, nil
+}
+
+// newScheduled returns sc, with cron, waiting for its next run after now.
+func newScheduled(sc Schedule, cron *cronSchedule, now time.Time) *scheduled {
+	s := &scheduled{Schedule: sc, cron: cron}
+	if cron != nil {
+		s.next = cron.next(now)
+	} else {
+		s.next = *sc.At
+	}
+
+	return s
+}
+
+// Add saves a schedule of cfg, and returns it.
+func (s *scheduler) Add(cfg ScheduleConfig) (Schedule, error) {
+	cron, err := cfg.validate()
+	if err != nil {
+		return Schedule{}, err
+	}
+	if stateDB == nil {
+		return Schedule{}, ErrStateDisabled
+	}
+
+	sc := Schedule{ScheduleConfig: cfg, CreatedAt: time.Now().UTC()}
+	if sc.ID, err = stateDB.saveSchedule(cfg, sc.CreatedAt); err != nil {
+		return Schedule{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added := newScheduled(sc, cron, sc.CreatedAt)
+	s.schedules[sc.ID] = added
+	logger.Stdout.Info().
+		Int64("schedule", sc.ID).
+		Str("action", cfg.Action).
+		Time("next-run", added.next).
+		Msg("schedule added")
+
+	return added.status(), nil
+}
+
+// Remove deletes the schedule id.
+func (s *scheduler) Remove(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[id]; !ok {
+		return fmt.Errorf("%w: %d", ErrScheduleNotFound, id)
+	}
+	if err := stateDB.deleteSchedule(id); err != nil {
+		return err
+	}
+	delete(s.schedules, id)
+
+	return nil
+}
+
+// List returns the schedules, by ID.
+func (s *scheduler) List() []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Schedule, 0, len(s.schedules))
+	for _, sc := range s.schedules {
+		list = append(list, sc.status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	return list
+}
+
+// status returns the Schedule of s, with its next run.
+func (s *scheduled) status() Schedule {
+	sc := s.Schedule
+	if !s.next.IsZero() {
+		next := s.next
+		sc.NextRun = &next
+	}
+
+	return sc
+}
+
+// run makes the changes of the schedules as they come due, until ctx is done.
+func (s *scheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.runDue(now)
+		}
+	}
+}
+
+// runDue makes the changes of the schedules due at now.
+func (s *scheduler) runDue(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, sc := range s.schedules {
+		if sc.next.IsZero() || now.Before(sc.next) {
+			continue
+		}
+
+		err := s.apply(sc.ScheduleConfig)
+		s.record(sc, now, err)
+		if sc.cron == nil {
+			if err := stateDB.deleteSchedule(id); err != nil {
+				logger.StderrWithSource.Error().
+					Str(logger.ErrAttr(err), logger.ErrValue(err)).
+					Int64("schedule", id).
+					Msg("failed to delete schedule run")
+			}
+			delete(s.schedules, id)
+			continue
+		}
+		sc.next = sc.cron.next(now)
+	}
+}
+
+// apply makes the change of cfg.
+func (s *scheduler) apply(cfg ScheduleConfig) error {
+	switch cfg.Action {
+	case ScheduleActionSwitch:
+		_, err := s.tunnels.Switch(cfg.Listen, cfg.TargetSwitchRequest)
+		return err
+	case ScheduleActionMaintenance:
+		duration, _ := time.ParseDuration(cfg.Duration)
+		maintenance.start(duration, cfg.Message)
+	case ScheduleActionMaintenanceEnd:
+		maintenance.stop()
+	}
+
+	return nil
+}
+
+// record logs, counts and saves the run of sc at now, which failed with err if not nil.
+func (s *scheduler) record(sc *scheduled, now time.Time, err error) {
+	result, lastError := "ok", ""
+	event := logger.Stdout.Info()
+	if err != nil {
+		result, lastError = "failed", err.Error()
+		event = logger.Stderr.Warn().Str(logger.ErrAttr(err), logger.ErrValue(err))
+	}
+	event.
+		Int64("schedule", sc.ID).
+		Str("action", sc.Action).
+		Str("note", sc.Note).
+		Dur("late", now.Sub(sc.next).Truncate(time.Second)).
+		Msg("schedule ran")
+	metrics.Default.Counter("railtail_schedule_runs_total",
+		"Runs of schedules, by action and result.", "action", sc.Action, "result", result).Inc()
+
+	ran := now.UTC()
+	sc.LastRun, sc.LastError = &ran, lastError
+	stateDB.scheduleRan(sc.ID, ran, lastError)
+	stateDB.audit("schedule.run", strconv.FormatInt(sc.ID, 10), "scheduler", sc.ScheduleConfig)
+}
+
+// cronSchedule is when a cron expression runs: the minutes, hours, days of the month,
+// months and days of the week it matches, as bit sets, in a time zone.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	anyDay, anyWeekday                     bool // the day fields are *, see matchesDay
+	loc                                    *time.Location
+}
+
+// cronSearchLimit bounds how far ahead the next run of a cron schedule is looked for,
+// for expressions that never match, like "0 0 30 2 *".
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// parseCron parses a cron expression of 5 fields, minute (0-59), hour (0-23), day of the
+// month (1-31), month (1-12) and day of the week (0-7, 0 and 7 being Sunday), each *, a
+// value, a range a-b or a list of them, with an optional /step, in the time zone tz.
+func parseCron(expr, tz string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: cron '%s': expected 5 fields, minute hour day month weekday", ErrScheduleInvalid, expr)
+	}
+
+	c := &cronSchedule{loc: time.UTC}
+	if tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("%w: time_zone: %w", ErrScheduleInvalid, err)
+		}
+		c.loc = loc
+	}
+
+	sets := []struct {
+		set      *uint64
+		min, max int
+	}{
+		{&c.minutes, 0, 59}, {&c.hours, 0, 23}, {&c.days, 1, 31}, {&c.months, 1, 12}, {&c.weekdays, 0, 7},
+	}
+	for i, f := range sets {
+		set, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cron '%s': %w", ErrScheduleInvalid, expr, err)
+		}
+		*f.set = set
+	}
+	if c.weekdays&(1<<7) != 0 {
+		c.weekdays |= 1 // 7 is Sunday too
+	}
+	c.anyDay, c.anyWeekday = fields[2] == "*", fields[4] == "*"
+
+	return c, nil
+}
+
+// parseCronField parses a field of a cron expression, of values from min to max.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeSpec, stepSpec, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepSpec); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step '%s'", part)
+			}
+		}
+
+		lo, hi := min, max
+		if rangeSpec != "*" {
+			loSpec, hiSpec, isRange := strings.Cut(rangeSpec, "-")
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(loSpec)
+			hi = lo
+			if isRange {
+				hi, err2 = strconv.Atoi(hiSpec)
+			} else if hasStep {
+				hi = max // a/step runs from a to the end
+			}
+			if err1 != nil || err2 != nil || lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("bad value '%s', expected %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+
+	return set, nil
+}
+
+// matchesDay reports whether the schedule runs on the day of t. Like cron, when both the
+// day of the month and the day of the week are restricted, either matching is enough.
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	day := c.days&(1<<t.Day()) != 0
+	weekday := c.weekdays&(1<<t.Weekday()) != 0
+	if !c.anyDay && !c.anyWeekday {
+		return day || weekday
+	}
+
+	return day && weekday
+}
+
+// next returns the first minute after t the schedule runs at, or the zero time if it
+// never does.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+
+	for t.Before(limit) {
+		switch {
+		case c.months&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+		case c.hours&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+		case c.minutes&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
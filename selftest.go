@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// maxBannerLength bounds the part of a TCP banner included in self-test results.
+const maxBannerLength = 80
+
+// selfTestResult is the outcome of one self-test check.
+type selfTestResult struct {
+	check   string // tcp-connect, <protocol>-probe or http-get
+	target  string
+	latency time.Duration
+	detail  string // banner or status line on success
+	err     error
+}
+
+// runSelfTest checks every target end-to-end over the tailnet and logs the results. It
+// returns whether all checks passed. Tailnet Proxies have no fixed target, so they are
+// not checked.
+func runSelfTest(ctx context.Context, cfg *Config, dialer Dialer, client *http.Client) bool {
+	var results []selfTestResult
+
+	switch cfg.ForwardTrafficType {
+	case ForwardTrafficTypeHTTP, ForwardTrafficTypeHTTPS:
+		for _, target := range cfg.Targets {
+			results = append(results, selfTestHTTP(ctx, cfg, client, target))
+		}
+	case ForwardTrafficTypeTCP:
+		for _, target := range cfg.Targets {
+			results = append(results, selfTestTCP(ctx, cfg, dialer, target, cfg.TCPProtocol))
+		}
+	}
+	for _, t := range cfg.Tunnels {
+		switch t.mode() {
+		case TunnelModeTCP:
+			results = append(results, selfTestTCP(ctx, cfg, dialer, t.Target, t.Protocol))
+		case TunnelModeHTTP:
+			for _, target := range splitList(t.Target) {
+				results = append(results, selfTestHTTP(ctx, cfg, client, target))
+			}
+		}
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(r.err), logger.ErrValue(r.err)).
+				Str("check", r.check).
+				Str("target", r.target).
+				Dur("latency", r.latency).
+				Msg("self-test failed")
+			continue
+		}
+
+		logger.Stdout.Info().
+			Str("check", r.check).
+			Str("target", r.target).
+			Dur("latency", r.latency).
+			Str("detail", r.detail).
+			Msg("self-test passed")
+	}
+
+	logger.Stdout.Info().
+		Str("mode", string(cfg.ForwardTrafficType)).
+		Int("checks", len(results)).
+		Int("passed", len(results)-failed).
+		Int("failed", failed).
+		Msg("self-test finished")
+
+	return failed == 0
+}
+
+// selfTestTCP connects to target and runs the probe of protocol, if set (see
+// probeProtocol). Otherwise, with SELF_TEST_BANNER_TIMEOUT, it expects the target to send
+// a banner first (as SSH, SMTP or MySQL servers do).
+func selfTestTCP(ctx context.Context, cfg *Config, dialer Dialer, target, protocol string) selfTestResult {
+	r := selfTestResult{check: "tcp-connect", target: target}
+	if protocol != TCPProtocolNone {
+		r.check = protocol + "-probe"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.SelfTestTimeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := targetDialer(dialer.Dial)(ctx, "tcp", target)
+	r.latency = time.Since(start)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	defer conn.Close()
+
+	if protocol != TCPProtocolNone {
+		_ = conn.SetDeadline(time.Now().Add(cfg.SelfTestTimeout))
+		r.detail, r.err = probeProtocol(conn, protocol)
+		r.detail = truncate(r.detail, maxBannerLength)
+		return r
+	}
+
+	if cfg.SelfTestBannerTimeout <= 0 {
+		r.detail = "connected"
+		return r
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(cfg.SelfTestBannerTimeout))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if banner == "" {
+		r.err = fmt.Errorf("no banner received: %w", err)
+		return r
+	}
+	r.detail = truncate(strings.TrimSpace(banner), maxBannerLength)
+
+	return r
+}
+
+// selfTestHTTP sends a GET request for SELF_TEST_PATH to target and checks the status:
+// SELF_TEST_STATUS if set, any status below 500 otherwise.
+func selfTestHTTP(ctx context.Context, cfg *Config, client *http.Client, target string) selfTestResult {
+	r := selfTestResult{check: "http-get", target: target}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.SelfTestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(target, "/")+cfg.SelfTestPath, nil)
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	r.latency = time.Since(start)
+	if err != nil {
+		r.err = err
+		return r
+	}
+	_ = resp.Body.Close()
+
+	r.detail = resp.Status
+	switch {
+	case cfg.SelfTestStatus != 0 && resp.StatusCode != cfg.SelfTestStatus:
+		r.err = fmt.Errorf("expected status %d, got %s", cfg.SelfTestStatus, resp.Status)
+	case cfg.SelfTestStatus == 0 && resp.StatusCode >= 500:
+		r.err = fmt.Errorf("server error: %s", resp.Status)
+	}
+
+	return r
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
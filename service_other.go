@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// serviceCommand handles `railtail service ...`, which is only available on Windows.
+func serviceCommand([]string) int {
+	fmt.Fprintln(os.Stderr, "railtail service is only supported on Windows")
+	return 2
+}
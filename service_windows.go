@@ -0,0 +1,156 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name railtail is registered under with the service control manager.
+const serviceName = "railtail"
+
+// serviceStopTimeout bounds how long a stop request waits for railtail to shut down.
+const serviceStopTimeout = 20 * time.Second
+
+// serviceCommand handles `railtail service install|uninstall|run [flags]` and returns
+// the process exit code.
+func serviceCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: railtail service install|uninstall|run [flags]")
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService(args[1:])
+	case "uninstall":
+		err = uninstallService()
+	case "run":
+		// Flags given at install time are passed back by the service control manager
+		os.Args = append(os.Args[:1], args[1:]...)
+		err = svc.Run(serviceName, windowsService{})
+	default:
+		err = fmt.Errorf("unknown service command '%s'", args[0])
+	}
+
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("command", args[0]).
+			Msg("service command failed")
+		return 1
+	}
+
+	return 0
+}
+
+// installService registers railtail as an automatically started service, run with flags.
+func installService(flags []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return errors.New("service is already installed")
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "railtail",
+		Description: "Forwards traffic into a Tailscale tailnet.",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"service", "run"}, flags...)...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	logger.Stdout.Info().
+		Str("service", serviceName).
+		Strs("flags", flags).
+		Msg("service installed")
+
+	return nil
+}
+
+// uninstallService removes the railtail service. A running service is removed once it stops.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service is not installed: %w", err)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return err
+	}
+
+	logger.Stdout.Info().
+		Str("service", serviceName).
+		Msg("service uninstalled")
+
+	return nil
+}
+
+// windowsService runs railtail under the service control manager.
+type windowsService struct{}
+
+// Execute implements the svc.Handler interface.
+func (windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		run(ctx)
+		close(done)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(serviceStopTimeout / time.Millisecond)}
+				cancel()
+				select {
+				case <-done:
+				case <-time.After(serviceStopTimeout):
+				}
+				return false, 0
+			}
+
+		case <-done:
+			// railtail stopped on its own, report it as a service-specific failure
+			return true, 1
+		}
+	}
+}
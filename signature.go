@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature schemes of hmac routes, after the webhook providers that use them.
+const (
+	SignatureSchemeCustom = "custom" // the HMAC of the body in a header, as configured
+	SignatureSchemeGitHub = "github" // X-Hub-Signature-256: sha256=<hex HMAC-SHA256 of the body>
+	SignatureSchemeStripe = "stripe" // Stripe-Signature: t=<unix time>,v1=<hex HMAC-SHA256 of "t.body">
+	SignatureSchemeSlack  = "slack"  // X-Slack-Signature: v0=<hex HMAC-SHA256 of "v0:timestamp:body">
+)
+
+// ErrSignature is returned for requests whose signature does not verify.
+var ErrSignature = errors.New("invalid request signature")
+
+const (
+	// signatureMaxBody bounds the bodies read to verify their signature, the size GitHub
+	// caps webhook payloads at.
+	signatureMaxBody = 25 << 20
+	// signatureTolerance is how old the timestamps of Stripe and Slack signatures may be
+	// by default, against replays.
+	signatureTolerance = 5 * time.Minute
+)
+
+// signatureHashes are the hash functions of custom signatures, by name.
+var signatureHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// validateSignature checks the settings of an hmac route.
+func (a RouteAuth) validateSignature() error {
+	if len(a.Secrets) == 0 {
+		return fmt.Errorf("%w: hmac auth requires secrets", ErrRouteAuthInvalid)
+	}
+	if slices.Contains(a.Secrets, "") {
+		return fmt.Errorf("%w: secrets cannot be empty", ErrRouteAuthInvalid)
+	}
+	if a.Tolerance < 0 {
+		return fmt.Errorf("%w: tolerance must not be negative", ErrRouteAuthInvalid)
+	}
+
+	switch a.Scheme {
+	case SignatureSchemeGitHub, SignatureSchemeStripe, SignatureSchemeSlack:
+	case "", SignatureSchemeCustom:
+		if a.Header == "" {
+			return fmt.Errorf("%w: custom signatures require header", ErrRouteAuthInvalid)
+		}
+		if _, ok := signatureHashes[cmp.Or(a.Algorithm, "sha256")]; !ok {
+			return fmt.Errorf("%w: algorithm must be sha1, sha256 or sha512, got '%s'", ErrRouteAuthInvalid, a.Algorithm)
+		}
+		if encoding := cmp.Or(a.Encoding, "hex"); encoding != "hex" && encoding != "base64" {
+			return fmt.Errorf("%w: encoding must be hex or base64, got '%s'", ErrRouteAuthInvalid, a.Encoding)
+		}
+	default:
+		return fmt.Errorf("%w: unknown signature scheme '%s', must be one of: %s, %s, %s, %s", ErrRouteAuthInvalid,
+			a.Scheme, SignatureSchemeCustom, SignatureSchemeGitHub, SignatureSchemeStripe, SignatureSchemeSlack)
+	}
+
+	return nil
+}
+
+// checkSignature verifies the signature of r, a webhook signed with one of the secrets of
+// the route, and returns the status refusing it and why if it does not verify. The body
+// is read to do so, and replaced for forwarding.
+func (a *routeAuth) checkSignature(r *http.Request) (int, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, signatureMaxBody+1))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("reading the body: %w", err)
+	}
+	if len(body) > signatureMaxBody {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("body is over %d bytes, too big to verify", signatureMaxBody)
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	r.ContentLength = int64(len(body))
+
+	signed, candidates, err := a.signedPayload(r, body)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("%w: %w", ErrSignature, err)
+	}
+	for _, secret := range a.cfg.Secrets {
+		want := a.sign(secret, signed)
+		for _, candidate := range candidates {
+			if hmac.Equal(want, candidate) {
+				return http.StatusOK, nil
+			}
+		}
+	}
+
+	return http.StatusUnauthorized, fmt.Errorf("%w: no secret of the route signed it", ErrSignature)
+}
+
+// signedPayload returns what the sender signed for r, of body, and the signatures it
+// carries, decoded.
+func (a *routeAuth) signedPayload(r *http.Request, body []byte) ([]byte, [][]byte, error) {
+	switch a.cfg.Scheme {
+	case SignatureSchemeGitHub:
+		signature, err := decodeSignature(r.Header.Get("X-Hub-Signature-256"), "sha256=", "hex")
+		if err != nil {
+			return nil, nil, fmt.Errorf("X-Hub-Signature-256: %w", err)
+		}
+		return body, [][]byte{signature}, nil
+	case SignatureSchemeStripe:
+		var timestamp string
+		var signatures [][]byte
+		for _, field := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "t":
+				timestamp = value
+			case "v1":
+				if signature, err := hex.DecodeString(value); err == nil {
+					signatures = append(signatures, signature)
+				}
+			}
+		}
+		if len(signatures) == 0 {
+			return nil, nil, errors.New("Stripe-Signature: no v1 signature")
+		}
+		if err := a.checkTimestamp(timestamp); err != nil {
+			return nil, nil, fmt.Errorf("Stripe-Signature: %w", err)
+		}
+		return append([]byte(timestamp+"."), body...), signatures, nil
+	case SignatureSchemeSlack:
+		signature, err := decodeSignature(r.Header.Get("X-Slack-Signature"), "v0=", "hex")
+		if err != nil {
+			return nil, nil, fmt.Errorf("X-Slack-Signature: %w", err)
+		}
+		timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+		if err := a.checkTimestamp(timestamp); err != nil {
+			return nil, nil, fmt.Errorf("X-Slack-Request-Timestamp: %w", err)
+		}
+		return append([]byte("v0:"+timestamp+":"), body...), [][]byte{signature}, nil
+	default:
+		signature, err := decodeSignature(r.Header.Get(a.cfg.Header), a.cfg.Prefix, cmp.Or(a.cfg.Encoding, "hex"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", a.cfg.Header, err)
+		}
+		return body, [][]byte{signature}, nil
+	}
+}
+
+// sign returns the HMAC of signed with secret, with the hash of the route's scheme.
+func (a *routeAuth) sign(secret string, signed []byte) []byte {
+	newHash := sha256.New
+	if a.cfg.Scheme == "" || a.cfg.Scheme == SignatureSchemeCustom {
+		newHash = signatureHashes[cmp.Or(a.cfg.Algorithm, "sha256")]
+	}
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(signed)
+
+	return mac.Sum(nil)
+}
+
+// checkTimestamp returns an error if timestamp, in Unix seconds, is further than the
+// tolerance of the route from now.
+func (a *routeAuth) checkTimestamp(timestamp string) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp '%s'", timestamp)
+	}
+	tolerance := cmp.Or(a.cfg.Tolerance, signatureTolerance)
+	if age := time.Since(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("timestamp is %s off, more than %s", age.Round(time.Second), tolerance)
+	}
+
+	return nil
+}
+
+// decodeSignature returns the signature of a header value, after its prefix, in encoding.
+func decodeSignature(value, prefix, encoding string) ([]byte, error) {
+	if value == "" {
+		return nil, errors.New("missing")
+	}
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(value), prefix)
+	if !ok {
+		return nil, fmt.Errorf("does not start with '%s'", prefix)
+	}
+
+	var signature []byte
+	var err error
+	if encoding == "base64" {
+		signature, err = base64.StdEncoding.DecodeString(encoded)
+	} else {
+		signature, err = hex.DecodeString(encoded)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("not %s encoded", encoding)
+	}
+
+	return signature, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Route labels of the sizes of requests served by no configured route.
+const (
+	sizeRouteDefault      = "default"       // the main target
+	sizeRouteTailnetProxy = "tailnet-proxy" // the Tailnet Proxy, by destination
+)
+
+// sizeMetrics records the body sizes of forwarded HTTP requests and responses, nil when
+// SIZE_METRICS is off.
+var sizeMetrics *sizeHistograms
+
+// sizeHistograms records request and response sizes by route and target, for capacity
+// planning and spotting payloads growing through the tunnel.
+type sizeHistograms struct{}
+
+// newSizeHistograms returns the sizeHistograms, or nil if not enabled.
+func newSizeHistograms(enabled bool) *sizeHistograms {
+	if !enabled {
+		return nil
+	}
+
+	return &sizeHistograms{}
+}
+
+// observe records the sizes of r, served by route and forwarded to target: the bytes read
+// of its body and written of the response, as counted by trackRequest.
+func (s *sizeHistograms) observe(route, target string, r *http.Request) {
+	if s == nil {
+		return
+	}
+	c, ok := r.Context().Value(trackedKey{}).(*trackedConn)
+	if !ok {
+		return
+	}
+	if route == "" {
+		route = sizeRouteDefault
+	}
+
+	metrics.Default.HistogramWithBuckets("railtail_http_request_size_bytes",
+		"Body sizes of forwarded HTTP requests, by route and target.", metrics.SizeBuckets,
+		"route", route, "target", target).Observe(float64(c.bytesIn.Load()))
+	metrics.Default.HistogramWithBuckets("railtail_http_response_size_bytes",
+		"Sizes of the responses to forwarded HTTP requests, by route and target.", metrics.SizeBuckets,
+		"route", route, "target", target).Observe(float64(c.bytesOut.Load()))
+}
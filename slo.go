@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Outcomes of connections (TCP) and requests (HTTP), by how they ended.
+const (
+	OutcomeNatural  = "natural"  // a side closed, or the response was sent
+	OutcomeDeadline = "deadline" // a deadline or timeout was hit: TCP_IDLE_TIMEOUT, MAX_CONN_LIFETIME, DRAIN_TIMEOUT, a dial or a peer that stopped answering
+	OutcomeFailed   = "failed"   // another error, such as a reset or a refused dial
+	OutcomeRefused  = "refused"  // turned away by limits, allowed hours, maintenance or credentials, not counted against the SLO
+)
+
+// ErrSLOSettingsInvalid is returned for SLO settings that cannot be used.
+var ErrSLOSettingsInvalid = errors.New("SLO settings are invalid")
+
+const (
+	// sloBucketWidth is the resolution of the error budget of each listener.
+	sloBucketWidth = time.Minute
+	// sloEvalInterval is how often burn rates are computed and alerted on.
+	sloEvalInterval = time.Minute
+	// sloLongWindow and sloShortWindow are the windows burn rates are measured over: an
+	// alert fires when both exceed SLO_BURN_RATE, so that it fires on a sustained burn,
+	// and resolves soon after the burn stops.
+	sloLongWindow  = time.Hour
+	sloShortWindow = 5 * time.Minute
+	// sloMinConnections is how many connections the short window needs for an alert, so
+	// that a single timeout on a quiet listener does not page anyone.
+	sloMinConnections = 10
+)
+
+// slo follows the error budget of every listener, nil when SLO_OBJECTIVE is 0.
+var slo *sloTracker
+
+// SLOStatus is the error budget of the connections and requests of a listener.
+type SLOStatus struct {
+	Listener        string  `json:"listener"`
+	Objective       float64 `json:"objective"`
+	Connections     uint64  `json:"connections"` // over SLO_WINDOW, refusals aside
+	Bad             uint64  `json:"bad"`         // ended by a deadline or failed, over SLO_WINDOW
+	BudgetRemaining float64 `json:"budget_remaining"`
+	BurnRateLong    float64 `json:"burn_rate_1h"`
+	BurnRateShort   float64 `json:"burn_rate_5m"`
+	Alerting        bool    `json:"alerting"`
+}
+
+// sloTracker keeps, for every listener, how many connections and requests ended well or
+// badly in one-minute buckets over the SLO window, and alerts when the error budget of a
+// listener burns faster than SLO_BURN_RATE: at a burn rate of 1 the budget lasts exactly
+// the window, at 14.4 a 30-day budget is gone in 2 days.
+type sloTracker struct {
+	objective float64
+	window    time.Duration
+	burnRate  float64
+
+	mu        sync.Mutex
+	listeners map[string]*sloBudget
+}
+
+// sloBudget is the error budget of a listener.
+type sloBudget struct {
+	buckets  []sloBucket // ring of the buckets of the window, by minute
+	alerting bool
+}
+
+// sloBucket counts the connections that ended during a minute.
+type sloBucket struct {
+	minute int64 // Unix minutes of the bucket, to tell stale buckets of the ring apart
+	total  uint64
+	bad    uint64
+}
+
+// validateSLOSettings checks the SLO settings.
+func validateSLOSettings(cfg *Config) error {
+	switch {
+	case cfg.SLOObjective == 0:
+		return nil
+	case cfg.SLOObjective < 0 || cfg.SLOObjective >= 1:
+		return fmt.Errorf("%w: SLO_OBJECTIVE must be within (0, 1), got %g", ErrSLOSettingsInvalid, cfg.SLOObjective)
+	case cfg.SLOWindow < sloLongWindow:
+		return fmt.Errorf("%w: SLO_WINDOW must be at least %s", ErrSLOSettingsInvalid, sloLongWindow)
+	case cfg.SLOBurnRate <= 0:
+		return fmt.Errorf("%w: SLO_BURN_RATE must be positive", ErrSLOSettingsInvalid)
+	}
+
+	return nil
+}
+
+// newSLOTracker returns the sloTracker of the settings, or nil if objective is 0.
+func newSLOTracker(objective float64, window time.Duration, burnRate float64) *sloTracker {
+	if objective == 0 {
+		return nil
+	}
+
+	return &sloTracker{
+		objective: objective,
+		window:    window,
+		burnRate:  burnRate,
+		listeners: make(map[string]*sloBudget),
+	}
+}
+
+// closeOutcome returns the outcome of a connection or request closed for reason, which
+// hit a deadline if timedOut.
+func closeOutcome(reason string, timedOut bool) string {
+	switch {
+	case reason == CloseLimitExceeded || reason == CloseOutsideWindow || reason == CloseUnauthorized ||
+		reason == CloseMaintenance:
+		return OutcomeRefused
+	case timedOut || reason == CloseIdleTimeout || reason == CloseMaxLifetime || reason == CloseDrained:
+		return OutcomeDeadline
+	case reason == CloseCompleted || reason == CloseClientEOF || reason == CloseUpstreamEOF:
+		return OutcomeNatural
+	default:
+		return OutcomeFailed
+	}
+}
+
+// isTimeout reports whether err is a deadline or timeout being hit.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrTimeout) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// countOutcome counts a connection or request of kind, accepted on listener, that ended
+// with outcome, and records it against the error budget of the listener.
+func countOutcome(kind, listener, outcome string) {
+	metrics.Default.Counter("railtail_connection_outcomes_total",
+		"Connections (TCP) and requests (HTTP) closed, by listen port and outcome.",
+		"kind", kind, "listener", listener, "outcome", outcome).Inc()
+	if outcome != OutcomeRefused {
+		slo.record(listener, outcome != OutcomeNatural, time.Now())
+	}
+}
+
+// record counts a connection of listener ended at now, badly if bad.
+func (t *sloTracker) record(listener string, bad bool, now time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.listeners[listener]
+	if b == nil {
+		b = &sloBudget{buckets: make([]sloBucket, t.window/sloBucketWidth)}
+		t.listeners[listener] = b
+	}
+	minute := now.Unix() / int64(sloBucketWidth/time.Second)
+	bucket := &b.buckets[minute%int64(len(b.buckets))]
+	if bucket.minute != minute {
+		*bucket = sloBucket{minute: minute}
+	}
+	bucket.total++
+	if bad {
+		bucket.bad++
+	}
+}
+
+// sumLocked returns the connections of b, and the bad ones, that ended over the window
+// up to now. It is called with t.mu held.
+func (b *sloBudget) sumLocked(now time.Time, window time.Duration) (total, bad uint64) {
+	minute := now.Unix() / int64(sloBucketWidth/time.Second)
+	oldest := minute - int64(window/sloBucketWidth) + 1
+	for _, bucket := range b.buckets {
+		if bucket.minute >= oldest && bucket.minute <= minute {
+			total += bucket.total
+			bad += bucket.bad
+		}
+	}
+
+	return total, bad
+}
+
+// burn returns the burn rate of bad out of total connections: how many times faster than
+// the objective allows the budget is spent.
+func (t *sloTracker) burn(total, bad uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(bad) / float64(total) / (1 - t.objective)
+}
+
+// statusLocked returns the SLOStatus of the listener at now. It is called with t.mu held.
+func (t *sloTracker) statusLocked(listener string, b *sloBudget, now time.Time) SLOStatus {
+	total, bad := b.sumLocked(now, t.window)
+	status := SLOStatus{
+		Listener:        listener,
+		Objective:       t.objective,
+		Connections:     total,
+		Bad:             bad,
+		BudgetRemaining: 1,
+		Alerting:        b.alerting,
+	}
+	if total > 0 {
+		status.BudgetRemaining = 1 - t.burn(total, bad)
+	}
+	status.BurnRateLong = t.burn(b.sumLocked(now, sloLongWindow))
+	status.BurnRateShort = t.burn(b.sumLocked(now, sloShortWindow))
+
+	return status
+}
+
+// Statuses returns the error budgets of the listeners, by listen port.
+func (t *sloTracker) Statuses() []SLOStatus {
+	if t == nil {
+		return []SLOStatus{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	statuses := make([]SLOStatus, 0, len(t.listeners))
+	for listener, b := range t.listeners {
+		statuses = append(statuses, t.statusLocked(listener, b, now))
+	}
+	slices.SortFunc(statuses, func(a, b SLOStatus) int {
+		pa, _ := strconv.Atoi(a.Listener)
+		pb, _ := strconv.Atoi(b.Listener)
+		return pa - pb
+	})
+
+	return statuses
+}
+
+// run evaluates the error budgets every sloEvalInterval until ctx is cancelled.
+func (t *sloTracker) run(ctx context.Context) {
+	if t == nil {
+		return
+	}
+
+	ticker := time.NewTicker(sloEvalInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.evaluate(now)
+		}
+	}
+}
+
+// evaluate updates the SLO metrics of every listener, and fires or resolves its alert.
+func (t *sloTracker) evaluate(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for listener, b := range t.listeners {
+		status := t.statusLocked(listener, b, now)
+		metrics.Default.Gauge("railtail_slo_error_budget_remaining_permille",
+			"Error budget of SLO_WINDOW left, in thousandths, by listen port; negative once overspent.",
+			"listener", listener).Set(permille(status.BudgetRemaining))
+		metrics.Default.Gauge("railtail_slo_burn_rate_permille",
+			"Rate the error budget is spent at, in thousandths, by listen port and window; 1000 spends it over exactly SLO_WINDOW.",
+			"listener", listener, "window", "1h").Set(permille(status.BurnRateLong))
+		metrics.Default.Gauge("railtail_slo_burn_rate_permille",
+			"Rate the error budget is spent at, in thousandths, by listen port and window; 1000 spends it over exactly SLO_WINDOW.",
+			"listener", listener, "window", "5m").Set(permille(status.BurnRateShort))
+
+		shortTotal, _ := b.sumLocked(now, sloShortWindow)
+		burning := status.BurnRateLong >= t.burnRate && status.BurnRateShort >= t.burnRate &&
+			shortTotal >= sloMinConnections
+		if burning == b.alerting {
+			continue
+		}
+		b.alerting = burning
+		status.Alerting = burning
+		t.alert(status)
+	}
+}
+
+// permille returns f in thousandths, for integer gauges.
+func permille(f float64) int64 {
+	return int64(math.Round(f * 1000))
+}
+
+// alert logs and emits the alert of status, firing or resolved.
+func (t *sloTracker) alert(status SLOStatus) {
+	state := "resolved"
+	event := logger.Stdout.Info()
+	if status.Alerting {
+		state = "firing"
+		event = logger.Stderr.Warn()
+		metrics.Default.Counter("railtail_slo_alerts_total",
+			"SLO burn rate alerts fired, by listen port.", "listener", status.Listener).Inc()
+	}
+	event.
+		Str("listener", status.Listener).
+		Str("state", state).
+		Float64("burn-rate-1h", status.BurnRateLong).
+		Float64("burn-rate-5m", status.BurnRateShort).
+		Float64("budget-remaining", status.BudgetRemaining).
+		Msg("SLO burn rate alert")
+
+	if hooks.wants(HookSLOBurn) {
+		hooks.emit(HookSLOBurn, map[string]string{
+			"listener":         status.Listener,
+			"state":            state,
+			"objective":        strconv.FormatFloat(status.Objective, 'g', -1, 64),
+			"burn_rate_1h":     strconv.FormatFloat(status.BurnRateLong, 'f', 2, 64),
+			"burn_rate_5m":     strconv.FormatFloat(status.BurnRateShort, 'f', 2, 64),
+			"budget_remaining": strconv.FormatFloat(status.BudgetRemaining, 'f', 4, 64),
+		})
+	}
+}
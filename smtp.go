@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smtpHandshakeTimeout bounds the exchange with the relay before the client is connected.
+const smtpHandshakeTimeout = 10 * time.Second
+
+// smtpMaxReplyLines bounds the lines of a multi-line SMTP reply read by railtail.
+const smtpMaxReplyLines = 100
+
+// ErrXClientUnsupported is returned when an SMTP relay does not offer XCLIENT to railtail.
+var ErrXClientUnsupported = errors.New("SMTP relay does not offer XCLIENT (is railtail in smtpd_authorized_xclient_hosts?)")
+
+// smtpReply is a reply read from an SMTP server.
+type smtpReply struct {
+	code  int
+	lines []string // text of each line, without the code
+	raw   []byte   // the reply as received
+}
+
+// readSMTPReply reads a reply, following continuation lines ("250-...").
+func readSMTPReply(r *bufio.Reader) (smtpReply, error) {
+	var reply smtpReply
+	for len(reply.lines) < smtpMaxReplyLines {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return reply, err
+		}
+		reply.raw = append(reply.raw, line...)
+
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 3 {
+			return reply, fmt.Errorf("malformed reply: %q", line)
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil || (reply.code != 0 && code != reply.code) {
+			return reply, fmt.Errorf("malformed reply: %q", line)
+		}
+		reply.code = code
+		reply.lines = append(reply.lines, strings.TrimSpace(line[3:]))
+
+		if len(line) == 3 || line[3] != '-' {
+			return reply, nil
+		}
+	}
+
+	return reply, errors.New("reply too long")
+}
+
+// smtpXClient introduces the client at client to the SMTP relay on conn with the XCLIENT
+// extension (supported by Postfix), so the relay applies its SPF checks,
+// access rules and logging to the real client instead of railtail. It returns the
+// greeting the relay sends once the client is introduced, which the client must get in
+// place of the original one.
+func smtpXClient(conn net.Conn, client net.Addr) ([]byte, error) {
+	_ = conn.SetDeadline(time.Now().Add(smtpHandshakeTimeout))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	r := bufio.NewReader(conn)
+	greeting, err := readSMTPReply(r)
+	if err != nil {
+		return nil, fmt.Errorf("no greeting: %w", err)
+	}
+	if greeting.code != 220 {
+		return nil, fmt.Errorf("relay refused the connection: %s", strings.TrimSpace(string(greeting.raw)))
+	}
+
+	if _, err := conn.Write([]byte("EHLO railtail\r\n")); err != nil {
+		return nil, err
+	}
+	ehlo, err := readSMTPReply(r)
+	if err != nil {
+		return nil, fmt.Errorf("no answer to EHLO: %w", err)
+	}
+	if ehlo.code != 250 || !smtpHasExtension(ehlo, "XCLIENT") {
+		return nil, ErrXClientUnsupported
+	}
+
+	if _, err := conn.Write([]byte("XCLIENT " + xclientAttrs(client) + "\r\n")); err != nil {
+		return nil, err
+	}
+	introduced, err := readSMTPReply(r)
+	if err != nil {
+		return nil, fmt.Errorf("no answer to XCLIENT: %w", err)
+	}
+	if introduced.code != 220 {
+		return nil, fmt.Errorf("XCLIENT refused: %s", strings.TrimSpace(string(introduced.raw)))
+	}
+	if r.Buffered() > 0 {
+		return nil, errors.New("unexpected data after XCLIENT")
+	}
+
+	return introduced.raw, nil
+}
+
+// smtpHasExtension reports whether an EHLO reply advertises the extension.
+func smtpHasExtension(ehlo smtpReply, extension string) bool {
+	// The first line is the server's greeting, the others its extensions
+	for _, line := range ehlo.lines[1:] {
+		keyword, _, _ := strings.Cut(line, " ")
+		if strings.EqualFold(keyword, extension) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// xclientAttrs returns the XCLIENT attributes describing the client at addr.
+func xclientAttrs(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "ADDR=[UNAVAILABLE] PORT=[UNAVAILABLE]"
+	}
+
+	ip := tcpAddr.IP.String()
+	if tcpAddr.IP.To4() == nil {
+		ip = "IPV6:" + ip
+	}
+
+	return "ADDR=" + ip + " PORT=" + strconv.Itoa(tcpAddr.Port)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Errors of connections refused by the per-source limits.
+var (
+	ErrSourceMaxConns    = errors.New("too many connections from the client address")
+	ErrSourceRateLimited = errors.New("the client address opens connections too fast")
+)
+
+// sourceSweepInterval is how often the state of addresses without connections is dropped.
+const sourceSweepInterval = time.Minute
+
+var (
+	sourceRefusedMaxConns = metrics.Default.Counter("railtail_source_refused_total",
+		"TCP connections refused by the per-client-address limits, by reason.", "reason", "max-conns")
+	sourceRefusedRate = metrics.Default.Counter("railtail_source_refused_total",
+		"TCP connections refused by the per-client-address limits, by reason.", "reason", "rate-limited")
+	sourceAddresses = metrics.Default.Gauge("railtail_source_addresses",
+		"Client addresses the per-client-address limits track.")
+)
+
+// sourceLimiter caps the connections each client address has open at once and how fast
+// it opens new ones, so that a single misbehaving client cannot take every connection of
+// a listener. A nil sourceLimiter admits everything.
+type sourceLimiter struct {
+	maxConns    int
+	rate, burst float64
+
+	mu      sync.Mutex
+	sources map[netip.Addr]*sourceState
+	swept   time.Time
+}
+
+// sourceState is what a sourceLimiter knows of a client address.
+type sourceState struct {
+	conns  int
+	bucket *tokenBucket // nil if the rate is unlimited
+}
+
+// newSourceLimiter returns the sourceLimiter of maxConns connections per address (0 for
+// unlimited) and rate new connections per second, with burst let through at once above it
+// (defaulting to the rate), or nil if both are unlimited.
+func newSourceLimiter(maxConns int, rate float64, burst int) *sourceLimiter {
+	if maxConns <= 0 && rate <= 0 {
+		return nil
+	}
+
+	l := &sourceLimiter{maxConns: maxConns, sources: make(map[netip.Addr]*sourceState), swept: time.Now()}
+	if rate > 0 {
+		l.rate, l.burst = rate, float64(burst)
+		if l.burst == 0 {
+			l.burst = math.Max(1, math.Ceil(rate))
+		}
+	}
+
+	return l
+}
+
+// admit admits a connection from remoteAddr within the limits of its address, returning
+// the function to call once it is closed.
+func (l *sourceLimiter) admit(remoteAddr string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	addr, ok := sourceAddr(remoteAddr)
+	if !ok {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweepLocked()
+	s := l.sources[addr]
+	if s == nil {
+		s = &sourceState{}
+		if l.rate > 0 {
+			s.bucket = newTokenBucket(l.rate, l.burst)
+		}
+		l.sources[addr] = s
+		sourceAddresses.Set(int64(len(l.sources)))
+	}
+
+	if l.maxConns > 0 && s.conns >= l.maxConns {
+		sourceRefusedMaxConns.Inc()
+		return nil, fmt.Errorf("%w: %s (%d)", ErrSourceMaxConns, addr, l.maxConns)
+	}
+	if !s.bucket.take() {
+		sourceRefusedRate.Inc()
+		return nil, fmt.Errorf("%w: %s", ErrSourceRateLimited, addr)
+	}
+	s.conns++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			s.conns--
+		})
+	}, nil
+}
+
+// sweepLocked drops the addresses without connections whose rate limit has recovered, at
+// most every sourceSweepInterval. It is called with l.mu held.
+func (l *sourceLimiter) sweepLocked() {
+	now := time.Now()
+	if now.Sub(l.swept) < sourceSweepInterval {
+		return
+	}
+	l.swept = now
+
+	for addr, s := range l.sources {
+		if s.conns == 0 && s.bucket.full(now) {
+			delete(l.sources, addr)
+		}
+	}
+	sourceAddresses.Set(int64(len(l.sources)))
+}
+
+// sourceAddr returns the IP address of remoteAddr, an address:port.
+func sourceAddr(remoteAddr string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
+
+// logSourceRefused logs and counts a connection refused by the per-source limits.
+func logSourceRefused(kind, remoteAddr string, err error) {
+	countClosed(kind, CloseLimitExceeded)
+	logger.Stderr.Warn().
+		Str(logger.ErrAttr(err), logger.ErrValue(err)).
+		Str("remote-addr", remoteAddr).
+		Str("reason", CloseLimitExceeded).
+		Msg("connection refused by the limits of its client address")
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/workloadpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// Errors of SPIFFE workload identities.
+var (
+	ErrWorkloadSocketInvalid = errors.New("SPIFFE_ENDPOINT_SOCKET must be unix:///path or tcp://ip:port")
+	ErrSVIDInvalid           = errors.New("SVID is invalid")
+	ErrSVIDUnavailable       = errors.New("no SVID fetched from the Workload API yet")
+)
+
+const (
+	// svidFetchTimeout is how long railtail waits for its first SVID on start.
+	svidFetchTimeout = 30 * time.Second
+	// svidRetryMax caps the backoff between attempts to reach the Workload API.
+	svidRetryMax = 30 * time.Second
+)
+
+// workloadSVIDs is the SVID of railtail and the bundles of the trust domains it trusts,
+// nil without SPIFFE_ENDPOINT_SOCKET.
+var workloadSVIDs *svidSource
+
+// svidSource keeps the X.509 SVID of railtail and the trust bundles current, as the
+// Workload API streams their rotations.
+type svidSource struct {
+	socket string
+	client workloadpb.SpiffeWorkloadAPIClient
+
+	mu      sync.RWMutex
+	svid    *tls.Certificate
+	bundles map[string]*x509.CertPool // by trust domain, like example.org
+	all     *x509.CertPool            // the certificates of every bundle
+
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// newSVIDSource returns the svidSource of the Workload API at socket, a
+// SPIFFE_ENDPOINT_SOCKET address. Nothing is fetched before watch is started.
+func newSVIDSource(socket string) (*svidSource, error) {
+	target, err := workloadTarget(socket)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &svidSource{
+		socket: socket,
+		client: workloadpb.NewSpiffeWorkloadAPIClient(conn),
+		ready:  make(chan struct{}),
+	}, nil
+}
+
+// workloadTarget returns the gRPC target of socket: unix:///path, or tcp://ip:port.
+func workloadTarget(socket string) (string, error) {
+	u, err := url.Parse(socket)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrWorkloadSocketInvalid, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		if u.Host != "" || u.Path == "" {
+			return "", fmt.Errorf("%w, got '%s'", ErrWorkloadSocketInvalid, socket)
+		}
+		return "unix://" + u.Path, nil
+	case "tcp":
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil || net.ParseIP(host) == nil || u.Path != "" {
+			return "", fmt.Errorf("%w, got '%s'", ErrWorkloadSocketInvalid, socket)
+		}
+		return "passthrough:///" + u.Host, nil
+	default:
+		return "", fmt.Errorf("%w, got '%s'", ErrWorkloadSocketInvalid, socket)
+	}
+}
+
+// watch streams the SVID and bundles from the Workload API until ctx is done,
+// reconnecting with backoff when the stream breaks, as it does on agent restarts.
+func (s *svidSource) watch(ctx context.Context) {
+	backoff := time.Second
+	for {
+		received, err := s.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			backoff = time.Second
+		}
+		logger.Stderr.Warn().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("socket", s.socket).
+			Dur("retry-in", backoff).
+			Msg("Workload API stream failed")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, svidRetryMax)
+	}
+}
+
+// stream applies the updates of one FetchX509SVID stream until it breaks, reporting
+// whether it received any.
+func (s *svidSource) stream(ctx context.Context) (bool, error) {
+	// Agents refuse calls without this header, a guard against request forgery
+	ctx = metadata.AppendToOutgoingContext(ctx, "workload.spiffe.io", "true")
+	stream, err := s.client.FetchX509SVID(ctx, &workloadpb.X509SVIDRequest{})
+	if err != nil {
+		return false, err
+	}
+
+	received := false
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		if err := s.update(resp); err != nil {
+			logger.Stderr.Warn().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("ignoring Workload API update, keeping the previous SVID")
+		}
+	}
+}
+
+// update replaces the SVID and bundles with those of resp, the default SVID being the
+// first one.
+func (s *svidSource) update(resp *workloadpb.X509SVIDResponse) error {
+	if len(resp.GetSvids()) == 0 {
+		return fmt.Errorf("%w: the response has no SVID", ErrSVIDInvalid)
+	}
+	svid := resp.GetSvids()[0]
+
+	chain, err := x509.ParseCertificates(svid.GetX509Svid())
+	if err != nil || len(chain) == 0 {
+		return fmt.Errorf("%w: certificates: %w", ErrSVIDInvalid, err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(svid.GetX509SvidKey())
+	if err != nil {
+		return fmt.Errorf("%w: key: %w", ErrSVIDInvalid, err)
+	}
+	id, trustDomain, err := spiffeID(chain[0])
+	if err != nil {
+		return err
+	}
+
+	bundles := make(map[string]*x509.CertPool, 1+len(resp.GetFederatedBundles()))
+	all := x509.NewCertPool()
+	add := func(trustDomain string, der []byte) error {
+		certs, err := x509.ParseCertificates(der)
+		if err != nil || len(certs) == 0 {
+			return fmt.Errorf("%w: bundle of %s: %w", ErrSVIDInvalid, trustDomain, err)
+		}
+		pool := x509.NewCertPool()
+		for _, cert := range certs {
+			pool.AddCert(cert)
+			all.AddCert(cert)
+		}
+		bundles[trustDomain] = pool
+		return nil
+	}
+	if err := add(trustDomain, svid.GetBundle()); err != nil {
+		return err
+	}
+	for name, der := range resp.GetFederatedBundles() {
+		if err := add(strings.TrimPrefix(name, "spiffe://"), der); err != nil {
+			return err
+		}
+	}
+
+	raw := make([][]byte, len(chain))
+	for i, cert := range chain {
+		raw[i] = cert.Raw
+	}
+
+	s.mu.Lock()
+	s.svid = &tls.Certificate{Certificate: raw, PrivateKey: key, Leaf: chain[0]}
+	s.bundles, s.all = bundles, all
+	s.mu.Unlock()
+	s.readyOnce.Do(func() { close(s.ready) })
+
+	logger.Stdout.Info().
+		Str("spiffe-id", id).
+		Time("expires", chain[0].NotAfter).
+		Int("trust-domains", len(bundles)).
+		Msg("fetched SVID from the Workload API")
+
+	return nil
+}
+
+// wait blocks until the first SVID is fetched, for at most timeout.
+func (s *svidSource) wait(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	select {
+	case <-s.ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %s: %w", ErrSVIDUnavailable, s.socket, ctx.Err())
+	}
+}
+
+// certificate returns the current SVID of railtail.
+func (s *svidSource) certificate() (*tls.Certificate, error) {
+	if s == nil {
+		return nil, ErrSVIDUnavailable
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.svid == nil {
+		return nil, ErrSVIDUnavailable
+	}
+
+	return s.svid, nil
+}
+
+// bundle returns the CA certificates of trustDomain, or nil if it is not trusted.
+func (s *svidSource) bundle(trustDomain string) *x509.CertPool {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.bundles[trustDomain]
+}
+
+// verify returns the SPIFFE ID of the SVID chain raw, leaf first, after verifying it
+// against the bundle of its trust domain, for usage.
+func (s *svidSource) verify(raw [][]byte, usage x509.ExtKeyUsage) (string, error) {
+	if len(raw) == 0 {
+		return "", fmt.Errorf("%w: no certificate", ErrSVIDInvalid)
+	}
+	certs := make([]*x509.Certificate, len(raw))
+	for i, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", ErrSVIDInvalid, err)
+		}
+		certs[i] = cert
+	}
+	id, trustDomain, err := spiffeID(certs[0])
+	if err != nil {
+		return "", err
+	}
+	roots := s.bundle(trustDomain)
+	if roots == nil {
+		return "", fmt.Errorf("%w: %s: trust domain %s is not trusted", ErrSVIDInvalid, id, trustDomain)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}); err != nil {
+		return "", fmt.Errorf("%w: %s: %w", ErrSVIDInvalid, id, err)
+	}
+
+	return id, nil
+}
+
+// requireClientSVIDs makes tlsConfig, a listener configuration, verify client
+// certificates as SVIDs: signed by the bundle of the trust domain of their SPIFFE ID.
+// The bundles are read on every handshake, so rotations apply to new connections.
+func (s *svidSource) requireClientSVIDs(tlsConfig *tls.Config) {
+	base := tlsConfig.Clone()
+	acme := tlsConfig.GetConfigForClient
+
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if acme != nil {
+			if config, err := acme(hello); config != nil || err != nil {
+				return config, err
+			}
+		}
+
+		s.mu.RLock()
+		all := s.all
+		s.mu.RUnlock()
+
+		config := base.Clone()
+		config.ClientCAs = all
+		// The handshake verified the chain against every bundle; each SVID must also
+		// chain to the bundle of its own trust domain
+		config.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return nil // TLS_CLIENT_AUTH=optional
+			}
+			_, err := s.verify(raw, x509.ExtKeyUsageClientAuth)
+			return err
+		}
+		return config, nil
+	}
+}
+
+// upstreamTLS makes tlsConfig, an upstream configuration, present the SVID of railtail
+// and verify the certificate of targets as an SVID whose SPIFFE ID matches ids, any if
+// empty. SVIDs carry no hostname, so hostname verification is replaced by the match.
+func upstreamTLS(tlsConfig *tls.Config, ids []string) {
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return workloadSVIDs.certificate()
+	}
+	tlsConfig.InsecureSkipVerify = true // verified below
+	tlsConfig.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if workloadSVIDs == nil {
+			return ErrSVIDUnavailable
+		}
+		id, err := workloadSVIDs.verify(raw, x509.ExtKeyUsageServerAuth)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 && !matchIdentity(id, ids) {
+			return fmt.Errorf("%w: %s is not one of %s", ErrSVIDInvalid, id, strings.Join(ids, ", "))
+		}
+		return nil
+	}
+}
+
+// spiffeID returns the SPIFFE ID of an SVID, its only URI SAN, and its trust domain.
+func spiffeID(cert *x509.Certificate) (string, string, error) {
+	if len(cert.URIs) != 1 {
+		return "", "", fmt.Errorf("%w: expected one URI SAN, got %d", ErrSVIDInvalid, len(cert.URIs))
+	}
+	u := cert.URIs[0]
+	if u.Scheme != "spiffe" || u.Host == "" || u.User != nil || u.Port() != "" {
+		return "", "", fmt.Errorf("%w: %s is not a SPIFFE ID", ErrSVIDInvalid, u)
+	}
+
+	return u.String(), u.Host, nil
+}
+
+// validateSPIFFE checks the SPIFFE settings, after the transport overrides are parsed.
+func validateSPIFFE(cfg *Config) []error {
+	var errors_ []error
+
+	if cfg.SPIFFEEndpointSocket != "" {
+		if _, err := workloadTarget(cfg.SPIFFEEndpointSocket); err != nil {
+			errors_ = append(errors_, err)
+		}
+		return errors_
+	}
+
+	if cfg.SPIFFEUpstream || len(cfg.SPIFFEUpstreamIDs) > 0 {
+		errors_ = append(errors_, errors.New("SPIFFE_UPSTREAM and SPIFFE_UPSTREAM_IDS require SPIFFE_ENDPOINT_SOCKET"))
+	}
+	for target, settings := range cfg.TransportOverrides {
+		if settings.TLSSPIFFE {
+			errors_ = append(errors_, fmt.Errorf("%w: %s: tls-spiffe requires SPIFFE_ENDPOINT_SOCKET",
+				ErrTransportOverrideInvalid, target))
+		}
+	}
+
+	return errors_
+}
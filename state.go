@@ -0,0 +1,475 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+	_ "modernc.org/sqlite" // registers the "sqlite" database/sql driver
+)
+
+// ErrStateDisabled is returned when state is asked for without a state database.
+var ErrStateDisabled = errors.New("the state database is disabled, set STATE_DB")
+
+// stateDBFile is the name of the state database, in the state directory.
+const stateDBFile = "railtail.db"
+
+// stateSaveInterval is how often counters are saved to the state database.
+const stateSaveInterval = 30 * time.Second
+
+// stateMigrations create the schema of the state database, one version each. The
+// user_version pragma records how many have been applied.
+var stateMigrations = []string{
+	`CREATE TABLE tunnels (
+		listen     INTEGER PRIMARY KEY,
+		config     TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE counters (
+		name  TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	);
+	CREATE TABLE audit (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		time        INTEGER NOT NULL,
+		action      TEXT NOT NULL,
+		subject     TEXT NOT NULL,
+		remote_addr TEXT NOT NULL,
+		detail      TEXT NOT NULL
+	);
+	CREATE TABLE webhooks (
+		id   INTEGER PRIMARY KEY AUTOINCREMENT,
+		data BLOB NOT NULL
+	);`,
+	`CREATE TABLE schedules (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		config     TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		last_run   INTEGER,
+		last_error TEXT NOT NULL DEFAULT ''
+	);`,
+}
+
+// AuditRecord is a change made through the admin server.
+type AuditRecord struct {
+	ID         int64           `json:"id"`
+	Time       time.Time       `json:"time"`
+	Action     string          `json:"action"`
+	Subject    string          `json:"subject"`
+	RemoteAddr string          `json:"remote_addr"`
+	Detail     json.RawMessage `json:"detail,omitempty"`
+}
+
+// stateDB keeps runtime state across restarts, nil if STATE_DB is not set.
+var stateDB *stateStore
+
+// stateStore is an embedded SQLite database keeping the state railtail otherwise holds
+// in memory: tunnels created through the admin server, the counters of tenants, the audit
+// trail of the admin server, schedules, and spooled webhook requests. A nil stateStore
+// keeps nothing.
+type stateStore struct {
+	db   *sql.DB
+	path string
+
+	mu       sync.Mutex
+	counters map[string]*metrics.Counter // saved periodically, by name
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// openStateStore opens the state database in dir, creating or upgrading its schema.
+func openStateStore(dir string) (*stateStore, error) {
+	path := filepath.Join(dir, stateDBFile)
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database: %w", err)
+	}
+	// SQLite writes one at a time anyway, and this keeps the pragmas on every connection
+	db.SetMaxOpenConns(1)
+
+	s := &stateStore{
+		db:       db,
+		path:     path,
+		counters: make(map[string]*metrics.Counter),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := s.migrate(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to migrate state database %s: %w", path, err)
+	}
+	go s.run()
+
+	logger.Stdout.Info().Str("path", path).Msg("state database opened")
+
+	return s, nil
+}
+
+// migrate applies the migrations the database has not seen yet.
+func (s *stateStore) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(stateMigrations) {
+		return fmt.Errorf("schema version %d is newer than this railtail's (%d)", version, len(stateMigrations))
+	}
+
+	for ; version < len(stateMigrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(stateMigrations[version]); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		// Pragmas don't take parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// run saves the counters every stateSaveInterval until close.
+func (s *stateStore) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.saveCounters()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close saves the counters a last time and closes the database.
+func (s *stateStore) close() {
+	if s == nil {
+		return
+	}
+
+	close(s.stop)
+	<-s.done
+	s.saveCounters()
+	if err := s.db.Close(); err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Msg("failed to close state database")
+	}
+}
+
+// saveTunnel saves a tunnel created at runtime, to be resumed on the next start.
+func (s *stateStore) saveTunnel(cfg TunnelConfig) error {
+	if s == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT OR REPLACE INTO tunnels (listen, config, created_at) VALUES (?, ?, ?)",
+		cfg.Listen, string(data), time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to save tunnel %d: %w", cfg.Listen, err)
+	}
+
+	return nil
+}
+
+// deleteTunnel forgets the tunnel listening on port, if saved.
+func (s *stateStore) deleteTunnel(port int) error {
+	if s == nil {
+		return nil
+	}
+
+	if _, err := s.db.Exec("DELETE FROM tunnels WHERE listen = ?", port); err != nil {
+		return fmt.Errorf("failed to delete saved tunnel %d: %w", port, err)
+	}
+
+	return nil
+}
+
+// tunnels returns the saved tunnels, in the order they were created.
+func (s *stateStore) tunnels() ([]TunnelConfig, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	rows, err := s.db.Query("SELECT config FROM tunnels ORDER BY created_at, listen")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load saved tunnels: %w", err)
+	}
+	defer rows.Close()
+
+	var tunnels []TunnelConfig
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var cfg TunnelConfig
+		if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+			return nil, fmt.Errorf("failed to load saved tunnel: %w", err)
+		}
+		tunnels = append(tunnels, cfg)
+	}
+
+	return tunnels, rows.Err()
+}
+
+// saveSchedule saves a schedule created at createdAt, and returns its ID.
+func (s *stateStore) saveSchedule(cfg ScheduleConfig, createdAt time.Time) (int64, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.Exec("INSERT INTO schedules (config, created_at) VALUES (?, ?)", string(data), createdAt.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to save schedule: %w", err)
+	}
+
+	return res.LastInsertId()
+}
+
+// deleteSchedule forgets the schedule id.
+func (s *stateStore) deleteSchedule(id int64) error {
+	if s == nil {
+		return nil
+	}
+
+	if _, err := s.db.Exec("DELETE FROM schedules WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete schedule %d: %w", id, err)
+	}
+
+	return nil
+}
+
+// scheduleRan records the last run of the schedule id, at, and its error if it failed.
+// Failing to record it is logged: the change is made already.
+func (s *stateStore) scheduleRan(id int64, at time.Time, lastError string) {
+	if s == nil {
+		return
+	}
+
+	_, err := s.db.Exec("UPDATE schedules SET last_run = ?, last_error = ? WHERE id = ?", at.UnixNano(), lastError, id)
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Int64("schedule", id).
+			Msg("failed to record schedule run")
+	}
+}
+
+// schedules returns the saved schedules, by ID.
+func (s *stateStore) schedules() ([]Schedule, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	rows, err := s.db.Query("SELECT id, config, created_at, last_run, last_error FROM schedules ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		var (
+			sc      Schedule
+			data    string
+			created int64
+			lastRun sql.NullInt64
+		)
+		if err := rows.Scan(&sc.ID, &data, &created, &lastRun, &sc.LastError); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &sc.ScheduleConfig); err != nil {
+			return nil, fmt.Errorf("failed to load schedule %d: %w", sc.ID, err)
+		}
+		sc.CreatedAt = time.Unix(0, created).UTC()
+		if lastRun.Valid {
+			ran := time.Unix(0, lastRun.Int64).UTC()
+			sc.LastRun = &ran
+		}
+		schedules = append(schedules, sc)
+	}
+
+	return schedules, rows.Err()
+}
+
+// keepCounters adds the values saved by previous runs to counters, by name, and saves
+// them from now on, so they keep counting across restarts.
+func (s *stateStore) keepCounters(counters map[string]*metrics.Counter) {
+	if s == nil || len(counters) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, counter := range counters {
+		var value int64
+		err := s.db.QueryRow("SELECT value FROM counters WHERE name = ?", name).Scan(&value)
+		switch {
+		case err == nil:
+			counter.Add(uint64(value))
+		case !errors.Is(err, sql.ErrNoRows):
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("counter", name).
+				Msg("failed to load saved counter")
+		}
+		s.counters[name] = counter
+	}
+}
+
+// saveCounters saves the current value of the counters kept by keepCounters.
+func (s *stateStore) saveCounters() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.counters) == 0 {
+		return
+	}
+
+	err := func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for name, counter := range s.counters {
+			if _, err := tx.Exec("INSERT OR REPLACE INTO counters (name, value) VALUES (?, ?)",
+				name, int64(counter.Value())); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Msg("failed to save counters")
+	}
+}
+
+// audit records that the admin client at remoteAddr did action on subject, with detail
+// encoded as JSON. Failing to record it is logged, not returned: the change is made
+// already.
+func (s *stateStore) audit(action, subject, remoteAddr string, detail any) {
+	if s == nil {
+		return
+	}
+
+	data := []byte("null")
+	if detail != nil {
+		if encoded, err := json.Marshal(detail); err == nil {
+			data = encoded
+		}
+	}
+	_, err := s.db.Exec("INSERT INTO audit (time, action, subject, remote_addr, detail) VALUES (?, ?, ?, ?, ?)",
+		time.Now().UnixNano(), action, subject, remoteAddr, string(data))
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("action", action).
+			Str("subject", subject).
+			Msg("failed to record audit record")
+	}
+}
+
+// auditRecords returns the latest limit audit records, newest first.
+func (s *stateStore) auditRecords(limit int) ([]AuditRecord, error) {
+	rows, err := s.db.Query(
+		"SELECT id, time, action, subject, remote_addr, detail FROM audit ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load audit records: %w", err)
+	}
+	defer rows.Close()
+
+	records := []AuditRecord{}
+	for rows.Next() {
+		var (
+			r      AuditRecord
+			nanos  int64
+			detail string
+		)
+		if err := rows.Scan(&r.ID, &nanos, &r.Action, &r.Subject, &r.RemoteAddr, &detail); err != nil {
+			return nil, err
+		}
+		r.Time = time.Unix(0, nanos).UTC()
+		if detail != "null" {
+			r.Detail = json.RawMessage(detail)
+		}
+		records = append(records, r)
+	}
+
+	return records, rows.Err()
+}
+
+// webhookQueue returns the spool queue kept in the database.
+func (s *stateStore) webhookQueue() spoolQueue {
+	return stateQueue{db: s.db}
+}
+
+// stateQueue is a spoolQueue in the webhooks table of the state database.
+type stateQueue struct {
+	db *sql.DB
+}
+
+func (q stateQueue) put(data []byte) error {
+	_, err := q.db.Exec("INSERT INTO webhooks (data) VALUES (?)", data)
+	return err
+}
+
+func (q stateQueue) list() ([]spoolEntry, error) {
+	rows, err := q.db.Query("SELECT id, length(data) FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook spool: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []spoolEntry
+	for rows.Next() {
+		var (
+			id   int64
+			size int64
+		)
+		if err := rows.Scan(&id, &size); err != nil {
+			return nil, err
+		}
+		entries = append(entries, spoolEntry{id: fmt.Sprint(id), size: size})
+	}
+
+	return entries, rows.Err()
+}
+
+func (q stateQueue) get(id string) ([]byte, error) {
+	var data []byte
+	err := q.db.QueryRow("SELECT data FROM webhooks WHERE id = ?", id).Scan(&data)
+	return data, err
+}
+
+func (q stateQueue) remove(id string) error {
+	_, err := q.db.Exec("DELETE FROM webhooks WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// ErrStaticHostInvalid is returned for entries of HOSTS_FILE or hosts: that cannot be used.
+var ErrStaticHostInvalid = errors.New("static host is invalid")
+
+// staticHosts resolves target names from HOSTS_FILE and the hosts: section of the config
+// file, nil if there are none.
+var staticHosts *hostsTable
+
+// hostsTable resolves names to fixed addresses before MagicDNS or DNS are asked, so targets
+// referenced by friendly names keep working on tailnets without MagicDNS.
+type hostsTable struct {
+	addrs map[string][]netip.Addr // lowercase name, without trailing dot -> addresses
+}
+
+// newHostsTable returns the hostsTable of addrs, or nil if it is empty.
+func newHostsTable(addrs map[string][]netip.Addr) *hostsTable {
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	return &hostsTable{addrs: addrs}
+}
+
+// parseStaticHosts returns the static hosts of the hosts file at path, if any, overridden
+// by those of hosts, mapping names to comma-separated addresses.
+func parseStaticHosts(path string, hosts map[string]string) (map[string][]netip.Addr, error) {
+	addrs := make(map[string][]netip.Addr)
+	if path != "" {
+		if err := readHostsFile(path, addrs); err != nil {
+			return nil, err
+		}
+	}
+
+	// Sorted, for errors to be reported in a stable order
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := validateStaticName(name); err != nil {
+			return nil, err
+		}
+		var ips []netip.Addr
+		for _, s := range splitList(hosts[name]) {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %w", ErrStaticHostInvalid, name, err)
+			}
+			ips = append(ips, ip.Unmap())
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("%w: %s: an address is required", ErrStaticHostInvalid, name)
+		}
+		addrs[normalizeStaticName(name)] = ips
+	}
+
+	return addrs, nil
+}
+
+// readHostsFile adds the entries of the hosts file at path, in the /etc/hosts format, to
+// addrs: an address then its names on each line, # starting comments.
+func readHostsFile(path string, addrs map[string][]netip.Addr) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return fmt.Errorf("%w: %s:%d: %w", ErrStaticHostInvalid, path, line, err)
+		}
+		if len(fields) == 1 {
+			return fmt.Errorf("%w: %s:%d: a name is required after the address", ErrStaticHostInvalid, path, line)
+		}
+		for _, name := range fields[1:] {
+			if err := validateStaticName(name); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			name = normalizeStaticName(name)
+			addrs[name] = append(addrs[name], ip.Unmap())
+		}
+	}
+
+	return scanner.Err()
+}
+
+func validateStaticName(name string) error {
+	if name == "" || strings.ContainsAny(name, ":/*[] ") {
+		return fmt.Errorf("%w: '%s' is not a host name", ErrStaticHostInvalid, name)
+	}
+	if _, err := netip.ParseAddr(name); err == nil {
+		return fmt.Errorf("%w: '%s' is an address, not a name", ErrStaticHostInvalid, name)
+	}
+
+	return nil
+}
+
+func normalizeStaticName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// lookup returns the static addresses of name.
+func (h *hostsTable) lookup(name string) ([]netip.Addr, bool) {
+	if h == nil {
+		return nil, false
+	}
+
+	ips, ok := h.addrs[normalizeStaticName(name)]
+	return ips, ok
+}
+
+// wrap returns next dialing the static addresses of the names in the table, in the
+// preferred address family first, until one answers. Other names are left to next.
+func (h *hostsTable) wrap(next dialFunc) dialFunc {
+	if h == nil {
+		return next
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return next(ctx, network, addr)
+		}
+		ips, ok := h.lookup(host)
+		if !ok {
+			return next(ctx, network, addr)
+		}
+		if ipFamilies != nil {
+			if ips = ipFamilies.order(ips); len(ips) == 0 {
+				return nil, fmt.Errorf("%w (%s): %s", ErrIPFamily, ipFamilies.family, addr)
+			}
+		}
+
+		var firstErr error
+		for _, ip := range ips {
+			conn, err := next(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		return nil, firstErr
+	}
+}
+
+// log logs the names the table resolves.
+func (h *hostsTable) log() {
+	if h == nil {
+		return
+	}
+
+	names := make([]string, 0, len(h.addrs))
+	for name := range h.addrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	logger.Stdout.Info().
+		Strs("names", names).
+		Msg("resolving target names from static hosts")
+}
+
+// targetDialer returns dial expanding target templates, resolving names from the static
+// hosts first, then dialing in the preferred address family. Targets are dialed through it.
+func targetDialer(dial dialFunc) dialFunc {
+	return expandTargets(staticHosts.wrap(ipFamilies.wrap(dial)))
+}
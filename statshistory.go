@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsInterval is how often the stats history is sampled.
+const statsInterval = time.Second
+
+// ErrStatsHistoryDisabled is returned when the stats history is asked for without one.
+var ErrStatsHistoryDisabled = errors.New("the stats history is disabled, set STATS_HISTORY")
+
+// statsHistory is the recent traffic, nil if STATS_HISTORY is 0, set in main.
+var statsHistory *statsRing
+
+// StatsSample is the traffic of one second.
+type StatsSample struct {
+	Time              time.Time `json:"time"`
+	BytesIn           uint64    `json:"bytes_in"`           // from clients, during the second
+	BytesOut          uint64    `json:"bytes_out"`          // back to them, during the second
+	Opened            uint64    `json:"opened"`             // connections and requests opened during the second
+	ActiveConnections int       `json:"active_connections"` // at the end of the second
+}
+
+// StatsHistory is the recent traffic, second by second, oldest first, as served by the
+// admin API.
+type StatsHistory struct {
+	Interval string        `json:"interval"`
+	Samples  []StatsSample `json:"samples"`
+}
+
+// statsRing keeps the last samples of the traffic in a ring buffer, so the dashboard and
+// `railtail top` can show how it went without a Prometheus server.
+type statsRing struct {
+	mu      sync.Mutex
+	samples []StatsSample
+	next    int  // where the next sample goes
+	full    bool // every slot holds a sample
+
+	// Totals at the last sample, the next one being the difference
+	bytesIn, bytesOut, opened uint64
+}
+
+// newStatsRing returns a ring keeping the samples of the last window, or nil if window
+// is 0.
+func newStatsRing(window time.Duration) *statsRing {
+	if window <= 0 {
+		return nil
+	}
+
+	return &statsRing{
+		samples:  make([]StatsSample, max(1, int(window/statsInterval))),
+		bytesIn:  bytesInTotal.Value(),
+		bytesOut: bytesOutTotal.Value(),
+		opened:   conns.nextID.Load(),
+	}
+}
+
+// run takes a sample every statsInterval until ctx is done.
+func (r *statsRing) run(ctx context.Context) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.sample(now)
+		}
+	}
+}
+
+// sample records the traffic since the last sample, at now.
+func (r *statsRing) sample(now time.Time) {
+	bytesIn, bytesOut, opened := bytesInTotal.Value(), bytesOutTotal.Value(), conns.nextID.Load()
+	active := conns.Len()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.samples[r.next] = StatsSample{
+		Time:              now.Truncate(time.Second).UTC(),
+		BytesIn:           bytesIn - r.bytesIn,
+		BytesOut:          bytesOut - r.bytesOut,
+		Opened:            opened - r.opened,
+		ActiveConnections: active,
+	}
+	r.bytesIn, r.bytesOut, r.opened = bytesIn, bytesOut, opened
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// History returns the samples taken since since, oldest first.
+func (r *statsRing) History(since time.Time) StatsHistory {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ordered := r.samples[:r.next]
+	if r.full {
+		ordered = append(append([]StatsSample(nil), r.samples[r.next:]...), r.samples[:r.next]...)
+	}
+	history := StatsHistory{Interval: statsInterval.String(), Samples: []StatsSample{}}
+	for _, s := range ordered {
+		if !s.Time.Before(since) {
+			history.Samples = append(history.Samples, s)
+		}
+	}
+
+	return history
+}
+
+// sparkBlocks draw sparklines, from lowest to highest.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws values as a line of blocks scaled to their maximum, like ▁▂▅█▃.
+func sparkline(values []float64) string {
+	peak := 0.0
+	for _, v := range values {
+		peak = max(peak, v)
+	}
+
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if peak > 0 {
+			i = min(int(v/peak*float64(len(sparkBlocks))), len(sparkBlocks)-1)
+		}
+		b.WriteRune(sparkBlocks[i])
+	}
+
+	return b.String()
+}
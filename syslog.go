@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// syslogMaxMessage bounds the size of a syslog message; clients sending bigger ones are
+// disconnected.
+const syslogMaxMessage = 64 << 10
+
+// Backoff between attempts to deliver messages to an unreachable target.
+const (
+	syslogMinBackoff = 500 * time.Millisecond
+	syslogMaxBackoff = 30 * time.Second
+)
+
+// syslogSettings configures the forwarding of TCP_PROTOCOL=syslog.
+type syslogSettings struct {
+	batchSize     int    // messages written to the target at once
+	queueSize     int    // messages held in memory while they cannot be delivered
+	spoolDir      string // where messages overflowing the queue are written; empty drops them
+	spoolMaxBytes int64  // size bound of each spool file
+}
+
+// syslogForwarder receives syslog messages from any number of client connections and
+// delivers them to a target of pool over a single connection, in batches. Messages are
+// only removed from the queue (or the spool) once written to the target, and written
+// again after a failure, so they are delivered at least once.
+type syslogForwarder struct {
+	dialer   Dialer
+	pool     *targetPool
+	settings syslogSettings
+	name     string       // listener name, for logs and metrics
+	spool    *syslogSpool // nil without SYSLOG_SPOOL_DIR
+
+	mu    sync.Mutex
+	queue [][]byte // frames, as received from the clients
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	forwarded, spooled, dropped *metrics.Counter
+	queued                      *metrics.Gauge
+}
+
+// newSyslogForwarder starts a syslogForwarder delivering messages to pool. name tells the
+// listener apart in logs and metrics, and names its spool file.
+func newSyslogForwarder(dialer Dialer, pool *targetPool, settings syslogSettings, name string) (*syslogForwarder, error) {
+	f := &syslogForwarder{
+		dialer:   dialer,
+		pool:     pool,
+		settings: settings,
+		name:     name,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+
+		forwarded: metrics.Default.Counter("railtail_syslog_messages_total",
+			"Syslog messages, by outcome.", "listener", name, "result", "forwarded"),
+		spooled: metrics.Default.Counter("railtail_syslog_messages_total",
+			"Syslog messages, by outcome.", "listener", name, "result", "spooled"),
+		dropped: metrics.Default.Counter("railtail_syslog_messages_total",
+			"Syslog messages, by outcome.", "listener", name, "result", "dropped"),
+		queued: metrics.Default.Gauge("railtail_syslog_queue_length",
+			"Syslog messages waiting in memory to be delivered.", "listener", name),
+	}
+
+	if settings.spoolDir != "" {
+		spool, err := openSyslogSpool(filepath.Join(settings.spoolDir, "syslog-"+name+".spool"), settings.spoolMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		f.spool = spool
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	go f.run(ctx)
+
+	return f, nil
+}
+
+// serveSyslog accepts connections on listener and hands their messages to f until the
+// listener is closed.
+func serveSyslog(listener net.Listener, f *syslogForwarder) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("failed to accept connection")
+			continue
+		}
+
+		go f.receive(conn)
+	}
+}
+
+// receive reads messages from a client connection until it is closed.
+func (f *syslogForwarder) receive(conn net.Conn) {
+	defer conn.Close()
+
+	tracked := conns.open(connKindTCP, conn.LocalAddr(), conn.RemoteAddr().String(), "syslog:"+f.name)
+	defer tracked.close()
+
+	r := bufio.NewReaderSize(conn, syslogMaxMessage)
+	for {
+		frame, err := readSyslogFrame(r)
+		if len(frame) > 0 {
+			tracked.countIn(len(frame))
+			f.enqueue(frame)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			tracked.setCloseReason(CloseClientEOF)
+			return
+		}
+		if err != nil {
+			tracked.setCloseCause(CloseClientError, err)
+			logger.Stderr.Warn().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("remote-addr", conn.RemoteAddr().String()).
+				Msg("closing syslog connection")
+			return
+		}
+	}
+}
+
+// readSyslogFrame reads a message framed with octet counting ("<length> <message>") or
+// terminated by a newline, as described by RFC 6587, and returns it with its framing.
+// A last message missing its newline gets one.
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] >= '1' && first[0] <= '9' {
+		header, err := r.ReadSlice(' ')
+		if err != nil {
+			return nil, fmt.Errorf("malformed octet count: %w", err)
+		}
+		length, err := strconv.Atoi(string(header[:len(header)-1]))
+		if err != nil || length > syslogMaxMessage {
+			return nil, fmt.Errorf("invalid octet count %q", header)
+		}
+
+		frame := make([]byte, len(header)+length)
+		copy(frame, header)
+		if _, err := io.ReadFull(r, frame[len(header):]); err != nil {
+			return nil, fmt.Errorf("truncated message: %w", err)
+		}
+		return frame, nil
+	}
+
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, errors.New("message too long")
+	}
+	if len(line) == 0 {
+		return nil, err
+	}
+
+	frame := append([]byte(nil), line...)
+	if frame[len(frame)-1] != '\n' {
+		frame = append(frame, '\n')
+	}
+	return frame, err
+}
+
+// enqueue queues a message for delivery, spilling to the spool once the queue is full.
+func (f *syslogForwarder) enqueue(frame []byte) {
+	f.mu.Lock()
+	switch {
+	case len(f.queue) < f.settings.queueSize:
+		f.queue = append(f.queue, frame)
+		f.queued.Set(int64(len(f.queue)))
+	case f.spool != nil && f.spool.append(frame):
+		f.spooled.Inc()
+	default:
+		f.dropped.Inc()
+	}
+	f.mu.Unlock()
+
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next batch of messages to deliver: from the queue first, then from
+// the spool. fromSpool is the spool offset to commit once the batch is delivered, or -1
+// for a batch from the queue.
+func (f *syslogForwarder) next() (batch [][]byte, fromSpool int64, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.queue) > 0 {
+		n := min(len(f.queue), f.settings.batchSize)
+		return f.queue[:n:n], -1, nil
+	}
+	if f.spool != nil {
+		return f.spool.read(f.settings.batchSize)
+	}
+
+	return nil, -1, nil
+}
+
+// commit removes a delivered batch from the queue or the spool.
+func (f *syslogForwarder) commit(batch [][]byte, fromSpool int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if fromSpool >= 0 {
+		f.spool.commit(fromSpool)
+	} else {
+		f.queue = f.queue[len(batch):]
+		f.queued.Set(int64(len(f.queue)))
+	}
+	f.forwarded.Add(uint64(len(batch)))
+}
+
+// run delivers queued messages until ctx is cancelled.
+func (f *syslogForwarder) run(ctx context.Context) {
+	defer close(f.done)
+
+	var (
+		conn    net.Conn
+		backoff = syslogMinBackoff
+		failing bool
+	)
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	for {
+		batch, fromSpool, err := f.next()
+		if err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("listener", f.name).
+				Msg("failed to read syslog spool")
+		}
+		if len(batch) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-f.wake:
+			}
+			continue
+		}
+
+		if conn != nil && !syslogConnAlive(conn) {
+			_ = conn.Close()
+			conn = nil
+		}
+		if conn == nil {
+			conn, err = f.dial(ctx)
+		}
+		if conn != nil {
+			err = writeSyslogBatch(conn, batch)
+		}
+
+		if err != nil {
+			if !failing {
+				logger.Stderr.Warn().
+					Str(logger.ErrAttr(err), logger.ErrValue(err)).
+					Str("listener", f.name).
+					Msg("failed to deliver syslog messages, retrying")
+			}
+			failing = true
+			if conn != nil {
+				_ = conn.Close()
+				conn = nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, syslogMaxBackoff)
+			continue
+		}
+
+		if failing {
+			logger.Stdout.Info().Str("listener", f.name).Msg("delivering syslog messages again")
+		}
+		failing, backoff = false, syslogMinBackoff
+		f.commit(batch, fromSpool)
+	}
+}
+
+// dial connects to a target of the pool.
+func (f *syslogForwarder) dial(ctx context.Context) (net.Conn, error) {
+	target := f.pool.pickTCP(f.name)
+
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := targetDialer(f.dialer.Dial)(dialCtx, "tcp", target.addr)
+	target.observe(time.Since(start), err != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// writeSyslogBatch writes the frames of a batch to conn at once.
+func writeSyslogBatch(conn net.Conn, batch [][]byte) error {
+	var buf []byte
+	for _, frame := range batch {
+		buf = append(buf, frame...)
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := conn.Write(buf)
+
+	return err
+}
+
+// syslogConnAlive reports whether the target kept conn open. Syslog receivers never send
+// anything, so anything but a read timeout means the connection is gone; writing to it
+// would lose the batch.
+func syslogConnAlive(conn net.Conn) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+
+	var b [1]byte
+	_, err := conn.Read(b[:])
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// stop stops delivering messages, keeping those not yet delivered in the spool if there
+// is one.
+func (f *syslogForwarder) stop() {
+	f.cancel()
+	<-f.done
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lost := 0
+	for _, frame := range f.queue {
+		if f.spool != nil && f.spool.append(frame) {
+			f.spooled.Inc()
+		} else {
+			lost++
+		}
+	}
+	f.queue = nil
+	f.queued.Set(0)
+
+	if f.spool != nil {
+		_ = f.spool.close()
+	}
+	if lost > 0 {
+		f.dropped.Add(uint64(lost))
+		logger.Stderr.Warn().Str("listener", f.name).Int("messages", lost).Msg("undelivered syslog messages dropped")
+	}
+}
+
+// syslogSpool is an append-only file of length-prefixed frames, delivered in order. It
+// is emptied once everything in it has been delivered. Frames left in it when railtail
+// stops are delivered on the next start.
+type syslogSpool struct {
+	file     *os.File
+	maxBytes int64
+	size     int64 // end of the written frames
+	offset   int64 // start of the frames not yet delivered
+}
+
+func openSyslogSpool(path string, maxBytes int64) (*syslogSpool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create syslog spool dir: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open syslog spool: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to open syslog spool: %w", err)
+	}
+
+	return &syslogSpool{file: file, maxBytes: maxBytes, size: info.Size()}, nil
+}
+
+// append writes a frame to the spool, or returns false if it is full or cannot be
+// written.
+func (s *syslogSpool) append(frame []byte) bool {
+	if s.size+4+int64(len(frame)) > s.maxBytes {
+		return false
+	}
+
+	record := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(frame)), uint32(len(frame)))
+	record = append(record, frame...)
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		return false
+	}
+	s.size += int64(len(record))
+
+	return true
+}
+
+// read returns up to n frames not yet delivered, and the offset following them. A frame
+// that cannot be read (e.g. cut short by a crash) is discarded, along with the rest of
+// the spool.
+func (s *syslogSpool) read(n int) ([][]byte, int64, error) {
+	var (
+		frames [][]byte
+		offset = s.offset
+		length [4]byte
+	)
+	for len(frames) < n && offset < s.size {
+		frame, err := s.readFrame(offset, length[:])
+		if err != nil {
+			s.size = offset
+			return frames, offset, fmt.Errorf("discarding the spool from offset %d: %w", offset, err)
+		}
+		frames = append(frames, frame)
+		offset += 4 + int64(len(frame))
+	}
+
+	return frames, offset, nil
+}
+
+func (s *syslogSpool) readFrame(offset int64, length []byte) ([]byte, error) {
+	if _, err := s.file.ReadAt(length, offset); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length)
+	if n > syslogMaxMessage+16 {
+		return nil, errors.New("corrupt frame length")
+	}
+
+	frame := make([]byte, n)
+	if _, err := s.file.ReadAt(frame, offset+4); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// commit marks the frames before offset as delivered.
+func (s *syslogSpool) commit(offset int64) {
+	s.offset = offset
+	if s.offset == s.size && s.file.Truncate(0) == nil {
+		s.offset, s.size = 0, 0
+	}
+}
+
+func (s *syslogSpool) close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+	"tailscale.com/tsnet"
+)
+
+// taildropPollInterval is how long each wait for incoming Taildrop files lasts, and how
+// long to back off after a failure.
+const taildropPollInterval = time.Minute
+
+// taildropReceiver moves files sent to the node with Taildrop into dir, or POSTs them to
+// forwardURL.
+type taildropReceiver struct {
+	ts         *tsnet.Server
+	dir        string
+	forwardURL string
+}
+
+// run receives files until ctx is cancelled. It is meant to be started in its own goroutine.
+func (r *taildropReceiver) run(ctx context.Context) {
+	logger.Stdout.Info().
+		Str("taildrop-dir", r.dir).
+		Str("taildrop-forward-url", r.forwardURL).
+		Msg("receiving taildrop files")
+
+	for ctx.Err() == nil {
+		if err := r.receive(ctx); err != nil && ctx.Err() == nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("failed to receive taildrop files")
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(taildropPollInterval):
+			}
+		}
+	}
+}
+
+// receive waits for files to arrive, then delivers and deletes each of them.
+func (r *taildropReceiver) receive(ctx context.Context) error {
+	lc, err := localClient(r.ts)
+	if err != nil {
+		return err
+	}
+
+	files, err := lc.AwaitWaitingFiles(ctx, taildropPollInterval)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		rc, size, err := lc.GetWaitingFile(ctx, f.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		err = r.deliver(ctx, f.Name, rc, size)
+		_ = rc.Close()
+
+		result := "delivered"
+		if err != nil {
+			// The file is kept waiting, and retried with the next batch
+			result = "failed"
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("file", f.Name).
+				Int64("size", size).
+				Msg("failed to deliver taildrop file")
+		} else {
+			if err := lc.DeleteWaitingFile(ctx, f.Name); err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+			logger.Stdout.Info().
+				Str("file", f.Name).
+				Int64("size", size).
+				Msg("received taildrop file")
+		}
+		metrics.Default.Counter("railtail_taildrop_files_total",
+			"Files received with Taildrop.", "result", result).Inc()
+	}
+
+	return nil
+}
+
+// deliver stores or forwards a received file.
+func (r *taildropReceiver) deliver(ctx context.Context, name string, body io.Reader, size int64) error {
+	if r.forwardURL != "" {
+		return r.forward(ctx, name, body, size)
+	}
+
+	return r.store(name, body)
+}
+
+// store writes the file into dir, renaming it into place once complete. Existing files
+// are never overwritten: the name gets a numeric suffix instead.
+func (r *taildropReceiver) store(name string, body io.Reader) error {
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(r.dir, ".taildrop-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(filepath.Base(name), ext)
+	for i := 0; ; i++ {
+		path := filepath.Join(r.dir, base+ext)
+		if i > 0 {
+			path = filepath.Join(r.dir, base+" ("+strconv.Itoa(i)+")"+ext)
+		}
+		// Link fails if path exists, unlike rename
+		err := os.Link(tmp.Name(), path)
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+}
+
+// forward POSTs the file to forwardURL, naming it in Content-Disposition.
+func (r *taildropReceiver) forward(ctx context.Context, name string, body io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.forwardURL, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(name)}))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("taildrop forward failed: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/tsnet"
+	"tailscale.com/types/key"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// tailnetCounters maps the engine counters of the tsnet user metrics, labelled by path
+// (derp, direct_ipv4 or direct_ipv6), to the railtail metrics they feed.
+var tailnetCounters = map[string]struct{ name, help, direction string }{
+	"tailscaled_inbound_bytes_total": {"railtail_tailnet_bytes_total",
+		"Bytes received from and sent to tailnet peers, by direction and path (derp or direct).", "in"},
+	"tailscaled_outbound_bytes_total": {"railtail_tailnet_bytes_total",
+		"Bytes received from and sent to tailnet peers, by direction and path (derp or direct).", "out"},
+	"tailscaled_inbound_packets_total": {"railtail_tailnet_packets_total",
+		"Packets received from and sent to tailnet peers, by direction and path (derp or direct).", "in"},
+	"tailscaled_outbound_packets_total": {"railtail_tailnet_packets_total",
+		"Packets received from and sent to tailnet peers, by direction and path (derp or direct).", "out"},
+}
+
+// tailnetStats exposes statistics of the Tailscale engine as railtail metrics: traffic by
+// path, to quantify how much of it is relayed, the peers being talked to, and WireGuard
+// handshakes.
+type tailnetStats struct {
+	ts *tsnet.Server
+
+	counters   map[string]uint64        // last value of each engine counter series
+	handshakes map[key.NodePublic]int64 // last handshake of each peer, in Unix nanoseconds
+	failing    bool
+}
+
+func newTailnetStats(ts *tsnet.Server) *tailnetStats {
+	return &tailnetStats{
+		ts:         ts,
+		counters:   make(map[string]uint64),
+		handshakes: make(map[key.NodePublic]int64),
+	}
+}
+
+// run collects the statistics every interval until ctx is done.
+func (s *tailnetStats) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := s.collect(ctx)
+		if err != nil && !s.failing && ctx.Err() == nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("failed to collect tailnet metrics")
+		}
+		s.failing = err != nil
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect reads the engine counters and the peer status once.
+func (s *tailnetStats) collect(ctx context.Context) error {
+	lc, err := localClient(s.ts)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	text, err := lc.UserMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	s.collectCounters(text)
+
+	status, err := lc.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	var direct, relayed int64
+	for id, peer := range status.Peer {
+		if peer.Active {
+			if peer.CurAddr != "" {
+				direct++
+			} else if peer.Relay != "" {
+				relayed++
+			}
+		}
+
+		handshake := peer.LastHandshake.UnixNano()
+		if last, ok := s.handshakes[id]; ok && handshake > last {
+			metrics.Default.Counter("railtail_tailnet_handshakes_total",
+				"WireGuard handshakes completed with tailnet peers.").Inc()
+		}
+		if !peer.LastHandshake.IsZero() {
+			s.handshakes[id] = handshake
+		}
+	}
+	metrics.Default.Gauge("railtail_tailnet_active_peers",
+		"Tailnet peers exchanged packets with in the last two minutes, by path.", "path", "direct").Set(direct)
+	metrics.Default.Gauge("railtail_tailnet_active_peers",
+		"Tailnet peers exchanged packets with in the last two minutes, by path.", "path", "derp").Set(relayed)
+	metrics.Default.Gauge("railtail_tailnet_peers",
+		"Peers in the tailnet's network map.").Set(int64(len(status.Peer)))
+
+	return nil
+}
+
+// collectCounters adds what the engine counters in text, in the Prometheus text format,
+// grew by since the last collection to the railtail metrics.
+func (s *tailnetStats) collectCounters(text []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		series, value, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		name, labels, _ := strings.Cut(series, "{")
+		target, ok := tailnetCounters[name]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			continue
+		}
+		_, path, _ := strings.Cut(labels, `path="`)
+		path, _, _ = strings.Cut(path, `"`)
+
+		current := uint64(n)
+		delta := current
+		if last, ok := s.counters[series]; ok && current >= last {
+			delta = current - last
+		}
+		s.counters[series] = current
+
+		metrics.Default.Counter(target.name, target.help,
+			"direction", target.direction, "path", path).Add(delta)
+	}
+}
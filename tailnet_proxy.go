@@ -1,23 +1,132 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
 )
 
+// ErrProxyHostsInvalid is returned for host mappings that cannot be parsed.
+var ErrProxyHostsInvalid = errors.New("tailnet proxy host mapping is invalid")
+
+// ErrOpenProxy is returned when the Tailnet Proxy would forward anyone's requests to
+// any host on the tailnet.
+var ErrOpenProxy = errors.New("tailnet proxy is open")
+
+// proxyIsOpen reports whether a Tailnet Proxy would be open without ALLOW_OPEN_PROXY
+// allowing it.
+func proxyIsOpen(cfg *Config) bool {
+	return !cfg.AllowOpenProxy && len(cfg.ProxyAllowedHosts) == 0 && cfg.TailnetProxyAuthToken == ""
+}
+
+// validateProxyAccess checks that the Tailnet Proxy restricts who it serves or where it
+// forwards to, unless ALLOW_OPEN_PROXY says otherwise.
+func validateProxyAccess(cfg *Config) []error {
+	var errors_ []error
+
+	// Compiled like the hosts of routes; an empty pattern would allow any host
+	cfg.ProxyAllowedHosts = nil
+	for _, pattern := range cfg.TailnetProxyAllowedHosts {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		hp, err := compileHostPattern(pattern)
+		if err != nil {
+			errors_ = append(errors_, fmt.Errorf("TAILNET_PROXY_ALLOWED_HOSTS: %w", err))
+			continue
+		}
+		cfg.ProxyAllowedHosts = append(cfg.ProxyAllowedHosts, hp)
+	}
+
+	serves := cfg.ProxyMode
+	for _, t := range cfg.Tunnels {
+		serves = serves || t.mode() == TunnelModeProxy
+	}
+	if serves && proxyIsOpen(cfg) {
+		errors_ = append(errors_, fmt.Errorf("%w: set TAILNET_PROXY_ALLOWED_HOSTS or TAILNET_PROXY_AUTH_TOKEN, "+
+			"or ALLOW_OPEN_PROXY=true if the listener is not reachable from the internet", ErrOpenProxy))
+	}
+
+	return errors_
+}
+
+// proxyHost is where the Tailnet Proxy sends requests for a mapped host.
+type proxyHost struct {
+	scheme string // http:// or https://; empty keeps the scheme of the request
+	addr   string // host:port on the tailnet
+}
+
+// parseProxyHosts parses host mappings of the form
+//
+//	host=tailnet-host:port,host=https://tailnet-host:port
+//
+// Hosts are matched without their port, case-insensitively.
+func parseProxyHosts(spec string) (map[string]proxyHost, error) {
+	hosts := make(map[string]proxyHost)
+
+	for _, entry := range splitList(spec) {
+		host, target, ok := strings.Cut(entry, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || host == "" {
+			return nil, fmt.Errorf("%w: '%s': expected host=host:port", ErrProxyHostsInvalid, entry)
+		}
+
+		var mapped proxyHost
+		target = strings.TrimSpace(target)
+		for _, scheme := range []string{"http://", "https://"} {
+			if rest, ok := strings.CutPrefix(strings.ToLower(target), scheme); ok {
+				mapped.scheme, target = scheme, rest
+			}
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrProxyHostsInvalid, host, err)
+		}
+		mapped.addr = target
+
+		hosts[host] = mapped
+	}
+
+	return hosts, nil
+}
+
+// otherDestination labels destinations beyond the cardinality limit.
+const otherDestination = "other"
+
+// proxyOptions configures a TailnetProxy.
+type proxyOptions struct {
+	hosts           map[string]proxyHost // requests for these hosts go to another host:port
+	searchDomain    string               // appended to short names, e.g. tailnet-name.ts.net
+	logSample       int                  // log one in logSample requests per destination
+	quiet           bool                 // only log failed requests
+	maxDestinations int                  // destinations tracked individually, the rest share "other"
+	allowedHosts    []hostPattern        // destination hosts; empty allows any
+	authToken       string               // required as Proxy-Authorization, if set
+}
+
 // TailnetProxy is a general proxy for the tailnet that forwards requests to their
 // tailscale destinations directly without requiring a specific target address.
 type TailnetProxy struct {
 	httpClient         *http.Client
 	insecureSkipVerify bool
+	opts               proxyOptions
+	destinations       *destinationStats
 }
 
 // NewTailnetProxy creates a new TailnetProxy with the given HTTP client
-func NewTailnetProxy(httpClient *http.Client, insecureSkipVerify bool) *TailnetProxy {
+func NewTailnetProxy(httpClient *http.Client, insecureSkipVerify bool, opts proxyOptions) *TailnetProxy {
 	return &TailnetProxy{
 		httpClient:         httpClient,
 		insecureSkipVerify: insecureSkipVerify,
+		opts:               opts,
+		destinations:       &destinationStats{max: opts.maxDestinations, counts: make(map[string]uint64)},
 	}
 }
 
@@ -32,8 +141,6 @@ func (p *TailnetProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		scheme = "https://"
 	}
 
-	// Construct the target URL
-	targetURL := scheme + targetHost
 	if targetHost == "" {
 		http.Error(w, "No Host header provided", http.StatusBadRequest)
 		logger.StderrWithSource.Error().
@@ -42,17 +149,59 @@ func (p *TailnetProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Log the forwarding
-	logger.Stdout.Info().
-		Str("remote-addr", r.RemoteAddr).
-		Str("host", targetHost).
-		Str("target-url", targetURL).
-		Str("method", r.Method).
-		Str("path", r.URL.Path).
-		Msg("tailnet proxy forwarding")
+	if p.opts.authToken != "" && !p.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="railtail"`)
+		http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		logger.Stderr.Warn().
+			Str("remote-addr", r.RemoteAddr).
+			Str("host", targetHost).
+			Msg("unauthenticated tailnet proxy request")
+		return
+	}
+
+	// Mapped hosts go to their own host and port, which clients may not be able to
+	// express in the Host header. They are allowed by definition.
+	if mapped, ok := p.opts.hosts[strings.ToLower(hostOnly(targetHost))]; ok {
+		targetHost = mapped.addr
+		if mapped.scheme != "" {
+			scheme = mapped.scheme
+		}
+	} else {
+		targetHost = expandShortName(targetHost, p.opts.searchDomain)
+
+		if !p.allowed(hostOnly(targetHost)) {
+			http.Error(w, "Destination not allowed", http.StatusForbidden)
+			logger.Stderr.Warn().
+				Str("remote-addr", r.RemoteAddr).
+				Str("host", targetHost).
+				Msg("tailnet proxy destination not allowed")
+			return
+		}
+	}
+
+	// Construct the target URL
+	targetURL := scheme + targetHost
+
+	// Count per destination, and log a sample of the forwarding
+	destination, n := p.destinations.observe(strings.ToLower(targetHost))
+	metrics.Default.Counter("railtail_tailnet_proxy_requests_total",
+		"Requests forwarded by the Tailnet Proxy, by destination.", "destination", destination).Inc()
+
+	if !p.opts.quiet && (n-1)%uint64(p.opts.logSample) == 0 {
+		logger.Stdout.Info().
+			Str("remote-addr", r.RemoteAddr).
+			Str("host", targetHost).
+			Str("target-url", targetURL).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Uint64("destination-requests", n).
+			Msg("tailnet proxy forwarding")
+	}
 
 	// Use the HTTP forwarding function to forward the request
 	if err := fwdHttp(p.httpClient, targetURL, w, r); err != nil {
+		metrics.Default.Counter("railtail_tailnet_proxy_errors_total",
+			"Requests the Tailnet Proxy failed to forward, by destination.", "destination", destination).Inc()
 		logger.StderrWithSource.Error().
 			Str(logger.ErrAttr(err), logger.ErrValue(err)).
 			Str("remote-addr", r.RemoteAddr).
@@ -61,5 +210,68 @@ func (p *TailnetProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Str("method", r.Method).
 			Str("path", r.URL.Path).
 			Msg("failed to forward request")
+		return
+	}
+	sizeMetrics.observe(sizeRouteTailnetProxy, destination, r)
+}
+
+// authorized reports whether r carries the auth token in its Proxy-Authorization header,
+// as a bearer token or as the password of basic auth (e.g. http://railtail:<token>@host
+// in HTTP_PROXY).
+func (p *TailnetProxy) authorized(r *http.Request) bool {
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+
+	var token string
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		token = credentials
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return false
+		}
+		_, token, _ = strings.Cut(string(decoded), ":")
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(p.opts.authToken)) == 1
+}
+
+// allowed reports whether requests may be forwarded to host.
+func (p *TailnetProxy) allowed(host string) bool {
+	if len(p.opts.allowedHosts) == 0 {
+		return true
+	}
+
+	for _, pattern := range p.opts.allowedHosts {
+		if pattern.match(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// destinationStats counts requests per destination. Past max distinct destinations, new
+// ones are counted together as "other", bounding memory and metric cardinality.
+type destinationStats struct {
+	max int
+
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+// observe counts a request to destination and returns the label it is counted under,
+// and the number of requests counted under it so far.
+func (s *destinationStats) observe(destination string) (string, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.counts[destination]; !ok && len(s.counts) >= s.max {
+		destination = otherDestination
 	}
+	s.counts[destination]++
+
+	return destination, s.counts[destination]
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// mustCompileHostPattern compiles pattern, failing the test if it does not compile.
+func mustCompileHostPattern(t *testing.T, pattern string) hostPattern {
+	t.Helper()
+
+	hp, err := compileHostPattern(pattern)
+	if err != nil {
+		t.Fatalf("failed to compile %q: %v", pattern, err)
+	}
+
+	return hp
+}
+
+func TestValidateProxyAccessAllowedHosts(t *testing.T) {
+	cfg := &Config{
+		ProxyMode:                true,
+		TailnetProxyAllowedHosts: []string{"grafana.tailnet.ts.net", "", "*.internal.example", "~db-\\d+", "100.64.0.0/10"},
+	}
+	if errs := validateProxyAccess(cfg); len(errs) > 0 {
+		t.Fatalf("validateProxyAccess = %v, want no errors", errs)
+	}
+	if len(cfg.ProxyAllowedHosts) != 4 {
+		t.Fatalf("compiled %d patterns, want 4 (empty ones skipped)", len(cfg.ProxyAllowedHosts))
+	}
+
+	proxy := NewTailnetProxy(nil, false, cfg.ProxyOptions())
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"grafana.tailnet.ts.net", true},
+		{"GRAFANA.tailnet.ts.net.", true},
+		{"api.internal.example", true},
+		{"internal.example", false},
+		{"db-12", true},
+		{"db-x", false},
+		{"100.100.1.1", true},
+		{"10.0.0.1", false},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		if got := proxy.allowed(tt.host); got != tt.allowed {
+			t.Errorf("allowed(%q) = %v, want %v", tt.host, got, tt.allowed)
+		}
+	}
+}
+
+func TestValidateProxyAccessInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"10.0.0.0/33", "*.a.*.b", "~(", "host:8080"} {
+		cfg := &Config{ProxyMode: true, TailnetProxyAllowedHosts: []string{pattern}}
+		errs := validateProxyAccess(cfg)
+		if len(errs) == 0 || !errors.Is(errs[0], ErrHostPattern) {
+			t.Errorf("validateProxyAccess(%q) = %v, want %v", pattern, errs, ErrHostPattern)
+		}
+	}
+}
+
+func TestValidateProxyAccessOpen(t *testing.T) {
+	// Only empty patterns restrict nothing
+	cfg := &Config{ProxyMode: true, TailnetProxyAllowedHosts: []string{"", " "}}
+	errs := validateProxyAccess(cfg)
+	if len(errs) != 1 || !errors.Is(errs[0], ErrOpenProxy) {
+		t.Errorf("validateProxyAccess = %v, want %v", errs, ErrOpenProxy)
+	}
+}
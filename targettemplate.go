@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// ErrTargetTemplate is returned for targets whose template cannot be expanded.
+var ErrTargetTemplate = errors.New("target template is invalid")
+
+// ErrTargetNotAllowed is returned when TARGET_HEADER names a target TARGET_HEADER_ALLOWED
+// does not list.
+var ErrTargetNotAllowed = errors.New("target is not allowed")
+
+// targetTemplatePattern matches the placeholders of target templates: {{ env "NAME" }},
+// or {{ env "NAME" "default" }}.
+var targetTemplatePattern = regexp.MustCompile(`\{\{\s*env\s+"([^"]+)"(?:\s+"([^"]*)")?\s*\}\}`)
+
+// targetEnv holds the variables of TARGET_ENV_FILE, which take precedence over the
+// environment in target templates.
+var targetEnv = &envOverlay{}
+
+// envOverlay is a set of variables replaced as a whole when TARGET_ENV_FILE is reloaded.
+type envOverlay struct {
+	mu   sync.RWMutex
+	vars map[string]string
+}
+
+// set replaces the variables of the overlay.
+func (e *envOverlay) set(vars map[string]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.vars = vars
+}
+
+// lookup returns the value of the variable name, from the overlay first, then the
+// environment.
+func (e *envOverlay) lookup(name string) (string, bool) {
+	e.mu.RLock()
+	value, ok := e.vars[name]
+	e.mu.RUnlock()
+	if ok {
+		return value, true
+	}
+
+	return os.LookupEnv(name)
+}
+
+// expandTarget returns addr with its placeholders replaced by the variables of
+// TARGET_ENV_FILE or the environment. Targets are expanded each time they are dialed, so
+// that a reload takes effect on the next connection.
+func expandTarget(addr string) (string, error) {
+	return expandTargetWith(addr, targetEnv.lookup)
+}
+
+// expandTargetWith expands addr with the variables lookup returns. Variables that are not
+// set, or empty, take the default of the placeholder, and are an error without one.
+func expandTargetWith(addr string, lookup func(string) (string, bool)) (string, error) {
+	if !strings.Contains(addr, "{{") {
+		return addr, nil
+	}
+	if rest := targetTemplatePattern.ReplaceAllString(addr, ""); strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+		return "", fmt.Errorf(`%w: %s: only {{ env "NAME" }} and {{ env "NAME" "default" }} are supported`,
+			ErrTargetTemplate, addr)
+	}
+
+	var err error
+	expanded := targetTemplatePattern.ReplaceAllStringFunc(addr, func(placeholder string) string {
+		match := targetTemplatePattern.FindStringSubmatch(placeholder)
+		if value, ok := lookup(match[1]); ok && value != "" {
+			return value
+		}
+		if match[2] != "" {
+			return match[2]
+		}
+		if err == nil {
+			err = fmt.Errorf("%w: %s: %s is not set", ErrTargetTemplate, addr, match[1])
+		}
+		return ""
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return expanded, nil
+}
+
+// expandTargets returns next dialing the expansion of target templates.
+func expandTargets(next dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		addr, err := expandTarget(addr)
+		if err != nil {
+			return nil, err
+		}
+		return next(ctx, network, addr)
+	}
+}
+
+// readEnvFile returns the variables of the env file at path: NAME=VALUE lines, optionally
+// prefixed with export, # starting comments. Values may be quoted.
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimPrefix(text, "export "), "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected NAME=VALUE", path, line)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[name] = value
+	}
+
+	return vars, scanner.Err()
+}
+
+// reloadTargetEnv re-reads the env file at path on every SIGHUP until ctx is done. The
+// new variables are only applied if every one of targets still expands with them.
+func reloadTargetEnv(ctx context.Context, path string, targets []string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+
+		vars, err := readEnvFile(path)
+		if err == nil {
+			err = checkTargetEnv(vars, targets)
+		}
+		if err != nil {
+			logger.Stderr.Warn().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("path", path).
+				Msg("failed to reload target environment, keeping the previous one")
+			continue
+		}
+
+		before := targetExpansions(targets)
+		reloaded := time.Now()
+		targetEnv.set(vars)
+		logger.Stdout.Info().
+			Str("path", path).
+			Int("variables", len(vars)).
+			Msg("reloaded target environment")
+		logTargetExpansions(targets)
+		drainChangedTargets(before, targetExpansions(targets), reloaded)
+	}
+}
+
+// targetExpansions returns what the templates among targets currently expand to.
+func targetExpansions(targets []string) map[string]string {
+	expansions := make(map[string]string)
+	for _, target := range targets {
+		if !strings.Contains(target, "{{") {
+			continue
+		}
+		if expanded, err := expandTarget(target); err == nil {
+			expansions[target] = expanded
+		}
+	}
+
+	return expansions
+}
+
+// drainChangedTargets drains the connections and requests opened before reloaded to the
+// templates whose expansion changed from before to after, as they still reach the
+// previous target.
+func drainChangedTargets(before, after map[string]string, reloaded time.Time) {
+	for target, previous := range before {
+		if after[target] == previous {
+			continue
+		}
+		conns.drain(func(c *trackedConn) bool {
+			return c.target == target && c.startedAt.Before(reloaded)
+		}, "target reloaded", previous)
+	}
+}
+
+// checkTargetEnv returns an error if one of targets does not expand with vars over the
+// environment.
+func checkTargetEnv(vars map[string]string, targets []string) error {
+	lookup := func(name string) (string, bool) {
+		if value, ok := vars[name]; ok {
+			return value, true
+		}
+		return os.LookupEnv(name)
+	}
+	for _, target := range targets {
+		if _, err := expandTargetWith(target, lookup); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// logTargetExpansions logs what the templates among targets currently expand to.
+func logTargetExpansions(targets []string) {
+	for _, target := range targets {
+		if !strings.Contains(target, "{{") {
+			continue
+		}
+		expanded, err := expandTarget(target)
+		if err != nil {
+			continue
+		}
+		logger.Stdout.Info().
+			Str("target", target).
+			Str("expanded", expanded).
+			Msg("target template expanded")
+	}
+}
+
+// targetSelector forwards requests naming an allowed target in a trusted header to that
+// target, and the others to the configured targets. The header is removed before
+// forwarding.
+type targetSelector struct {
+	header   string
+	targets  map[string]http.Handler // allowed target -> its forward handler
+	fallback http.Handler
+}
+
+// newTargetSelector returns fallback selecting the target of requests from header, or
+// fallback itself without a header.
+func newTargetSelector(header string, targets map[string]http.Handler, fallback http.Handler) http.Handler {
+	if header == "" {
+		return fallback
+	}
+
+	return &targetSelector{header: header, targets: targets, fallback: fallback}
+}
+
+func (s *targetSelector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimRight(strings.TrimSpace(r.Header.Get(s.header)), "/")
+	if name == "" {
+		s.fallback.ServeHTTP(w, r)
+		return
+	}
+	r.Header.Del(s.header)
+
+	handler, ok := s.targets[name]
+	if !ok {
+		logger.Stderr.Warn().
+			Str("remote-addr", r.RemoteAddr).
+			Str("target", name).
+			Str("header", s.header).
+			Msg("request refused: target not allowed")
+		http.Error(w, fmt.Sprintf("%v: %s", ErrTargetNotAllowed, name), http.StatusForbidden)
+		return
+	}
+
+	handler.ServeHTTP(w, r)
+}
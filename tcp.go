@@ -2,22 +2,85 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net"
+	"net/netip"
 	"time"
 
 	"golang.org/x/sync/errgroup"
-	"tailscale.com/tsnet"
 )
 
-// fwdTCP forwards TCP traffic between the client connection and the Tailscale target.
+// halfCloseTimeout is how long one side of a TCP connection may keep sending once the
+// other closed its end cleanly, as RDP servers do while they tear down a session, and
+// targets of request-response protocols while they answer. Bounded, so that a target that
+// never closes its end does not hold the connection open.
+const halfCloseTimeout = time.Minute
+
+// tcpOptions configures how TCP connections are forwarded.
+type tcpOptions struct {
+	proxyProtocol     string         // PROXY protocol header to send first, if any
+	acceptProxy       bool           // clients send a PROXY protocol header first, see acceptProxyHeader
+	proxyPeers        []netip.Prefix // peers trusted to send PROXY protocol headers, with acceptProxy
+	mirror            string         // target client traffic is also copied to, see withMirror
+	protocol          string         // application protocol, for protocol-aware idle handling, XCLIENT, MQTT and FTP
+	mqttTopics        []string       // topic filters passed on to MQTT 5 brokers, see mqttHandshake
+	profile           string         // tuning profile, see withProfile
+	idleTimeout       time.Duration  // close connections without traffic for this long; 0 disables
+	deadClientTimeout time.Duration  // close connections of clients not answering for this long; 0 keeps the system defaults
+	syslog            syslogSettings // message forwarding with the syslog protocol
+	record            bool           // record sessions, see recordingStore
+	window            *accessWindow  // when connections are accepted; always if nil
+	maintenance       bool           // connections are refused during maintenance, see maintenanceMode
+	requireToken      bool           // clients send a tunnel token first, see tokenStore
+	tenant            *tenant        // tenant whose limits and traffic the connections count toward, if any
+	sources           *sourceLimiter // connections per client address, unlimited if nil
+	maxInflight       int64          // bytes read ahead of the writes in each direction, see copyAhead; 0 copies as it reads
+}
+
+// fwdTCP forwards TCP traffic between the client connection and the Tailscale target,
+// dialed with dialer.
 // It ensures proper resource cleanup and implements timeouts for stability.
-func fwdTCP(lstConn net.Conn, ts *tsnet.Server, targetAddr string) error {
+// observeDial is told how long dialing the target took and whether it failed.
+// With a PROXY protocol version set, a header carrying the client address is sent first,
+// the client and address announced to railtail itself when the client is another hop;
+// SMTP relays are otherwise told the client address with XCLIENT. The CONNECT packets of
+// MQTT clients are read before dialing, so that refused clients never reach the broker,
+// and the passive-mode replies of FTP servers are rewritten, see ftpControl.
+func fwdTCP(lstConn net.Conn, dialer Dialer, targetAddr string, opts tcpOptions,
+	observeDial func(latency time.Duration, failed bool)) error {
 	// Always close the local connection when this function exits
 	defer lstConn.Close()
 
+	// Reserve the copy buffers, or turn the connection away before dialing
+	buffers, bufferBytes := opts.buffers()
+	bufferBytes += 2 * opts.maxInflight
+	if !budget.admit(context.Background(), bufferBytes) {
+		countClosed(connKindTCP, CloseLimitExceeded)
+		return withCloseReason(CloseLimitExceeded, ErrBufferBudgetExhausted)
+	}
+	defer budget.release(bufferBytes)
+	opts.tuneSocket(lstConn)
+
+	// Keep the connection visible in the registry (admin API, dashboard) while it lives
+	tracked := conns.open(connKindTCP, lstConn.LocalAddr(), lstConn.RemoteAddr().String(), targetAddr)
+	defer tracked.close()
+
+	var mqttConnect []byte
+	if opts.protocol == TCPProtocolMQTT {
+		var err error
+		if mqttConnect, err = mqttHandshake(lstConn, opts.mqttTopics); err != nil {
+			reason := CloseClientError
+			if errors.Is(err, ErrMQTTRefused) {
+				reason = CloseUnauthorized
+			}
+			tracked.setCloseReason(reason)
+			return withCloseReason(reason, fmt.Errorf("failed to read MQTT CONNECT: %w", err))
+		}
+	}
+
 	// Create a context with a cancel function for coordinating the copy operations
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel() // Ensure we cancel the context to prevent goroutine leaks
@@ -26,37 +89,188 @@ func fwdTCP(lstConn net.Conn, ts *tsnet.Server, targetAddr string) error {
 	dialCtx, dialCancel := context.WithTimeout(ctx, 10*time.Second)
 	defer dialCancel()
 
-	tsConn, err := ts.Dial(dialCtx, "tcp", targetAddr)
+	dialStart := time.Now()
+	tsConn, err := targetDialer(dialer.Dial)(dialCtx, "tcp", targetAddr)
+	observeDial(time.Since(dialStart), err != nil)
 	if err != nil {
-		return fmt.Errorf("failed to dial tailscale node: %w", err)
+		err = classifyError(targetAddr, true, err)
+		tracked.setCloseCause(CloseDialFailed, err)
+		return withCloseReason(CloseDialFailed, fmt.Errorf("failed to dial tailscale node: %w", err))
 	}
 	defer tsConn.Close() // Always close the target connection when this function exits
+	opts.tuneSocket(tsConn)
+	closeBoth := func() {
+		_ = lstConn.Close()
+		_ = tsConn.Close()
+	}
+	tracked.setCloser(closeBoth)
+	if opts.profile != TCPProfileBroker {
+		tracked.setReaper(closeBoth)
+	}
+	tailnetPaths.logConn(tsConn, targetAddr)
+
+	// Close both ends once the connection reaches its maximum lifetime, if any
+	stopLifetime := connLifetime.enforce(lstConn.RemoteAddr().String(), targetAddr, func() {
+		tracked.setCloseReason(CloseMaxLifetime)
+		_ = lstConn.Close()
+		_ = tsConn.Close()
+	})
+	defer stopLifetime()
+
+	// Keep the connection from being dropped on the way while it sits idle, if enabled
+	defer opts.keepalive().hold(lstConn, tsConn)()
+	// Notice clients that went away without closing their connection
+	detectDeadClient(lstConn, opts.deadClientTimeout)
+
+	if err := writeProxyHeader(tsConn, opts.proxyProtocol, lstConn.RemoteAddr(), originalDst(lstConn)); err != nil {
+		tracked.setCloseReason(CloseUpstreamError)
+		return withCloseReason(CloseUpstreamError, fmt.Errorf("failed to send proxy protocol header: %w", err))
+	}
+
+	// Introduce the client to SMTP relays with XCLIENT, unless the PROXY protocol does
+	if opts.protocol == TCPProtocolSMTP && opts.proxyProtocol == ProxyProtocolNone {
+		greeting, err := smtpXClient(tsConn, lstConn.RemoteAddr())
+		if err != nil {
+			tracked.setCloseReason(CloseUpstreamError)
+			return withCloseReason(CloseUpstreamError, fmt.Errorf("failed to introduce client to SMTP relay: %w", err))
+		}
+		if _, err := lstConn.Write(greeting); err != nil {
+			tracked.setCloseReason(CloseClientError)
+			return withCloseReason(CloseClientError, fmt.Errorf("failed to send SMTP greeting: %w", err))
+		}
+		tracked.countOut(len(greeting))
+	}
+
+	// Pass the CONNECT packet of MQTT clients on, after the PROXY header
+	if len(mqttConnect) > 0 {
+		if _, err := tsConn.Write(mqttConnect); err != nil {
+			tracked.setCloseReason(CloseUpstreamError)
+			return withCloseReason(CloseUpstreamError, fmt.Errorf("failed to send MQTT CONNECT: %w", err))
+		}
+		tracked.countIn(len(mqttConnect))
+	}
+
+	// Close the connection once idle, watching what each side sends
+	var (
+		clientSrc = lstConn
+		targetSrc = tsConn
+		targetDst = tsConn
+		countIn   = tracked.countIn
+		countOut  = tracked.countOut
+	)
+
+	// Open the data connections of FTP transfers the server points the client to
+	if opts.protocol == TCPProtocolFTP {
+		targetSrc = newFTPControl(tsConn, lstConn, targetAddr, targetDialer(dialer.Dial))
+	}
+	if opts.idleTimeout > 0 {
+		idle := newIdleWatch(opts.idleTimeout, opts.protocol)
+		clientSrc = sniffingConn{Conn: lstConn, observe: idle.client}
+		countOut = func(n int) {
+			tracked.countOut(n)
+			idle.target(n)
+		}
+		go idle.run(ctx, lstConn, tsConn, func() { tracked.setCloseReason(CloseIdleTimeout) })
+	}
+
+	// Measure how fast the target responds to desktop clients
+	if opts.profile == TCPProfileDesktop {
+		latency := newResponseLatency(lstConn.LocalAddr())
+		tracked.setLatency(latency)
+		clientSrc = sniffingConn{Conn: clientSrc, observe: latency.client}
+		out := countOut
+		countOut = func(n int) {
+			out(n)
+			latency.target(n)
+		}
+	}
+
+	// Coalesce the writes of bulk transfers into the tailnet, measure their throughput, and
+	// warn when they are relayed
+	if opts.profile == TCPProfileBulk {
+		meter := &transferMeter{}
+		in, out := countIn, countOut
+		countIn = func(n int) {
+			in(n)
+			meter.upload.count(n)
+		}
+		countOut = func(n int) {
+			out(n)
+			meter.download.count(n)
+		}
+		defer meter.record(lstConn.LocalAddr(), lstConn.RemoteAddr().String(), targetAddr)
+		targetDst = newCoalescingConn(tsConn)
+		defer bulkPaths.warnRelayed(tsConn, targetAddr)()
+	}
+
+	// Account the traffic to the tenant owning the listener, if any
+	if opts.tenant != nil {
+		in, out := countIn, countOut
+		countIn = func(n int) {
+			in(n)
+			opts.tenant.countIn(n)
+		}
+		countOut = func(n int) {
+			out(n)
+			opts.tenant.countOut(n)
+		}
+	}
+
+	// Copy what the client sends to the mirror target too, while a tunnel switches targets
+	if opts.mirror != "" {
+		var preamble bytes.Buffer
+		_ = writeProxyHeader(&preamble, opts.proxyProtocol, lstConn.RemoteAddr(), originalDst(lstConn))
+		preamble.Write(mqttConnect)
+		mirror := openMirror(ctx, targetDialer(dialer.Dial), opts.mirror, preamble.Bytes())
+		defer mirror.close()
+		clientSrc = sniffingConn{Conn: clientSrc, observe: mirror.observe}
+	}
+
+	// Record what each side sends, if enabled
+	if opts.record {
+		if rec := recordings.start(listenPort(lstConn.LocalAddr()), lstConn.RemoteAddr().String(), targetAddr); rec != nil {
+			defer rec.close()
+			clientSrc = sniffingConn{Conn: clientSrc, observe: rec.client}
+			targetSrc = sniffingConn{Conn: targetSrc, observe: rec.target}
+		}
+	}
+
+	// Watch both directions for one side not keeping up with the other
+	flowIn, flowOut := newCopyFlows(tracked, opts.maxInflight)
 
 	// Use errgroup to manage the bidirectional copy operations
-	g, groupCtx := errgroup.WithContext(ctx)
+	var g errgroup.Group
 
 	// Copy data from local connection to tailscale connection
 	g.Go(func() error {
+		halfClosed := false
 		defer func() {
-			// Ensure connections are properly closed after copy completes
-			// This helps with half-open connections
-			if err := tsConn.SetDeadline(time.Now()); err != nil {
-				// This is a best-effort cleanup, so we just continue if it fails
+			// Stop the other direction too, right away unless the end of the client's data
+			// was passed on, then once the target had halfCloseTimeout to finish
+			deadline := time.Now()
+			if halfClosed {
+				deadline = deadline.Add(halfCloseTimeout)
 			}
+			_ = tsConn.SetDeadline(deadline)
 		}()
 
-		if _, err := io.Copy(tsConn, lstConn); err != nil {
+		if _, err := copyConn(targetDst, clientSrc, buffers, countIn, flowIn); err != nil {
+			reason := copyFailureReason(err, "client", "upstream")
+			tracked.setCloseCause(reason, err)
+			propagateAbort(reason, lstConn, tsConn)
 			// Cancel context to signal the other goroutine to stop
 			cancel()
 			return fmt.Errorf("failed to copy data to tailscale node: %w", err)
 		}
+		tracked.setCloseReason(CloseClientEOF)
 
 		// Properly close the write side of the connection to signal EOF
-		if conn, ok := tsConn.(interface{ CloseWrite() error }); ok {
+		if conn, ok := targetDst.(interface{ CloseWrite() error }); ok {
 			if err := conn.CloseWrite(); err != nil {
 				// Log but continue, as we're still closing the entire connection with defer
 				return fmt.Errorf("error when closing write end of connection: %w", err)
 			}
+			halfClosed = true
 		}
 
 		return nil
@@ -64,18 +278,25 @@ func fwdTCP(lstConn net.Conn, ts *tsnet.Server, targetAddr string) error {
 
 	// Copy data from tailscale connection to local connection
 	g.Go(func() error {
+		halfClosed := false
 		defer func() {
-			// Ensure connections are properly closed after copy completes
-			if err := lstConn.SetDeadline(time.Now()); err != nil {
-				// This is best-effort cleanup, so we just continue if it fails
+			// Stop the other direction too, like above
+			deadline := time.Now()
+			if halfClosed {
+				deadline = deadline.Add(halfCloseTimeout)
 			}
+			_ = lstConn.SetDeadline(deadline)
 		}()
 
-		if _, err := io.Copy(lstConn, tsConn); err != nil {
+		if _, err := copyConn(lstConn, targetSrc, buffers, countOut, flowOut); err != nil {
+			reason := copyFailureReason(err, "upstream", "client")
+			tracked.setCloseCause(reason, err)
+			propagateAbort(reason, lstConn, tsConn)
 			// Cancel context to signal the other goroutine to stop
 			cancel()
 			return fmt.Errorf("failed to copy data from tailscale node: %w", err)
 		}
+		tracked.setCloseReason(CloseUpstreamEOF)
 
 		// Properly close the write side of the connection to signal EOF
 		if conn, ok := lstConn.(interface{ CloseWrite() error }); ok {
@@ -83,14 +304,16 @@ func fwdTCP(lstConn net.Conn, ts *tsnet.Server, targetAddr string) error {
 				// Log but continue, as we're still closing the entire connection with defer
 				return fmt.Errorf("error when closing write end of connection: %w", err)
 			}
+			halfClosed = true
 		}
 
 		return nil
 	})
 
-	// Wait for both copy operations to complete or fail
-	if err := g.Wait(); err != nil && groupCtx.Err() == nil {
-		return fmt.Errorf("connection error: %w", err)
+	// Wait for both copy operations to complete or fail. Once one side closed, or railtail
+	// closed both, the other copy fails too, which is no failure of the connection.
+	if err := g.Wait(); err != nil && !closedNormally(tracked.closeReason()) {
+		return withCloseReason(tracked.closeReason(), fmt.Errorf("connection error: %w", err))
 	}
 
 	return nil
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Tuning profiles of TCP connections, for protocols the defaults do not suit.
+const (
+	TCPProfileNone    = ""
+	TCPProfileBroker  = "broker"  // message brokers (AMQP 0-9-1, Kafka, NATS), whose connections last for hours
+	TCPProfileDesktop = "desktop" // interactive desktops (RDP, VNC), where every keystroke waits for a screen update
+	TCPProfileBulk    = "bulk"    // file protocols (SMB, NFS), moving large files
+)
+
+// ErrTCPProfileInvalid is returned for unknown TCP tuning profiles.
+var ErrTCPProfileInvalid = errors.New("TCP profile is invalid")
+
+const (
+	// brokerKeepaliveInterval is the keepalive period of broker connections, unless
+	// TCP_KEEPALIVE is shorter: well below the idle timeouts of NATs and load balancers,
+	// which start at a few minutes.
+	brokerKeepaliveInterval = 30 * time.Second
+	// brokerCopyBufferSize is the size of the copy buffers of broker connections, for the
+	// fetch responses and produce batches of Kafka, which run to megabytes.
+	brokerCopyBufferSize = 256 << 10
+	// brokerSocketBufferSize is the size asked for the socket buffers of broker clients.
+	brokerSocketBufferSize = 1 << 20
+)
+
+// brokerKeepalive is the keepalive of broker connections, set in main.
+var brokerKeepalive *keepalive
+
+var brokerCopyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, brokerCopyBufferSize)
+		return &b
+	},
+}
+
+// validateTCPProfile checks a TCP tuning profile setting.
+func validateTCPProfile(profile string) error {
+	switch profile {
+	case TCPProfileNone, TCPProfileBroker, TCPProfileDesktop, TCPProfileBulk:
+		return nil
+	default:
+		return fmt.Errorf("%w: expected broker, desktop or bulk, got '%s'", ErrTCPProfileInvalid, profile)
+	}
+}
+
+// withProfile returns o tuned for profile. Broker connections are never closed for being
+// idle, by TCP_IDLE_TIMEOUT or the reaper, as brokers and their clients keep connections
+// open for hours between messages, with heartbeats of their own; they are kept alive on
+// the way instead, and copied through bigger buffers. Desktop connections are sent on
+// without delay and copied through small buffers, and how fast their targets respond is
+// measured, see responseLatency. Bulk connections are copied through large buffers, with
+// the writes into the tailnet coalesced, and their throughput is measured, see
+// transferMeter.
+func (o tcpOptions) withProfile(profile string) tcpOptions {
+	o.profile = profile
+	if profile == TCPProfileBroker {
+		o.idleTimeout = 0
+	}
+
+	return o
+}
+
+// keepalive returns the keepalive of the connections of o, nil if disabled.
+func (o tcpOptions) keepalive() *keepalive {
+	if o.profile == TCPProfileBroker {
+		return brokerKeepalive
+	}
+
+	return tcpKeepalive
+}
+
+// buffers returns the pool of the copy buffers of the connections of o, and the bytes
+// a connection takes from the buffer budget.
+func (o tcpOptions) buffers() (*sync.Pool, int64) {
+	switch o.profile {
+	case TCPProfileBroker:
+		return &brokerCopyBuffers, 2 * brokerCopyBufferSize
+	case TCPProfileDesktop:
+		return &desktopCopyBuffers, 2 * desktopCopyBufferSize
+	case TCPProfileBulk:
+		return &bulkCopyBuffers, 2 * bulkCopyBufferSize
+	}
+
+	return &copyBuffers, tcpConnBufferBytes
+}
+
+// tuneSocket tunes the connection conn, to the client or the target, for the profile of
+// o, where the connection supports it: broker and bulk connections get bigger socket
+// buffers, and desktop connections have Nagle's algorithm disabled, so that small writes
+// such as input events are not held back waiting for the previous ones to be acknowledged.
+func (o tcpOptions) tuneSocket(conn net.Conn) {
+	conn = plainConn(conn)
+	switch o.profile {
+	case TCPProfileBroker, TCPProfileBulk:
+		size := brokerSocketBufferSize
+		if o.profile == TCPProfileBulk {
+			size = bulkSocketBufferSize
+		}
+		if c, ok := conn.(interface {
+			SetReadBuffer(int) error
+			SetWriteBuffer(int) error
+		}); ok {
+			_ = c.SetReadBuffer(size)
+			_ = c.SetWriteBuffer(size)
+		}
+	case TCPProfileDesktop:
+		if c, ok := conn.(interface{ SetNoDelay(bool) error }); ok {
+			_ = c.SetNoDelay(true)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Tenant errors.
+var (
+	ErrTenantInvalid       = errors.New("tenant is invalid")
+	ErrTenantNotFound      = errors.New("no such tenant")
+	ErrTenantUnidentified  = errors.New("no tenant matches the request")
+	ErrTenantRateLimited   = errors.New("the tenant's rate limit is exceeded")
+	ErrTenantQuotaExceeded = errors.New("the tenant's connection quota is exceeded")
+)
+
+// tenantHeader carries the token identifying the tenant of HTTP requests. It is not
+// forwarded.
+const tenantHeader = "X-Railtail-Tenant"
+
+// TenantConfig describes a team served by a shared railtail: how its requests are told
+// apart, its own routes, its limits, and the tunnels it owns (see TunnelConfig.Tenant).
+// Tenants are only configurable through the config file.
+type TenantConfig struct {
+	Name   string        `yaml:"name"`   // Name used in logs, metrics and tunnels
+	Hosts  []string      `yaml:"hosts"`  // Request hosts or TLS server names, without port; *.suffix matches subdomains
+	CIDRs  []string      `yaml:"cidrs"`  // Client addresses
+	Tokens []string      `yaml:"tokens"` // Tokens clients send in the X-Railtail-Tenant header
+	Routes []RouteConfig `yaml:"routes"` // Routes of the tenant's requests; the shared routes and target if empty
+
+	RateLimit      float64 `yaml:"rate_limit"`      // Requests (HTTP) and connections (TCP) per second; unlimited if 0
+	Burst          int     `yaml:"burst"`           // Requests and connections let through at once above the rate; defaults to the rate
+	MaxConnections int     `yaml:"max_connections"` // Concurrent requests and connections; unlimited if 0
+}
+
+// validate checks the tenant's matchers, routes and limits.
+func (tc TenantConfig) validate() error {
+	if tc.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrTenantInvalid)
+	}
+	for _, cidr := range tc.CIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrTenantInvalid, tc.Name, err)
+		}
+	}
+	for _, token := range tc.Tokens {
+		if token == "" {
+			return fmt.Errorf("%w: %s: tokens must not be empty", ErrTenantInvalid, tc.Name)
+		}
+	}
+	for _, rc := range tc.Routes {
+		if err := rc.validate(); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrTenantInvalid, tc.Name, err)
+		}
+	}
+	if tc.RateLimit < 0 || tc.Burst < 0 || tc.MaxConnections < 0 {
+		return fmt.Errorf("%w: %s: rate_limit, burst and max_connections must not be negative", ErrTenantInvalid, tc.Name)
+	}
+
+	return nil
+}
+
+// TenantUsage is the admin API representation of a tenant's traffic.
+type TenantUsage struct {
+	Name              string `json:"name"`
+	ActiveConnections int64  `json:"active_connections"`
+	Accepted          uint64 `json:"accepted"`
+	RateLimited       uint64 `json:"rate_limited"`
+	OverQuota         uint64 `json:"over_quota"`
+	BytesIn           uint64 `json:"bytes_in"`
+	BytesOut          uint64 `json:"bytes_out"`
+}
+
+// tenants are the configured tenants, nil if none are.
+var tenants *tenantSet
+
+// tenantSet identifies the tenant of requests.
+type tenantSet struct {
+	list     []*tenant
+	byName   map[string]*tenant
+	required bool // refuse requests no tenant matches
+}
+
+func newTenantSet(configs []TenantConfig, required bool) *tenantSet {
+	if len(configs) == 0 {
+		return nil
+	}
+
+	s := &tenantSet{byName: make(map[string]*tenant), required: required}
+	for _, tc := range configs {
+		t := newTenant(tc)
+		s.list = append(s.list, t)
+		s.byName[tc.Name] = t
+	}
+
+	return s
+}
+
+// get returns the tenant named name, or nil.
+func (s *tenantSet) get(name string) *tenant {
+	if s == nil || name == "" {
+		return nil
+	}
+
+	return s.byName[name]
+}
+
+// identify returns the tenant of r, by the first of its token, TLS server name, host
+// and client address matching a tenant, or nil.
+func (s *tenantSet) identify(r *http.Request) *tenant {
+	if token := r.Header.Get(tenantHeader); token != "" {
+		for _, t := range s.list {
+			if t.hasToken(token) {
+				return t
+			}
+		}
+	}
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		for _, t := range s.list {
+			if t.hasHost(r.TLS.ServerName) {
+				return t
+			}
+		}
+	}
+	host := hostOnly(r.Host)
+	for _, t := range s.list {
+		if t.hasHost(host) {
+			return t
+		}
+	}
+	if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		for _, t := range s.list {
+			if t.hasAddr(addr.Addr().Unmap()) {
+				return t
+			}
+		}
+	}
+
+	return nil
+}
+
+// handler returns a handler serving the requests of each tenant through its own routes,
+// scoped by tenant name, or shared when the tenant has none, within its limits.
+// Requests no tenant matches are served by shared, unless tenants are required.
+func (s *tenantSet) handler(shared http.Handler, scoped map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := s.identify(r)
+		r.Header.Del(tenantHeader)
+		if t == nil {
+			if s.required {
+				logger.Stderr.Warn().
+					Str("remote-addr", r.RemoteAddr).
+					Str("host", r.Host).
+					Msg("request refused: no tenant matches it")
+				http.Error(w, "Forbidden: "+ErrTenantUnidentified.Error(), http.StatusForbidden)
+				return
+			}
+			shared.ServeHTTP(w, r)
+			return
+		}
+
+		next := shared
+		if h, ok := scoped[t.Name]; ok {
+			next = h
+		}
+		t.wrap(next).ServeHTTP(w, r)
+	})
+}
+
+// usage returns the traffic of every tenant.
+func (s *tenantSet) usage() []TenantUsage {
+	if s == nil {
+		return []TenantUsage{}
+	}
+
+	usage := make([]TenantUsage, 0, len(s.list))
+	for _, t := range s.list {
+		usage = append(usage, t.usage())
+	}
+
+	return usage
+}
+
+// counters returns the counters of every tenant, by names stable across restarts.
+func (s *tenantSet) counters() map[string]*metrics.Counter {
+	if s == nil {
+		return nil
+	}
+
+	counters := make(map[string]*metrics.Counter)
+	for _, t := range s.list {
+		counters["tenant/"+t.Name+"/accepted"] = t.accepted
+		counters["tenant/"+t.Name+"/rate-limited"] = t.rateLimited
+		counters["tenant/"+t.Name+"/over-quota"] = t.overQuota
+		counters["tenant/"+t.Name+"/bytes-in"] = t.bytesIn
+		counters["tenant/"+t.Name+"/bytes-out"] = t.bytesOut
+	}
+
+	return counters
+}
+
+// tenant is a TenantConfig at runtime: its rate limiter, connection quota and traffic.
+type tenant struct {
+	TenantConfig
+	prefixes []netip.Prefix
+	bucket   *tokenBucket // nil if unlimited
+	conns    atomic.Int64 // connections and requests in progress
+
+	active                           *metrics.Gauge
+	accepted, rateLimited, overQuota *metrics.Counter
+	bytesIn, bytesOut                *metrics.Counter
+}
+
+func newTenant(tc TenantConfig) *tenant {
+	t := &tenant{
+		TenantConfig: tc,
+
+		active: metrics.Default.Gauge("railtail_tenant_active_connections",
+			"Connections (TCP) and requests (HTTP) of each tenant in progress.", "tenant", tc.Name),
+		accepted: metrics.Default.Counter("railtail_tenant_connections_total",
+			"Connections (TCP) and requests (HTTP) of each tenant, by outcome.", "tenant", tc.Name, "result", "accepted"),
+		rateLimited: metrics.Default.Counter("railtail_tenant_connections_total",
+			"Connections (TCP) and requests (HTTP) of each tenant, by outcome.", "tenant", tc.Name, "result", "rate-limited"),
+		overQuota: metrics.Default.Counter("railtail_tenant_connections_total",
+			"Connections (TCP) and requests (HTTP) of each tenant, by outcome.", "tenant", tc.Name, "result", "over-quota"),
+		bytesIn: metrics.Default.Counter("railtail_tenant_bytes_total",
+			"Bytes of each tenant, by direction (in: client to target, out: target to client).", "tenant", tc.Name, "direction", "in"),
+		bytesOut: metrics.Default.Counter("railtail_tenant_bytes_total",
+			"Bytes of each tenant, by direction (in: client to target, out: target to client).", "tenant", tc.Name, "direction", "out"),
+	}
+	for _, cidr := range tc.CIDRs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			t.prefixes = append(t.prefixes, prefix.Masked())
+		}
+	}
+	if tc.RateLimit > 0 {
+		burst := float64(tc.Burst)
+		if burst == 0 {
+			burst = math.Max(1, math.Ceil(tc.RateLimit))
+		}
+		t.bucket = newTokenBucket(tc.RateLimit, burst)
+	}
+
+	return t
+}
+
+func (t *tenant) hasToken(token string) bool {
+	for _, candidate := range t.Tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *tenant) hasHost(host string) bool {
+	for _, pattern := range t.Hosts {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if len(host) > len(suffix)+1 && strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(suffix)) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(host, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *tenant) hasAddr(addr netip.Addr) bool {
+	for _, prefix := range t.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// admit admits a connection or request of the tenant within its rate limit and
+// connection quota, returning the function to call once it is done. A nil tenant
+// admits everything.
+func (t *tenant) admit() (func(), error) {
+	if t == nil {
+		return func() {}, nil
+	}
+
+	if !t.bucket.take() {
+		t.rateLimited.Inc()
+		return nil, fmt.Errorf("%w: %s", ErrTenantRateLimited, t.Name)
+	}
+	if n := t.conns.Add(1); t.MaxConnections > 0 && n > int64(t.MaxConnections) {
+		t.conns.Add(-1)
+		t.overQuota.Inc()
+		return nil, fmt.Errorf("%w: %s", ErrTenantQuotaExceeded, t.Name)
+	}
+	t.active.Inc()
+	t.accepted.Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.conns.Add(-1)
+			t.active.Dec()
+		})
+	}, nil
+}
+
+// countIn counts n bytes sent by a client of the tenant. Nil tenants count nothing.
+func (t *tenant) countIn(n int) {
+	if t != nil {
+		t.bytesIn.Add(uint64(n))
+	}
+}
+
+// countOut counts n bytes sent to a client of the tenant.
+func (t *tenant) countOut(n int) {
+	if t != nil {
+		t.bytesOut.Add(uint64(n))
+	}
+}
+
+// wrap returns next, serving requests of the tenant within its limits and counting
+// their traffic. Requests over the limits are answered with 429 Too Many Requests.
+func (t *tenant) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := t.admit()
+		if err != nil {
+			logTenantRefused(connKindHTTP, r.RemoteAddr, err)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too Many Requests: "+err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+
+		if r.Body != nil {
+			r.Body = countingReadCloser{ReadCloser: r.Body, count: t.countIn}
+		}
+		next.ServeHTTP(countingResponseWriter{ResponseWriter: w, count: t.countOut}, r)
+	})
+}
+
+func (t *tenant) usage() TenantUsage {
+	return TenantUsage{
+		Name:              t.Name,
+		ActiveConnections: t.active.Value(),
+		Accepted:          t.accepted.Value(),
+		RateLimited:       t.rateLimited.Value(),
+		OverQuota:         t.overQuota.Value(),
+		BytesIn:           t.bytesIn.Value(),
+		BytesOut:          t.bytesOut.Value(),
+	}
+}
+
+// logTenantRefused logs that a connection or request of kind from remoteAddr was
+// refused by the limits of its tenant, and counts it.
+func logTenantRefused(kind, remoteAddr string, err error) {
+	countClosed(kind, CloseLimitExceeded)
+	logger.Stderr.Warn().
+		Str(logger.ErrAttr(err), logger.ErrValue(err)).
+		Str("remote-addr", remoteAddr).
+		Str("reason", CloseLimitExceeded).
+		Msg("connection refused by its tenant's limits")
+}
+
+// newTenantRouter returns the router of the routes of a tenant. Requests none of them
+// matches are answered with 404 Not Found, or the status of unmatched: they never fall
+// through to the shared routes, or its default backend.
+func newTenantRouter(name string, routes []route, unmatched UnmatchedRouteConfig) http.Handler {
+	explanation := fmt.Sprintf("no route of tenant %s matches the request", name)
+	fallback := unmatched.handler(explanation)
+	if fallback == nil {
+		fallback = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Not Found: "+explanation, http.StatusNotFound)
+		})
+	}
+
+	return &router{routes: routes, fallback: fallback}
+}
+
+// tokenBucket is a token bucket rate limiter. A nil tokenBucket never limits.
+type tokenBucket struct {
+	rate, burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take takes a token, reporting whether there was one.
+func (b *tokenBucket) take() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// full reports whether the bucket will have refilled by now, which a nil bucket always is.
+func (b *tokenBucket) full(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
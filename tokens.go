@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Tunnel token errors.
+var (
+	ErrTokenMissing     = errors.New("this tunnel requires a token")
+	ErrTokenInvalid     = errors.New("the token is invalid or expired")
+	ErrTokenTunnel      = errors.New("the token is for another tunnel")
+	ErrTokenClient      = errors.New("the token is in use by another client")
+	ErrTokenTTL         = errors.New("token ttl is invalid")
+	ErrTokenNotFound    = errors.New("no such token")
+	ErrTokenNotRequired = errors.New("the listener does not require tokens")
+)
+
+const (
+	// tokenHeader carries the token of HTTP requests. It is not forwarded.
+	tokenHeader = "X-Railtail-Token"
+
+	// tokenPreamble starts the line TCP clients send their token in, before any data:
+	// "RAILTAIL-TOKEN <token>\r\n".
+	tokenPreamble = "RAILTAIL-TOKEN "
+
+	// tokenPreambleTimeout is how long TCP clients get to send the token line.
+	tokenPreambleTimeout = 10 * time.Second
+
+	// tokenPrefix starts every token, to make them recognizable.
+	tokenPrefix = "rtt_"
+)
+
+// tunnelToken is a short-lived token granting one client the use of a tunnel.
+type tunnelToken struct {
+	id        string // hex prefix of the token's hash, to list and revoke it
+	hash      [sha256.Size]byte
+	listen    string // port of the tunnel
+	expiresAt time.Time
+	once      bool   // the token authorizes a single connection or request
+	client    string // IP address of the client the token is bound to, once used
+	note      string
+}
+
+// TokenInfo is the admin API representation of a token, without the token itself.
+type TokenInfo struct {
+	ID        string    `json:"id"`
+	Listen    string    `json:"listen"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Once      bool      `json:"once"`
+	Client    string    `json:"client,omitempty"`
+	Note      string    `json:"note,omitempty"`
+}
+
+// tunnelTokens holds the tokens minted through the admin server.
+var tunnelTokens *tokenStore
+
+// tokenStore mints short-lived tokens authorizing a single client to use a tunnel, and
+// checks them. Tokens are kept in memory only, hashed, so restarting railtail revokes
+// them all.
+type tokenStore struct {
+	maxTTL time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*tunnelToken // by id
+}
+
+func newTokenStore(maxTTL time.Duration) *tokenStore {
+	return &tokenStore{maxTTL: maxTTL, tokens: make(map[string]*tunnelToken)}
+}
+
+// Mint returns a new token for the tunnel listening on listen, valid for ttl. A token
+// minted with once authorizes a single connection (TCP) or request (HTTP).
+func (s *tokenStore) Mint(listen string, ttl time.Duration, once bool, note string) (string, TokenInfo, error) {
+	if ttl <= 0 || ttl > s.maxTTL {
+		return "", TokenInfo{}, fmt.Errorf("%w: must be positive and at most %s, got %s", ErrTokenTTL, s.maxTTL, ttl)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", TokenInfo{}, err
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(token))
+
+	t := &tunnelToken{
+		id:        hex.EncodeToString(hash[:6]),
+		hash:      hash,
+		listen:    listen,
+		expiresAt: time.Now().Add(ttl),
+		once:      once,
+		note:      note,
+	}
+
+	s.mu.Lock()
+	s.expireLocked()
+	s.tokens[t.id] = t
+	s.mu.Unlock()
+
+	metrics.Default.Counter("railtail_tunnel_tokens_total",
+		"Tunnel tokens minted, and connections and requests accepted or rejected for their token.",
+		"result", "minted").Inc()
+	logger.Stdout.Info().
+		Str("token-id", t.id).
+		Str("listen", listen).
+		Time("expires-at", t.expiresAt).
+		Bool("once", once).
+		Str("note", note).
+		Msg("tunnel token minted")
+
+	return token, t.info(), nil
+}
+
+// check checks token authorizes the client at remoteAddr to use the tunnel listening
+// on listen, binding the token to the client the first time it is used.
+func (s *tokenStore) check(listen, token, remoteAddr string) error {
+	result := "rejected"
+	defer func() {
+		metrics.Default.Counter("railtail_tunnel_tokens_total",
+			"Tunnel tokens minted, and connections and requests accepted or rejected for their token.",
+			"result", result).Inc()
+	}()
+
+	if token == "" {
+		return ErrTokenMissing
+	}
+	if s == nil {
+		return ErrTokenInvalid
+	}
+	client, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		client = remoteAddr
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	id := hex.EncodeToString(hash[:6])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+
+	t, ok := s.tokens[id]
+	if !ok || subtle.ConstantTimeCompare(t.hash[:], hash[:]) != 1 {
+		return ErrTokenInvalid
+	}
+	if t.listen != listen {
+		return ErrTokenTunnel
+	}
+	if t.client != "" && t.client != client {
+		return ErrTokenClient
+	}
+
+	t.client = client
+	if t.once {
+		delete(s.tokens, id)
+	}
+	result = "accepted"
+
+	return nil
+}
+
+// List returns the tokens that have not expired, soonest to expire first.
+func (s *tokenStore) List() []TokenInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireLocked()
+
+	infos := make([]TokenInfo, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		infos = append(infos, t.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ExpiresAt.Before(infos[j].ExpiresAt) })
+
+	return infos
+}
+
+// Revoke revokes the token id.
+func (s *tokenStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tokens[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrTokenNotFound, id)
+	}
+	delete(s.tokens, id)
+
+	logger.Stdout.Info().Str("token-id", id).Msg("tunnel token revoked")
+	return nil
+}
+
+// expireLocked forgets the expired tokens. s.mu is held.
+func (s *tokenStore) expireLocked() {
+	now := time.Now()
+	for id, t := range s.tokens {
+		if now.After(t.expiresAt) {
+			delete(s.tokens, id)
+		}
+	}
+}
+
+func (t *tunnelToken) info() TokenInfo {
+	return TokenInfo{ID: t.id, Listen: t.listen, ExpiresAt: t.expiresAt, Once: t.once, Client: t.client, Note: t.note}
+}
+
+// logTokenRejected logs that a connection of kind from remoteAddr to the tunnel
+// listening on listen was refused for its token, and counts it.
+func logTokenRejected(kind, listen, remoteAddr string, err error) {
+	countClosed(kind, CloseUnauthorized)
+	logger.Stderr.Warn().
+		Str(logger.ErrAttr(err), logger.ErrValue(err)).
+		Str("remote-addr", remoteAddr).
+		Str("listen", listen).
+		Str("reason", CloseUnauthorized).
+		Msg("connection refused for its tunnel token")
+}
+
+// checkTokenPreamble reads the token line TCP clients send first, and checks it. When
+// the token is rejected, the client is told why in a line of its own before the
+// connection is closed.
+func checkTokenPreamble(conn net.Conn) error {
+	listen := listenPort(conn.LocalAddr())
+
+	_ = conn.SetReadDeadline(time.Now().Add(tokenPreambleTimeout))
+	line, err := readTokenLine(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err == nil {
+		token, ok := strings.CutPrefix(line, tokenPreamble)
+		if !ok {
+			err = ErrTokenMissing
+		} else {
+			err = tunnelTokens.check(listen, strings.TrimSpace(token), conn.RemoteAddr().String())
+		}
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(conn, "RAILTAIL-ERROR %s\r\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// readTokenLine reads a line of up to 256 bytes, a byte at a time so that nothing the
+// client sends after it is consumed.
+func readTokenLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 256 {
+		if _, err := conn.Read(b); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrTokenMissing, err)
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+
+	return "", ErrTokenMissing
+}
+
+// requireToken returns handler refusing requests without a valid token in the
+// X-Railtail-Token header with 401 Unauthorized. The header is not forwarded.
+func requireToken(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listen := ""
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			listen = listenPort(addr)
+		}
+
+		token := r.Header.Get(tokenHeader)
+		r.Header.Del(tokenHeader)
+		if err := tunnelTokens.check(listen, token, r.RemoteAddr); err != nil {
+			logTokenRejected(connKindHTTP, listen, r.RemoteAddr, err)
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// topInterval is how often `railtail top` refreshes by default.
+const topInterval = 2 * time.Second
+
+// topErrors is how many of the latest errors `railtail top` shows.
+const topErrors = 5
+
+// topHistory is how much of the stats history `railtail top` draws.
+const topHistory = time.Minute
+
+// Terminal escape sequences used to redraw the view in place
+const (
+	escAltScreen  = "\x1b[?1049h\x1b[?25l" // switch to the alternate screen, hide the cursor
+	escMainScreen = "\x1b[?25h\x1b[?1049l" // restore both
+	escClear      = "\x1b[H\x1b[2J"
+)
+
+// topSnapshot is what `railtail top` fetches from the admin API on every refresh.
+type topSnapshot struct {
+	status      *NodeStatus
+	statusErr   error
+	stats       topStats
+	history     *StatsHistory // nil without a stats history
+	tunnels     []TunnelStatus
+	connections []ConnSnapshot
+	errors      []map[string]any
+}
+
+type topStats struct {
+	Time              time.Time `json:"time"`
+	ActiveConnections int       `json:"active_connections"`
+	BytesIn           uint64    `json:"bytes_in"`
+	BytesOut          uint64    `json:"bytes_out"`
+}
+
+// topCommand implements `railtail top`, a live view of a running railtail built from its
+// admin API. It returns the process exit code.
+func topCommand(args []string) int {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	addr := fs.String("addr", "", "Address of the admin server, like railtail:9090. Defaults to localhost:ADMIN_PORT.")
+	interval := fs.Duration("interval", topInterval, "How often to refresh.")
+	once := fs.Bool("once", false, "Print a single view and exit.")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: railtail top [-addr HOST:PORT] [-interval DURATION] [-once]")
+		return 2
+	}
+	if *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "-interval must be positive")
+		return 2
+	}
+
+	// The token is a secret, so it is only taken from the environment
+	token := os.Getenv("ADMIN_TOKEN")
+	if *addr == "" {
+		cfg, errs := loadEnvironmentConfig()
+		if len(errs) > 0 {
+			fmt.Fprintln(os.Stderr, errs[0])
+			return 1
+		}
+		applyRailwayEnvironment(cfg)
+		if cfg.AdminPort == "" {
+			fmt.Fprintln(os.Stderr, "ADMIN_PORT is not set, pass the admin server with -addr")
+			return 1
+		}
+		*addr = net.JoinHostPort("localhost", cfg.AdminPort)
+		token = cfg.AdminToken
+	}
+	base := "http://" + *addr
+	if strings.Contains(*addr, "://") {
+		base = strings.TrimSuffix(*addr, "/")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client := &http.Client{Timeout: 5 * time.Second, Transport: adminTransport{token: token}}
+	if *once {
+		snap, err := fetchTop(ctx, client, base)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		renderTop(os.Stdout, snap, nil, 0)
+		return 0
+	}
+
+	fmt.Print(escAltScreen)
+	defer fmt.Print(escMainScreen)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	var prev *topSnapshot
+	for {
+		var buf bytes.Buffer
+		buf.WriteString(escClear)
+		snap, err := fetchTop(ctx, client, base)
+		if err != nil {
+			fmt.Fprintf(&buf, "railtail top: %s\n\n%v\n\nretrying every %s, ctrl-c to quit\n", base, err, *interval)
+		} else {
+			renderTop(&buf, snap, prev, terminalHeight())
+			prev = snap
+		}
+		_, _ = os.Stdout.Write(buf.Bytes())
+
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchTop queries the admin API at base for a snapshot. The node status is optional: the
+// admin server answers 503 while the node is not running.
+func fetchTop(ctx context.Context, client *http.Client, base string) (*topSnapshot, error) {
+	snap := &topSnapshot{}
+	if err := getJSON(ctx, client, base+"/admin/stats", &snap.stats); err != nil {
+		return nil, err
+	}
+	if err := getJSON(ctx, client, base+"/admin/tunnels", &snap.tunnels); err != nil {
+		return nil, err
+	}
+	if err := getJSON(ctx, client, base+"/admin/connections", &snap.connections); err != nil {
+		return nil, err
+	}
+	if err := getJSON(ctx, client, base+"/admin/errors", &snap.errors); err != nil {
+		return nil, err
+	}
+	snap.history = &StatsHistory{}
+	if err := getJSON(ctx, client, base+"/admin/stats/history?last="+topHistory.String(), snap.history); err != nil {
+		snap.history = nil
+	}
+	snap.status = &NodeStatus{}
+	if snap.statusErr = getJSON(ctx, client, base+"/admin/status", snap.status); snap.statusErr != nil {
+		snap.status = nil
+	}
+
+	return snap, nil
+}
+
+// adminTransport sends the admin token, if any, with every request.
+type adminTransport struct {
+	token string
+}
+
+func (t adminTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// getJSON decodes the JSON response to a GET of url into v.
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body)
+		if body.Error != "" {
+			return fmt.Errorf("%s returned %s: %s", url, resp.Status, body.Error)
+		}
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// renderTop writes the view of snap to w. Throughput is computed against prev, if any,
+// and the busiest connections are listed to fit height lines (0 = no limit).
+func renderTop(w io.Writer, snap, prev *topSnapshot, height int) {
+	lines := 0
+	printf := func(format string, args ...any) {
+		fmt.Fprintf(w, format, args...)
+		lines += strings.Count(format, "\n")
+	}
+
+	if st := snap.status; st != nil {
+		printf("railtail %s (%s)  %s  up %s  %s\n", st.Hostname, strings.TrimSuffix(st.DNSName, "."),
+			st.BackendState, st.Uptime, st.Version)
+		printf("%s on :%s -> %s  peers %d/%d online\n", st.Mode, st.ListenPort, orDash(st.TargetAddr),
+			st.OnlinePeers, st.Peers)
+	} else {
+		printf("status unavailable: %v\n\n", snap.statusErr)
+	}
+
+	rateIn, rateOut := "-", "-"
+	// Counters going down mean railtail restarted in between
+	if prev != nil && snap.stats.BytesIn >= prev.stats.BytesIn && snap.stats.BytesOut >= prev.stats.BytesOut {
+		if elapsed := snap.stats.Time.Sub(prev.stats.Time).Seconds(); elapsed > 0 {
+			rateIn = formatBytes(float64(snap.stats.BytesIn-prev.stats.BytesIn)/elapsed) + "/s"
+			rateOut = formatBytes(float64(snap.stats.BytesOut-prev.stats.BytesOut)/elapsed) + "/s"
+		}
+	}
+	printf("connections %d  in %s (%s)  out %s (%s)\n", snap.stats.ActiveConnections,
+		rateIn, formatBytes(float64(snap.stats.BytesIn)), rateOut, formatBytes(float64(snap.stats.BytesOut)))
+	if h := snap.history; h != nil && len(h.Samples) > 0 {
+		in, out := make([]float64, len(h.Samples)), make([]float64, len(h.Samples))
+		for i, s := range h.Samples {
+			in[i], out[i] = float64(s.BytesIn), float64(s.BytesOut)
+		}
+		printf("in  %s  peak %s/s\n", sparkline(in), formatBytes(slices.Max(in)))
+		printf("out %s  peak %s/s\n", sparkline(out), formatBytes(slices.Max(out)))
+	}
+	printf("\n")
+
+	printf("TUNNELS\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LISTEN\tMODE\tTARGET\tTENANT\tOPTIONS")
+	for _, t := range snap.tunnels {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", t.Listen, t.mode(), t.Target, orDash(t.Tenant), tunnelOptions(t))
+	}
+	_ = tw.Flush()
+	lines += len(snap.tunnels) + 1
+	if len(snap.tunnels) == 0 {
+		printf("(none)\n")
+	}
+
+	// Room left for errors below the connections
+	shownErrors := min(len(snap.errors), topErrors)
+	room := len(snap.connections)
+	if height > 0 {
+		room = max(height-lines-shownErrors-6, 1)
+	}
+
+	busiest := append([]ConnSnapshot(nil), snap.connections...)
+	sort.Slice(busiest, func(i, j int) bool {
+		return busiest[i].BytesIn+busiest[i].BytesOut > busiest[j].BytesIn+busiest[j].BytesOut
+	})
+	printf("\nCONNECTIONS\n")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tKIND\tCLIENT\tTARGET\tAGE\tIN\tOUT")
+	for _, c := range busiest[:min(room, len(busiest))] {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", c.ID, c.Kind, c.RemoteAddr, c.Target,
+			snap.stats.Time.Sub(c.StartedAt).Round(time.Second), bytesIn(c), formatBytes(float64(c.BytesOut)))
+	}
+	_ = tw.Flush()
+	if hidden := len(busiest) - room; hidden > 0 {
+		printf("... %d more\n", hidden)
+	}
+
+	printf("\nERRORS\n")
+	if shownErrors == 0 {
+		printf("(none)\n")
+	}
+	for _, e := range snap.errors[len(snap.errors)-shownErrors:] {
+		printf("%v  %v", e["time"], e["message"])
+		if msg, ok := e["err"]; ok {
+			printf(": %v", msg)
+		}
+		printf("\n")
+	}
+}
+
+// tunnelOptions summarizes the options of a tunnel for `railtail top`.
+func tunnelOptions(t TunnelStatus) string {
+	var options []string
+	if t.Protocol != "" {
+		options = append(options, t.Protocol)
+	}
+	if t.ProxyProtocol != "" {
+		options = append(options, "proxy-protocol "+t.ProxyProtocol)
+	}
+	if t.Record {
+		options = append(options, "recorded")
+	}
+	if t.RequireToken {
+		options = append(options, "token")
+	}
+	if t.AllowedHours != "" {
+		options = append(options, t.AllowedHours)
+	}
+	if t.Persisted {
+		options = append(options, "persisted")
+	}
+
+	return orDash(strings.Join(options, ", "))
+}
+
+// bytesIn formats the bytes received from the client of c, with the progress of the
+// upload if its size is known.
+func bytesIn(c ConnSnapshot) string {
+	in := formatBytes(float64(c.BytesIn))
+	if c.Uploading && c.UploadSize > 0 {
+		in += fmt.Sprintf(" (%d%%)", c.BytesIn*100/c.UploadSize)
+	}
+
+	return in
+}
+
+// terminalHeight returns the number of lines of the terminal, 0 if unknown.
+func terminalHeight() int {
+	_, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return 0
+	}
+	return height
+}
+
+// formatBytes formats n bytes with a binary unit, like 1.5 MiB.
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	exp := 0
+	for n >= unit*unit && exp < 4 {
+		n /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", n/unit, "KMGTP"[exp])
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
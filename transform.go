@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// ErrTransformInvalid is returned for body transformations that cannot be compiled.
+var ErrTransformInvalid = errors.New("body transform is invalid")
+
+const (
+	// transformMaxBody bounds the JSON bodies transformed. Bigger ones are refused rather
+	// than forwarded untransformed.
+	transformMaxBody = 10 << 20
+	// transformRedacted replaces redacted values by default.
+	transformRedacted = "[REDACTED]"
+)
+
+// transformPlaceholder matches the placeholders of the values of set: {{ remote_addr }},
+// {{ host }}, {{ time }}, {{ client_identity }} and {{ header "Name" }}.
+var transformPlaceholder = regexp.MustCompile(`\{\{\s*(remote_addr|host|time|client_identity|header\s+"([^"]+)")\s*\}\}`)
+
+// BodyTransform changes the JSON bodies of matching requests on their way to the target,
+// like masking personal data before it reaches a node operated by a third party. Fields
+// are named by dotted paths, like user.email, where * stands for any key or array element.
+type BodyTransform struct {
+	Host       string            `yaml:"host"`        // Request host pattern to match (see hostPattern); empty matches any host
+	Path       string            `yaml:"path"`        // Regular expression the request path must match; empty matches any path
+	Rename     map[string]string `yaml:"rename"`      // Fields to rename in place: path -> new key
+	Drop       []string          `yaml:"drop"`        // Fields to remove
+	Redact     []string          `yaml:"redact"`      // Fields whose value is replaced with RedactWith
+	RedactWith string            `yaml:"redact_with"` // Replacement of redacted values; [REDACTED] if empty
+	Set        map[string]string `yaml:"set"`         // Fields to set, without wildcards: path -> value, with placeholders
+}
+
+// bodyTransform is a compiled BodyTransform.
+type bodyTransform struct {
+	match      urlMatcher
+	rename     map[string]string
+	drop       [][]string
+	redact     [][]string
+	redactWith string
+	set        map[string]string
+	setPaths   map[string][]string
+}
+
+// bodyTransforms applies the transforms of the config file to the requests they match,
+// in order. A nil bodyTransforms leaves bodies alone.
+type bodyTransforms struct {
+	transforms []bodyTransform
+	applied    *metrics.Counter
+	refused    *metrics.Counter
+}
+
+// newBodyTransforms compiles rules, returning nil without any.
+func newBodyTransforms(rules []BodyTransform) (*bodyTransforms, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	t := &bodyTransforms{
+		applied: metrics.Default.Counter("railtail_body_transforms_total",
+			"Requests whose JSON body was transformed, or refused as it could not be.", "result", "applied"),
+		refused: metrics.Default.Counter("railtail_body_transforms_total",
+			"Requests whose JSON body was transformed, or refused as it could not be.", "result", "refused"),
+	}
+	for i, rule := range rules {
+		match, err := newURLMatcher(rule.Host, rule.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %d: %w", ErrTransformInvalid, i, err)
+		}
+		bt := bodyTransform{
+			match:      match,
+			rename:     rule.Rename,
+			redactWith: rule.RedactWith,
+			set:        rule.Set,
+			setPaths:   make(map[string][]string, len(rule.Set)),
+		}
+		if bt.redactWith == "" {
+			bt.redactWith = transformRedacted
+		}
+		for from, to := range rule.Rename {
+			if path := fieldPath(from); path == nil || path[len(path)-1] == "*" || to == "" || strings.Contains(to, ".") {
+				return nil, fmt.Errorf("%w: %d: cannot rename '%s' to '%s'", ErrTransformInvalid, i, from, to)
+			}
+		}
+		for _, list := range []struct {
+			fields []string
+			paths  *[][]string
+		}{{rule.Drop, &bt.drop}, {rule.Redact, &bt.redact}} {
+			for _, field := range list.fields {
+				path := fieldPath(field)
+				if path == nil {
+					return nil, fmt.Errorf("%w: %d: invalid field '%s'", ErrTransformInvalid, i, field)
+				}
+				*list.paths = append(*list.paths, path)
+			}
+		}
+		for field := range rule.Set {
+			path := fieldPath(field)
+			if path == nil || slices.Contains(path, "*") {
+				return nil, fmt.Errorf("%w: %d: set needs a field without wildcards, got '%s'", ErrTransformInvalid, i, field)
+			}
+			bt.setPaths[field] = path
+		}
+		t.transforms = append(t.transforms, bt)
+	}
+
+	return t, nil
+}
+
+// fieldPath splits a dotted field path into its keys, or returns nil if one is empty.
+func fieldPath(field string) []string {
+	path := strings.Split(field, ".")
+	if slices.Contains(path, "") {
+		return nil
+	}
+
+	return path
+}
+
+// wrap returns next, transforming the JSON bodies of the requests a transform matches.
+// Bodies that cannot be transformed are refused, not forwarded as they are: compressed
+// ones with 415, bigger than transformMaxBody with 413, and invalid JSON with 400. Other
+// content types go through untouched.
+func (t *bodyTransforms) wrap(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var matched []bodyTransform
+		for _, bt := range t.transforms {
+			if _, ok := bt.match.match(r, ""); ok {
+				matched = append(matched, bt)
+			}
+		}
+		if len(matched) == 0 || r.Body == nil || r.Body == http.NoBody || !isJSON(r.Header.Get("Content-Type")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if status, err := t.apply(r, matched); err != nil {
+			t.refused.Inc()
+			logger.Stderr.Warn().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("remote-addr", r.RemoteAddr).
+				Str("path", r.URL.Path).
+				Msg("request refused: body cannot be transformed")
+			http.Error(w, "Error transforming request body: "+err.Error(), status)
+			return
+		}
+		t.applied.Inc()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apply transforms the body of r with matched, returning the status refusing r and why
+// if it cannot.
+func (t *bodyTransforms) apply(r *http.Request, matched []bodyTransform) (int, error) {
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("content encoding %s", encoding)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, transformMaxBody+1))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(body) > transformMaxBody {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("body is over %d bytes", transformMaxBody)
+	}
+	r.Body.Close()
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber() // numbers are passed on as they were written
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if dec.More() {
+		return http.StatusBadRequest, errors.New("invalid JSON: data after the top-level value")
+	}
+
+	for _, bt := range matched {
+		doc = bt.apply(doc, r)
+	}
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return http.StatusBadRequest, err
+	}
+	transformed := bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+
+	r.Body = io.NopCloser(bytes.NewReader(transformed))
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(transformed)), nil }
+	r.ContentLength = int64(len(transformed))
+	r.Header.Set("Content-Length", strconv.Itoa(len(transformed)))
+
+	return http.StatusOK, nil
+}
+
+// apply returns doc transformed for r: fields renamed, dropped, redacted, then set.
+func (bt bodyTransform) apply(doc any, r *http.Request) any {
+	for from, to := range bt.rename {
+		path := fieldPath(from)
+		eachParent(doc, path, func(obj map[string]any, key string) {
+			if value, ok := obj[key]; ok {
+				delete(obj, key)
+				obj[to] = value
+			}
+		})
+	}
+	for _, path := range bt.drop {
+		eachParent(doc, path, func(obj map[string]any, key string) {
+			delete(obj, key)
+		})
+	}
+	for _, path := range bt.redact {
+		eachParent(doc, path, func(obj map[string]any, key string) {
+			if _, ok := obj[key]; ok {
+				obj[key] = bt.redactWith
+			}
+		})
+	}
+	for field, value := range bt.set {
+		path := bt.setPaths[field]
+		obj, ok := doc.(map[string]any)
+		if !ok {
+			continue // only objects have fields to set
+		}
+		for _, key := range path[:len(path)-1] {
+			child, ok := obj[key].(map[string]any)
+			if !ok {
+				child = make(map[string]any)
+				obj[key] = child
+			}
+			obj = child
+		}
+		obj[path[len(path)-1]] = expandTransformValue(value, r)
+	}
+
+	return doc
+}
+
+// eachParent calls fn with the object holding each field of doc matching path, and the
+// key of the field in it, the last key of path or every key of the object for *.
+func eachParent(doc any, path []string, fn func(obj map[string]any, key string)) {
+	if len(path) == 1 {
+		obj, ok := doc.(map[string]any)
+		if !ok {
+			return
+		}
+		if path[0] != "*" {
+			fn(obj, path[0])
+			return
+		}
+		for key := range obj {
+			fn(obj, key)
+		}
+		return
+	}
+
+	switch v := doc.(type) {
+	case map[string]any:
+		if path[0] == "*" {
+			for _, child := range v {
+				eachParent(child, path[1:], fn)
+			}
+		} else if child, ok := v[path[0]]; ok {
+			eachParent(child, path[1:], fn)
+		}
+	case []any:
+		if path[0] == "*" {
+			for _, child := range v {
+				eachParent(child, path[1:], fn)
+			}
+		} else if i, err := strconv.Atoi(path[0]); err == nil && i >= 0 && i < len(v) {
+			eachParent(v[i], path[1:], fn)
+		}
+	}
+}
+
+// expandTransformValue returns value with its placeholders replaced by what they stand
+// for in r.
+func expandTransformValue(value string, r *http.Request) string {
+	return transformPlaceholder.ReplaceAllStringFunc(value, func(placeholder string) string {
+		match := transformPlaceholder.FindStringSubmatch(placeholder)
+		switch {
+		case match[2] != "":
+			return r.Header.Get(match[2])
+		case match[1] == "remote_addr":
+			return hostOnly(r.RemoteAddr)
+		case match[1] == "host":
+			return hostOnly(r.Host)
+		case match[1] == "time":
+			return time.Now().UTC().Format(time.RFC3339)
+		default:
+			return clientIdentity(r.TLS)
+		}
+	})
+}
+
+// isJSON reports whether contentType is JSON: application/json, or a +json type.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
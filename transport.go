@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TransportSettings tunes the connection pool kept towards an upstream target.
+type TransportSettings struct {
+	MaxIdleConns        int           // Idle connections kept across all hosts of the transport
+	MaxIdleConnsPerHost int           // Idle connections kept per upstream host
+	MaxConnsPerHost     int           // Total connections per upstream host (0 = unlimited)
+	IdleConnTimeout     time.Duration // How long an idle connection is kept before closing
+	DisableKeepAlives   bool          // Use a fresh connection for every request
+
+	TLSInsecureSkipVerify bool     // Skip verification of the target's certificate
+	TLSCAFile             string   // PEM CA bundle to verify the target with, instead of the system roots
+	TLSCertFile           string   // PEM client certificate presented to the target
+	TLSKeyFile            string   // PEM key of TLSCertFile
+	TLSServerName         string   // Server name sent in SNI and verified, instead of the target host
+	TLSSPIFFE             bool     // Present the SVID of railtail and verify the target's as an SVID
+	TLSSPIFFEIDs          []string // SPIFFE IDs the target may present, exact or with a trailing *; any if empty
+
+	UpstreamProxy string // HTTP or SOCKS5 proxy on the tailnet the target is reached through
+}
+
+// Upstream proxy schemes. HTTP proxies tunnel HTTPS targets with CONNECT.
+var upstreamProxySchemes = []string{"http", "socks5", "socks5h"}
+
+// validateUpstreamProxy checks an upstream proxy URL, like socks5://100.64.0.9:1080.
+func validateUpstreamProxy(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUpstreamProxyInvalid, err)
+	}
+	if !slices.Contains(upstreamProxySchemes, u.Scheme) {
+		return fmt.Errorf("%w: scheme must be http, socks5 or socks5h, got '%s'", ErrUpstreamProxyInvalid, u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return fmt.Errorf("%w: %w", ErrUpstreamProxyInvalid, err)
+	}
+
+	return nil
+}
+
+// redactedProxy returns an upstream proxy URL with its password hidden, for logs.
+func redactedProxy(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return ""
+	}
+
+	return u.Redacted()
+}
+
+// dialFunc dials an address through the dial backend, the tailnet by default.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// targetTransport is an http.RoundTripper that keeps a dedicated http.Transport for
+// every target with overridden settings, and a shared one for everything else.
+type targetTransport struct {
+	dial     dialFunc
+	logConns bool // log connection details of every upstream request
+
+	shared     *http.Transport
+	transports map[string]*http.Transport // by host:port, read-only once built
+}
+
+// newTargetTransport creates a targetTransport dialing through dial. Targets listed in
+// overrides (keyed by host:port) get their own pool and TLS settings; all others share
+// one built from defaults.
+func newTargetTransport(dial dialFunc, defaults TransportSettings,
+	overrides map[string]TransportSettings, logConns bool) (*targetTransport, error) {
+
+	t := &targetTransport{
+		dial:       dial,
+		logConns:   logConns,
+		transports: make(map[string]*http.Transport, len(overrides)),
+	}
+
+	var err error
+	if t.shared, err = t.newTransport(defaults); err != nil {
+		return nil, err
+	}
+	for key, settings := range overrides {
+		if t.transports[key], err = t.newTransport(settings); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	return t, nil
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *targetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, trace := withUpstreamTrace(req)
+	defer trace.record(t.logConns)
+
+	return t.transportFor(req.URL).RoundTrip(req)
+}
+
+// CloseIdleConnections closes idle connections on every underlying transport.
+func (t *targetTransport) CloseIdleConnections() {
+	t.shared.CloseIdleConnections()
+	for _, tr := range t.transports {
+		tr.CloseIdleConnections()
+	}
+}
+
+// transportFor returns the transport responsible for the target of u.
+func (t *targetTransport) transportFor(u *url.URL) *http.Transport {
+	if tr, ok := t.transports[targetKey(u.Scheme, u.Host)]; ok {
+		return tr
+	}
+
+	return t.shared
+}
+
+// newTransport builds an http.Transport over the tailnet dialer.
+// No dial or response timeouts are set here: tsnet's own 5-min timeout is avoided on purpose.
+func (t *targetTransport) newTransport(s TransportSettings) (*http.Transport, error) {
+	tlsConfig, err := s.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// The proxy is dialed over the tailnet like any target; the SOCKS5 handshake or
+	// CONNECT then happens on that connection
+	var proxy func(*http.Request) (*url.URL, error)
+	if s.UpstreamProxy != "" {
+		u, err := url.Parse(s.UpstreamProxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	return &http.Transport{
+		Proxy:               proxy,
+		DialContext:         tracedDial(t.dial),
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        s.MaxIdleConns,
+		MaxIdleConnsPerHost: s.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     s.MaxConnsPerHost,
+		IdleConnTimeout:     s.IdleConnTimeout,
+		DisableKeepAlives:   s.DisableKeepAlives,
+		// Clients negotiate the encoding with the target themselves. Transparent gzip would
+		// drop Content-Length and send a different representation than the one Range and
+		// If-Range requests resuming a download refer to.
+		DisableCompression: true,
+	}, nil
+}
+
+// TLSConfig builds the TLS client configuration of the settings, loading the CA bundle
+// and client certificate from disk, or using the SVID of railtail.
+func (s TransportSettings) TLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: s.TLSInsecureSkipVerify,
+		ServerName:         s.TLSServerName,
+	}
+
+	if s.TLSCAFile != "" {
+		pem, err := os.ReadFile(s.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", s.TLSCAFile)
+		}
+	}
+
+	if s.TLSCertFile != "" || s.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.TLSCertFile, s.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if s.TLSSPIFFE {
+		upstreamTLS(cfg, s.TLSSPIFFEIDs)
+	}
+
+	return cfg, nil
+}
+
+// targetKey normalizes a scheme and host into the host:port form used to look up overrides.
+func targetKey(scheme, host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return strings.ToLower(host)
+	}
+
+	port := "80"
+	if strings.EqualFold(scheme, "https") {
+		port = "443"
+	}
+
+	return strings.ToLower(net.JoinHostPort(strings.Trim(host, "[]"), port))
+}
+
+// parseTransportOverrides parses per-target transport overrides of the form
+//
+//	host:port=key=value,key=value;host:port=key=value
+//
+// Every target starts from defaults and only the listed keys are changed.
+func parseTransportOverrides(spec string, defaults TransportSettings) (map[string]TransportSettings, error) {
+	overrides := make(map[string]TransportSettings)
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		target, opts, ok := strings.Cut(entry, "=")
+		if !ok || target == "" {
+			return nil, fmt.Errorf("%w: '%s': expected host:port=key=value[,key=value]",
+				ErrTransportOverrideInvalid, entry)
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("%w: '%s': %w", ErrTransportOverrideInvalid, target, err)
+		}
+
+		settings := defaults
+		for _, opt := range strings.Split(opts, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(opt), "=")
+			if !ok {
+				return nil, fmt.Errorf("%w: '%s': expected key=value", ErrTransportOverrideInvalid, opt)
+			}
+			if err := settings.set(key, value); err != nil {
+				return nil, fmt.Errorf("%w: %s: %w", ErrTransportOverrideInvalid, target, err)
+			}
+		}
+
+		overrides[strings.ToLower(target)] = settings
+	}
+
+	return overrides, nil
+}
+
+// set updates a single setting by its override key.
+func (s *TransportSettings) set(key, value string) error {
+	var err error
+
+	switch key {
+	case "max-idle-conns":
+		s.MaxIdleConns, err = strconv.Atoi(value)
+	case "max-idle-conns-per-host":
+		s.MaxIdleConnsPerHost, err = strconv.Atoi(value)
+	case "max-conns-per-host":
+		s.MaxConnsPerHost, err = strconv.Atoi(value)
+	case "idle-conn-timeout":
+		s.IdleConnTimeout, err = time.ParseDuration(value)
+	case "disable-keepalives":
+		s.DisableKeepAlives, err = strconv.ParseBool(value)
+	case "tls-skip-verify":
+		s.TLSInsecureSkipVerify, err = strconv.ParseBool(value)
+	case "tls-ca":
+		s.TLSCAFile = value
+	case "tls-cert":
+		s.TLSCertFile = value
+	case "tls-key":
+		s.TLSKeyFile = value
+	case "tls-server-name":
+		s.TLSServerName = value
+	case "tls-spiffe":
+		s.TLSSPIFFE, err = strconv.ParseBool(value)
+	case "tls-spiffe-id":
+		s.TLSSPIFFEIDs = []string{value}
+	case "upstream-proxy":
+		if err = validateUpstreamProxy(value); err == nil {
+			s.UpstreamProxy = value
+		}
+	default:
+		return fmt.Errorf("unknown setting '%s'", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// downloadSize is the size of the file served for resumable downloads.
+const downloadSize = 4 << 20
+
+// downloadPeer serves a file of downloadSize bytes with http.ServeContent, which answers
+// Range and If-Range requests, gzipping whole responses for clients that ask for it. It
+// records the Accept-Encoding of the last request.
+func downloadPeer(t *testing.T, acceptEncoding *string) *httptest.Server {
+	t.Helper()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), downloadSize/16)
+	modTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*acceptEncoding = r.Header.Get("Accept-Encoding")
+		mu.Unlock()
+
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("Range") == "" && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			_, _ = gz.Write(content)
+			return
+		}
+		http.ServeContent(w, r, "artifact.bin", modTime, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// forwardHandlerVia serves newForwardHandler for targetAddr on a loopback server, dialing
+// through dialer, and returns its URL.
+func forwardHandlerVia(t *testing.T, dialer Dialer, targetAddr string) string {
+	t.Helper()
+
+	transport, err := newTargetTransport(dialer.Dial, TransportSettings{}, nil, false)
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+
+	pool := newTargetPool([]string{targetAddr}, poolOptions{})
+	srv := httptest.NewServer(newForwardHandler("", &http.Client{Transport: transport}, pool, nil))
+	t.Cleanup(srv.Close)
+
+	return srv.URL
+}
+
+// identityClient does not ask for compressed responses, like download tools resuming
+// a download.
+var identityClient = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+// get requests url with headers, and returns the response with its body read.
+func get(t *testing.T, url string, headers map[string]string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := identityClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read the body: %v", err)
+	}
+
+	return res, body
+}
+
+func TestRangeRequestsPassThrough(t *testing.T) {
+	var acceptEncoding string
+	peer := downloadPeer(t, &acceptEncoding)
+	tailnet := newFakeTailnet()
+	tailnet.addPeer("files.tailnet.ts.net:80", peer.Listener)
+	url := forwardHandlerVia(t, tailnet, "http://files.tailnet.ts.net:80")
+
+	const offset = 1<<20 + 17
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+		length  int
+	}{
+		{"whole file", nil, http.StatusOK, downloadSize},
+		{"resumed", map[string]string{"Range": fmt.Sprintf("bytes=%d-", offset)},
+			http.StatusPartialContent, downloadSize - offset},
+		{"resumed, unchanged", map[string]string{"Range": fmt.Sprintf("bytes=%d-", offset), "If-Range": `"v1"`},
+			http.StatusPartialContent, downloadSize - offset},
+		{"resumed, changed since", map[string]string{"Range": fmt.Sprintf("bytes=%d-", offset), "If-Range": `"v0"`},
+			http.StatusOK, downloadSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			direct, directBody := get(t, peer.URL+"/artifact.bin", tt.headers)
+			res, body := get(t, url+"/artifact.bin", tt.headers)
+
+			if res.StatusCode != tt.status || len(body) != tt.length {
+				t.Fatalf("got %d with %d bytes, want %d with %d bytes", res.StatusCode, len(body), tt.status, tt.length)
+			}
+			if !bytes.Equal(body, directBody) {
+				t.Error("body differs from the target's")
+			}
+			for _, h := range []string{"Content-Range", "Content-Length", "Accept-Ranges", "ETag", "Last-Modified"} {
+				if got, want := res.Header.Get(h), direct.Header.Get(h); got != want {
+					t.Errorf("%s = %q, want %q as sent by the target", h, got, want)
+				}
+			}
+			// Transparent gzip would drop Content-Length, and the offsets of ranges would no
+			// longer refer to what the client received
+			if acceptEncoding != "" {
+				t.Errorf("target was asked for Accept-Encoding %q the client did not send", acceptEncoding)
+			}
+		})
+	}
+}
+
+func TestLargeResponsesAreStreamed(t *testing.T) {
+	const (
+		size  = 64 << 20
+		first = 256 << 10
+	)
+
+	// The target sends the start of a large file, then stalls until the test ends
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	tailnet := newFakeTailnet()
+	tailnet.addPeer("files.tailnet.ts.net:80", httpPeer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		w.Header().Set("Accept-Ranges", "bytes")
+		_, _ = w.Write(make([]byte, first))
+		http.NewResponseController(w).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})))
+	url := forwardHandlerVia(t, tailnet, "http://files.tailnet.ts.net:80")
+
+	res, err := identityClient.Get(url + "/artifact.bin")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+	if res.ContentLength != size {
+		t.Errorf("Content-Length = %d, want %d", res.ContentLength, size)
+	}
+
+	// The first bytes arrive while the target is still sending, not once it is done
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(res.Body, make([]byte, first/2))
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatalf("failed to read the first bytes: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no bytes arrived before the target finished sending: the response is buffered")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// upstreamTrace collects connection details for a single upstream request.
+// Hooks may run on the transport's dial goroutine, hence the mutex.
+type upstreamTrace struct {
+	target string
+
+	mu       sync.Mutex
+	getConn  time.Time
+	dnsStart time.Time
+	tlsStart time.Time
+	gotConn  bool
+	reused   bool
+	wasIdle  bool
+	idleTime time.Duration
+	connWait time.Duration
+	dnsTime  time.Duration
+	tlsTime  time.Duration
+}
+
+// clientTrace returns the httptrace hooks filling in t.
+func (t *upstreamTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.getConn = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.gotConn = true
+			t.reused = info.Reused
+			t.wasIdle = info.WasIdle
+			t.idleTime = info.IdleTime
+			t.connWait = time.Since(t.getConn)
+		},
+		// DNS hooks only fire when the standard resolver is involved; tsnet resolves
+		// MagicDNS names inside Dial, so that time is part of the dial duration instead.
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsTime = time.Since(t.dnsStart)
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsTime = time.Since(t.tlsStart)
+		},
+	}
+}
+
+// record publishes the collected details as metrics and, if enabled, as a log line.
+func (t *upstreamTrace) record(logEnabled bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.gotConn {
+		return
+	}
+
+	reused := "false"
+	if t.reused {
+		reused = "true"
+	}
+	metrics.Default.Counter("railtail_upstream_requests_total",
+		"Upstream HTTP requests by target and whether a pooled connection was reused.",
+		"target", t.target, "reused", reused).Inc()
+
+	metrics.Default.Histogram("railtail_upstream_conn_wait_seconds",
+		"Time spent obtaining an upstream connection, including any dial.",
+		"target", t.target).Observe(t.connWait.Seconds())
+
+	if t.dnsTime > 0 {
+		metrics.Default.Histogram("railtail_upstream_dns_seconds",
+			"Time spent resolving upstream hosts.",
+			"target", t.target).Observe(t.dnsTime.Seconds())
+	}
+	if t.tlsTime > 0 {
+		metrics.Default.Histogram("railtail_upstream_tls_handshake_seconds",
+			"Time spent on upstream TLS handshakes.",
+			"target", t.target).Observe(t.tlsTime.Seconds())
+	}
+
+	if logEnabled {
+		logger.Stdout.Info().
+			Str("target", t.target).
+			Bool("reused", t.reused).
+			Bool("was-idle", t.wasIdle).
+			Dur("idle-time", t.idleTime).
+			Dur("conn-wait", t.connWait).
+			Dur("dns", t.dnsTime).
+			Dur("tls-handshake", t.tlsTime).
+			Msg("upstream connection")
+	}
+}
+
+// tracedDial wraps dial to record how long establishing new upstream connections takes.
+func tracedDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, network, addr)
+
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		metrics.Default.Counter("railtail_upstream_dials_total",
+			"Upstream connections dialed over the tailnet.",
+			"target", addr, "result", result).Inc()
+		metrics.Default.Histogram("railtail_upstream_dial_seconds",
+			"Time spent dialing upstream connections over the tailnet.",
+			"target", addr).Observe(time.Since(start).Seconds())
+		if err == nil {
+			tailnetPaths.logConn(conn, addr)
+		}
+
+		return conn, err
+	}
+}
+
+// withUpstreamTrace attaches an upstreamTrace to req and returns it with the trace.
+func withUpstreamTrace(req *http.Request) (*http.Request, *upstreamTrace) {
+	t := &upstreamTrace{target: targetKey(req.URL.Scheme, req.URL.Host)}
+	ctx := httptrace.WithClientTrace(req.Context(), t.clientTrace())
+
+	return req.WithContext(ctx), t
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/middleware"
+	"gopkg.in/yaml.v3"
+)
+
+// Tunnel errors.
+var (
+	ErrTunnelExists       = errors.New("a tunnel already listens on this port")
+	ErrTunnelNotFound     = errors.New("no tunnel listens on this port")
+	ErrTunnelPersistUnset = errors.New("persisting tunnels requires CONFIG_FILE to be set")
+)
+
+// Tunnel modes. Additional tunnels run alongside the main listener, whatever its mode.
+const (
+	TunnelModeTCP   = "tcp"   // forward connections to a tailnet host:port
+	TunnelModeHTTP  = "http"  // forward HTTP requests to one or more HTTP(S) targets
+	TunnelModeProxy = "proxy" // serve as a Tailnet Proxy
+)
+
+// ErrTunnelModeInvalid is returned for unknown tunnel modes.
+var ErrTunnelModeInvalid = errors.New("tunnel mode is invalid")
+
+// TunnelConfig describes an additional tunnel from a local port to the tailnet.
+type TunnelConfig struct {
+	Listen        int    `yaml:"listen" json:"listen"`                                     // Local port to listen on
+	Mode          string `yaml:"mode,omitempty" json:"mode,omitempty"`                     // tcp (default), http or proxy
+	Target        string `yaml:"target,omitempty" json:"target,omitempty"`                 // Tailnet host:port, or HTTP(S) URL(s) in http mode
+	ProxyProtocol string `yaml:"proxy_protocol,omitempty" json:"proxy_protocol,omitempty"` // PROXY protocol header to send (v1 or v2), tcp mode only
+	Protocol      string `yaml:"protocol,omitempty" json:"protocol,omitempty"`             // Application protocol (postgres, mysql, redis, smtp, syslog, mqtt or ftp), tcp mode only
+	Record        bool   `yaml:"record,omitempty" json:"record,omitempty"`                 // Record sessions to RECORDING_DIR, tcp mode only
+	AllowedHours  string `yaml:"allowed_hours,omitempty" json:"allowed_hours,omitempty"`   // When connections are accepted, like "Mon-Fri 08:00-18:00 Europe/Madrid"; always if empty
+	RequireToken  bool   `yaml:"require_token,omitempty" json:"require_token,omitempty"`   // Only accept clients with a token minted through the admin API
+	Tenant        string `yaml:"tenant,omitempty" json:"tenant,omitempty"`                 // Tenant owning the tunnel, whose limits and traffic its connections count toward
+
+	MQTTAllowedTopics []string `yaml:"mqtt_allowed_topics,omitempty" json:"mqtt_allowed_topics,omitempty"` // Topic filters MQTT 5 clients may use, mqtt protocol only
+	Profile           string   `yaml:"profile,omitempty" json:"profile,omitempty"`                         // Tuning profile (broker, desktop, bulk), tcp mode only
+}
+
+// mode returns the tunnel's mode, defaulting to tcp.
+func (t TunnelConfig) mode() string {
+	if t.Mode == "" {
+		return TunnelModeTCP
+	}
+	return t.Mode
+}
+
+// validate checks the tunnel's port, mode and target address.
+func (t TunnelConfig) validate() error {
+	if err := validateListenPort(strconv.Itoa(t.Listen)); err != nil {
+		return err
+	}
+	if _, err := parseAccessWindow(t.AllowedHours); err != nil {
+		return err
+	}
+	if t.AllowedHours != "" && t.Protocol == TCPProtocolSyslog {
+		return fmt.Errorf("%w: allowed_hours does not apply to syslog tunnels", ErrAllowedHoursInvalid)
+	}
+	if t.RequireToken && t.Protocol == TCPProtocolSyslog {
+		return fmt.Errorf("%w: require_token does not apply to syslog tunnels", ErrTCPProtocolInvalid)
+	}
+	if t.Tenant != "" && t.Protocol == TCPProtocolSyslog {
+		return fmt.Errorf("%w: tenant does not apply to syslog tunnels", ErrTCPProtocolInvalid)
+	}
+
+	switch t.mode() {
+	case TunnelModeTCP:
+		if err := validateProxyProtocol(t.ProxyProtocol); err != nil {
+			return err
+		}
+		if err := validateTCPProtocol(t.Protocol); err != nil {
+			return err
+		}
+		if len(t.MQTTAllowedTopics) > 0 && t.Protocol != TCPProtocolMQTT {
+			return fmt.Errorf("%w: mqtt_allowed_topics requires protocol mqtt", ErrTCPProtocolInvalid)
+		}
+		if err := validateMQTTTopics(t.MQTTAllowedTopics); err != nil {
+			return err
+		}
+		if err := validateTCPProfile(t.Profile); err != nil {
+			return err
+		}
+		return validateTCPAddress(t.Target)
+
+	case TunnelModeHTTP:
+		targets := splitList(t.Target)
+		if len(targets) == 0 {
+			return ErrMissingTargetAddr
+		}
+		for _, target := range targets {
+			if err := validateHTTPAddress(target); err != nil {
+				return err
+			}
+		}
+
+	case TunnelModeProxy:
+		if t.Target != "" {
+			return fmt.Errorf("%w: proxy tunnels take no target", ErrTunnelModeInvalid)
+		}
+
+	default:
+		return fmt.Errorf("%w: expected tcp, http or proxy, got '%s'", ErrTunnelModeInvalid, t.Mode)
+	}
+
+	if t.ProxyProtocol != "" || t.Protocol != "" || t.Record || len(t.MQTTAllowedTopics) > 0 || t.Profile != "" {
+		return fmt.Errorf("%w: proxy_protocol, protocol, record, mqtt_allowed_topics and profile only apply to tcp tunnels",
+			ErrTunnelModeInvalid)
+	}
+
+	return nil
+}
+
+// tunnel is a running TunnelConfig.
+type tunnel struct {
+	TunnelConfig
+	persisted bool
+	createdAt time.Time
+	listener  net.Listener
+	server    *http.Server // serves the tunnel in http and proxy modes
+
+	targets     *targetSwitch // picks the target of tcp tunnels, but syslog ones, see Switch
+	lastSwitch  *TargetSwitch // the last time the target was switched, if ever
+	mirroring   *TargetSwitch // the switch mirroring to its target, if any
+	mirrorTimer *time.Timer   // ends mirroring
+}
+
+// TunnelStatus is the admin API representation of a tunnel.
+type TunnelStatus struct {
+	TunnelConfig
+	Persisted bool          `json:"persisted"`
+	CreatedAt time.Time     `json:"created_at"`
+	Switch    *TargetSwitch `json:"switch,omitempty"` // the last target switch
+}
+
+// tunnelHandlerFunc builds the handler of an http or proxy tunnel.
+type tunnelHandlerFunc func(TunnelConfig) (http.Handler, error)
+
+// tunnelManager runs the tunnels that can be added and removed at runtime.
+type tunnelManager struct {
+	dialer     Dialer
+	configFile string     // where persisted tunnels are written; empty disables persistence
+	tcp        tcpOptions // defaults of tcp tunnels
+	handler    tunnelHandlerFunc
+
+	mu      sync.Mutex
+	tunnels map[int]*tunnel
+}
+
+// newTunnelManager creates a tunnelManager dialing TCP targets with dialer, with the idle
+// timeout of tcp, and serving HTTP tunnels with the handlers built by handler.
+func newTunnelManager(dialer Dialer, configFile string, tcp tcpOptions, handler tunnelHandlerFunc) *tunnelManager {
+	return &tunnelManager{
+		dialer:     dialer,
+		configFile: configFile,
+		tcp:        tcp,
+		handler:    handler,
+		tunnels:    make(map[int]*tunnel),
+	}
+}
+
+// newTunnelHandler returns a tunnelHandlerFunc building handlers like the main listener's,
+// with HTTP_MIDDLEWARE and the buffer budget, but without routes or URL rules. Targets are
+// dialed with dial to probe their latency, when balancing by latency.
+func newTunnelHandler(cfg *Config, httpClient *http.Client, dial dialFunc) tunnelHandlerFunc {
+	return func(t TunnelConfig) (http.Handler, error) {
+		var handler http.Handler
+		switch t.mode() {
+		case TunnelModeHTTP:
+			handler = newForwardHandler("tunnel-"+strconv.Itoa(t.Listen), httpClient, newTargetPool(splitList(t.Target), cfg.PoolOptions(dial)), nil)
+		case TunnelModeProxy:
+			if proxyIsOpen(cfg) {
+				return nil, fmt.Errorf("%w: set TAILNET_PROXY_ALLOWED_HOSTS or TAILNET_PROXY_AUTH_TOKEN, "+
+					"or ALLOW_OPEN_PROXY=true", ErrOpenProxy)
+			}
+			handler = trackRequests(
+				func(r *http.Request) string { return r.Host },
+				NewTailnetProxy(httpClient, cfg.InsecureSkipVerify, cfg.ProxyOptions()),
+			)
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrTunnelModeInvalid, t.Mode)
+		}
+
+		chain, err := middleware.Chain(cfg.HTTPMiddleware...)
+		if err != nil {
+			return nil, err
+		}
+		handler = chain(handler)
+		if budget != nil {
+			handler = admitRequests(handler)
+		}
+
+		return handler, nil
+	}
+}
+
+// Add starts a tunnel. If persist is true, the tunnel is also written to the config file
+// so it is recreated on the next start. Otherwise it is saved to the state database, if
+// any, to be resumed on the next start.
+func (m *tunnelManager) Add(cfg TunnelConfig, persist bool) error {
+	if err := m.add(cfg, persist, persist); err != nil {
+		return err
+	}
+	if !persist {
+		if err := stateDB.saveTunnel(cfg); err != nil {
+			_ = m.Remove(cfg.Listen)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Resume starts a tunnel saved to the state database by a previous run.
+func (m *tunnelManager) Resume(cfg TunnelConfig) error {
+	return m.add(cfg, false, false)
+}
+
+// Restore starts a tunnel loaded from the config file. It is kept in the file when other
+// tunnels are persisted, without rewriting the file now.
+func (m *tunnelManager) Restore(cfg TunnelConfig) error {
+	return m.add(cfg, true, false)
+}
+
+func (m *tunnelManager) add(cfg TunnelConfig, persist, write bool) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if persist && m.configFile == "" {
+		return ErrTunnelPersistUnset
+	}
+	if cfg.Record && recordings == nil {
+		return ErrRecordingDisabled
+	}
+	owner := tenants.get(cfg.Tenant)
+	if cfg.Tenant != "" && owner == nil {
+		return fmt.Errorf("%w: %s", ErrTenantNotFound, cfg.Tenant)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tunnels[cfg.Listen]; ok {
+		return fmt.Errorf("%w: %d", ErrTunnelExists, cfg.Listen)
+	}
+
+	var (
+		handler   http.Handler
+		pool      *targetPool
+		forwarder *syslogForwarder
+	)
+	window, _ := parseAccessWindow(cfg.AllowedHours)
+	if cfg.mode() != TunnelModeTCP {
+		var err error
+		if handler, err = m.handler(cfg); err != nil {
+			return err
+		}
+		if owner != nil {
+			handler = owner.wrap(handler)
+		}
+		handler = limitHours(window, handler)
+		if cfg.RequireToken {
+			handler = requireToken(handler)
+		}
+	} else {
+		pool = newTargetPool([]string{cfg.Target}, poolOptions{})
+	}
+	if cfg.Protocol == TCPProtocolSyslog {
+		var err error
+		if forwarder, err = newSyslogForwarder(m.dialer, pool, m.tcp.syslog, strconv.Itoa(cfg.Listen)); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("tcp", "[::]:"+strconv.Itoa(cfg.Listen))
+	if err != nil {
+		if forwarder != nil {
+			forwarder.stop()
+		}
+		return fmt.Errorf("failed to listen on port %d: %w", cfg.Listen, err)
+	}
+
+	t := &tunnel{
+		TunnelConfig: cfg,
+		persisted:    persist,
+		createdAt:    time.Now(),
+		listener:     listener,
+	}
+	m.tunnels[cfg.Listen] = t
+
+	if write {
+		if err := m.persistLocked(); err != nil {
+			delete(m.tunnels, cfg.Listen)
+			_ = listener.Close()
+			if forwarder != nil {
+				forwarder.stop()
+			}
+			return err
+		}
+	}
+
+	switch {
+	case forwarder != nil:
+		// Messages not yet delivered when the tunnel is removed are kept in the spool
+		go func() {
+			serveSyslog(listener, forwarder)
+			forwarder.stop()
+		}()
+	case handler == nil:
+		opts := m.tcp
+		opts.proxyProtocol, opts.protocol, opts.record = cfg.ProxyProtocol, cfg.Protocol, cfg.Record
+		opts.acceptProxy = false // tunnels take their clients directly, never behind another hop
+		opts.mqttTopics = cfg.MQTTAllowedTopics
+		opts = opts.withProfile(cfg.Profile)
+		opts.window, opts.requireToken, opts.tenant = window, cfg.RequireToken, owner
+		t.targets = newTargetSwitch(cfg.Target)
+		go serveTCP(listener, m.dialer, t.targets, opts)
+	default:
+		server := &http.Server{ReadHeaderTimeout: 5 * time.Second, Handler: handler}
+		connLifetime.limitHTTP(server)
+		t.server = server
+		go func() { _ = server.Serve(listener) }()
+	}
+
+	logger.Stdout.Info().
+		Int("listen-port", cfg.Listen).
+		Str("mode", cfg.mode()).
+		Str("target-addr", cfg.Target).
+		Bool("persisted", persist).
+		Bool("record", cfg.Record).
+		Str("profile", cfg.Profile).
+		Str("allowed-hours", cfg.AllowedHours).
+		Bool("require-token", cfg.RequireToken).
+		Str("tenant", cfg.Tenant).
+		Msg("tunnel started")
+
+	return nil
+}
+
+// Remove stops the tunnel listening on port. Connections and requests already
+// established through it are drained, see connRegistry.drain; HTTP clients get no further
+// requests through their connections.
+func (m *tunnelManager) Remove(port int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tunnels[port]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrTunnelNotFound, port)
+	}
+
+	delete(m.tunnels, port)
+	_ = t.listener.Close()
+	if t.mirrorTimer != nil {
+		t.mirrorTimer.Stop()
+	}
+	if t.server != nil {
+		t.server.SetKeepAlivesEnabled(false)
+	}
+	listen := strconv.Itoa(port)
+	conns.drain(func(c *trackedConn) bool { return c.listener == listen }, "tunnel removed", t.Target)
+
+	if t.persisted {
+		if err := m.persistLocked(); err != nil {
+			return err
+		}
+	} else if err := stateDB.deleteTunnel(port); err != nil {
+		return err
+	}
+
+	logger.Stdout.Info().
+		Int("listen-port", t.Listen).
+		Str("target-addr", t.Target).
+		Msg("tunnel stopped")
+
+	return nil
+}
+
+// List returns the running tunnels ordered by port.
+func (m *tunnelManager) List() []TunnelStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]TunnelStatus, 0, len(m.tunnels))
+	for _, t := range m.tunnels {
+		list = append(list, TunnelStatus{
+			TunnelConfig: t.TunnelConfig,
+			Persisted:    t.persisted,
+			CreatedAt:    t.createdAt,
+			Switch:       t.lastSwitch,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Listen < list[j].Listen })
+
+	return list
+}
+
+// Get returns the configuration of the tunnel listening on port, if any.
+func (m *tunnelManager) Get(port int) (TunnelConfig, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tunnels[port]
+	if !ok {
+		return TunnelConfig{}, false
+	}
+	return t.TunnelConfig, true
+}
+
+// persistLocked writes the persisted tunnels to the config file. m.mu must be held.
+func (m *tunnelManager) persistLocked() error {
+	var persisted []TunnelConfig
+	for _, t := range m.tunnels {
+		if t.persisted {
+			persisted = append(persisted, t.TunnelConfig)
+		}
+	}
+	sort.Slice(persisted, func(i, j int) bool { return persisted[i].Listen < persisted[j].Listen })
+
+	if err := writeConfigTunnels(m.configFile, persisted); err != nil {
+		return fmt.Errorf("failed to persist tunnels to %s: %w", m.configFile, err)
+	}
+
+	return nil
+}
+
+// writeConfigTunnels replaces the `tunnels` key of the YAML config file at path, keeping
+// the rest of the document (including comments) untouched.
+func writeConfigTunnels(path string, tunnels []TunnelConfig) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	default:
+		return errors.New("only YAML config files can be updated")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return errors.New("config file is not a YAML mapping")
+	}
+
+	var value yaml.Node
+	if err := value.Encode(tunnels); err != nil {
+		return err
+	}
+
+	replaced := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "tunnels" {
+			root.Content[i+1] = &value
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		root.Content = append(root.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: "tunnels"}, &value)
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated config behind.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// serveTCP accepts connections on listener and forwards each of them to a target of
+// pool with opts until the listener is closed.
+func serveTCP(listener net.Listener, dialer Dialer, pool tcpTargetPicker, opts tcpOptions) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Msg("failed to accept connection")
+			continue
+		}
+
+		go func(c net.Conn) {
+			if opts.acceptProxy {
+				proxied, err := acceptProxyHeader(c, opts.proxyPeers)
+				if err != nil {
+					logProxyHeaderRejected(c.RemoteAddr().String(), err)
+					_ = c.Close()
+					return
+				}
+				c = proxied
+			}
+			// Count the connection against its address before anything that may wait on it
+			releaseSource, err := opts.sources.admit(c.RemoteAddr().String())
+			if err != nil {
+				logSourceRefused(connKindTCP, c.RemoteAddr().String(), err)
+				_ = c.Close()
+				return
+			}
+			defer releaseSource()
+			if now := time.Now(); !opts.window.open(now) {
+				opts.window.logRefused(connKindTCP, c.RemoteAddr().String(), now)
+				_ = c.Close()
+				return
+			}
+			if opts.maintenance {
+				if _, _, on := maintenance.check(time.Now()); on {
+					logMaintenanceRefused(connKindTCP, c.RemoteAddr().String())
+					_ = c.Close()
+					return
+				}
+			}
+			if opts.requireToken {
+				if err := checkTokenPreamble(c); err != nil {
+					logTokenRejected(connKindTCP, listenPort(c.LocalAddr()), c.RemoteAddr().String(), err)
+					_ = c.Close()
+					return
+				}
+			}
+			release, err := opts.tenant.admit()
+			if err != nil {
+				logTenantRefused(connKindTCP, c.RemoteAddr().String(), err)
+				_ = c.Close()
+				return
+			}
+			defer release()
+
+			target := pool.pickTCP(c.RemoteAddr().String())
+			targetAddr := target.addr
+
+			// Wait for a slot if the target is at its concurrency limit
+			if err := target.limiter.acquire(context.Background()); err != nil {
+				logger.Stderr.Warn().
+					Str(logger.ErrAttr(err), logger.ErrValue(err)).
+					Str("remote-addr", c.RemoteAddr().String()).
+					Str("target-addr", targetAddr).
+					Str("reason", CloseLimitExceeded).
+					Msg("connection refused")
+				countClosed(connKindTCP, CloseLimitExceeded)
+				_ = c.Close()
+				return
+			}
+			defer target.limiter.release()
+			if err := fwdTCP(c, dialer, targetAddr, opts.withMirror(target.mirror), target.observe); err != nil {
+				err = classifyError(targetAddr, false, err)
+				countForwardError(connKindTCP, err)
+				dialDoctor.check(targetAddr, err)
+				logger.StderrWithSource.Error().
+					Str(logger.ErrAttr(err), logger.ErrValue(err)).
+					Str("remote-addr", c.RemoteAddr().String()).
+					Str("target-addr", targetAddr).
+					Str("reason", closeReasonOf(err)).
+					Str("category", errorCategory(err)).
+					Bool("retryable", isRetryable(err)).
+					Msg("connection failed")
+			}
+		}(conn)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+)
+
+// Policies of tunnel target switches, for what happens to the connections to the
+// previous target.
+const (
+	SwitchPolicyDrain   = "drain"   // they drain, for drain_timeout or DRAIN_TIMEOUT
+	SwitchPolicyCutover = "cutover" // they are closed right away
+	SwitchPolicyMirror  = "mirror"  // new ones keep going to it for mirror_for, copying what clients send to the new target; then they drain
+)
+
+var (
+	// ErrSwitchInvalid is returned for target switches that cannot be made.
+	ErrSwitchInvalid = errors.New("target switch is invalid")
+	// ErrTunnelSwitching is returned for target switches of a tunnel still mirroring.
+	ErrTunnelSwitching = errors.New("the tunnel is still mirroring to its next target")
+)
+
+// defaultMirrorFor is how long the mirror policy mirrors, unless told otherwise.
+const defaultMirrorFor = 5 * time.Minute
+
+// TargetSwitchRequest asks for the target of a tunnel to be switched, as sent to the
+// admin API.
+type TargetSwitchRequest struct {
+	Target       string `json:"target,omitempty"`        // new tailnet host:port
+	Policy       string `json:"policy,omitempty"`        // drain (default), cutover or mirror
+	DrainTimeout string `json:"drain_timeout,omitempty"` // how long connections to the previous target get, DRAIN_TIMEOUT if empty
+	MirrorFor    string `json:"mirror_for,omitempty"`    // how long the mirror policy mirrors, 5m if empty
+}
+
+// TargetSwitch is a target switch of a tunnel, as listed by the admin API.
+type TargetSwitch struct {
+	From        string     `json:"from"`
+	To          string     `json:"to"`
+	Policy      string     `json:"policy"`
+	At          time.Time  `json:"at"`
+	MirrorUntil *time.Time `json:"mirror_until,omitempty"` // when new connections go to To, with the mirror policy
+
+	drainTimeout time.Duration
+}
+
+// parse returns the switch req asks for, with drainTimeout as the default drain timeout.
+func (req TargetSwitchRequest) parse(drainTimeout time.Duration) (TargetSwitch, time.Duration, error) {
+	sw := TargetSwitch{To: req.Target, Policy: req.Policy, drainTimeout: drainTimeout}
+	if sw.Policy == "" {
+		sw.Policy = SwitchPolicyDrain
+	}
+	switch sw.Policy {
+	case SwitchPolicyDrain, SwitchPolicyCutover, SwitchPolicyMirror:
+	default:
+		return TargetSwitch{}, 0, fmt.Errorf("%w: expected drain, cutover or mirror, got '%s'", ErrSwitchInvalid, req.Policy)
+	}
+	if err := validateTCPAddress(req.Target); err != nil {
+		return TargetSwitch{}, 0, err
+	}
+
+	if req.DrainTimeout != "" {
+		d, err := time.ParseDuration(req.DrainTimeout)
+		if err != nil || d < 0 {
+			return TargetSwitch{}, 0, fmt.Errorf("%w: drain_timeout '%s'", ErrSwitchInvalid, req.DrainTimeout)
+		}
+		sw.drainTimeout = d
+	}
+	if req.DrainTimeout != "" && sw.Policy == SwitchPolicyCutover {
+		return TargetSwitch{}, 0, fmt.Errorf("%w: cutover takes no drain_timeout", ErrSwitchInvalid)
+	}
+
+	mirrorFor := defaultMirrorFor
+	if req.MirrorFor != "" {
+		d, err := time.ParseDuration(req.MirrorFor)
+		if err != nil || d <= 0 || sw.Policy != SwitchPolicyMirror {
+			return TargetSwitch{}, 0, fmt.Errorf("%w: mirror_for '%s' needs the mirror policy and a positive duration",
+				ErrSwitchInvalid, req.MirrorFor)
+		}
+		mirrorFor = d
+	}
+
+	return sw, mirrorFor, nil
+}
+
+// targetSwitch picks the target of the connections of a TCP tunnel, which can be
+// switched while the tunnel runs.
+type targetSwitch struct {
+	target atomic.Pointer[poolTarget]
+}
+
+// newTargetSwitch returns a targetSwitch picking addr.
+func newTargetSwitch(addr string) *targetSwitch {
+	s := &targetSwitch{}
+	s.set(addr, "")
+	return s
+}
+
+// set sends new connections to addr, copying what their clients send to mirror, if set.
+func (s *targetSwitch) set(addr, mirror string) {
+	s.target.Store(&poolTarget{addr: addr, id: strconv.FormatUint(hashString(addr), 16), mirror: mirror})
+}
+
+// pickTCP returns the current target.
+func (s *targetSwitch) pickTCP(string) *poolTarget {
+	return s.target.Load()
+}
+
+// Switch swaps the target of the TCP tunnel listening on port for the one req names,
+// right away or, with the mirror policy, once it mirrored the previous one for a while,
+// and hands off the connections to the previous target by the policy of req.
+func (m *tunnelManager) Switch(port int, req TargetSwitchRequest) (TargetSwitch, error) {
+	sw, mirrorFor, err := req.parse(conns.drainTimeout)
+	if err != nil {
+		return TargetSwitch{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tunnels[port]
+	if !ok {
+		return TargetSwitch{}, fmt.Errorf("%w: %d", ErrTunnelNotFound, port)
+	}
+	if t.targets == nil {
+		return TargetSwitch{}, fmt.Errorf("%w: only tcp tunnels other than syslog ones switch targets", ErrTunnelModeInvalid)
+	}
+	if t.mirroring != nil {
+		return TargetSwitch{}, fmt.Errorf("%w: until %s", ErrTunnelSwitching, t.mirroring.MirrorUntil.Format(time.RFC3339))
+	}
+
+	// Save the new target first, so that a restart picks it up
+	previous := t.TunnelConfig
+	t.Target = sw.To
+	if err := m.saveLocked(t); err != nil {
+		t.TunnelConfig = previous
+		return TargetSwitch{}, err
+	}
+
+	sw.From, sw.At = previous.Target, time.Now()
+	if sw.Policy == SwitchPolicyMirror {
+		until := sw.At.Add(mirrorFor)
+		sw.MirrorUntil = &until
+		t.targets.set(sw.From, sw.To)
+		t.mirroring = &sw
+		t.mirrorTimer = time.AfterFunc(mirrorFor, func() { m.finishMirror(t) })
+	} else {
+		t.cutOver(sw)
+	}
+	t.lastSwitch = &sw
+
+	event := logger.Stdout.Info().
+		Int("listen-port", t.Listen).
+		Str("from", sw.From).
+		Str("to", sw.To).
+		Str("policy", sw.Policy)
+	if sw.MirrorUntil != nil {
+		event = event.Time("mirror-until", *sw.MirrorUntil)
+	}
+	event.Msg("tunnel target switched")
+
+	return sw, nil
+}
+
+// finishMirror sends the new connections of t to the target it mirrored to.
+func (m *tunnelManager) finishMirror(t *tunnel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.tunnels[t.Listen] != t || t.mirroring == nil {
+		return // removed meanwhile
+	}
+	sw := *t.mirroring
+	t.mirroring, t.mirrorTimer = nil, nil
+	t.cutOver(sw)
+
+	logger.Stdout.Info().
+		Int("listen-port", t.Listen).
+		Str("from", sw.From).
+		Str("to", sw.To).
+		Msg("tunnel done mirroring, switched to its new target")
+}
+
+// cutOver sends the new connections of t to the target of sw, and drains or closes the
+// connections to the previous one, by the policy of sw. t's manager lock must be held.
+func (t *tunnel) cutOver(sw TargetSwitch) {
+	t.targets.set(sw.To, "")
+
+	listen, switched := strconv.Itoa(t.Listen), time.Now()
+	toPrevious := func(c *trackedConn) bool {
+		return c.listener == listen && c.target == sw.From && c.startedAt.Before(switched)
+	}
+	switch {
+	case sw.Policy == SwitchPolicyCutover:
+		conns.drainFor(toPrevious, "tunnel target switched", sw.From, 0)
+	case sw.drainTimeout > 0:
+		conns.drainFor(toPrevious, "tunnel target switched", sw.From, sw.drainTimeout)
+	}
+}
+
+// saveLocked saves the configuration of t where it is kept: the config file, or the
+// state database. m.mu must be held.
+func (m *tunnelManager) saveLocked(t *tunnel) error {
+	if t.persisted {
+		return m.persistLocked()
+	}
+
+	return stateDB.saveTunnel(t.TunnelConfig)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Formats of the usage export file.
+const (
+	UsageFormatCSV  = "csv"
+	UsageFormatJSON = "json" // one report per line
+)
+
+// Kinds of usage records.
+const (
+	usageKindTenant   = "tenant"
+	usageKindListener = "listener"
+)
+
+// ErrUsageExportInvalid is returned for usage export settings that cannot be used.
+var ErrUsageExportInvalid = errors.New("usage export settings are invalid")
+
+// usageExportTimeout bounds each delivery of a report to the usage webhook.
+const usageExportTimeout = 30 * time.Second
+
+// usageCSVHeader is the first line of CSV usage files.
+var usageCSVHeader = []string{"from", "to", "hostname", "kind", "name", "tenant", "bytes_in", "bytes_out"}
+
+// listenerBytes are the bytes forwarded through each listener, by port: the main listener
+// and every tunnel.
+var listenerBytes = &listenerUsage{byPort: make(map[string]*listenerCounters)}
+
+// listenerUsage keeps the traffic counters of listeners.
+type listenerUsage struct {
+	mu     sync.Mutex
+	byPort map[string]*listenerCounters
+}
+
+// listenerCounters count the bytes of a listener sent from clients (in) and back to them (out).
+type listenerCounters struct {
+	in, out *metrics.Counter
+}
+
+// get returns the counters of the listener on port.
+func (u *listenerUsage) get(port string) *listenerCounters {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	c, ok := u.byPort[port]
+	if !ok {
+		c = &listenerCounters{
+			in: metrics.Default.Counter("railtail_listener_bytes_total",
+				"Bytes forwarded, by listen port and direction.", "listener", port, "direction", "in"),
+			out: metrics.Default.Counter("railtail_listener_bytes_total",
+				"Bytes forwarded, by listen port and direction.", "listener", port, "direction", "out"),
+		}
+		u.byPort[port] = c
+	}
+
+	return c
+}
+
+// UsageRecord is the traffic of a tenant or a listener over a report's period.
+type UsageRecord struct {
+	Kind     string `json:"kind"`             // tenant or listener
+	Name     string `json:"name"`             // tenant name, or listen port
+	Tenant   string `json:"tenant,omitempty"` // of listeners of tunnels owned by a tenant
+	BytesIn  uint64 `json:"bytes_in"`         // sent by clients
+	BytesOut uint64 `json:"bytes_out"`        // sent back to them
+}
+
+// UsageReport is the traffic forwarded from From to To, by tenant and listener, as
+// exported. Tenants and listeners without traffic are left out.
+type UsageReport struct {
+	Hostname string        `json:"hostname"`
+	From     time.Time     `json:"from"`
+	To       time.Time     `json:"to"`
+	Usage    []UsageRecord `json:"usage"`
+}
+
+// validateUsageExport checks the usage export settings.
+func validateUsageExport(cfg *Config) []error {
+	var errors_ []error
+
+	switch cfg.UsageExportFormat {
+	case UsageFormatCSV, UsageFormatJSON:
+	default:
+		errors_ = append(errors_, fmt.Errorf("%w: USAGE_EXPORT_FORMAT must be csv or json, got '%s'",
+			ErrUsageExportInvalid, cfg.UsageExportFormat))
+	}
+	if cfg.UsageExportURL != "" {
+		if err := validateHTTPAddress(cfg.UsageExportURL); err != nil {
+			errors_ = append(errors_, fmt.Errorf("USAGE_EXPORT_URL: %w", err))
+		}
+	}
+	if cfg.UsageExportInterval < time.Minute {
+		errors_ = append(errors_, fmt.Errorf("%w: USAGE_EXPORT_INTERVAL must be at least 1m, got %s",
+			ErrUsageExportInvalid, cfg.UsageExportInterval))
+	}
+
+	return errors_
+}
+
+// usageExporter reports the traffic of tenants and listeners every interval to a file,
+// a webhook or both. Each keeps its own period: one that fails gets the traffic since
+// its last success on its next export.
+type usageExporter struct {
+	hostname string
+	interval time.Duration
+	tunnels  *tunnelManager // for the tenants of tunnels
+	sinks    []*usageSink
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// usageSink is where reports go, and what it last got.
+type usageSink struct {
+	name  string // file or webhook, for logs and metrics
+	write func(UsageReport) error
+	since time.Time
+	last  map[string]UsageRecord // totals at the last export, by kind and name
+}
+
+// newUsageExporter starts exporting the usage of cfg's tenants and listeners, and of
+// tunnels, or returns nil if no usage export is configured.
+func newUsageExporter(cfg *Config, tunnels *tunnelManager) *usageExporter {
+	if cfg.UsageExportFile == "" && cfg.UsageExportURL == "" {
+		return nil
+	}
+
+	e := &usageExporter{
+		hostname: cfg.TSHostname,
+		interval: cfg.UsageExportInterval,
+		tunnels:  tunnels,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	// What was forwarded before now, like counters restored from the state database, is
+	// not this run's to report
+	now, totals := time.Now().UTC(), e.totals()
+	if cfg.UsageExportFile != "" {
+		path, format := cfg.UsageExportFile, cfg.UsageExportFormat
+		e.sinks = append(e.sinks, &usageSink{name: "file", write: func(r UsageReport) error {
+			return appendUsage(path, format, r)
+		}, since: now, last: totals})
+	}
+	if cfg.UsageExportURL != "" {
+		url, client := cfg.UsageExportURL, &http.Client{Timeout: usageExportTimeout}
+		e.sinks = append(e.sinks, &usageSink{name: "webhook", write: func(r UsageReport) error {
+			return postUsage(client, url, r)
+		}, since: now, last: totals})
+	}
+	go e.run()
+
+	logger.Stdout.Info().
+		Str("file", cfg.UsageExportFile).
+		Str("format", cfg.UsageExportFormat).
+		Str("url", cfg.UsageExportURL).
+		Dur("interval", cfg.UsageExportInterval).
+		Msg("exporting usage")
+
+	return e
+}
+
+// run exports every interval until close.
+func (e *usageExporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.export()
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// close exports the traffic since the last export a last time, and stops exporting. It
+// is meant for shutdown.
+func (e *usageExporter) close() {
+	if e == nil {
+		return
+	}
+
+	close(e.stop)
+	<-e.done
+	e.export()
+}
+
+// totals returns the traffic of every tenant and listener so far, by kind and name.
+func (e *usageExporter) totals() map[string]UsageRecord {
+	totals := make(map[string]UsageRecord)
+	for _, t := range tenants.usage() {
+		totals[usageKindTenant+"/"+t.Name] = UsageRecord{
+			Kind: usageKindTenant, Name: t.Name, BytesIn: t.BytesIn, BytesOut: t.BytesOut,
+		}
+	}
+
+	owners := make(map[string]string)
+	for _, t := range e.tunnels.List() {
+		owners[strconv.Itoa(t.Listen)] = t.Tenant
+	}
+	listenerBytes.mu.Lock()
+	for port, c := range listenerBytes.byPort {
+		totals[usageKindListener+"/"+port] = UsageRecord{
+			Kind: usageKindListener, Name: port, Tenant: owners[port], BytesIn: c.in.Value(), BytesOut: c.out.Value(),
+		}
+	}
+	listenerBytes.mu.Unlock()
+
+	return totals
+}
+
+// export sends every sink the traffic since it last got a report.
+func (e *usageExporter) export() {
+	now, totals := time.Now().UTC(), e.totals()
+	for _, sink := range e.sinks {
+		report := UsageReport{Hostname: e.hostname, From: sink.since, To: now, Usage: []UsageRecord{}}
+		for key, total := range totals {
+			last := sink.last[key]
+			record := total
+			record.BytesIn, record.BytesOut = total.BytesIn-last.BytesIn, total.BytesOut-last.BytesOut
+			if record.BytesIn > 0 || record.BytesOut > 0 {
+				report.Usage = append(report.Usage, record)
+			}
+		}
+		sort.Slice(report.Usage, func(i, j int) bool {
+			a, b := report.Usage[i], report.Usage[j]
+			return a.Kind > b.Kind || a.Kind == b.Kind && a.Name < b.Name // tenants first
+		})
+
+		if err := sink.write(report); err != nil {
+			metrics.Default.Counter("railtail_usage_exports_total",
+				"Usage reports exported, by sink and result.", "sink", sink.name, "result", "failed").Inc()
+			logger.StderrWithSource.Error().
+				Str(logger.ErrAttr(err), logger.ErrValue(err)).
+				Str("sink", sink.name).
+				Time("since", sink.since).
+				Msg("failed to export usage, retrying with the next export")
+			continue
+		}
+		metrics.Default.Counter("railtail_usage_exports_total",
+			"Usage reports exported, by sink and result.", "sink", sink.name, "result", "ok").Inc()
+		sink.since, sink.last = now, totals
+	}
+}
+
+// appendUsage appends r to the file at path, in format, starting CSV files with a header.
+func appendUsage(path, format string, r UsageReport) error {
+	var buf bytes.Buffer
+	switch format {
+	case UsageFormatJSON:
+		if err := json.NewEncoder(&buf).Encode(r); err != nil {
+			return err
+		}
+	default:
+		w := csv.NewWriter(&buf)
+		if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+			_ = w.Write(usageCSVHeader)
+		}
+		from, to := r.From.Format(time.RFC3339), r.To.Format(time.RFC3339)
+		for _, u := range r.Usage {
+			_ = w.Write([]string{from, to, r.Hostname, u.Kind, u.Name, u.Tenant,
+				strconv.FormatUint(u.BytesIn, 10), strconv.FormatUint(u.BytesOut, 10)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// postUsage sends r as JSON to the webhook at url.
+func postUsage(client *http.Client, url string, r UsageReport) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), usageExportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("usage webhook failed: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// verifySettings configures sending requests to a second target, to compare its
+// responses with the primary's.
+type verifySettings struct {
+	target        string        // URL of the target verified against the primary
+	methods       []string      // methods of the requests verified; all if empty
+	ignoreHeaders []string      // canonical names of the response headers not compared
+	sample        float64       // fraction of the requests verified
+	maxBodyBytes  int64         // requests with bigger bodies are not verified
+	timeout       time.Duration // of the request to the verified target
+}
+
+// verifier sends each request to the verified target too, in the background, and
+// compares the response with the one of the primary, which is the one served: their
+// status, headers and a hash of their bodies. Differences are logged, for validating a
+// migration of the service behind the tunnel before switching over to it.
+type verifier struct {
+	client   *http.Client
+	settings verifySettings
+
+	matched, mismatched, failed *metrics.Counter
+}
+
+func newVerifier(client *http.Client, settings verifySettings) *verifier {
+	return &verifier{
+		client:   client,
+		settings: settings,
+
+		matched: metrics.Default.Counter("railtail_verify_requests_total",
+			"Requests sent to the verified target too, by outcome of the comparison.", "result", "match"),
+		mismatched: metrics.Default.Counter("railtail_verify_requests_total",
+			"Requests sent to the verified target too, by outcome of the comparison.", "result", "mismatch"),
+		failed: metrics.Default.Counter("railtail_verify_requests_total",
+			"Requests sent to the verified target too, by outcome of the comparison.", "result", "error"),
+	}
+}
+
+// verifiedResponse is what is compared of a response.
+type verifiedResponse struct {
+	status int
+	header http.Header
+	body   string // SHA-256 of the body, hex-encoded
+}
+
+// wrap returns next, the handler forwarding to the primary target, verifying the
+// requests it serves against the verified target.
+func (v *verifier) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Bodies declared too big to verify are streamed as they arrive, not buffered first
+		if r.ContentLength > v.settings.maxBodyBytes || !v.verifies(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, v.settings.maxBodyBytes+1))
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > v.settings.maxBodyBytes {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Both requests leave before either response is in, for both to see the same state
+		secondary := make(chan verifiedResponse, 1)
+		errs := make(chan error, 1)
+		header := r.Header.Clone()
+		go func() {
+			resp, err := v.send(r, header, body)
+			if err != nil {
+				errs <- err
+				return
+			}
+			secondary <- resp
+		}()
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		rec := &verifyRecorder{ResponseWriter: w, hash: sha256.New()}
+		next.ServeHTTP(rec, r)
+		if r.Context().Err() != nil || rec.status == 0 {
+			// The client went away, or forwarding failed before a response: nothing to compare
+			return
+		}
+		primary := verifiedResponse{status: rec.status, header: rec.header, body: hex.EncodeToString(rec.hash.Sum(nil))}
+
+		go func() {
+			select {
+			case err := <-errs:
+				v.failed.Inc()
+				logger.Stderr.Warn().
+					Str(logger.ErrAttr(err), logger.ErrValue(err)).
+					Str("method", r.Method).
+					Str("path", r.URL.Path).
+					Str("verify-target", v.settings.target).
+					Msg("verification request failed")
+			case resp := <-secondary:
+				v.compare(r, primary, resp)
+			}
+		}()
+	})
+}
+
+// verifies reports whether r is verified: its method is, and it is sampled.
+func (v *verifier) verifies(r *http.Request) bool {
+	if len(v.settings.methods) > 0 && !slices.Contains(v.settings.methods, r.Method) {
+		return false
+	}
+
+	return v.settings.sample >= 1 || rand.Float64() < v.settings.sample
+}
+
+// send sends the request r, with header and body, to the verified target, and reads
+// the response. It outlives r, so a client going away doesn't count as a difference.
+func (v *verifier) send(r *http.Request, header http.Header, body []byte) (verifiedResponse, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), v.settings.timeout)
+	defer cancel()
+
+	targetURL, err := url.Parse(v.settings.target + r.URL.RequestURI())
+	if err != nil {
+		return verifiedResponse{}, fmt.Errorf("invalid target URL: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return verifiedResponse{}, err
+	}
+	req.Header = header
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			host = strings.Join(prior, ", ") + ", " + host
+		}
+		req.Header.Set("X-Forwarded-For", host)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return verifiedResponse{}, classifyError(v.settings.target, false, err)
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return verifiedResponse{}, classifyError(v.settings.target, false, err)
+	}
+
+	return verifiedResponse{status: resp.StatusCode, header: resp.Header, body: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// compare logs the differences between the responses of the primary and the verified
+// target to r.
+func (v *verifier) compare(r *http.Request, primary, secondary verifiedResponse) {
+	var diffs []string
+	if primary.status != secondary.status {
+		diffs = append(diffs, fmt.Sprintf("status: %d != %d", primary.status, secondary.status))
+	}
+
+	names := make(map[string]bool)
+	for name := range primary.header {
+		names[name] = true
+	}
+	for name := range secondary.header {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !slices.Contains(v.settings.ignoreHeaders, name) && !slices.Contains(hopHeaders, name) {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		a, b := strings.Join(primary.header.Values(name), ", "), strings.Join(secondary.header.Values(name), ", ")
+		if a != b {
+			diffs = append(diffs, fmt.Sprintf("header %s: %q != %q", name, a, b))
+		}
+	}
+
+	if primary.body != secondary.body {
+		diffs = append(diffs, fmt.Sprintf("body sha256: %s != %s", primary.body, secondary.body))
+	}
+
+	if len(diffs) == 0 {
+		v.matched.Inc()
+		return
+	}
+	v.mismatched.Inc()
+	logger.Stderr.Warn().
+		Str("method", r.Method).
+		Str("path", r.URL.Path).
+		Str("verify-target", v.settings.target).
+		Strs("diffs", diffs).
+		Msg("verification mismatch")
+}
+
+// verifyRecorder records the status and headers of the primary's response, and hashes
+// its body, as it is written.
+type verifyRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	hash   hash.Hash
+}
+
+func (w *verifyRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *verifyRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (flushing, hijacking).
+func (w *verifyRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
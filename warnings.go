@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ErrConfigWarning wraps settings that work, but are likely mistakes in production.
+// They are logged at startup, or refused with STRICT.
+var ErrConfigWarning = errors.New("configuration warning")
+
+// configWarnings returns the warnings about a validated configuration.
+func configWarnings(cfg *Config) []error {
+	var warnings []error
+
+	// SVIDs of targets are verified whatever INSECURE_SKIP_VERIFY says
+	if cfg.InsecureSkipVerify && !cfg.SPIFFEUpstream && cfg.ForwardTrafficType != ForwardTrafficTypeTCP {
+		warnings = append(warnings, fmt.Errorf("%w: INSECURE_SKIP_VERIFY is enabled, "+
+			"HTTPS targets are not authenticated", ErrConfigWarning))
+	}
+	for target, settings := range cfg.TransportOverrides {
+		if settings.TLSInsecureSkipVerify && !settings.TLSSPIFFE && !cfg.InsecureSkipVerify {
+			warnings = append(warnings, fmt.Errorf("%w: tls-skip-verify is enabled for %s",
+				ErrConfigWarning, target))
+		}
+	}
+
+	// Without a token, only the ACLs keep peers from adding tunnels and minting tokens
+	if (cfg.AdminPort != "" || cfg.AdminGRPCPort != "") && cfg.AdminNetwork == AdminNetworkTailnet && cfg.AdminToken == "" {
+		warnings = append(warnings, fmt.Errorf("%w: the admin API is served on the tailnet without ADMIN_TOKEN, "+
+			"any peer the ACLs let reach the node can add tunnels and mint tokens", ErrConfigWarning))
+	}
+
+	if onTmpfs(cfg.TSStateDirPath) {
+		warnings = append(warnings, fmt.Errorf("%w: TS_STATEDIR_PATH %s is on tmpfs, "+
+			"the node will register as a new machine after every restart", ErrConfigWarning, cfg.TSStateDirPath))
+	}
+
+	ports := []struct{ name, value string }{
+		{"LISTEN_PORT", cfg.ListenPort},
+		{"HTTP_REDIRECT_PORT", cfg.HTTPRedirectPort},
+	}
+	if cfg.AdminNetwork == AdminNetworkLocal {
+		ports = append(ports, struct{ name, value string }{"ADMIN_PORT", cfg.AdminPort})
+	}
+	for _, port := range ports {
+		if n, err := strconv.Atoi(port.value); err == nil && !canBindPort(n) {
+			warnings = append(warnings, fmt.Errorf("%w: %s %d is privileged and the process "+
+				"lacks CAP_NET_BIND_SERVICE", ErrConfigWarning, port.name, n))
+		}
+	}
+
+	// Without routes, every request goes to the main target
+	if cfg.UnmatchedRoute != (UnmatchedRouteConfig{}) && len(cfg.allRoutes()) == 0 {
+		warnings = append(warnings, fmt.Errorf("%w: unmatched_route has no effect without routes", ErrConfigWarning))
+	}
+
+	return warnings
+}
+
+// existingParent returns path, or its closest ancestor that exists.
+func existingParent(path string) string {
+	path = filepath.Clean(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,59 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// capNetBindService is the bit of CAP_NET_BIND_SERVICE in the capability sets.
+const capNetBindService = 10
+
+// onTmpfs reports whether path, or the closest existing ancestor, is on tmpfs.
+func onTmpfs(path string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(existingParent(path), &st); err != nil {
+		return false
+	}
+
+	return st.Type == unix.TMPFS_MAGIC
+}
+
+// canBindPort reports whether the process may listen on port.
+func canBindPort(port int) bool {
+	if port == 0 || os.Geteuid() == 0 {
+		return true
+	}
+
+	// Containers commonly lower the privileged range, often to 0
+	unprivilegedStart := 1024
+	if data, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			unprivilegedStart = n
+		}
+	}
+	if port >= unprivilegedStart {
+		return true
+	}
+
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return true // unknown, do not warn
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			return err != nil || caps&(1<<capNetBindService) != 0
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// onTmpfs is only checked on Linux.
+func onTmpfs(string) bool { return false }
+
+// canBindPort is only checked on Linux.
+func canBindPort(int) bool { return true }
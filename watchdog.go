@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Resources each connection in the registry may account for, and the slack allowed
+// on top before the watchdog reports a possible leak.
+const (
+	watchdogGoroutinesPerConn = 8
+	watchdogGoroutineSlack    = 200
+	watchdogFDsPerConn        = 2
+	watchdogFDSlack           = 64
+)
+
+// watchdogDumpInterval rate-limits heap dumps triggered by the watchdog.
+const watchdogDumpInterval = time.Hour
+
+// watchdog periodically compares the goroutines and file descriptors of the process
+// against the connection registry, logging when they drift apart.
+type watchdog struct {
+	interval time.Duration
+	heapDump bool   // write a heap profile when a leak is suspected
+	dumpDir  string // where heap profiles are written
+
+	baseGoroutines int
+	baseFDs        int
+	lastDump       time.Time
+}
+
+// newWatchdog creates a watchdog, using the current resource usage as the baseline.
+func newWatchdog(interval time.Duration, heapDump bool, dumpDir string) *watchdog {
+	return &watchdog{
+		interval:       interval,
+		heapDump:       heapDump,
+		dumpDir:        dumpDir,
+		baseGoroutines: runtime.NumGoroutine(),
+		baseFDs:        openFDs(),
+	}
+}
+
+// run checks resources every interval, for the life of the process.
+func (w *watchdog) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.check()
+	}
+}
+
+func (w *watchdog) check() {
+	goroutines := runtime.NumGoroutine()
+	fds := openFDs()
+	open := conns.Len()
+
+	metrics.Default.Gauge("railtail_goroutines", "Goroutines of the process.").Set(int64(goroutines))
+	if fds >= 0 {
+		metrics.Default.Gauge("railtail_open_fds", "Open file descriptors of the process.").Set(int64(fds))
+	}
+
+	var anomalies []string
+	if limit := w.baseGoroutines + watchdogGoroutineSlack + watchdogGoroutinesPerConn*open; goroutines > limit {
+		anomalies = append(anomalies, fmt.Sprintf("%d goroutines for %d connections (expected at most %d)",
+			goroutines, open, limit))
+	}
+	if limit := w.baseFDs + watchdogFDSlack + watchdogFDsPerConn*open; fds >= 0 && fds > limit {
+		anomalies = append(anomalies, fmt.Sprintf("%d open file descriptors for %d connections (expected at most %d)",
+			fds, open, limit))
+	}
+	if len(anomalies) == 0 {
+		return
+	}
+
+	metrics.Default.Counter("railtail_watchdog_anomalies_total",
+		"Watchdog checks that found more resources than connections account for.").Inc()
+	event := logger.Stderr.Warn().
+		Strs("anomalies", anomalies).
+		Int("goroutines", goroutines).
+		Int("open-fds", fds).
+		Int("connections", open)
+
+	if w.heapDump && time.Since(w.lastDump) > watchdogDumpInterval {
+		w.lastDump = time.Now()
+		path, err := writeProfile(w.dumpDir, "heap")
+		if err != nil {
+			event = event.Str(logger.ErrAttr(err), logger.ErrValue(err))
+		} else {
+			event = event.Str("heap-profile", path)
+		}
+	}
+
+	event.Msg("possible resource leak")
+}
+
+// openFDs returns the number of open file descriptors, or -1 where it is unknown.
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+
+	return len(entries)
+}
+
+// writeProfile writes the named pprof profile (heap, goroutine, ...) to a timestamped
+// file in dir and returns its path.
+func writeProfile(dir, name string) (string, error) {
+	profile := pprof.Lookup(name)
+	if profile == nil {
+		return "", fmt.Errorf("unknown profile '%s'", name)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.pprof", name, time.Now().UTC().Format("20060102T150405Z")))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Goroutine profiles are written with full stacks, the most useful for leaks
+	debug := 0
+	if name == "goroutine" {
+		debug = 2
+	}
+	if err := profile.WriteTo(f, debug); err != nil {
+		return "", err
+	}
+
+	return path, f.Close()
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rmonvfer/railtail/internal/logger"
+	"github.com/rmonvfer/railtail/internal/metrics"
+)
+
+// Backoff between attempts to replay spooled requests to an unreachable target.
+const (
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = time.Minute
+)
+
+// webhookSpoolExt is the extension of spooled request files.
+const webhookSpoolExt = ".http"
+
+// ErrWebhookSpoolFull is returned when a request does not fit in the spool.
+var ErrWebhookSpoolFull = errors.New("webhook spool is full")
+
+// webhookSpoolSettings configures store-and-forward of POST requests in HTTP mode.
+type webhookSpoolSettings struct {
+	dir          string // where requests are spooled
+	maxBytes     int64  // size bound of the spool
+	maxBodyBytes int64  // bigger requests are forwarded, never spooled
+	hostHeader   string // Host header of the requests sent to the target, see outboundHost
+}
+
+// webhookSpool stores POST requests the target cannot be reached for on disk, answers
+// them with 202 Accepted, and replays them in order, with backoff, once the target is
+// reachable again. Replayed requests are removed once the target answered them with
+// anything but a 5xx status, so they are delivered at least once.
+type webhookSpool struct {
+	client   *http.Client
+	pool     *targetPool
+	settings webhookSpoolSettings
+	queue    spoolQueue
+
+	mu      sync.Mutex
+	size    int64 // bytes of the spooled requests
+	pending int   // spooled requests
+	wake    chan struct{}
+
+	spooled, replayed, rejected *metrics.Counter
+	queued                      *metrics.Gauge
+}
+
+// spoolQueue stores the spooled requests, oldest first. It is only used with the
+// webhookSpool's mutex held, or by its replaying goroutine.
+type spoolQueue interface {
+	put(data []byte) error
+	list() ([]spoolEntry, error)
+	get(id string) ([]byte, error)
+	remove(id string) error
+}
+
+// spoolEntry is a request in a spoolQueue.
+type spoolEntry struct {
+	id   string
+	size int64
+}
+
+// newWebhookSpool opens the spool, and starts replaying the requests left in it by a
+// previous run, if any, to a target of pool. Requests are kept in the state database if
+// there is one, and in files in the spool directory otherwise.
+func newWebhookSpool(client *http.Client, pool *targetPool, settings webhookSpoolSettings) (*webhookSpool, error) {
+	if err := os.MkdirAll(settings.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create webhook spool dir: %w", err)
+	}
+
+	var queue spoolQueue = &dirQueue{dir: settings.dir}
+	if stateDB != nil {
+		if err := moveSpooledRequests(queue, stateDB.webhookQueue()); err != nil {
+			return nil, err
+		}
+		queue = stateDB.webhookQueue()
+	}
+
+	s := &webhookSpool{
+		client:   client,
+		pool:     pool,
+		settings: settings,
+		queue:    queue,
+		wake:     make(chan struct{}, 1),
+
+		spooled: metrics.Default.Counter("railtail_webhook_requests_total",
+			"POST requests handled by the webhook spool, by outcome.", "result", "spooled"),
+		replayed: metrics.Default.Counter("railtail_webhook_requests_total",
+			"POST requests handled by the webhook spool, by outcome.", "result", "replayed"),
+		rejected: metrics.Default.Counter("railtail_webhook_requests_total",
+			"POST requests handled by the webhook spool, by outcome.", "result", "rejected"),
+		queued: metrics.Default.Gauge("railtail_webhook_spool_requests",
+			"Requests waiting in the webhook spool."),
+	}
+
+	entries, err := queue.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		s.size += e.size
+		s.pending++
+	}
+	s.queued.Set(int64(s.pending))
+	if s.pending > 0 {
+		logger.Stdout.Info().Int("requests", s.pending).Msg("replaying spooled webhook requests")
+	}
+
+	go s.replay()
+
+	return s, nil
+}
+
+// forward forwards a POST request like fwdHttp, unless the target cannot be reached or
+// earlier requests are still spooled: the request is then spooled and answered with 202
+// Accepted. The error returned, if any, is the one that made the request spooled.
+func (s *webhookSpool) forward(targetAddr string, w http.ResponseWriter, r *http.Request) error {
+	// Bodies declared too big to spool are streamed as they arrive, not buffered first
+	if r.ContentLength > s.settings.maxBodyBytes {
+		return fwdHttp(s.client, targetAddr, w, r)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, s.settings.maxBodyBytes+1))
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return err
+	}
+	if int64(len(body)) > s.settings.maxBodyBytes {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return fwdHttp(s.client, targetAddr, w, r)
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			host = strings.Join(prior, ", ") + ", " + host
+		}
+		r.Header.Set("X-Forwarded-For", host)
+	}
+
+	var deliveryErr error
+	if !s.backlogged() {
+		resp, err := s.send(r.Context(), targetAddr, r, body)
+		if err == nil {
+			defer resp.Body.Close()
+			if err := runResponseHooks(resp); err != nil {
+				http.Error(w, "Error proxying request: "+err.Error(), http.StatusBadGateway)
+				return err
+			}
+			for _, h := range hopHeaders {
+				resp.Header.Del(h)
+			}
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(resp.StatusCode)
+			_, err = io.Copy(w, resp.Body)
+			return err
+		}
+		if r.Context().Err() != nil {
+			return err
+		}
+		deliveryErr = err
+	}
+
+	if err := s.store(r, body); err != nil {
+		http.Error(w, "Error spooling request: "+err.Error(), http.StatusServiceUnavailable)
+		return err
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	if deliveryErr != nil {
+		return fmt.Errorf("%w (request spooled)", deliveryErr)
+	}
+	return nil
+}
+
+// send sends the request, with body, to targetAddr.
+func (s *webhookSpool) send(ctx context.Context, targetAddr string, r *http.Request, body []byte) (*http.Response, error) {
+	targetAddr, err := expandTarget(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	targetURL, err := url.Parse(targetAddr + r.URL.RequestURI())
+	if err != nil {
+		return nil, errors.New("invalid target URL: " + err.Error())
+	}
+
+	out, err := http.NewRequestWithContext(ctx, r.Method, targetURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	out.Host = outboundHost(s.settings.hostHeader, r.Host, targetURL.Host)
+	out.Header = r.Header.Clone()
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+
+	return s.client.Transport.RoundTrip(out)
+}
+
+// backlogged reports whether requests are waiting in the spool, in which case new ones
+// are spooled behind them to keep their order.
+func (s *webhookSpool) backlogged() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pending > 0
+}
+
+// store writes the request, with body, to the spool.
+func (s *webhookSpool) store(r *http.Request, body []byte) error {
+	var buf bytes.Buffer
+	stored := &http.Request{
+		Method:        r.Method,
+		URL:           &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery},
+		Host:          r.Host,
+		Header:        r.Header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	if err := stored.Write(&buf); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size+int64(buf.Len()) > s.settings.maxBytes {
+		return ErrWebhookSpoolFull
+	}
+
+	if err := s.queue.put(buf.Bytes()); err != nil {
+		return err
+	}
+
+	s.size += int64(buf.Len())
+	s.pending++
+	s.queued.Set(int64(s.pending))
+	s.spooled.Inc()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// replay sends the spooled requests to the target, oldest first. It is meant to be
+// started in its own goroutine, and runs for the life of the process.
+func (s *webhookSpool) replay() {
+	backoff := webhookMinBackoff
+	for {
+		entries, err := s.queue.list()
+		if err != nil || len(entries) == 0 {
+			if err != nil {
+				logger.StderrWithSource.Error().
+					Str(logger.ErrAttr(err), logger.ErrValue(err)).
+					Msg("failed to list spooled webhook requests")
+			}
+			select {
+			case <-s.wake:
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+
+		for _, e := range entries {
+			if !s.replayOne(e.id) {
+				time.Sleep(backoff)
+				backoff = min(2*backoff, webhookMaxBackoff)
+				break
+			}
+			backoff = webhookMinBackoff
+		}
+	}
+}
+
+// replayOne sends a spooled request, and removes it from the spool unless it should be
+// retried. It returns false if the target could not take it.
+func (s *webhookSpool) replayOne(id string) bool {
+	data, err := s.queue.get(id)
+	if err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("request", id).
+			Msg("failed to read spooled webhook request")
+		return false
+	}
+
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	var body []byte
+	if err == nil {
+		body, err = io.ReadAll(r.Body)
+	}
+	if err != nil {
+		// It will never be readable, there is no point in keeping it
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("request", id).
+			Msg("discarding unreadable spooled webhook request")
+		s.remove(id, int64(len(data)))
+		return true
+	}
+
+	target := s.pool.pickAny()
+	start := time.Now()
+	resp, err := s.send(context.Background(), target.addr, r, body)
+	failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+	target.observe(time.Since(start), failed)
+	if err == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	switch {
+	case failed:
+		event := logger.Stderr.Warn().Str("target", target.addr).Str("path", r.URL.Path)
+		if err != nil {
+			event = event.Str(logger.ErrAttr(err), logger.ErrValue(err))
+		} else {
+			event = event.Int("status", resp.StatusCode)
+		}
+		event.Msg("failed to replay spooled webhook request, retrying")
+		return false
+	case resp.StatusCode >= http.StatusBadRequest:
+		// Retrying a request the target refused would not change its answer
+		logger.Stderr.Warn().
+			Str("target", target.addr).
+			Str("path", r.URL.Path).
+			Int("status", resp.StatusCode).
+			Msg("spooled webhook request rejected by the target")
+		s.rejected.Inc()
+	default:
+		s.replayed.Inc()
+	}
+	s.remove(id, int64(len(data)))
+
+	return true
+}
+
+// remove deletes a spooled request of size bytes.
+func (s *webhookSpool) remove(id string, size int64) {
+	if err := s.queue.remove(id); err != nil {
+		logger.StderrWithSource.Error().
+			Str(logger.ErrAttr(err), logger.ErrValue(err)).
+			Str("request", id).
+			Msg("failed to remove spooled webhook request")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.size -= size
+	s.pending--
+	s.queued.Set(int64(s.pending))
+}
+
+// dirQueue is a spoolQueue of files in a directory, named after when they were spooled.
+type dirQueue struct {
+	dir string
+	seq uint64
+}
+
+func (q *dirQueue) put(data []byte) error {
+	q.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), q.seq%1000000, webhookSpoolExt)
+	tmp := filepath.Join(q.dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func (q *dirQueue) list() ([]spoolEntry, error) {
+	dirEntries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook spool: %w", err)
+	}
+
+	var entries []spoolEntry
+	for _, e := range dirEntries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), webhookSpoolExt) {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			entries = append(entries, spoolEntry{id: e.Name(), size: info.Size()})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+
+	return entries, nil
+}
+
+func (q *dirQueue) get(id string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(q.dir, id))
+}
+
+func (q *dirQueue) remove(id string) error {
+	return os.Remove(filepath.Join(q.dir, id))
+}
+
+// moveSpooledRequests moves the requests of from to the end of to, in order.
+func moveSpooledRequests(from, to spoolQueue) error {
+	entries, err := from.list()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		data, err := from.get(e.id)
+		if err != nil {
+			return err
+		}
+		if err := to.put(data); err != nil {
+			return err
+		}
+		if err := from.remove(e.id); err != nil {
+			return err
+		}
+	}
+	if len(entries) > 0 {
+		logger.Stdout.Info().Int("requests", len(entries)).Msg("moved spooled webhook requests to the state database")
+	}
+
+	return nil
+}
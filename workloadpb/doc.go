@@ -0,0 +1,6 @@
+// Package workloadpb holds the Go code generated from proto/spiffe/workload/workload.proto,
+// the X.509 part of the SPIFFE Workload API railtail fetches its SVID from. Regenerate it
+// after changing the proto file.
+package workloadpb
+
+//go:generate sh -c "cd .. && buf generate"